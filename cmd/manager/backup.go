@@ -0,0 +1,148 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"manager/internal/backup"
+	"manager/internal/disk"
+	"manager/internal/service"
+	"manager/pkg/config"
+)
+
+// manageBackups lists, creates and restores backups of the storage while the server is not running.
+// list and restore take the name of a remote target to work on its copies instead of the local ones.
+func manageBackups(cfg *config.Config, args []string) error {
+	usage := fmt.Errorf("usage: manager backup list [target] | create | restore [target] <name>")
+
+	if len(args) == 0 {
+		return usage
+	}
+
+	switch {
+	case args[0] == "list" && len(args) <= 2:
+		target := ""
+		if len(args) == 2 {
+			target = args[1]
+		}
+
+		return listBackups(cfg, target)
+	case args[0] == "create" && len(args) == 1:
+		return withService(cfg, disk.LockWriter, func(s *service.Service, _ credentials) error {
+			backups, err := newBackups(cfg, s)
+			if err != nil {
+				return err
+			}
+
+			b, err := backups.Create()
+			if err != nil {
+				return err
+			}
+
+			fmt.Printf("created %s\n", b.Name)
+
+			for _, target := range b.Targets {
+				fmt.Printf("uploaded to %s\n", target)
+			}
+
+			return nil
+		})
+	case args[0] == "restore" && (len(args) == 2 || len(args) == 3):
+		target, name := "", args[len(args)-1]
+		if len(args) == 3 {
+			target = args[1]
+		}
+
+		return withService(cfg, disk.LockExclusive, func(s *service.Service, _ credentials) error {
+			backups, err := newBackups(cfg, s)
+			if err != nil {
+				return err
+			}
+
+			err = backups.Restore(target, name)
+			if err != nil {
+				return err
+			}
+
+			fmt.Printf("restored %s\n", name)
+
+			return nil
+		})
+	}
+
+	return usage
+}
+
+func listBackups(cfg *config.Config, target string) error {
+	remote, err := backupRemote(cfg)
+	if err != nil {
+		return err
+	}
+
+	backups := backup.NewList(cfg.BackupDir, cfg.FilePath, remote)
+
+	list, err := backups.List(target)
+	if err != nil {
+		return err
+	}
+
+	if len(list) == 0 {
+		fmt.Println("no backups")
+
+		return nil
+	}
+
+	for _, b := range list {
+		fmt.Printf("%s\t%s\t%d bytes\n", b.Name, b.Time.Local().Format(time.DateTime), b.Size)
+	}
+
+	return nil
+}
+
+// withService runs fn with the storage unlocked and locks it again afterwards. An empty password
+// asks for key shares instead.
+func withService(cfg *config.Config, mode disk.LockMode, fn func(s *service.Service, c credentials) error) error {
+	lock, err := disk.AcquireLock(cfg.FilePath, mode)
+	if err != nil {
+		return err
+	}
+	defer lock.Release()
+
+	repo, err := newRepository(cfg)
+	if err != nil {
+		return err
+	}
+
+	s := service.New(repo, cfg.RecordTypes)
+
+	err = s.Check()
+	if err != nil {
+		return err
+	}
+
+	password, err := readPassword("Master password (empty for key shares): ")
+	if err != nil {
+		return err
+	}
+
+	var c credentials
+
+	if len(password) == 0 {
+		c.shares, err = unsealWithShares(s)
+	} else {
+		c.password = password
+		err = s.Unlock(string(password))
+	}
+	if err != nil {
+		return err
+	}
+
+	err = fn(s, c)
+
+	lockErr := s.Lock()
+	if err == nil {
+		err = lockErr
+	}
+
+	return err
+}
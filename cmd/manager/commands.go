@@ -0,0 +1,85 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+
+	"golang.org/x/term"
+
+	"manager/pkg/config"
+)
+
+const (
+	passwordEnv    = "MANAGER_MASTER_PASSWORD"
+	newPasswordEnv = "MANAGER_NEW_MASTER_PASSWORD"
+)
+
+type command func(cfg *config.Config, args []string) error
+
+var commands = map[string]command{
+	"backup":   manageBackups,
+	"init":     initStorage,
+	"migrate":  migrate,
+	"recovery": manageRecovery,
+	"rekey":    rekey,
+	"resign":   resign,
+	"salvage":  salvage,
+	"shares":   manageShares,
+}
+
+// credentials unlocked the storage, a password or the key shares of a split vault.
+type credentials struct {
+	password []byte
+	shares   []string
+}
+
+// stdin is shared so that answers following the password on a pipe are not lost to a buffer.
+var stdin = bufio.NewReader(os.Stdin)
+
+func runCommand(cfg *config.Config, args []string) error {
+	cmd, ok := commands[args[0]]
+	if !ok {
+		return fmt.Errorf("unknown command %q", args[0])
+	}
+
+	return cmd(cfg, args[1:])
+}
+
+// readPassword takes the master password from the environment or asks for it on the terminal.
+func readPassword(prompt string) ([]byte, error) {
+	return readSecret(passwordEnv, prompt)
+}
+
+// readSecret takes a secret from the environment variable env, unless it is empty, or asks for it on
+// the terminal.
+func readSecret(env, prompt string) ([]byte, error) {
+	if password, ok := os.LookupEnv(env); ok && env != "" {
+		return []byte(password), nil
+	}
+
+	fmt.Fprint(os.Stderr, prompt)
+	defer fmt.Fprintln(os.Stderr)
+
+	if term.IsTerminal(int(os.Stdin.Fd())) {
+		return term.ReadPassword(int(os.Stdin.Fd()))
+	}
+
+	line, err := stdin.ReadString('\n')
+	if err != nil && line == "" {
+		return nil, fmt.Errorf("failed to read password: %s", err.Error())
+	}
+
+	return []byte(strings.TrimRight(line, "\r\n")), nil
+}
+
+// confirm asks a yes or no question on the terminal, anything but yes is a no.
+func confirm(prompt string) bool {
+	fmt.Fprint(os.Stderr, prompt+" [y/N] ")
+
+	line, _ := stdin.ReadString('\n')
+	answer := strings.ToLower(strings.TrimSpace(line))
+
+	return answer == "y" || answer == "yes"
+}
@@ -0,0 +1,213 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"time"
+
+	"manager/internal/backup"
+	"manager/internal/disk"
+	"manager/internal/domain"
+	"manager/internal/service"
+	"manager/pkg/config"
+)
+
+const duressHookTimeout = time.Minute
+
+// enableDecoy sets up the second vault as the decoy, which has to exist: any password would create
+// a missing one with some backends.
+func enableDecoy(cfg *config.Config, s *service.Service) error {
+	_, err := os.Stat(cfg.SecondFilePath)
+	if errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("%s does not exist, create it with manager init --second", cfg.SecondFilePath)
+	}
+	if err != nil {
+		return err
+	}
+
+	decoy, err := newRepository(decoyConfig(cfg))
+	if err != nil {
+		return err
+	}
+
+	s.EnableDecoy(decoy, duressAlert(cfg.SecondHook))
+
+	return nil
+}
+
+func decoyConfig(cfg *config.Config) *config.Config {
+	decoy := *cfg
+	decoy.FilePath = cfg.SecondFilePath
+
+	return &decoy
+}
+
+// duressBackups hands the backup requests to the manager of the vault that is open. The decoy is
+// backed up under the name of the storage, to its own directory and remote prefix, so its backups
+// look like those of the storage and neither prunes the other.
+type duressBackups struct {
+	s       *service.Service
+	storage *backup.Manager
+	decoy   *backup.Manager
+}
+
+func newDuressBackups(cfg *config.Config, s *service.Service, storage *backup.Manager) (*duressBackups, error) {
+	if cfg.SecondBackupDir == "" || cfg.SecondBackupDir == cfg.BackupDir {
+		return nil, fmt.Errorf("second_backup_dir must be set and differ from backup_dir")
+	}
+
+	remote, err := backupRemote(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(remote.Targets) > 0 && cfg.SecondBackupPrefix == "" {
+		return nil, fmt.Errorf("second_backup_prefix must be set with remote backup targets")
+	}
+
+	for i, t := range remote.Targets {
+		remote.Targets[i] = backup.Prefixed(t, cfg.SecondBackupPrefix)
+	}
+
+	decoy := backup.New(s.DecoyVault(), cfg.SecondBackupDir, cfg.FilePath, backupRetention(cfg), remote)
+
+	return &duressBackups{s: s, storage: storage, decoy: decoy}, nil
+}
+
+func (b *duressBackups) manager() *backup.Manager {
+	if b.s.Duress() {
+		return b.decoy
+	}
+
+	return b.storage
+}
+
+func (b *duressBackups) Create() (backup.Backup, error) {
+	return b.manager().Create()
+}
+
+func (b *duressBackups) List(target string) ([]backup.Backup, error) {
+	return b.manager().List(target)
+}
+
+func (b *duressBackups) Restore(target, name string) error {
+	return b.manager().Restore(target, name)
+}
+
+// Run backs up both vaults, each only while it is open.
+func (b *duressBackups) Run(ctx context.Context, interval time.Duration) {
+	go b.decoy.Run(ctx, interval)
+
+	b.storage.Run(ctx, interval)
+}
+
+// duressAlert runs the hook without any trace in the responses, only a failure is logged.
+func duressAlert(hook string) func() {
+	return func() {
+		if hook == "" {
+			return
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), duressHookTimeout)
+		defer cancel()
+
+		err := exec.CommandContext(ctx, "/bin/sh", "-c", hook).Run()
+		if err != nil {
+			log.Printf("second_hook failed: %s", err.Error())
+		}
+	}
+}
+
+// initDecoy creates the decoy with its duress password. It is an empty vault like a new storage,
+// it is filled through the API after unlocking it with the duress password.
+func initDecoy(cfg *config.Config) error {
+	if cfg.SecondFilePath == "" {
+		return fmt.Errorf("second_file_path is not configured")
+	}
+
+	lock, err := disk.AcquireLock(cfg.SecondFilePath, disk.LockExclusive)
+	if err != nil {
+		return err
+	}
+	defer lock.Release()
+
+	_, err = os.Stat(cfg.SecondFilePath)
+	if err == nil {
+		return fmt.Errorf("%s exists already", cfg.SecondFilePath)
+	}
+
+	password, err := readSecret(newPasswordEnv, "Password of the second vault: ")
+	if err != nil {
+		return err
+	}
+
+	repeated, err := readSecret(newPasswordEnv, "Repeat password of the second vault: ")
+	if err != nil {
+		return err
+	}
+
+	if !bytes.Equal(password, repeated) {
+		return fmt.Errorf("passwords do not match")
+	}
+
+	if len(password) == 0 {
+		return fmt.Errorf("password is empty")
+	}
+
+	// the storage would open first and the decoy never
+	opens, err := opensStorage(cfg, password)
+	if err != nil {
+		return err
+	}
+
+	if opens {
+		return fmt.Errorf("the password of the second vault must differ from the master password")
+	}
+
+	err = createVault(decoyConfig(cfg), password)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("created %s\n", cfg.SecondFilePath)
+
+	return nil
+}
+
+// opensStorage tells whether the password unlocks the storage, from its key slot alone, so nothing
+// is written to it. A missing storage is opened by no password.
+func opensStorage(cfg *config.Config, password []byte) (bool, error) {
+	_, err := os.Stat(cfg.FilePath)
+	if errors.Is(err, os.ErrNotExist) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	lock, err := disk.AcquireLock(cfg.FilePath, disk.LockShared)
+	if err != nil {
+		return false, err
+	}
+	defer lock.Release()
+
+	repo, err := newRepository(cfg)
+	if err != nil {
+		return false, err
+	}
+
+	err = repo.Probe(password)
+	if errors.Is(err, domain.ErrWrongPassword) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+
+	"manager/internal/disk"
+	"manager/internal/service"
+	"manager/pkg/config"
+)
+
+// creator is a backend that starts a new vault only when asked to, a missing file is refused
+// otherwise.
+type creator interface {
+	Create()
+}
+
+// initStorage creates the storage with its master password, or with --second the second vault with
+// its own one. The server and the other commands only open an existing vault.
+func initStorage(cfg *config.Config, args []string) error {
+	flags := flag.NewFlagSet("init", flag.ContinueOnError)
+	second := flags.Bool("second", false, "create the vault of second_file_path")
+
+	err := flags.Parse(args)
+	if err != nil {
+		return err
+	}
+
+	if flags.NArg() != 0 {
+		return fmt.Errorf("usage: manager init [--second]")
+	}
+
+	if *second {
+		return initDecoy(cfg)
+	}
+
+	lock, err := disk.AcquireLock(cfg.FilePath, disk.LockExclusive)
+	if err != nil {
+		return err
+	}
+	defer lock.Release()
+
+	_, err = os.Stat(cfg.FilePath)
+	if err == nil {
+		return fmt.Errorf("%s exists already", cfg.FilePath)
+	}
+	if !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+
+	password, err := readSecret(newPasswordEnv, "Master password: ")
+	if err != nil {
+		return err
+	}
+
+	repeated, err := readSecret(newPasswordEnv, "Repeat master password: ")
+	if err != nil {
+		return err
+	}
+
+	if !bytes.Equal(password, repeated) {
+		return fmt.Errorf("passwords do not match")
+	}
+
+	if len(password) == 0 {
+		return fmt.Errorf("master password is empty")
+	}
+
+	err = createVault(cfg, password)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("created storage %s\n", cfg.FilePath)
+
+	return nil
+}
+
+// createVault writes an empty vault to cfg.FilePath under the password.
+func createVault(cfg *config.Config, password []byte) error {
+	repo, err := newRepository(cfg)
+	if err != nil {
+		return err
+	}
+
+	if c, ok := repo.(creator); ok {
+		c.Create()
+	}
+
+	s := service.New(repo, cfg.RecordTypes)
+
+	err = s.Unlock(string(password))
+	if err != nil {
+		return err
+	}
+
+	return s.Lock()
+}
@@ -2,39 +2,132 @@ package main
 
 import (
 	"context"
+	"fmt"
 	"log"
 	"manager/internal/handler"
 	"manager/internal/server"
+	"os"
 	"os/signal"
 	"sync"
 	"syscall"
+	"time"
 
+	"manager/internal/backend/bolt"
+	"manager/internal/backend/jsonfile"
+	"manager/internal/backend/kdbx"
+	"manager/internal/backend/pass"
+	"manager/internal/backend/sqlite"
+	"manager/internal/backup"
+	"manager/internal/disk"
+	"manager/internal/domain"
+	"manager/internal/history"
 	"manager/internal/repository"
+	"manager/internal/secmem"
 	"manager/internal/service"
+	"manager/internal/vault"
 	"manager/pkg/config"
 )
 
 func main() {
+	// before anything is decrypted
+	err := secmem.DisableCoreDumps()
+	if err != nil {
+		log.Fatal(err.Error())
+	}
+
 	cfg, err := config.New("config.yaml")
 	if err != nil {
 		log.Fatalf("failed to init config: %s", err.Error())
 	}
 
-	repo := repository.New()
-	s := service.New(repo, cfg.FilePath, cfg.RecordTypes)
+	err = kdfParams(cfg).Validate()
+	if err != nil {
+		log.Fatalf("invalid kdf_time, kdf_memory or kdf_threads: %s", err.Error())
+	}
+
+	if len(os.Args) > 1 {
+		err = runCommand(cfg, os.Args[1:])
+		secmem.Wipe()
+		if err != nil {
+			log.Fatal(err.Error())
+		}
+
+		return
+	}
+
+	lock, err := disk.AcquireLock(cfg.FilePath, disk.LockWriter)
+	if err != nil {
+		log.Fatalf("failed to lock storage: %s", err.Error())
+	}
+	defer lock.Release()
+
+	repo, err := newRepository(cfg)
+	if err != nil {
+		log.Fatalf("failed to init storage: %s", err.Error())
+	}
+
+	s := service.New(repo, cfg.RecordTypes)
 
-	// init storage
-	err = s.WriteStorageFromFile()
+	if cfg.SecondFilePath != "" {
+		decoyLock, err := disk.AcquireLock(cfg.SecondFilePath, disk.LockWriter)
+		if err != nil {
+			log.Fatalf("failed to lock second vault: %s", err.Error())
+		}
+		defer decoyLock.Release()
+
+		err = enableDecoy(cfg, s)
+		if err != nil {
+			log.Fatalf("failed to init second vault: %s", err.Error())
+		}
+	}
+
+	err = s.Check()
 	if err != nil {
-		log.Printf("Failed to read storage file: %s", err.Error())
+		log.Fatalf("failed to check storage file: %s", err.Error())
+	}
+
+	if cfg.History {
+		err = enableHistory(cfg, s)
+		if err != nil {
+			log.Fatalf("failed to init history: %s", err.Error())
+		}
 	}
 
-	h := handler.New(s)
+	storageBackups, err := newBackups(cfg, s)
+	if err != nil {
+		log.Fatalf("failed to init backups: %s", err.Error())
+	}
+
+	var backups serverBackups = storageBackups
+
+	if cfg.SecondFilePath != "" {
+		backups, err = newDuressBackups(cfg, s, storageBackups)
+		if err != nil {
+			log.Fatalf("failed to init backups of the second vault: %s", err.Error())
+		}
+	}
+
+	h := handler.New(s, backups)
 	serv := server.New(h, cfg.ServerPort)
 
 	ctx, cancel := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
 	defer cancel()
 
+	go s.RunPersister(ctx, cfg.FlushDebounce, cfg.FlushMaxLatency, cfg.DegradeAfter)
+
+	// the storage starts sealed and is unlocked through the API
+	if cfg.AutoLockTimeout > 0 {
+		go s.RunAutoLock(ctx, cfg.AutoLockTimeout)
+	}
+
+	if cfg.WatchInterval > 0 {
+		go s.RunWatcher(ctx, cfg.WatchInterval)
+	}
+
+	if cfg.BackupInterval > 0 {
+		go backups.Run(ctx, cfg.BackupInterval)
+	}
+
 	wg := new(sync.WaitGroup)
 	wg.Add(1)
 	serv.Run(ctx, wg)
@@ -42,10 +135,131 @@ func main() {
 	<-ctx.Done()
 	wg.Wait()
 
-	err = s.UpdateFile()
+	err = s.Lock()
 	if err != nil {
+		secmem.Wipe()
 		log.Fatalf("failed to update file: %s", err.Error())
 	}
 
 	log.Print("successful completion")
 }
+
+type backend interface {
+	Check() error
+	Open(password []byte) error
+	Probe(password []byte) error
+	Close() error
+	Flush() error
+	ReadOnly() bool
+	GetAll() (domain.Storage, error)
+	GetByType(recordType string) (domain.Storage, error)
+	GetFavorites() (domain.Storage, error)
+	Apply(domain.Operation) (bool, error)
+}
+
+func newRepository(cfg *config.Config) (backend, error) {
+	switch cfg.Backend {
+	case "json":
+		return jsonfile.New(repository.New(), cfg.FilePath, cfg.CompactSize, !cfg.Plaintext, kdfParams(cfg)), nil
+	case "bolt":
+		return bolt.New(cfg.FilePath, kdfParams(cfg)), nil
+	case "kdbx":
+		return kdbx.New(cfg.FilePath, kdfParams(cfg)), nil
+	case "pass":
+		return pass.New(cfg.FilePath), nil
+	case "sqlite":
+		return sqlite.New(cfg.FilePath, kdfParams(cfg)), nil
+	}
+
+	return nil, fmt.Errorf("unknown backend %q", cfg.Backend)
+}
+
+// kdfParams returns the configured cost new password slots are made with and older ones are
+// upgraded to.
+func kdfParams(cfg *config.Config) vault.KDFParams {
+	return vault.KDFParams{
+		Time:    cfg.KDFTime,
+		Memory:  cfg.KDFMemory,
+		Threads: cfg.KDFThreads,
+	}
+}
+
+func enableHistory(cfg *config.Config, s *service.Service) error {
+	h := history.New(cfg.FilePath)
+
+	err := h.Init()
+	if err != nil {
+		return err
+	}
+
+	err = s.EnableHistory(h)
+	if err != nil || cfg.SecondFilePath == "" {
+		return err
+	}
+
+	decoy := history.New(cfg.SecondFilePath)
+
+	err = decoy.Init()
+	if err != nil {
+		return err
+	}
+
+	return s.EnableDecoyHistory(decoy)
+}
+
+// serverBackups are the backups the server takes and serves.
+type serverBackups interface {
+	Create() (backup.Backup, error)
+	List(target string) ([]backup.Backup, error)
+	Restore(target, name string) error
+	Run(ctx context.Context, interval time.Duration)
+}
+
+func newBackups(cfg *config.Config, s *service.Service) (*backup.Manager, error) {
+	remote, err := backupRemote(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	return backup.New(s, cfg.BackupDir, cfg.FilePath, backupRetention(cfg), remote), nil
+}
+
+func backupRemote(cfg *config.Config) (backup.Remote, error) {
+	recipients, err := backup.ParseRecipients(cfg.BackupRecipients)
+	if err != nil {
+		return backup.Remote{}, err
+	}
+
+	remote := backup.Remote{
+		Recipients:   recipients,
+		IdentityFile: cfg.BackupIdentity,
+	}
+
+	if cfg.S3Endpoint != "" {
+		s3, err := backup.NewS3(cfg.S3Endpoint, cfg.S3Bucket, cfg.S3Prefix, cfg.S3AccessKey, cfg.S3SecretKey, !cfg.S3DisableTLS)
+		if err != nil {
+			return backup.Remote{}, err
+		}
+
+		remote.Targets = append(remote.Targets, s3)
+	}
+
+	if cfg.WebDAVURL != "" {
+		remote.Targets = append(remote.Targets, backup.NewWebDAV(cfg.WebDAVURL, cfg.WebDAVDir, cfg.WebDAVUser, cfg.WebDAVPassword))
+	}
+
+	// backups must not leave the host unencrypted, whatever the storage does with its own file
+	if len(remote.Targets) > 0 && len(recipients) == 0 {
+		return backup.Remote{}, fmt.Errorf("backup targets are configured but backup_recipients is empty")
+	}
+
+	return remote, nil
+}
+
+func backupRetention(cfg *config.Config) backup.Retention {
+	return backup.Retention{
+		Hourly: cfg.BackupHourly,
+		Daily:  cfg.BackupDaily,
+		Weekly: cfg.BackupWeekly,
+	}
+}
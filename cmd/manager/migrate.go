@@ -0,0 +1,111 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	"manager/internal/backend/jsonfile"
+	"manager/internal/disk"
+	"manager/internal/repository"
+	"manager/pkg/config"
+)
+
+// migrate upgrades the storage file to the current format, keeping a copy of the old file next to
+// it. With --dry-run it only reports what the upgrade would do.
+func migrate(cfg *config.Config, args []string) error {
+	flags := flag.NewFlagSet("migrate", flag.ContinueOnError)
+	dryRun := flags.Bool("dry-run", false, "report the changes without writing anything")
+
+	err := flags.Parse(args)
+	if err != nil {
+		return err
+	}
+
+	if flags.NArg() > 1 {
+		return fmt.Errorf("usage: manager migrate [--dry-run] [file]")
+	}
+
+	if cfg.Backend != "json" && flags.NArg() == 0 {
+		return fmt.Errorf("migrations apply to the json backend only, the %s backend is configured", cfg.Backend)
+	}
+
+	filename := cfg.FilePath
+	if flags.NArg() == 1 {
+		filename = flags.Arg(0)
+	}
+
+	mode := disk.LockExclusive
+	if *dryRun {
+		mode = disk.LockShared
+	}
+
+	lock, err := disk.AcquireLock(filename, mode)
+	if err != nil {
+		return err
+	}
+	defer lock.Release()
+
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return fmt.Errorf("failed to read file: %s", err.Error())
+	}
+
+	password, err := readPassword("Master password: ")
+	if err != nil {
+		return err
+	}
+
+	m, err := jsonfile.Inspect(data, password)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("%s: version %d, current version %d\n", filename, m.From, m.To)
+
+	if !m.Needed() {
+		fmt.Println("nothing to migrate")
+
+		return nil
+	}
+
+	for _, step := range m.Steps {
+		fmt.Println("  " + step)
+	}
+
+	fmt.Printf("services added: %s\n", list(m.Added))
+	fmt.Printf("services removed: %s\n", list(m.Removed))
+	fmt.Printf("services changed: %s\n", list(m.Changed))
+
+	if *dryRun {
+		fmt.Println("dry run, nothing was written")
+
+		return nil
+	}
+
+	repo := jsonfile.New(repository.New(), filename, cfg.CompactSize, !cfg.Plaintext, kdfParams(cfg))
+	repo.AcceptLegacy()
+
+	err = repo.Open(password)
+	if err != nil {
+		return err
+	}
+
+	err = repo.Close()
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("migrated, the previous file is kept in %s.pre-migration-v%d\n", filename, m.From)
+
+	return nil
+}
+
+func list(names []string) string {
+	if len(names) == 0 {
+		return "none"
+	}
+
+	return strings.Join(names, ", ")
+}
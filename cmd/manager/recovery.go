@@ -0,0 +1,149 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+
+	"manager/internal/disk"
+	"manager/internal/service"
+	"manager/pkg/config"
+)
+
+// manageRecovery shows how many recovery codes are left, generates new ones or unlocks the storage
+// with one to set a new master password.
+func manageRecovery(cfg *config.Config, args []string) error {
+	usage := fmt.Errorf("usage: manager recovery status | generate [--codes n] [--key] | use")
+
+	if len(args) == 0 {
+		return usage
+	}
+
+	switch args[0] {
+	case "status":
+		if len(args) != 1 {
+			return usage
+		}
+
+		return recoveryStatus(cfg)
+	case "generate":
+		flags := flag.NewFlagSet("recovery generate", flag.ContinueOnError)
+		count := flags.Int("codes", 10, "number of one-time recovery codes")
+		withKey := flags.Bool("key", false, "generate a recovery key to keep offline as well")
+
+		err := flags.Parse(args[1:])
+		if err != nil {
+			return err
+		}
+
+		if flags.NArg() != 0 {
+			return usage
+		}
+
+		return withService(cfg, disk.LockExclusive, func(s *service.Service, c credentials) error {
+			codes, err := s.GenerateRecovery("manager", string(c.password), *count, *withKey)
+			if err != nil {
+				return err
+			}
+
+			for _, code := range codes.Codes {
+				fmt.Println(code)
+			}
+
+			if codes.Key != "" {
+				fmt.Printf("recovery key: %s\n", codes.Key)
+			}
+
+			return nil
+		})
+	case "use":
+		if len(args) != 1 {
+			return usage
+		}
+
+		return recoverStorage(cfg)
+	}
+
+	return usage
+}
+
+// recoveryStatus reads the recovery slots under the shared lock, next to a running server.
+func recoveryStatus(cfg *config.Config) error {
+	lock, err := disk.AcquireLock(cfg.FilePath, disk.LockShared)
+	if err != nil {
+		return err
+	}
+	defer lock.Release()
+
+	repo, err := newRepository(cfg)
+	if err != nil {
+		return err
+	}
+
+	password, err := readPassword("Master password: ")
+	if err != nil {
+		return err
+	}
+
+	recovery, err := service.New(repo, cfg.RecordTypes).ProbeRecovery(string(password))
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("%d recovery codes left\n", recovery.Codes)
+
+	if recovery.Key {
+		fmt.Println("a recovery key is set")
+	}
+
+	return nil
+}
+
+// recoverStorage unlocks the storage with a recovery code and sets the new master password.
+func recoverStorage(cfg *config.Config) error {
+	lock, err := disk.AcquireLock(cfg.FilePath, disk.LockExclusive)
+	if err != nil {
+		return err
+	}
+	defer lock.Release()
+
+	repo, err := newRepository(cfg)
+	if err != nil {
+		return err
+	}
+
+	s := service.New(repo, cfg.RecordTypes)
+
+	err = s.Check()
+	if err != nil {
+		return err
+	}
+
+	code, err := readSecret("", "Recovery code: ")
+	if err != nil {
+		return err
+	}
+
+	password, err := readSecret(newPasswordEnv, "New master password: ")
+	if err != nil {
+		return err
+	}
+
+	repeated, err := readSecret(newPasswordEnv, "Repeat new master password: ")
+	if err != nil {
+		return err
+	}
+
+	if !bytes.Equal(password, repeated) {
+		return fmt.Errorf("passwords do not match")
+	}
+
+	err = s.Recover(string(code), string(password))
+	if err != nil {
+		return err
+	}
+
+	fmt.Println("master password changed")
+
+	return s.Lock()
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+
+	"manager/internal/disk"
+	"manager/internal/service"
+	"manager/pkg/config"
+)
+
+// rekey changes the master password while the server is not running. The new password is asked
+// twice, or taken from MANAGER_NEW_MASTER_PASSWORD.
+func rekey(cfg *config.Config, args []string) error {
+	if len(args) != 0 {
+		return fmt.Errorf("usage: manager rekey")
+	}
+
+	return withService(cfg, disk.LockExclusive, func(s *service.Service, c credentials) error {
+		if c.password == nil {
+			return fmt.Errorf("the storage is split into key shares, use manager shares rekey")
+		}
+
+		password, err := readSecret(newPasswordEnv, "New master password: ")
+		if err != nil {
+			return err
+		}
+
+		if _, ok := os.LookupEnv(newPasswordEnv); !ok {
+			repeated, err := readSecret(newPasswordEnv, "Repeat new master password: ")
+			if err != nil {
+				return err
+			}
+
+			if !bytes.Equal(password, repeated) {
+				return fmt.Errorf("passwords do not match")
+			}
+		}
+
+		err = s.Rekey("manager", string(c.password), string(password))
+		if err != nil {
+			return err
+		}
+
+		fmt.Println("master password changed, backups made before stay readable with the old password")
+
+		return nil
+	})
+}
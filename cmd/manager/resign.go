@@ -0,0 +1,93 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"manager/internal/backend/jsonfile"
+	"manager/internal/disk"
+	"manager/internal/repository"
+	"manager/pkg/config"
+)
+
+// resign acknowledges intentional edits of an unencrypted storage file: it lists the records that
+// fail verification and signs the file as it is now.
+func resign(cfg *config.Config, args []string) error {
+	flags := flag.NewFlagSet("resign", flag.ContinueOnError)
+	yes := flags.Bool("yes", false, "sign without asking for confirmation")
+
+	err := flags.Parse(args)
+	if err != nil {
+		return err
+	}
+
+	if flags.NArg() > 1 {
+		return fmt.Errorf("usage: manager resign [--yes] [file]")
+	}
+
+	if cfg.Backend != "json" && flags.NArg() == 0 {
+		return fmt.Errorf("signatures apply to the json backend only, the %s backend is configured", cfg.Backend)
+	}
+
+	filename := cfg.FilePath
+	if flags.NArg() == 1 {
+		filename = flags.Arg(0)
+	}
+
+	lock, err := disk.AcquireLock(filename, disk.LockExclusive)
+	if err != nil {
+		return err
+	}
+	defer lock.Release()
+
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return fmt.Errorf("failed to read file: %s", err.Error())
+	}
+
+	password, err := readPassword("Master password: ")
+	if err != nil {
+		return err
+	}
+
+	tamper, err := jsonfile.Verify(data, password)
+	if err != nil {
+		return err
+	}
+
+	if tamper == nil {
+		fmt.Printf("%s: all records verify, nothing to sign\n", filename)
+
+		return nil
+	}
+
+	fmt.Printf("%s: records failing verification: %s\n", filename, list(tamper.Records))
+
+	if tamper.Index {
+		fmt.Println("the list of records was changed, records may have been removed")
+	}
+
+	if !*yes && !confirm("Sign the file with its current content?") {
+		fmt.Println("nothing was written")
+
+		return nil
+	}
+
+	repo := jsonfile.New(repository.New(), filename, cfg.CompactSize, !cfg.Plaintext, kdfParams(cfg))
+	repo.Acknowledge()
+
+	err = repo.Open(password)
+	if err != nil {
+		return err
+	}
+
+	err = repo.Close()
+	if err != nil {
+		return err
+	}
+
+	fmt.Println("signed")
+
+	return nil
+}
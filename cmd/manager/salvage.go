@@ -0,0 +1,82 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+
+	"manager/internal/backend/jsonfile"
+	"manager/internal/disk"
+	"manager/internal/vault"
+	"manager/pkg/config"
+)
+
+// salvage recovers the readable records of a damaged (usually quarantined) storage file into a new
+// file. The result is encrypted with the same master password and can replace the storage file.
+func salvage(cfg *config.Config, args []string) error {
+	flags := flag.NewFlagSet("salvage", flag.ContinueOnError)
+	out := flags.String("o", "", "output file (default <file>.salvaged)")
+
+	err := flags.Parse(args)
+	if err != nil {
+		return err
+	}
+
+	if flags.NArg() != 1 {
+		return fmt.Errorf("usage: manager salvage [-o output] <file>")
+	}
+
+	filename := flags.Arg(0)
+	if *out == "" {
+		*out = filename + ".salvaged"
+	}
+
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return fmt.Errorf("failed to read file: %s", err.Error())
+	}
+
+	password, err := readPassword("Master password: ")
+	if err != nil {
+		return err
+	}
+
+	storage, key, err := jsonfile.Salvage(data, password)
+	if err != nil {
+		return err
+	}
+
+	logins := 0
+	for _, s := range storage {
+		logins += len(s.Elements)
+	}
+
+	log.Printf("salvaged %d services and %d logins", len(storage), logins)
+
+	if key == nil {
+		key, err = vault.NewKey(password, kdfParams(cfg))
+		if err != nil {
+			return fmt.Errorf("failed to create vault key: %s", err.Error())
+		}
+	}
+
+	plaintext, err := jsonfile.Encode(storage)
+	if err != nil {
+		return fmt.Errorf("failed to marshal storage: %s", err.Error())
+	}
+
+	ciphertext, err := key.Encrypt(plaintext)
+	if err != nil {
+		return fmt.Errorf("failed to encrypt storage: %s", err.Error())
+	}
+
+	err = disk.WriteFile(*out, ciphertext, 0600)
+	if err != nil {
+		return err
+	}
+
+	log.Printf("written to %s, stop the server and move it to %s to restore", *out, cfg.FilePath)
+
+	return nil
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+
+	"manager/internal/disk"
+	"manager/internal/service"
+	"manager/pkg/config"
+)
+
+// manageShares splits the storage key into shares, from the master password with init or from the
+// shares of the current split with rekey. The new shares are printed one per line.
+func manageShares(cfg *config.Config, args []string) error {
+	usage := fmt.Errorf("usage: manager shares init|rekey <shares> <threshold>")
+
+	if len(args) != 3 || (args[0] != "init" && args[0] != "rekey") {
+		return usage
+	}
+
+	count, err := strconv.Atoi(args[1])
+	if err != nil {
+		return usage
+	}
+
+	threshold, err := strconv.Atoi(args[2])
+	if err != nil {
+		return usage
+	}
+
+	return withService(cfg, disk.LockExclusive, func(s *service.Service, c credentials) error {
+		var shares []string
+
+		switch {
+		case args[0] == "init" && c.password != nil:
+			shares, err = s.InitShares("manager", string(c.password), count, threshold)
+		case args[0] == "rekey" && c.shares != nil:
+			shares, err = s.RekeyShares("manager", c.shares, count, threshold)
+		case args[0] == "init":
+			return fmt.Errorf("the storage is split into key shares already, use manager shares rekey")
+		default:
+			return fmt.Errorf("the storage is protected by a password, use manager shares init")
+		}
+		if err != nil {
+			return err
+		}
+
+		for _, share := range shares {
+			fmt.Println(share)
+		}
+
+		return nil
+	})
+}
+
+// unsealWithShares asks for key shares until the storage is unsealed and returns them.
+func unsealWithShares(s *service.Service) ([]string, error) {
+	var shares []string
+
+	for {
+		prompt := "Key share: "
+		if progress := s.UnsealProgress(); progress.Threshold > 0 {
+			prompt = fmt.Sprintf("Key share %d of %d: ", progress.Progress+1, progress.Threshold)
+		}
+
+		share, err := readSecret("", prompt)
+		if err != nil {
+			return nil, err
+		}
+
+		if len(share) == 0 {
+			return nil, fmt.Errorf("no key share given")
+		}
+
+		progress, err := s.Unseal(string(share))
+		if err != nil {
+			return nil, err
+		}
+
+		shares = append(shares, string(share))
+
+		if !progress.Sealed {
+			return shares, nil
+		}
+	}
+}
@@ -0,0 +1,346 @@
+// Package backendtest checks that a storage backend behaves the way the service expects from any
+// of them.
+package backendtest
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"manager/internal/domain"
+)
+
+// Repository is the part of a backend the service relies on.
+type Repository interface {
+	Check() error
+	Open(password []byte) error
+	Probe(password []byte) error
+	Close() error
+	Flush() error
+	ReadOnly() bool
+	GetAll() (domain.Storage, error)
+	GetByType(recordType string) (domain.Storage, error)
+	GetFavorites() (domain.Storage, error)
+	Apply(domain.Operation) (bool, error)
+}
+
+// Run runs the conformance tests. newRepository returns a repository for the storage at path, it
+// is called again with the same path to read back what the first one wrote.
+func Run(t *testing.T, newRepository func(path string) Repository) {
+	t.Run("new storage", func(t *testing.T) {
+		testNewStorage(t, newRepository)
+	})
+	t.Run("operations", func(t *testing.T) {
+		testOperations(t, newRepository)
+	})
+	t.Run("filters", func(t *testing.T) {
+		testFilters(t, newRepository)
+	})
+	t.Run("persistence", func(t *testing.T) {
+		testPersistence(t, newRepository)
+	})
+	t.Run("wrong password", func(t *testing.T) {
+		testWrongPassword(t, newRepository)
+	})
+	t.Run("probe", func(t *testing.T) {
+		testProbe(t, newRepository)
+	})
+}
+
+func storagePath(t *testing.T) string {
+	return filepath.Join(t.TempDir(), "storage")
+}
+
+func open(t *testing.T, r Repository, password string) {
+	t.Helper()
+
+	err := r.Check()
+	if err != nil {
+		t.Fatalf("Check: %s", err)
+	}
+
+	err = r.Open([]byte(password))
+	if err != nil {
+		t.Fatalf("Open: %s", err)
+	}
+}
+
+func closeRepository(t *testing.T, r Repository) {
+	t.Helper()
+
+	err := r.Flush()
+	if err == nil {
+		err = r.Close()
+	}
+	if err != nil {
+		t.Fatalf("Close: %s", err)
+	}
+}
+
+func apply(t *testing.T, r Repository, op domain.Operation, want bool) {
+	t.Helper()
+
+	ok, err := r.Apply(op)
+	if err != nil {
+		t.Fatalf("Apply %s %s/%s: %s", op.Op, op.Service, op.Login, err)
+	}
+
+	if ok != want {
+		t.Fatalf("Apply %s %s/%s reported %v, want %v", op.Op, op.Service, op.Login, ok, want)
+	}
+}
+
+func element(password, description, additional string) *domain.Element {
+	return &domain.Element{
+		Password:    domain.NewSecret([]byte(password)),
+		Description: description,
+		Additional:  additional,
+	}
+}
+
+func getAll(t *testing.T, r Repository) domain.Storage {
+	t.Helper()
+
+	storage, err := r.GetAll()
+	if err != nil {
+		t.Fatalf("GetAll: %s", err)
+	}
+
+	return storage
+}
+
+// describe renders a storage comparably, a service without logins is the same with a nil or an
+// empty map.
+func describe(storage domain.Storage) map[string]string {
+	out := make(map[string]string)
+
+	for name, service := range storage {
+		out[name] = fmt.Sprintf("type=%s favorite=%v logins=%d", service.Type, service.Favorite, len(service.Elements))
+
+		for login, elem := range service.Elements {
+			out[name+"/"+login] = fmt.Sprintf("%q %q %q", elem.Password.Bytes(), elem.Description, elem.Additional)
+		}
+	}
+
+	return out
+}
+
+func checkStorage(t *testing.T, got, want domain.Storage) {
+	t.Helper()
+
+	g, w := describe(got), describe(want)
+
+	for key, value := range w {
+		if g[key] != value {
+			t.Errorf("%s: got %s, want %s", key, g[key], value)
+		}
+	}
+
+	for key, value := range g {
+		if _, ok := w[key]; !ok {
+			t.Errorf("%s: unexpected %s", key, value)
+		}
+	}
+}
+
+// fill writes services of every kind and returns what the storage holds then.
+func fill(t *testing.T, r Repository) domain.Storage {
+	t.Helper()
+
+	apply(t, r, domain.Operation{Op: domain.OpAppendService, Service: "mail", Type: "password", Favorite: true}, true)
+	apply(t, r, domain.Operation{Op: domain.OpAppendService, Service: "bank", Type: "card"}, true)
+	apply(t, r, domain.Operation{Op: domain.OpAppendService, Service: "empty", Type: "password"}, true)
+
+	apply(t, r, domain.Operation{Op: domain.OpAppendLogin, Service: "mail", Login: "alice", Element: element("one", "work", "recovery: two")}, true)
+	apply(t, r, domain.Operation{Op: domain.OpAppendLogin, Service: "mail", Login: "bob", Element: element("pässwörd \"quoted\"", "", "")}, true)
+	apply(t, r, domain.Operation{Op: domain.OpAppendLogin, Service: "bank", Login: "card", Element: element("1234", "", "line one\nline two")}, true)
+
+	return domain.Storage{
+		"mail": {Type: "password", Favorite: true, Elements: map[string]domain.Element{
+			"alice": *element("one", "work", "recovery: two"),
+			"bob":   *element("pässwörd \"quoted\"", "", ""),
+		}},
+		"bank": {Type: "card", Elements: map[string]domain.Element{
+			"card": *element("1234", "", "line one\nline two"),
+		}},
+		"empty": {Type: "password"},
+	}
+}
+
+func testNewStorage(t *testing.T, newRepository func(path string) Repository) {
+	r := newRepository(storagePath(t))
+	open(t, r, "secret")
+	defer r.Close()
+
+	if r.ReadOnly() {
+		t.Fatal("a new storage is read-only")
+	}
+
+	if storage := getAll(t, r); len(storage) != 0 {
+		t.Fatalf("a new storage holds %v", describe(storage))
+	}
+}
+
+func testOperations(t *testing.T, newRepository func(path string) Repository) {
+	r := newRepository(storagePath(t))
+	open(t, r, "secret")
+	defer r.Close()
+
+	want := fill(t, r)
+	checkStorage(t, getAll(t, r), want)
+
+	// operations on what does not exist or already exists change nothing
+	apply(t, r, domain.Operation{Op: domain.OpAppendService, Service: "mail", Type: "card"}, false)
+	apply(t, r, domain.Operation{Op: domain.OpUpdateService, Service: "missing", Type: "card"}, false)
+	apply(t, r, domain.Operation{Op: domain.OpDeleteService, Service: "missing"}, false)
+	apply(t, r, domain.Operation{Op: domain.OpAppendLogin, Service: "missing", Login: "alice", Element: element("x", "", "")}, false)
+	apply(t, r, domain.Operation{Op: domain.OpAppendLogin, Service: "mail", Login: "alice", Element: element("x", "", "")}, false)
+	apply(t, r, domain.Operation{Op: domain.OpUpdateLogin, Service: "mail", Login: "carol", Element: element("x", "", "")}, false)
+	apply(t, r, domain.Operation{Op: domain.OpDeleteLogin, Service: "mail", Login: "carol"}, false)
+	checkStorage(t, getAll(t, r), want)
+
+	apply(t, r, domain.Operation{Op: domain.OpUpdateService, Service: "bank", Type: "password", Favorite: true}, true)
+	apply(t, r, domain.Operation{Op: domain.OpUpdateLogin, Service: "mail", Login: "alice", Element: element("three", "home", "")}, true)
+	apply(t, r, domain.Operation{Op: domain.OpDeleteLogin, Service: "mail", Login: "bob"}, true)
+	apply(t, r, domain.Operation{Op: domain.OpDeleteService, Service: "empty"}, true)
+
+	want["bank"] = domain.Service{Type: "password", Favorite: true, Elements: want["bank"].Elements}
+	want["mail"] = domain.Service{Type: "password", Favorite: true, Elements: map[string]domain.Element{
+		"alice": *element("three", "home", ""),
+	}}
+	delete(want, "empty")
+	checkStorage(t, getAll(t, r), want)
+
+	// a deleted service is gone with its logins
+	apply(t, r, domain.Operation{Op: domain.OpDeleteService, Service: "mail"}, true)
+	apply(t, r, domain.Operation{Op: domain.OpAppendService, Service: "mail", Type: "password"}, true)
+
+	want["mail"] = domain.Service{Type: "password"}
+	checkStorage(t, getAll(t, r), want)
+}
+
+func testFilters(t *testing.T, newRepository func(path string) Repository) {
+	r := newRepository(storagePath(t))
+	open(t, r, "secret")
+	defer r.Close()
+
+	all := fill(t, r)
+
+	byType, err := r.GetByType("card")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	checkStorage(t, byType, domain.Storage{"bank": all["bank"]})
+
+	favorites, err := r.GetFavorites()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	checkStorage(t, favorites, domain.Storage{"mail": all["mail"]})
+
+	byType, err = r.GetByType("note")
+	if err != nil || len(byType) != 0 {
+		t.Fatalf("GetByType of an unused type: %v, %v", describe(byType), err)
+	}
+}
+
+func testPersistence(t *testing.T, newRepository func(path string) Repository) {
+	path := storagePath(t)
+
+	r := newRepository(path)
+	open(t, r, "secret")
+	want := fill(t, r)
+	closeRepository(t, r)
+
+	for i := 0; i < 2; i++ {
+		r = newRepository(path)
+		open(t, r, "secret")
+		checkStorage(t, getAll(t, r), want)
+		closeRepository(t, r)
+	}
+
+	// a closed repository can be opened again
+	r = newRepository(path)
+	open(t, r, "secret")
+	closeRepository(t, r)
+	open(t, r, "secret")
+	checkStorage(t, getAll(t, r), want)
+	closeRepository(t, r)
+}
+
+func testWrongPassword(t *testing.T, newRepository func(path string) Repository) {
+	path := storagePath(t)
+
+	r := newRepository(path)
+	open(t, r, "secret")
+	fill(t, r)
+	closeRepository(t, r)
+
+	r = newRepository(path)
+
+	err := r.Open([]byte("guess"))
+	if !errors.Is(err, domain.ErrWrongPassword) {
+		r.Close()
+
+		t.Fatalf("got %v, want ErrWrongPassword", err)
+	}
+}
+
+func testProbe(t *testing.T, newRepository func(path string) Repository) {
+	path := storagePath(t)
+
+	r := newRepository(path)
+	open(t, r, "secret")
+	fill(t, r)
+	closeRepository(t, r)
+
+	before := files(t, filepath.Dir(path))
+
+	r = newRepository(path)
+
+	err := r.Probe([]byte("secret"))
+	if err != nil {
+		t.Fatalf("Probe: %s", err)
+	}
+
+	err = r.Probe([]byte("guess"))
+	if !errors.Is(err, domain.ErrWrongPassword) {
+		t.Fatalf("got %v, want ErrWrongPassword", err)
+	}
+
+	// a database may add files of its own for readers, like the shared memory index of SQLite
+	after := files(t, filepath.Dir(path))
+	for name, content := range before {
+		if after[name] != content {
+			t.Fatalf("Probe changed %s", name)
+		}
+	}
+}
+
+// files returns the content of every file below dir.
+func files(t *testing.T, dir string) map[string]string {
+	t.Helper()
+
+	contents := make(map[string]string)
+
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+
+		data, err := os.ReadFile(path)
+		contents[path] = string(data)
+
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return contents
+}
@@ -0,0 +1,611 @@
+package bolt
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	bbolt "go.etcd.io/bbolt"
+
+	"manager/internal/disk"
+	"manager/internal/domain"
+	"manager/internal/secmem"
+	"manager/internal/vault"
+)
+
+// Bucket layout:
+//
+//	meta
+//	  key_slot -> vault key slot
+//	services
+//	  <service>
+//	    type     -> record type
+//	    favorite -> "0" or "1"
+//	    logins
+//	      <login> -> encrypted element
+var (
+	metaBucket     = []byte("meta")
+	servicesBucket = []byte("services")
+	loginsBucket   = []byte("logins")
+
+	keySlot     = []byte("key_slot")
+	typeKey     = []byte("type")
+	favoriteKey = []byte("favorite")
+)
+
+const openTimeout = time.Second
+
+var errCorrupted = errors.New("database is corrupted")
+
+// Repository keeps the storage in a bbolt database. Every operation runs in its own read or
+// write transaction, so a change is on disk once Apply returns. The elements are encrypted
+// with the vault key, service names, types and logins are kept in plain text as bucket keys.
+type Repository struct {
+	path string
+	db   *bbolt.DB
+
+	// kdf is the cost new password slots are made with and cheaper ones are upgraded to
+	kdf vault.KDFParams
+
+	// key is nil while the repository is closed
+	key *vault.Key
+}
+
+func New(path string, kdf vault.KDFParams) *Repository {
+	return &Repository{
+		path: path,
+		kdf:  kdf,
+	}
+}
+
+// Check verifies the consistency of an existing database at startup.
+func (r *Repository) Check() error {
+	_, err := os.Stat(r.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+
+	db, err := bbolt.Open(r.path, 0600, &bbolt.Options{Timeout: openTimeout, ReadOnly: true})
+	if err != nil {
+		return fmt.Errorf("failed to open database: %s", err.Error())
+	}
+	defer db.Close()
+
+	return db.View(func(tx *bbolt.Tx) error {
+		for err := range tx.Check() {
+			return fmt.Errorf("%w: %s", errCorrupted, err.Error())
+		}
+
+		return nil
+	})
+}
+
+// Probe tells whether Open would accept the password, opening the key slot in a read-only
+// transaction. A new database accepts any password.
+func (r *Repository) Probe(password []byte) error {
+	_, err := r.ProbeKey(password)
+
+	return err
+}
+
+// ProbeKey returns the key the password opens, read like Probe does. It is nil for a new database.
+func (r *Repository) ProbeKey(password []byte) (*vault.Key, error) {
+	_, err := os.Stat(r.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+
+	db, err := bbolt.Open(r.path, 0600, &bbolt.Options{Timeout: openTimeout, ReadOnly: true})
+	if err != nil {
+		return nil, fmt.Errorf("failed to open database: %s", err.Error())
+	}
+	defer db.Close()
+
+	var key *vault.Key
+
+	err = db.View(func(tx *bbolt.Tx) error {
+		meta := tx.Bucket(metaBucket)
+		if meta == nil || meta.Get(keySlot) == nil {
+			return nil
+		}
+
+		key, err = vault.UnlockSlot(meta.Get(keySlot), password)
+		if errors.Is(err, vault.ErrWrongPassword) {
+			return domain.ErrWrongPassword
+		}
+
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return key, nil
+}
+
+func (r *Repository) Open(password []byte) error {
+	return r.openWith(func(tx *bbolt.Tx) (*vault.Key, error) {
+		return unlock(tx, password, r.kdf)
+	})
+}
+
+// Recover opens the database with a recovery code instead of the master password and protects it
+// with a new password and a new data key in the same transaction. A recovery code is used up by
+// that, the recovery key is not.
+func (r *Repository) Recover(code, password []byte) error {
+	return r.openWith(func(tx *bbolt.Tx) (*vault.Key, error) {
+		meta := tx.Bucket(metaBucket)
+		if meta == nil || meta.Get(keySlot) == nil {
+			return nil, domain.ErrInvalidCode
+		}
+
+		old, err := vault.UnlockSlotRecovery(meta.Get(keySlot), code)
+		if errors.Is(err, vault.ErrInvalidCode) {
+			return nil, domain.ErrInvalidCode
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		key, err := old.Rotate(password, r.kdf)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create vault key: %s", err.Error())
+		}
+
+		err = putSlot(meta, key)
+		if err != nil {
+			return nil, err
+		}
+
+		return key, reseal(tx.Bucket(servicesBucket), old, key)
+	})
+}
+
+// openWith opens the database and takes the key from unlock, which runs in a write transaction.
+func (r *Repository) openWith(unlock func(tx *bbolt.Tx) (*vault.Key, error)) error {
+	db, err := bbolt.Open(r.path, 0600, &bbolt.Options{Timeout: openTimeout})
+	if err != nil {
+		return fmt.Errorf("failed to open database: %s", err.Error())
+	}
+
+	var key *vault.Key
+
+	err = db.Update(func(tx *bbolt.Tx) error {
+		key, err = unlock(tx)
+
+		return err
+	})
+	if err != nil {
+		db.Close()
+
+		return err
+	}
+
+	r.db = db
+	r.key = key
+
+	return nil
+}
+
+// unlock creates the top level buckets if needed and opens the key slot, a new database gets
+// a new key made with params.
+func unlock(tx *bbolt.Tx, password []byte, params vault.KDFParams) (*vault.Key, error) {
+	meta, err := tx.CreateBucketIfNotExists(metaBucket)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create bucket: %s", err.Error())
+	}
+
+	_, err = tx.CreateBucketIfNotExists(servicesBucket)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create bucket: %s", err.Error())
+	}
+
+	slot := meta.Get(keySlot)
+	if slot != nil {
+		key, err := vault.UnlockSlot(slot, password)
+		if errors.Is(err, vault.ErrWrongPassword) {
+			return nil, domain.ErrWrongPassword
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		// a slot made with cheaper parameters than the configured ones is upgraded right away, the
+		// elements are sealed under the new data key in the same transaction
+		upgraded, err := key.Upgrade(password, params)
+		if err != nil {
+			return nil, fmt.Errorf("failed to upgrade vault key: %s", err.Error())
+		}
+		if upgraded == nil {
+			return key, nil
+		}
+
+		err = putSlot(meta, upgraded)
+		if err != nil {
+			return nil, err
+		}
+
+		return upgraded, reseal(tx.Bucket(servicesBucket), key, upgraded)
+	}
+
+	key, err := vault.NewKey(password, params)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create vault key: %s", err.Error())
+	}
+
+	return key, putSlot(meta, key)
+}
+
+func putSlot(meta *bbolt.Bucket, key *vault.Key) error {
+	slot, err := key.Slot()
+	if err != nil {
+		return err
+	}
+
+	err = meta.Put(keySlot, slot)
+	if err != nil {
+		return fmt.Errorf("failed to write key slot: %s", err.Error())
+	}
+
+	return nil
+}
+
+// Rekey protects the database with a new master password and the current key derivation
+// parameters. The elements are encrypted under a new data key in the same transaction as the new
+// slot, so the database holds either the old key or the new one.
+func (r *Repository) Rekey(current, password []byte) error {
+	err := r.key.Verify(current)
+	if errors.Is(err, vault.ErrWrongPassword) {
+		return domain.ErrWrongPassword
+	}
+	if err != nil {
+		return err
+	}
+
+	key, err := r.key.Rotate(password, r.kdf)
+	if err != nil {
+		return fmt.Errorf("failed to create vault key: %s", err.Error())
+	}
+
+	err = r.db.Update(func(tx *bbolt.Tx) error {
+		meta := tx.Bucket(metaBucket)
+
+		err := putSlot(meta, key)
+		if err != nil {
+			return err
+		}
+
+		// the slot as written has to open with the new password before anything depends on it
+		key, err = vault.UnlockSlot(meta.Get(keySlot), password)
+		if err != nil {
+			return fmt.Errorf("failed to verify key slot: %s", err.Error())
+		}
+
+		return reseal(tx.Bucket(servicesBucket), r.key, key)
+	})
+	if err != nil {
+		return fmt.Errorf("failed to change key: %s", err.Error())
+	}
+
+	r.key = key
+
+	return nil
+}
+
+// Key returns the key the database is open with.
+func (r *Repository) Key() *vault.Key {
+	return r.key
+}
+
+// SetKey writes the slot of a key with the same data key and other slots, like new recovery codes.
+func (r *Repository) SetKey(key *vault.Key) error {
+	err := r.db.Update(func(tx *bbolt.Tx) error {
+		return putSlot(tx.Bucket(metaBucket), key)
+	})
+	if err != nil {
+		return err
+	}
+
+	r.key = key
+
+	return nil
+}
+
+// reseal encrypts every element under the new key.
+func reseal(services *bbolt.Bucket, old, key *vault.Key) error {
+	var names [][]byte
+
+	err := services.ForEach(func(name, _ []byte) error {
+		names = append(names, name)
+
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, name := range names {
+		logins := services.Bucket(name).Bucket(loginsBucket)
+		sealed := make(map[string][]byte)
+
+		err = logins.ForEach(func(login, element []byte) error {
+			ad := elementAD(string(name), string(login))
+
+			data, err := old.Open(element, ad)
+			if err != nil {
+				return fmt.Errorf("failed to decrypt element %s/%s: %s", name, login, err.Error())
+			}
+
+			sealed[string(login)], err = key.Seal(data, ad)
+			secmem.Zero(data)
+
+			return err
+		})
+		if err != nil {
+			return err
+		}
+
+		// values may not be changed while iterating
+		for login, element := range sealed {
+			err = logins.Put([]byte(login), element)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+func (r *Repository) Close() error {
+	if r.db == nil {
+		return nil
+	}
+
+	err := r.db.Close()
+	r.db = nil
+	r.key = nil
+
+	if err != nil {
+		return fmt.Errorf("failed to close database: %s", err.Error())
+	}
+
+	return nil
+}
+
+// Snapshot returns a consistent copy of the database file.
+func (r *Repository) Snapshot() ([]byte, error) {
+	var buf bytes.Buffer
+
+	err := r.db.View(func(tx *bbolt.Tx) error {
+		_, err := tx.WriteTo(&buf)
+
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to copy database: %s", err.Error())
+	}
+
+	return buf.Bytes(), nil
+}
+
+// Restore replaces the database file while the repository is closed.
+func (r *Repository) Restore(data []byte) error {
+	if r.db != nil {
+		return fmt.Errorf("database is open")
+	}
+
+	return disk.WriteFile(r.path, data, 0600)
+}
+
+// Flush has nothing to do, every change is committed as it is applied.
+func (r *Repository) Flush() error {
+	return nil
+}
+
+func (r *Repository) ReadOnly() bool {
+	return false
+}
+
+func (r *Repository) GetAll() (domain.Storage, error) {
+	return r.get(func(domain.Service) bool { return true })
+}
+
+func (r *Repository) GetByType(recordType string) (domain.Storage, error) {
+	return r.get(func(service domain.Service) bool { return service.Type == recordType })
+}
+
+func (r *Repository) GetFavorites() (domain.Storage, error) {
+	return r.get(func(service domain.Service) bool { return service.Favorite })
+}
+
+// get decrypts the logins of the services that match.
+func (r *Repository) get(match func(service domain.Service) bool) (domain.Storage, error) {
+	storage := make(domain.Storage)
+
+	err := r.db.View(func(tx *bbolt.Tx) error {
+		return tx.Bucket(servicesBucket).ForEachBucket(func(name []byte) error {
+			bucket := tx.Bucket(servicesBucket).Bucket(name)
+
+			service := domain.Service{
+				Type:     string(bucket.Get(typeKey)),
+				Favorite: string(bucket.Get(favoriteKey)) == "1",
+			}
+
+			if !match(service) {
+				return nil
+			}
+
+			err := bucket.Bucket(loginsBucket).ForEach(func(login, sealed []byte) error {
+				elem, err := r.openElement(string(name), string(login), sealed)
+				if err != nil {
+					return err
+				}
+
+				if service.Elements == nil {
+					service.Elements = make(map[string]domain.Element)
+				}
+
+				service.Elements[string(login)] = elem
+
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+
+			storage[string(name)] = service
+
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to read storage: %s", err.Error())
+	}
+
+	return storage, nil
+}
+
+// Apply runs the operation in a write transaction, it reports false when the service or login
+// it refers to does not exist or already exists.
+func (r *Repository) Apply(op domain.Operation) (bool, error) {
+	ok := false
+
+	err := r.db.Update(func(tx *bbolt.Tx) error {
+		var err error
+
+		ok, err = r.apply(tx.Bucket(servicesBucket), op)
+
+		return err
+	})
+	if err != nil {
+		return false, fmt.Errorf("failed to apply %s: %s", op.Op, err.Error())
+	}
+
+	return ok, nil
+}
+
+func (r *Repository) apply(services *bbolt.Bucket, op domain.Operation) (bool, error) {
+	name := []byte(op.Service)
+	service := services.Bucket(name)
+
+	switch op.Op {
+	case domain.OpAppendService:
+		if service != nil {
+			return false, nil
+		}
+
+		service, err := services.CreateBucket(name)
+		if err != nil {
+			return false, err
+		}
+
+		_, err = service.CreateBucket(loginsBucket)
+		if err != nil {
+			return false, err
+		}
+
+		return true, putService(service, op)
+	case domain.OpUpdateService:
+		if service == nil {
+			return false, nil
+		}
+
+		return true, putService(service, op)
+	case domain.OpDeleteService:
+		if service == nil {
+			return false, nil
+		}
+
+		return true, services.DeleteBucket(name)
+	}
+
+	if service == nil {
+		return false, nil
+	}
+
+	logins := service.Bucket(loginsBucket)
+	login := []byte(op.Login)
+	exists := logins.Get(login) != nil
+
+	switch op.Op {
+	case domain.OpAppendLogin, domain.OpUpdateLogin:
+		if exists != (op.Op == domain.OpUpdateLogin) {
+			return false, nil
+		}
+
+		var elem domain.Element
+		if op.Element != nil {
+			elem = *op.Element
+		}
+
+		sealed, err := r.sealElement(op.Service, op.Login, elem)
+		if err != nil {
+			return false, err
+		}
+
+		return true, logins.Put(login, sealed)
+	case domain.OpDeleteLogin:
+		if !exists {
+			return false, nil
+		}
+
+		return true, logins.Delete(login)
+	}
+
+	return false, fmt.Errorf("unknown operation %q", op.Op)
+}
+
+func putService(service *bbolt.Bucket, op domain.Operation) error {
+	favorite := "0"
+	if op.Favorite {
+		favorite = "1"
+	}
+
+	err := service.Put(typeKey, []byte(op.Type))
+	if err != nil {
+		return err
+	}
+
+	return service.Put(favoriteKey, []byte(favorite))
+}
+
+// elementAD binds an encrypted element to its key, so elements cannot be swapped between logins.
+func elementAD(service, login string) []byte {
+	return []byte(service + "\x00" + login)
+}
+
+func (r *Repository) sealElement(service, login string, elem domain.Element) ([]byte, error) {
+	data, err := json.Marshal(elem)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal element: %s", err.Error())
+	}
+
+	sealed, err := r.key.Seal(data, elementAD(service, login))
+	secmem.Zero(data)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encrypt element: %s", err.Error())
+	}
+
+	return sealed, nil
+}
+
+func (r *Repository) openElement(service, login string, sealed []byte) (domain.Element, error) {
+	data, err := r.key.Open(sealed, elementAD(service, login))
+	if err != nil {
+		return domain.Element{}, fmt.Errorf("failed to decrypt element %s/%s: %s", service, login, err.Error())
+	}
+
+	var elem domain.Element
+
+	err = json.Unmarshal(data, &elem)
+	secmem.Zero(data)
+	if err != nil {
+		return domain.Element{}, fmt.Errorf("failed to unmarshal element: %s", err.Error())
+	}
+
+	return elem, nil
+}
@@ -0,0 +1,211 @@
+package bolt
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+
+	bbolt "go.etcd.io/bbolt"
+
+	"manager/internal/backend/backendtest"
+	"manager/internal/domain"
+	"manager/internal/vault"
+)
+
+var testKDF = vault.KDFParams{Time: 1, Memory: 64, Threads: 1}
+
+func TestConformance(t *testing.T) {
+	backendtest.Run(t, func(path string) backendtest.Repository {
+		return New(path, testKDF)
+	})
+}
+
+func openTestRepository(t *testing.T, path, password string) *Repository {
+	t.Helper()
+
+	r := New(path, testKDF)
+
+	err := r.Open([]byte(password))
+	if err != nil {
+		t.Fatalf("Open: %s", err)
+	}
+
+	t.Cleanup(func() {
+		r.Close()
+	})
+
+	return r
+}
+
+func addLogin(t *testing.T, r *Repository, service, login, password string) {
+	t.Helper()
+
+	for _, op := range []domain.Operation{
+		{Op: domain.OpAppendService, Service: service, Type: "password"},
+		{Op: domain.OpAppendLogin, Service: service, Login: login, Element: &domain.Element{Password: domain.NewSecret([]byte(password))}},
+	} {
+		_, err := r.Apply(op)
+		if err != nil {
+			t.Fatalf("Apply %s: %s", op.Op, err)
+		}
+	}
+}
+
+// element returns the encrypted element as it is stored.
+func element(t *testing.T, r *Repository, service, login string) []byte {
+	t.Helper()
+
+	var sealed []byte
+
+	err := r.db.View(func(tx *bbolt.Tx) error {
+		sealed = append(sealed, tx.Bucket(servicesBucket).Bucket([]byte(service)).Bucket(loginsBucket).Get([]byte(login))...)
+
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return sealed
+}
+
+func TestRekey(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "storage.db")
+
+	r := openTestRepository(t, path, "old")
+	addLogin(t, r, "mail", "alice", "one")
+
+	old := r.Key()
+
+	err := r.Rekey([]byte("guess"), []byte("new"))
+	if !errors.Is(err, domain.ErrWrongPassword) {
+		t.Fatalf("Rekey with a wrong password: got %v", err)
+	}
+
+	err = r.Rekey([]byte("old"), []byte("new"))
+	if err != nil {
+		t.Fatalf("Rekey: %s", err)
+	}
+
+	// the elements are under the new data key
+	_, err = old.Open(element(t, r, "mail", "alice"), elementAD("mail", "alice"))
+	if err == nil {
+		t.Fatal("the old data key still opens the elements")
+	}
+
+	err = r.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = New(path, testKDF).Open([]byte("old"))
+	if !errors.Is(err, domain.ErrWrongPassword) {
+		t.Fatalf("old password after Rekey: got %v", err)
+	}
+
+	storage, err := openTestRepository(t, path, "new").GetAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if string(storage["mail"].Elements["alice"].Password.Bytes()) != "one" {
+		t.Fatalf("got %v", storage)
+	}
+}
+
+// A slot made with cheaper parameters is upgraded on Open, the elements move to a new data key.
+func TestKDFUpgrade(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "storage.db")
+
+	r := openTestRepository(t, path, "secret")
+	addLogin(t, r, "mail", "alice", "one")
+
+	cheap := r.Key()
+
+	err := r.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stronger := vault.KDFParams{Time: testKDF.Time + 1, Memory: testKDF.Memory, Threads: testKDF.Threads}
+
+	r = New(path, stronger)
+
+	err = r.Open([]byte("secret"))
+	if err != nil {
+		t.Fatalf("Open: %s", err)
+	}
+	defer r.Close()
+
+	if got := r.Key().KDF(); got != stronger {
+		t.Fatalf("got %+v, want %+v", got, stronger)
+	}
+
+	_, err = cheap.Open(element(t, r, "mail", "alice"), elementAD("mail", "alice"))
+	if err == nil {
+		t.Fatal("the cheaper slot still reaches the elements")
+	}
+
+	storage, err := r.GetAll()
+	if err != nil || string(storage["mail"].Elements["alice"].Password.Bytes()) != "one" {
+		t.Fatalf("got %v, %v", storage, err)
+	}
+}
+
+func TestRecover(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "storage.db")
+
+	r := openTestRepository(t, path, "old")
+	addLogin(t, r, "mail", "alice", "one")
+
+	key, codes, _, err := r.Key().WithRecovery(2, false)
+	if err == nil {
+		err = r.SetKey(key)
+	}
+	if err == nil {
+		err = r.Close()
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r = New(path, testKDF)
+
+	err = r.Recover([]byte(codes[0]), []byte("new"))
+	if err != nil {
+		t.Fatalf("Recover: %s", err)
+	}
+
+	storage, err := r.GetAll()
+	if err != nil || string(storage["mail"].Elements["alice"].Password.Bytes()) != "one" {
+		t.Fatalf("got %v, %v", storage, err)
+	}
+
+	if n, _ := r.Key().Recovery(); n != 1 {
+		t.Fatalf("%d codes left, want 1", n)
+	}
+
+	err = r.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = New(path, testKDF).Recover([]byte(codes[0]), []byte("other"))
+	if !errors.Is(err, domain.ErrInvalidCode) {
+		t.Fatalf("used code: got %v", err)
+	}
+
+	openTestRepository(t, path, "new")
+}
+
+// A second process waits for the database and gives up instead of opening it twice.
+func TestOpenLocked(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "storage.db")
+
+	openTestRepository(t, path, "secret")
+
+	err := New(path, testKDF).Open([]byte("secret"))
+	if err == nil {
+		t.Fatal("the database was opened twice")
+	}
+}
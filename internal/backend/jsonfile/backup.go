@@ -0,0 +1,84 @@
+package jsonfile
+
+import (
+	"fmt"
+	"os"
+
+	"manager/internal/disk"
+	"manager/internal/domain"
+	repo "manager/internal/repository"
+	"manager/internal/secmem"
+	"manager/internal/vault"
+)
+
+// Snapshot returns the storage as a complete storage file, encrypted or signed like the file itself.
+func (r *Repository) Snapshot() ([]byte, error) {
+	return r.SnapshotOf(r.Current())
+}
+
+// Current returns the version of the storage that is open, it must not be modified.
+func (r *Repository) Current() *repo.Snapshot {
+	return r.repo.Current()
+}
+
+// SnapshotOf returns a version of the storage taken with Current as a complete storage file, like
+// Snapshot. It is written with the key that is open now.
+func (r *Repository) SnapshotOf(snap *repo.Snapshot) ([]byte, error) {
+	r.opsMutex.Lock()
+	data, err := r.encode(snap.Storage(), r.key)
+	r.opsMutex.Unlock()
+
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal storage: %s", err.Error())
+	}
+
+	if !r.encrypt {
+		return data, nil
+	}
+	defer secmem.Zero(data)
+
+	return r.key.Encrypt(data)
+}
+
+// Decode reads a storage file written with the open key, like a snapshot.
+func (r *Repository) Decode(data []byte) (domain.Storage, error) {
+	if r.key == nil {
+		return nil, fmt.Errorf("storage is closed")
+	}
+
+	snap, err := loadSnapshot(data, keyOpener{r.key})
+	if err != nil {
+		return nil, err
+	}
+
+	if snap.tamper != nil {
+		return nil, snap.tamper
+	}
+
+	return snap.storage, nil
+}
+
+// Restore replaces the storage file while the repository is closed. The journal belongs to the
+// previous file and goes with it, a recovery ends with a restored file.
+func (r *Repository) Restore(data []byte) error {
+	if r.key != nil {
+		return fmt.Errorf("storage is open")
+	}
+
+	if vault.IsEncrypted(data) {
+		err := vault.CheckHeader(data)
+		if err != nil {
+			return err
+		}
+	}
+
+	err := disk.WriteFile(r.filename, data, 0600)
+	if err != nil {
+		return err
+	}
+
+	os.Remove(r.filename + journalSuffix)
+	r.recovery = false
+
+	return nil
+}
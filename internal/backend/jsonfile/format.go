@@ -0,0 +1,183 @@
+package jsonfile
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"sort"
+
+	"manager/internal/domain"
+)
+
+// The storage is written as an envelope around the records:
+//
+//	{"version": N, "data": {...}}
+//
+// Files without the envelope are version 0, the bare map of services.
+type envelope struct {
+	Version int             `json:"version"`
+	Data    json.RawMessage `json:"data"`
+}
+
+// document is the data of the envelope since version 2. The signature is only written when the
+// file is not encrypted.
+type document struct {
+	Services  domain.Storage `json:"services"`
+	Signature *signature     `json:"signature,omitempty"`
+}
+
+// signedVersion is the first version that signs unencrypted files.
+const signedVersion = 2
+
+type migration struct {
+	description string
+	migrate     func(data json.RawMessage) (json.RawMessage, error)
+}
+
+// migrations[n] upgrades the data of version n to version n+1. A change to domain.Service or
+// domain.Element that changes the JSON gets a new migration appended here.
+var migrations = []migration{
+	{
+		description: "wrap the bare map of services in a versioned envelope",
+		migrate: func(data json.RawMessage) (json.RawMessage, error) {
+			return data, nil
+		},
+	},
+	{
+		description: "move the services into a document that can carry record signatures",
+		migrate: func(data json.RawMessage) (json.RawMessage, error) {
+			return json.Marshal(map[string]json.RawMessage{"services": data})
+		},
+	},
+}
+
+var currentVersion = len(migrations)
+
+var ErrNewerVersion = errors.New("storage was written by a newer version of the manager")
+
+// Migration describes the upgrade of a storage file to the current format.
+type Migration struct {
+	From  int
+	To    int
+	Steps []string
+
+	// names of the services the upgrade adds, removes or changes
+	Added   []string
+	Removed []string
+	Changed []string
+}
+
+func (m Migration) Needed() bool {
+	return m.From < m.To
+}
+
+// Encode serializes the storage in the current format.
+func Encode(storage domain.Storage) ([]byte, error) {
+	return encode(document{Services: storage})
+}
+
+func encode(doc document) ([]byte, error) {
+	data, err := json.Marshal(doc)
+	if err != nil {
+		return nil, err
+	}
+
+	return json.Marshal(envelope{Version: currentVersion, Data: data})
+}
+
+// decode reads a storage of any known version and upgrades it to the current one in memory.
+func decode(plaintext []byte) (document, Migration, error) {
+	var fields map[string]json.RawMessage
+
+	err := json.Unmarshal(plaintext, &fields)
+	if err != nil {
+		return document{}, Migration{}, fmt.Errorf("%w: failed to unmarshal file: %s", errCorrupted, err.Error())
+	}
+
+	version := 0
+	data := json.RawMessage(plaintext)
+
+	// a bare map cannot be mistaken for an envelope, services are objects and not numbers
+	if len(fields) == 2 && fields["data"] != nil && json.Unmarshal(fields["version"], &version) == nil {
+		data = fields["data"]
+	}
+
+	if version > currentVersion {
+		return document{}, Migration{}, fmt.Errorf("%w: version %d, supported up to %d", ErrNewerVersion, version, currentVersion)
+	}
+
+	m := Migration{From: version, To: currentVersion}
+	original := data
+
+	for v := version; v < currentVersion; v++ {
+		data, err = migrations[v].migrate(data)
+		if err != nil {
+			return document{}, Migration{}, fmt.Errorf("failed to migrate storage from version %d: %s", v, err.Error())
+		}
+
+		m.Steps = append(m.Steps, fmt.Sprintf("v%d -> v%d: %s", v, v+1, migrations[v].description))
+	}
+
+	var doc document
+
+	err = json.Unmarshal(data, &doc)
+	if err != nil {
+		return document{}, Migration{}, fmt.Errorf("%w: failed to unmarshal file: %s", errCorrupted, err.Error())
+	}
+
+	if doc.Services == nil {
+		doc.Services = make(domain.Storage)
+	}
+
+	if m.Needed() {
+		m.diff(original, doc.Services)
+	}
+
+	return doc, m, nil
+}
+
+// diff compares the services of the original data with the migrated ones by their JSON values.
+func (m *Migration) diff(original json.RawMessage, storage domain.Storage) {
+	var before map[string]json.RawMessage
+
+	if m.From >= signedVersion {
+		var doc struct {
+			Services map[string]json.RawMessage `json:"services"`
+		}
+
+		json.Unmarshal(original, &doc)
+		before = doc.Services
+	} else {
+		json.Unmarshal(original, &before)
+	}
+
+	for name, service := range storage {
+		old, ok := before[name]
+		if !ok {
+			m.Added = append(m.Added, name)
+
+			continue
+		}
+
+		migrated, _ := json.Marshal(service)
+
+		var a, b any
+		json.Unmarshal(old, &a)
+		json.Unmarshal(migrated, &b)
+
+		if !reflect.DeepEqual(a, b) {
+			m.Changed = append(m.Changed, name)
+		}
+	}
+
+	for name := range before {
+		if _, ok := storage[name]; !ok {
+			m.Removed = append(m.Removed, name)
+		}
+	}
+
+	sort.Strings(m.Added)
+	sort.Strings(m.Removed)
+	sort.Strings(m.Changed)
+}
@@ -0,0 +1,204 @@
+package jsonfile
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"reflect"
+	"sort"
+	"testing"
+
+	"manager/internal/domain"
+)
+
+const bareStorage = `{"mail":{"type":"password","favorite":true,"elements":{"alice":{"password":"hunter2","description":"personal","additional":""}}},"bank":{"type":"card","favorite":false,"elements":{}}}`
+
+// storages of every earlier version with the same services
+var olderVersions = map[int]string{
+	0: bareStorage,
+	1: `{"version":1,"data":` + bareStorage + `}`,
+}
+
+func TestDecodeOlderVersions(t *testing.T) {
+	for version, data := range olderVersions {
+		doc, m, err := decode([]byte(data))
+		if err != nil {
+			t.Fatalf("version %d: %s", version, err)
+		}
+
+		if m.From != version || m.To != currentVersion || len(m.Steps) != currentVersion-version {
+			t.Fatalf("version %d: got migration %+v", version, m)
+		}
+
+		if len(m.Added) != 0 || len(m.Removed) != 0 || len(m.Changed) != 0 {
+			t.Fatalf("version %d: migration changed services: %+v", version, m)
+		}
+
+		if len(doc.Services) != 2 || password(doc.Services, "mail", "alice") != "hunter2" || !doc.Services["mail"].Favorite {
+			t.Fatalf("version %d: got %+v", version, doc.Services)
+		}
+	}
+}
+
+func TestDecodeCurrentVersion(t *testing.T) {
+	storage := domain.Storage{
+		"mail": {Type: "password", Elements: map[string]domain.Element{
+			"alice": {Password: domain.NewSecret([]byte("hunter2")), Additional: "line one\nline two"},
+		}},
+	}
+
+	data, err := Encode(storage)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	doc, m, err := decode(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if m.Needed() {
+		t.Fatalf("got migration %+v", m)
+	}
+
+	if password(doc.Services, "mail", "alice") != "hunter2" || doc.Services["mail"].Elements["alice"].Additional != "line one\nline two" {
+		t.Fatalf("got %+v", doc.Services)
+	}
+}
+
+func TestDecodeNewerVersion(t *testing.T) {
+	data, err := json.Marshal(envelope{Version: currentVersion + 1, Data: json.RawMessage(`{}`)})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, _, err = decode(data)
+	if !errors.Is(err, ErrNewerVersion) {
+		t.Fatalf("got %v, want ErrNewerVersion", err)
+	}
+
+	// the file is left alone
+	filename := testFile(t)
+
+	err = os.WriteFile(filename, data, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = newTestRepository(filename, false).Open([]byte("secret"))
+	if !errors.Is(err, ErrNewerVersion) {
+		t.Fatalf("Open: got %v, want ErrNewerVersion", err)
+	}
+
+	if string(readTestFile(t, filename)) != string(data) {
+		t.Fatal("the file of a newer version was changed")
+	}
+}
+
+// A service whose name looks like an envelope field stays a bare map.
+func TestDecodeBareMapWithEnvelopeNames(t *testing.T) {
+	data := `{"version":{"type":"password","favorite":false,"elements":{}},"data":{"type":"card","favorite":false,"elements":{}}}`
+
+	doc, m, err := decode([]byte(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if m.From != 0 || len(doc.Services) != 2 || doc.Services["data"].Type != "card" {
+		t.Fatalf("got %+v, %+v", m, doc.Services)
+	}
+}
+
+func TestOpenMigrates(t *testing.T) {
+	for version, data := range olderVersions {
+		for _, encrypt := range []bool{true, false} {
+			filename := testFile(t)
+
+			err := os.WriteFile(filename, []byte(data), 0600)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			r := newTestRepository(filename, encrypt)
+			r.AcceptLegacy()
+
+			err = r.Open([]byte("secret"))
+			if err != nil {
+				t.Fatalf("version %d: Open: %s", version, err)
+			}
+
+			storage, err := r.GetAll()
+			if err != nil || password(storage, "mail", "alice") != "hunter2" || len(storage) != 2 {
+				t.Fatalf("version %d: got %+v, %v", version, storage, err)
+			}
+
+			backup := fmt.Sprintf("%s.pre-migration-v%d", filename, version)
+			if string(readTestFile(t, backup)) != data {
+				t.Fatalf("version %d: the file before the migration was not kept", version)
+			}
+
+			err = r.Close()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			m, err := Inspect(readTestFile(t, filename), []byte("secret"))
+			if err != nil || m.Needed() {
+				t.Fatalf("version %d: the file was not written in the current format: %+v, %v", version, m, err)
+			}
+
+			r = openTestRepository(t, filename, "secret", encrypt)
+
+			reopened, err := r.GetAll()
+			if err != nil || !reflect.DeepEqual(names(reopened), names(storage)) || password(reopened, "mail", "alice") != "hunter2" {
+				t.Fatalf("version %d: got %+v, %v after reopening", version, reopened, err)
+			}
+		}
+	}
+}
+
+func TestInspect(t *testing.T) {
+	m, err := Inspect([]byte(bareStorage), []byte("secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if m.From != 0 || m.To != currentVersion || !m.Needed() {
+		t.Fatalf("got %+v", m)
+	}
+
+	_, err = Inspect([]byte("{not json"), []byte("secret"))
+	if err == nil {
+		t.Fatal("a damaged file was inspected")
+	}
+}
+
+func TestMigrationDiff(t *testing.T) {
+	m := Migration{From: 0, To: currentVersion}
+
+	storage := domain.Storage{
+		"mail": {Type: "password", Favorite: true, Elements: map[string]domain.Element{
+			"alice": {Password: domain.NewSecret([]byte("changed"))},
+		}},
+		"new": {Type: "password", Elements: map[string]domain.Element{}},
+	}
+
+	m.diff(json.RawMessage(bareStorage), storage)
+
+	if !reflect.DeepEqual(m.Added, []string{"new"}) || !reflect.DeepEqual(m.Removed, []string{"bank"}) || !reflect.DeepEqual(m.Changed, []string{"mail"}) {
+		t.Fatalf("got %+v", m)
+	}
+}
+
+func names(storage domain.Storage) []string {
+	var result []string
+
+	for name := range storage {
+		result = append(result, name)
+	}
+
+	sort.Strings(result)
+
+	return result
+}
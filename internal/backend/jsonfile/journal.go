@@ -0,0 +1,311 @@
+package jsonfile
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+
+	"manager/internal/disk"
+	"manager/internal/domain"
+	"manager/internal/secmem"
+	"manager/internal/vault"
+)
+
+const journalSuffix = ".journal"
+
+// Apply changes the storage in memory and queues the operation for the journal in the same order.
+func (r *Repository) Apply(op domain.Operation) (bool, error) {
+	if r.recovery || r.stale {
+		return false, domain.ErrReadOnly
+	}
+
+	r.opsMutex.Lock()
+	defer r.opsMutex.Unlock()
+
+	r.remember(op.Service)
+
+	ok := r.repo.Apply(op)
+	if ok {
+		r.pending = append(r.pending, op)
+	}
+
+	return ok, nil
+}
+
+// ApplyBatch changes the storage in memory with all operations at once, or with none of them when
+// one fails, and queues them like Apply.
+func (r *Repository) ApplyBatch(ops []domain.Operation) (bool, error) {
+	if r.recovery || r.stale {
+		return false, domain.ErrReadOnly
+	}
+
+	r.opsMutex.Lock()
+	defer r.opsMutex.Unlock()
+
+	for _, op := range ops {
+		r.remember(op.Service)
+	}
+
+	ok := r.repo.ApplyBatch(ops)
+	if ok {
+		r.pending = append(r.pending, ops...)
+	}
+
+	return ok, nil
+}
+
+// Flush appends the pending operations to the journal and compacts it once it grows too big.
+func (r *Repository) Flush() error {
+	if r.recovery || r.stale {
+		return nil
+	}
+
+	r.fileMutex.Lock()
+	defer r.fileMutex.Unlock()
+
+	if r.journal == nil {
+		return r.compact()
+	}
+
+	r.opsMutex.Lock()
+	ops := r.pending
+	r.pending = nil
+	r.opsMutex.Unlock()
+
+	payloads := make([][]byte, 0, len(ops))
+
+	for _, op := range ops {
+		payload, err := json.Marshal(op)
+		if err == nil {
+			plain := payload
+			payload, err = r.key.Seal(plain, r.journal.Base())
+			secmem.Zero(plain)
+		}
+
+		if err != nil {
+			r.requeue(ops, nil)
+
+			return fmt.Errorf("failed to encode journal entry: %s", err.Error())
+		}
+
+		payloads = append(payloads, payload)
+	}
+
+	err := r.journal.Append(payloads)
+	if err != nil {
+		r.requeue(ops, nil)
+
+		return err
+	}
+
+	r.unsaved = append(r.unsaved, ops...)
+
+	if r.journal.Size() >= r.compactSize {
+		return r.compact()
+	}
+
+	return nil
+}
+
+// compact writes a new snapshot with everything applied so far and starts an empty journal after it.
+func (r *Repository) compact() error {
+	return r.compactWith(r.key, nil)
+}
+
+// compactWith writes the snapshot under key, which is the key of the repository from then on. check
+// runs on the new file before it replaces the current one.
+func (r *Repository) compactWith(key *vault.Key, check func(data []byte, storage domain.Storage) error) error {
+	r.opsMutex.Lock()
+	storage := r.repo.GetAll()
+	data, err := r.encode(storage, key)
+	ops := r.pending
+	base := r.base
+	r.pending = nil
+	r.base = nil
+	r.opsMutex.Unlock()
+
+	if err != nil {
+		r.requeue(ops, base)
+
+		return fmt.Errorf("failed to marshal storage: %s", err.Error())
+	}
+
+	if r.encrypt {
+		plain := data
+		data, err = key.Encrypt(plain)
+		secmem.Zero(plain)
+		if err != nil {
+			r.requeue(ops, base)
+
+			return fmt.Errorf("failed to encrypt storage: %s", err.Error())
+		}
+	}
+
+	if check != nil {
+		err = check(data, storage)
+		if err != nil {
+			r.requeue(ops, base)
+
+			return fmt.Errorf("failed to verify storage: %s", err.Error())
+		}
+	}
+
+	err = disk.WriteFile(r.filename, data, 0600)
+	if err != nil {
+		r.requeue(ops, base)
+
+		return fmt.Errorf("failed to write storage in file: %s", err.Error())
+	}
+
+	// from here on the snapshot holds every change, a failure below only delays the new journal
+	if r.journal != nil {
+		r.journal.Close()
+		r.journal = nil
+	}
+
+	r.key = key
+
+	sum := sha256.Sum256(data)
+	r.sum = sum[:]
+	r.info, _ = os.Stat(r.filename)
+	r.unsaved = nil
+
+	r.journal, err = disk.CreateJournal(r.filename+journalSuffix, sum[:])
+	if err != nil {
+		return fmt.Errorf("failed to create journal: %s", err.Error())
+	}
+
+	return nil
+}
+
+// encode serializes the storage for the snapshot, signing it with key when it is not going to be
+// encrypted.
+func (r *Repository) encode(storage domain.Storage, key *vault.Key) ([]byte, error) {
+	if r.encrypt {
+		return Encode(storage)
+	}
+
+	sig, err := sign(storage, key)
+	if err != nil {
+		return nil, err
+	}
+
+	return encode(document{Services: storage, Signature: sig})
+}
+
+// requeue puts operations that were not written back in front of the pending ones, together with
+// the base of the services they touch when it was taken away with them.
+func (r *Repository) requeue(ops []domain.Operation, base map[string]*domain.Service) {
+	r.opsMutex.Lock()
+	r.pending = append(ops, r.pending...)
+
+	for name, service := range base {
+		if r.base == nil {
+			r.base = make(map[string]*domain.Service)
+		}
+
+		r.base[name] = service
+	}
+
+	r.opsMutex.Unlock()
+}
+
+// remember keeps the service as the storage file has it before the first change to it.
+func (r *Repository) remember(name string) {
+	if _, ok := r.base[name]; ok {
+		return
+	}
+
+	if r.base == nil {
+		r.base = make(map[string]*domain.Service)
+	}
+
+	service, ok := r.repo.Get(name)
+	if !ok {
+		r.base[name] = nil
+
+		return
+	}
+
+	service = cloneService(service)
+	r.base[name] = &service
+}
+
+func cloneService(service domain.Service) domain.Service {
+	elements := make(map[string]domain.Element, len(service.Elements))
+	for login, elem := range service.Elements {
+		elements[login] = elem
+	}
+
+	service.Elements = elements
+
+	return service
+}
+
+// replay applies the journal written after the snapshot with the given checksum. A journal that
+// belongs to another snapshot is left for the next compaction, one that cannot be replayed
+// completely is quarantined so the entries that are not applied are kept.
+func (r *Repository) replay(snapshotSum []byte) {
+	journal, entries, err := disk.OpenJournal(r.filename + journalSuffix)
+	if errors.Is(err, os.ErrNotExist) {
+		return
+	}
+	if err != nil {
+		log.Printf("failed to open journal: %s", err.Error())
+
+		return
+	}
+
+	if !bytes.Equal(journal.Base(), snapshotSum) {
+		// the snapshot was written after the journal had been compacted into it
+		journal.Close()
+
+		return
+	}
+
+	for i, entry := range entries {
+		payload, err := r.key.Open(entry, journal.Base())
+
+		var op domain.Operation
+		if err == nil {
+			err = json.Unmarshal(payload, &op)
+			secmem.Zero(payload)
+		}
+
+		if err != nil {
+			journal.Close()
+
+			quarantined, qerr := disk.Quarantine(r.filename + journalSuffix)
+			if qerr != nil {
+				log.Printf("failed to replay journal entry %d of %d, dropping %d entries: %s, %s", i+1, len(entries), len(entries)-i, err.Error(), qerr.Error())
+
+				return
+			}
+
+			log.Printf("failed to replay journal entry %d of %d, dropping %d entries, the journal is kept in %s: %s", i+1, len(entries), len(entries)-i, quarantined, err.Error())
+
+			return
+		}
+
+		r.remember(op.Service)
+		r.repo.Apply(op)
+		r.unsaved = append(r.unsaved, op)
+	}
+
+	r.journal = journal
+}
+
+func (r *Repository) closeJournal() {
+	if r.journal != nil {
+		r.journal.Close()
+		r.journal = nil
+	}
+
+	r.pending = nil
+	r.unsaved = nil
+	r.base = nil
+}
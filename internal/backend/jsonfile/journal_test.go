@@ -0,0 +1,139 @@
+package jsonfile
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"manager/internal/disk"
+)
+
+func TestJournalReplay(t *testing.T) {
+	filename := testFile(t)
+
+	r := openTestRepository(t, filename, "secret", true)
+	addLogin(t, r, "mail", "alice", "one")
+	addLogin(t, r, "mail", "bob", "two")
+
+	err := r.Flush()
+	if err == nil {
+		err = r.Close()
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	info, err := os.Stat(filename + journalSuffix)
+	if err != nil || info.Size() == 0 {
+		t.Fatalf("the changes are not in the journal: %v", err)
+	}
+
+	storage, err := openTestRepository(t, filename, "secret", true).GetAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if password(storage, "mail", "alice") != "one" || password(storage, "mail", "bob") != "two" {
+		t.Fatal("the journal was not replayed")
+	}
+}
+
+func TestJournalTruncatedTail(t *testing.T) {
+	filename := testFile(t)
+
+	r := openTestRepository(t, filename, "secret", true)
+	addLogin(t, r, "mail", "alice", "one")
+
+	err := r.Flush()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	addLogin(t, r, "mail", "bob", "two")
+
+	err = r.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a crash in the middle of the second append
+	journal := filename + journalSuffix
+
+	info, err := os.Stat(journal)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = os.Truncate(journal, info.Size()-5)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	storage, err := openTestRepository(t, filename, "secret", true).GetAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if password(storage, "mail", "alice") != "one" || password(storage, "mail", "bob") != "" {
+		t.Fatalf("got %v", storage)
+	}
+}
+
+// An entry that passes the checksum but does not decrypt stops the replay, the journal is kept with
+// the entries after it.
+func TestJournalCorruptMiddle(t *testing.T) {
+	filename := testFile(t)
+	journal := filename + journalSuffix
+
+	r := openTestRepository(t, filename, "secret", true)
+	addLogin(t, r, "mail", "alice", "one")
+
+	err := r.Flush()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	other, _, err := disk.OpenJournal(journal)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = other.Append([][]byte{[]byte("not sealed with the key")})
+	other.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	addLogin(t, r, "mail", "bob", "two")
+
+	err = r.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	damaged := readTestFile(t, journal)
+
+	storage, err := openTestRepository(t, filename, "secret", true).GetAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if password(storage, "mail", "alice") != "one" || password(storage, "mail", "bob") != "" {
+		t.Fatalf("got %v", storage)
+	}
+
+	files, err := filepath.Glob(journal + ".corrupt-*")
+	if err != nil || len(files) != 1 {
+		t.Fatalf("got quarantined journals %v, %v", files, err)
+	}
+
+	if !bytes.Equal(readTestFile(t, files[0]), damaged) {
+		t.Fatal("the quarantined journal differs from the damaged one")
+	}
+
+	// the compaction on open started a new journal
+	if bytes.Equal(readTestFile(t, journal), damaged) {
+		t.Fatal("the damaged journal is still in use")
+	}
+}
@@ -0,0 +1,550 @@
+package jsonfile
+
+import (
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+
+	"manager/internal/disk"
+	"manager/internal/domain"
+	repo "manager/internal/repository"
+	"manager/internal/secmem"
+	"manager/internal/vault"
+)
+
+// ErrDowngrade is returned for a storage file that is neither encrypted nor signed. Files of the
+// first versions look like that, and so does a file put in place of the vault.
+var ErrDowngrade = fmt.Errorf("%w: the storage file is neither encrypted nor signed, accept it with manager migrate", domain.ErrTampered)
+
+// ErrNoStorage is returned by Open for a missing storage file unless Create was called.
+var ErrNoStorage = errors.New("storage file does not exist, create it with manager init")
+
+type repository interface {
+	SetStorage(domain.Storage)
+	Get(name string) (domain.Service, bool)
+	GetAll() domain.Storage
+	GetByType(recordType string) domain.Storage
+	GetFavorites() domain.Storage
+	Apply(domain.Operation) bool
+	ApplyBatch([]domain.Operation) bool
+	Current() *repo.Snapshot
+	Reset()
+}
+
+// Repository keeps the whole storage in memory and persists it as an encrypted JSON snapshot
+// followed by a journal of the changes made since. Open and Close must not run concurrently
+// with the other methods.
+//
+// Without encryption the snapshot is plain JSON with a signature for every record, it is left
+// complete on Close so it can be read and edited by hand.
+type Repository struct {
+	repo        repository
+	filename    string
+	compactSize int64
+	encrypt     bool
+
+	// kdf is the cost new password slots are made with and cheaper ones are upgraded to
+	kdf vault.KDFParams
+
+	// acknowledged accepts the records failing verification on the next Open and signs them again,
+	// legacy accepts a file from before signatures and encryption, create accepts a missing file
+	acknowledged bool
+	legacy       bool
+	create       bool
+
+	// key is nil while the repository is closed
+	key *vault.Key
+
+	// recovery is set when the storage file turned out to be unreadable, nothing is written then
+	recovery bool
+
+	// stale is set when the file was replaced on disk by something that cannot be loaded, the
+	// previous state is served read-only until the next Open
+	stale bool
+
+	// sum and info identify the storage file as last read or written by this process
+	sum  []byte
+	info os.FileInfo
+
+	fileMutex *sync.Mutex
+	journal   *disk.Journal
+
+	// opsMutex keeps pending in the order the operations were applied to the repository
+	opsMutex *sync.Mutex
+	pending  []domain.Operation
+
+	// unsaved are the operations in the journal, they are not part of the storage file yet
+	unsaved []domain.Operation
+
+	// base holds the services touched by unsaved and pending operations as the storage file has
+	// them, nil when it does not. A reload compares them with the replaced file.
+	base map[string]*domain.Service
+}
+
+func New(repo repository, filename string, compactSize int64, encrypt bool, kdf vault.KDFParams) *Repository {
+	return &Repository{
+		repo:        repo,
+		filename:    filename,
+		compactSize: compactSize,
+		encrypt:     encrypt,
+		kdf:         kdf,
+		fileMutex:   new(sync.Mutex),
+		opsMutex:    new(sync.Mutex),
+	}
+}
+
+// snapshot is a storage file as it was read from disk.
+type snapshot struct {
+	storage   domain.Storage
+	key       *vault.Key
+	sum       []byte
+	raw       []byte
+	migration Migration
+	encrypted bool
+	info      os.FileInfo
+
+	// tamper lists the records of an unencrypted file that fail verification
+	tamper *TamperError
+
+	// legacy is set for a file from before signatures and encryption, nothing vouches for it
+	legacy bool
+}
+
+// readFile returns the storage together with the key and the checksum of the file it was read from.
+func readFile(filename string, o opener) (snapshot, error) {
+	// taken before reading, a replacement in between is noticed as a change later
+	info, err := os.Stat(filename)
+	if err != nil {
+		return snapshot{}, fmt.Errorf("failed to read file: %w", err)
+	}
+
+	raw, err := os.ReadFile(filename)
+	if err != nil {
+		return snapshot{}, fmt.Errorf("failed to read file: %w", err)
+	}
+
+	snap, err := loadSnapshot(raw, o)
+	snap.info = info
+
+	return snap, err
+}
+
+func readSnapshot(raw []byte, password []byte) (snapshot, error) {
+	return loadSnapshot(raw, passwordOpener(password))
+}
+
+// opener unlocks a storage file, with the master password or with the key of the vault that is
+// already open.
+type opener interface {
+	decrypt(raw []byte) (*vault.Key, []byte, error)
+	unlockSlot(slot []byte) (*vault.Key, error)
+}
+
+type passwordOpener []byte
+
+func (p passwordOpener) decrypt(raw []byte) (*vault.Key, []byte, error) {
+	return vault.Decrypt(raw, p)
+}
+
+func (p passwordOpener) unlockSlot(slot []byte) (*vault.Key, error) {
+	return vault.UnlockSlot(slot, p)
+}
+
+type recoveryOpener []byte
+
+func (c recoveryOpener) decrypt(raw []byte) (*vault.Key, []byte, error) {
+	return vault.DecryptRecovery(raw, c)
+}
+
+func (c recoveryOpener) unlockSlot(slot []byte) (*vault.Key, error) {
+	return vault.UnlockSlotRecovery(slot, c)
+}
+
+type keyOpener struct {
+	key *vault.Key
+}
+
+func (o keyOpener) decrypt(raw []byte) (*vault.Key, []byte, error) {
+	plaintext, err := o.key.Decrypt(raw)
+
+	return o.key, plaintext, err
+}
+
+// unlockSlot keeps the open key, signatures made under another one fail verification
+func (o keyOpener) unlockSlot(slot []byte) (*vault.Key, error) {
+	return o.key, nil
+}
+
+func loadSnapshot(raw []byte, o opener) (snapshot, error) {
+	sum := sha256.Sum256(raw)
+	plaintext := raw
+
+	var key *vault.Key
+	var err error
+
+	encrypted := vault.IsEncrypted(raw)
+
+	// files written before encryption was introduced are plain JSON, they get encrypted on unlock
+	if encrypted {
+		key, plaintext, err = o.decrypt(raw)
+		if errors.Is(err, vault.ErrCorrupted) {
+			return snapshot{}, fmt.Errorf("%w: %s", errCorrupted, err.Error())
+		}
+		if err != nil {
+			return snapshot{}, fmt.Errorf("failed to decrypt file: %w", err)
+		}
+	}
+
+	doc, migration, err := decode(plaintext)
+	if encrypted {
+		secmem.Zero(plaintext)
+	}
+	if err != nil {
+		return snapshot{}, err
+	}
+
+	snap := snapshot{
+		storage:   doc.Services,
+		key:       key,
+		sum:       sum[:],
+		raw:       raw,
+		migration: migration,
+		encrypted: encrypted,
+		legacy:    !encrypted && doc.Signature == nil && migration.From < signedVersion,
+	}
+
+	if !encrypted {
+		snap.key, snap.tamper, err = authenticate(doc, migration, o)
+		if err != nil {
+			return snapshot{}, err
+		}
+	}
+
+	return snap, nil
+}
+
+// authenticate checks the signature of an unencrypted file. Files older than signatures have none,
+// they are only opened when accepted explicitly, see AcceptLegacy.
+func authenticate(doc document, m Migration, o opener) (*vault.Key, *TamperError, error) {
+	if doc.Signature == nil {
+		if m.From < signedVersion {
+			return nil, nil, nil
+		}
+
+		return nil, unsigned(doc.Services), nil
+	}
+
+	key, err := o.unlockSlot(doc.Signature.Key)
+	if errors.Is(err, vault.ErrCorrupted) {
+		return nil, unsigned(doc.Services), nil
+	}
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to unlock signature key: %w", err)
+	}
+
+	return key, verify(doc.Services, doc.Signature, key), nil
+}
+
+// Inspect reports how the storage file data would be migrated to the current format.
+func Inspect(data []byte, password []byte) (Migration, error) {
+	snap, err := readSnapshot(data, password)
+	if errors.Is(err, vault.ErrWrongPassword) {
+		return Migration{}, domain.ErrWrongPassword
+	}
+	if err != nil {
+		return Migration{}, err
+	}
+
+	if snap.tamper != nil {
+		return Migration{}, snap.tamper
+	}
+
+	return snap.migration, nil
+}
+
+// Verify checks the signatures of an unencrypted storage file, it returns nil when all records
+// match. Encrypted files are authenticated by the encryption and always pass, files from before
+// signatures fail with all their records.
+func Verify(data []byte, password []byte) (*TamperError, error) {
+	snap, err := readSnapshot(data, password)
+	if errors.Is(err, vault.ErrWrongPassword) {
+		return nil, domain.ErrWrongPassword
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if snap.legacy {
+		return unsigned(snap.storage), nil
+	}
+
+	return snap.tamper, nil
+}
+
+// Acknowledge accepts the current content of the storage file on the next Open, even when records
+// fail verification or the file is not signed at all, and signs it again. It is meant for
+// intentional edits made by hand.
+func (r *Repository) Acknowledge() {
+	r.acknowledged = true
+}
+
+// AcceptLegacy accepts a file from before signatures and encryption on the next Open, which then
+// protects it under the password. Anyone able to write the file could have put it there, so it is
+// only accepted on request, by the migrate command.
+func (r *Repository) AcceptLegacy() {
+	r.legacy = true
+}
+
+// Create lets the next Open start an empty vault under the password when the storage file does not
+// exist. Otherwise a missing file is refused, the password would not be checked against anything.
+func (r *Repository) Create() {
+	r.create = true
+}
+
+// accepts tells whether the content of a storage file may be opened.
+func (r *Repository) accepts(snap snapshot) error {
+	if snap.legacy && !r.legacy && !r.acknowledged {
+		return ErrDowngrade
+	}
+
+	if snap.tamper != nil && !r.acknowledged {
+		return snap.tamper
+	}
+
+	return nil
+}
+
+// Probe tells whether Open would accept the password, without writing anything: an encrypted file
+// only has its key slot opened, a plain one is verified.
+func (r *Repository) Probe(password []byte) error {
+	_, err := r.ProbeKey(password)
+
+	return err
+}
+
+// ProbeKey returns the key the password opens, checked like Probe does. It is nil for a plain file
+// and for a storage that does not exist yet.
+func (r *Repository) ProbeKey(password []byte) (*vault.Key, error) {
+	filename := r.filename
+	if r.recovery {
+		filename += disk.BackupSuffix
+	}
+
+	raw, err := os.ReadFile(filename)
+	switch {
+	case errors.Is(err, os.ErrNotExist) && r.recovery:
+		// an empty storage is served for any password
+		return nil, nil
+	case errors.Is(err, os.ErrNotExist) && !r.create:
+		return nil, ErrNoStorage
+	case errors.Is(err, os.ErrNotExist):
+		return nil, nil
+	case err != nil:
+		return nil, fmt.Errorf("failed to read file: %s", err.Error())
+	}
+
+	var key *vault.Key
+
+	if vault.IsEncrypted(raw) {
+		key, err = vault.UnlockHeader(raw, password)
+	} else {
+		var snap snapshot
+
+		snap, err = readSnapshot(raw, password)
+		if err == nil && !r.recovery {
+			err = r.accepts(snap)
+		}
+	}
+	if errors.Is(err, vault.ErrWrongPassword) {
+		return nil, domain.ErrWrongPassword
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return key, nil
+}
+
+func (r *Repository) Open(password []byte) error {
+	// what was accepted holds for this Open only
+	defer func() {
+		r.acknowledged, r.legacy, r.create = false, false, false
+	}()
+
+	if !r.recovery {
+		snap, err := readFile(r.filename, passwordOpener(password))
+
+		switch {
+		case errors.Is(err, vault.ErrWrongPassword):
+			return domain.ErrWrongPassword
+		case errors.Is(err, os.ErrNotExist):
+			err = r.checkBackupMissing()
+			if err == nil && !r.recovery && !r.create {
+				err = ErrNoStorage
+			}
+			if err != nil {
+				return err
+			}
+		case errors.Is(err, errCorrupted):
+			err = r.quarantine(err)
+			if err != nil {
+				return err
+			}
+		case err != nil:
+			return err
+		}
+
+		if !r.recovery {
+			err = r.accepts(snap)
+		}
+
+		if err != nil {
+			log.Printf("refusing to open storage: %s", err.Error())
+
+			return err
+		}
+
+		if !r.recovery {
+			if snap.tamper != nil {
+				log.Printf("signing storage again as acknowledged: %s", snap.tamper.Error())
+			}
+
+			return r.open(snap, password)
+		}
+	}
+
+	return r.openBackup(password)
+}
+
+func (r *Repository) open(snap snapshot, password []byte) error {
+	r.repo.SetStorage(snap.storage)
+	r.key = snap.key
+	r.sum = snap.sum
+	r.info = snap.info
+
+	// a vault to create or an accepted plain JSON file from an older version: encrypt it right away
+	if r.key == nil {
+		var err error
+
+		r.key, err = vault.NewKey(password, r.kdf)
+		if err != nil {
+			r.repo.Reset()
+
+			return fmt.Errorf("failed to create vault key: %s", err.Error())
+		}
+	} else if !r.recovery {
+		r.replay(snap.sum)
+	}
+
+	migrate := !r.recovery && snap.migration.Needed()
+	if migrate {
+		err := r.backupBeforeMigration(snap)
+		if err != nil {
+			r.key = nil
+			r.repo.Reset()
+			r.closeJournal()
+
+			return err
+		}
+	}
+
+	// without a usable journal, after a migration, to sign it again or to switch between encrypted
+	// and plain, the current state goes into a fresh snapshot
+	rewrite := migrate || snap.tamper != nil || snap.encrypted != r.encrypt
+	if !r.recovery && (r.journal == nil || rewrite) {
+		err := r.compact()
+		if err != nil {
+			r.key = nil
+			r.repo.Reset()
+			r.closeJournal()
+
+			return err
+		}
+	}
+
+	// a slot made with cheaper parameters than the configured ones is upgraded with the password it
+	// was just opened with, the cheaper slot stays in the previous generation. The storage stays
+	// usable when that fails.
+	if !r.recovery {
+		key, err := r.key.Upgrade(password, r.kdf)
+		if err == nil && key != nil {
+			err = r.compactWith(key, readBack(passwordOpener(password)))
+			if err == nil {
+				log.Print("key derivation parameters upgraded")
+			}
+		}
+		if err != nil {
+			log.Printf("failed to upgrade key derivation parameters: %s", err.Error())
+		}
+	}
+
+	return nil
+}
+
+// backupBeforeMigration keeps the file as it was before the upgrade, it is never rotated away.
+func (r *Repository) backupBeforeMigration(snap snapshot) error {
+	path := fmt.Sprintf("%s.pre-migration-v%d", r.filename, snap.migration.From)
+
+	err := disk.WriteFile(path, snap.raw, 0600)
+	if err != nil {
+		return fmt.Errorf("failed to back up storage before migration: %s", err.Error())
+	}
+
+	log.Printf("migrating storage from version %d to %d, the previous file is kept in %s", snap.migration.From, snap.migration.To, path)
+
+	return nil
+}
+
+// Close persists pending changes and drops the key and the decrypted records from memory.
+func (r *Repository) Close() error {
+	if r.key == nil {
+		return nil
+	}
+
+	// the state that could not be reloaded was saved aside already, the file on disk wins
+	if r.stale {
+		r.stale = false
+		r.closeJournal()
+		r.key = nil
+		r.repo.Reset()
+
+		return nil
+	}
+
+	err := r.Flush()
+	if err != nil {
+		return err
+	}
+
+	// a journal is sealed and would be lost by a hand edit of the plain file, so fold it in
+	if !r.encrypt && !r.recovery {
+		r.fileMutex.Lock()
+		err = r.compact()
+		r.fileMutex.Unlock()
+
+		if err != nil {
+			return err
+		}
+	}
+
+	r.closeJournal()
+	r.key = nil
+	r.repo.Reset()
+
+	return nil
+}
+
+func (r *Repository) GetAll() (domain.Storage, error) {
+	return r.repo.GetAll(), nil
+}
+
+func (r *Repository) GetByType(recordType string) (domain.Storage, error) {
+	return r.repo.GetByType(recordType), nil
+}
+
+func (r *Repository) GetFavorites() (domain.Storage, error) {
+	return r.repo.GetFavorites(), nil
+}
@@ -0,0 +1,174 @@
+package jsonfile
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"manager/internal/backend/backendtest"
+	"manager/internal/domain"
+	repo "manager/internal/repository"
+	"manager/internal/vault"
+)
+
+// testKDF keeps unlocks fast, the configured parameters make every one of them take seconds
+var testKDF = vault.KDFParams{Time: 1, Memory: 64, Threads: 1}
+
+func TestConformance(t *testing.T) {
+	for _, encrypt := range []bool{true, false} {
+		t.Run(map[bool]string{true: "encrypted", false: "plain"}[encrypt], func(t *testing.T) {
+			backendtest.Run(t, func(path string) backendtest.Repository {
+				r := newTestRepository(path, encrypt)
+				r.Create()
+
+				return r
+			})
+		})
+	}
+}
+
+// A missing file is only created on request, any password would open it otherwise.
+func TestOpenMissingFile(t *testing.T) {
+	filename := testFile(t)
+
+	err := newTestRepository(filename, true).Open([]byte("secret"))
+	if !errors.Is(err, ErrNoStorage) {
+		t.Fatalf("got %v, want ErrNoStorage", err)
+	}
+
+	_, err = os.Stat(filename)
+	if !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("a storage file was created: %v", err)
+	}
+
+	r := newTestRepository(filename, true)
+	r.Create()
+
+	err = r.Open([]byte("secret"))
+	if err == nil {
+		err = r.Close()
+	}
+	if err != nil {
+		t.Fatalf("Create: %s", err)
+	}
+
+	// it holds for one Open only
+	err = os.Remove(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = r.Open([]byte("secret"))
+	if !errors.Is(err, ErrNoStorage) {
+		t.Fatalf("got %v after reopening, want ErrNoStorage", err)
+	}
+}
+
+// A vault of another password put in place of the storage does not open with the master password.
+func TestOpenSubstitutedFile(t *testing.T) {
+	forEachMode(t, func(t *testing.T, encrypt bool) {
+		filename := testFile(t)
+
+		r := openTestRepository(t, filename, "secret", encrypt)
+		addLogin(t, r, "mail", "alice", "hunter2")
+		closeRepository(t, r)
+
+		substitute := testFile(t)
+
+		s := openTestRepository(t, substitute, "guess", encrypt)
+		addLogin(t, s, "mail", "alice", "planted")
+		closeRepository(t, s)
+
+		data := readTestFile(t, substitute)
+
+		err := os.WriteFile(filename, data, 0600)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		r = newTestRepository(filename, encrypt)
+		r.Create()
+
+		err = r.Open([]byte("secret"))
+		if !errors.Is(err, domain.ErrWrongPassword) {
+			t.Fatalf("got %v, want ErrWrongPassword", err)
+		}
+
+		if string(readTestFile(t, filename)) != string(data) {
+			t.Fatal("the substituted file was changed")
+		}
+	})
+}
+
+func newTestRepository(filename string, encrypt bool) *Repository {
+	return New(repo.New(), filename, 1<<20, encrypt, testKDF)
+}
+
+// openTestRepository opens the storage file in a new repository and closes it when the test ends.
+func openTestRepository(t *testing.T, filename, password string, encrypt bool) *Repository {
+	t.Helper()
+
+	r := newTestRepository(filename, encrypt)
+	r.Create()
+
+	err := r.Open([]byte(password))
+	if err != nil {
+		t.Fatalf("Open: %s", err)
+	}
+
+	t.Cleanup(func() {
+		r.Close()
+	})
+
+	return r
+}
+
+func testFile(t *testing.T) string {
+	return filepath.Join(t.TempDir(), "storage.txt")
+}
+
+func apply(t *testing.T, r *Repository, op domain.Operation) {
+	t.Helper()
+
+	ok, err := r.Apply(op)
+	if err != nil || !ok {
+		t.Fatalf("Apply %s %s/%s: %v, %v", op.Op, op.Service, op.Login, ok, err)
+	}
+}
+
+func addLogin(t *testing.T, r *Repository, service, login, password string) {
+	t.Helper()
+
+	storage, err := r.GetAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, ok := storage[service]; !ok {
+		apply(t, r, domain.Operation{Op: domain.OpAppendService, Service: service, Type: "password"})
+	}
+
+	apply(t, r, domain.Operation{
+		Op:      domain.OpAppendLogin,
+		Service: service,
+		Login:   login,
+		Element: &domain.Element{Password: domain.NewSecret([]byte(password))},
+	})
+}
+
+// password returns the password of a login, or "" when it is missing.
+func password(storage domain.Storage, service, login string) string {
+	return string(storage[service].Elements[login].Password.Bytes())
+}
+
+func readTestFile(t *testing.T, name string) []byte {
+	t.Helper()
+
+	data, err := os.ReadFile(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return data
+}
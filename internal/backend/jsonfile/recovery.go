@@ -0,0 +1,214 @@
+package jsonfile
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"regexp"
+
+	"manager/internal/disk"
+	"manager/internal/domain"
+	"manager/internal/vault"
+)
+
+var errCorrupted = errors.New("storage file is corrupted")
+
+var (
+	serviceRecord = regexp.MustCompile(`"((?:[^"\\]|\\.)*)":\{"type":`)
+	serviceMeta   = regexp.MustCompile(`^\{"type":("(?:[^"\\]|\\.)*"),"favorite":(true|false)`)
+	loginRecord   = regexp.MustCompile(`"((?:[^"\\]|\\.)*)":\{"password":`)
+)
+
+// Check validates whatever can be checked without the password at startup. A damaged file is
+// quarantined and the repository stays in read-only recovery mode instead of overwriting it.
+func (r *Repository) Check() error {
+	data, err := os.ReadFile(r.filename)
+	if errors.Is(err, os.ErrNotExist) {
+		return r.checkBackupMissing()
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read file: %s", err.Error())
+	}
+
+	if vault.IsEncrypted(data) {
+		err = vault.CheckHeader(data)
+	} else if !json.Valid(data) {
+		err = fmt.Errorf("%w: invalid JSON", errCorrupted)
+	}
+
+	if err != nil {
+		return r.quarantine(err)
+	}
+
+	return nil
+}
+
+func (r *Repository) ReadOnly() bool {
+	return r.recovery || r.stale
+}
+
+func (r *Repository) quarantine(reason error) error {
+	quarantined, err := disk.Quarantine(r.filename)
+	if err != nil {
+		return err
+	}
+
+	r.recovery = true
+	log.Printf("storage file is unreadable (%s), moved to %s, starting in read-only recovery mode", reason.Error(), quarantined)
+
+	return nil
+}
+
+// checkBackupMissing refuses to start a new vault when only the previous generation is left.
+func (r *Repository) checkBackupMissing() error {
+	_, err := os.Stat(r.filename + disk.BackupSuffix)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to check backup file: %s", err.Error())
+	}
+
+	r.recovery = true
+	log.Printf("storage file is missing but %s exists, starting in read-only recovery mode", r.filename+disk.BackupSuffix)
+
+	return nil
+}
+
+// openBackup serves the previous generation read-only, or an empty storage if it is unusable too.
+func (r *Repository) openBackup(password []byte) error {
+	snap, err := readFile(r.filename+disk.BackupSuffix, passwordOpener(password))
+	if errors.Is(err, vault.ErrWrongPassword) {
+		return domain.ErrWrongPassword
+	}
+
+	if err == nil && snap.legacy {
+		err = ErrDowngrade
+	}
+
+	if err != nil {
+		log.Printf("failed to read backup file: %s", err.Error())
+
+		snap = snapshot{storage: domain.Storage{}}
+	}
+
+	if snap.tamper != nil {
+		log.Printf("backup file: %s", snap.tamper.Error())
+	}
+
+	if snap.key == nil {
+		snap.key, err = vault.NewKey(password, r.kdf)
+		if err != nil {
+			return fmt.Errorf("failed to create vault key: %s", err.Error())
+		}
+	}
+
+	return r.open(snap, password)
+}
+
+// Salvage extracts every record that can still be decoded from a damaged storage file. It returns
+// the key of the vault when the file was encrypted, so the result can be written back under it.
+func Salvage(data []byte, password []byte) (domain.Storage, *vault.Key, error) {
+	segments := [][]byte{data}
+
+	var key *vault.Key
+
+	if vault.IsEncrypted(data) {
+		var err error
+
+		key, segments, err = vault.DecryptPartial(data, password)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to decrypt file: %w", err)
+		}
+	}
+
+	storage := make(domain.Storage)
+
+	for _, segment := range segments {
+		salvageSegment(segment, storage)
+	}
+
+	return storage, key, nil
+}
+
+func salvageSegment(segment []byte, storage domain.Storage) {
+	matches := serviceRecord.FindAllSubmatchIndex(segment, -1)
+
+	for i, match := range matches {
+		end := len(segment)
+		if i+1 < len(matches) {
+			end = matches[i+1][0]
+		}
+
+		name, ok := unquote(segment[match[2]:match[3]])
+		if !ok {
+			continue
+		}
+
+		if _, exists := storage[name]; exists {
+			continue
+		}
+
+		// the record starts at the opening brace of the service object inside the match
+		record := segment[match[1]-len(`{"type":`) : end]
+
+		var service domain.Service
+
+		err := json.NewDecoder(bytes.NewReader(record)).Decode(&service)
+		if err == nil {
+			storage[name] = service
+
+			continue
+		}
+
+		service, ok = salvageService(record)
+		if ok {
+			storage[name] = service
+		}
+	}
+}
+
+// salvageService recovers the type of a truncated service record and whatever logins are intact.
+func salvageService(record []byte) (domain.Service, bool) {
+	meta := serviceMeta.FindSubmatch(record)
+	if meta == nil {
+		return domain.Service{}, false
+	}
+
+	service := domain.Service{
+		Favorite: string(meta[2]) == "true",
+		Elements: make(map[string]domain.Element),
+	}
+
+	err := json.Unmarshal(meta[1], &service.Type)
+	if err != nil {
+		return domain.Service{}, false
+	}
+
+	for _, match := range loginRecord.FindAllSubmatchIndex(record, -1) {
+		login, ok := unquote(record[match[2]:match[3]])
+		if !ok {
+			continue
+		}
+
+		var elem domain.Element
+
+		err = json.NewDecoder(bytes.NewReader(record[match[1]-len(`{"password":`):])).Decode(&elem)
+		if err == nil {
+			service.Elements[login] = elem
+		}
+	}
+
+	return service, true
+}
+
+func unquote(raw []byte) (string, bool) {
+	var s string
+
+	err := json.Unmarshal(append(append([]byte{'"'}, raw...), '"'), &s)
+
+	return s, err == nil
+}
@@ -0,0 +1,156 @@
+package jsonfile
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"manager/internal/domain"
+)
+
+// writeGenerations leaves a storage file with alice and a previous generation with her only.
+func writeGenerations(t *testing.T, filename string) {
+	t.Helper()
+
+	r := newTestRepository(filename, true)
+	r.Create()
+
+	err := r.Open([]byte("secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	addLogin(t, r, "mail", "alice", "one")
+
+	r.fileMutex.Lock()
+	err = r.compact()
+	r.fileMutex.Unlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	addLogin(t, r, "mail", "bob", "two")
+
+	r.fileMutex.Lock()
+	err = r.compact()
+	r.fileMutex.Unlock()
+	if err == nil {
+		err = r.Close()
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDamagedFileIsQuarantined(t *testing.T) {
+	filename := testFile(t)
+	writeGenerations(t, filename)
+
+	err := os.WriteFile(filename, []byte("MGRV garbage"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := newTestRepository(filename, true)
+
+	err = r.Check()
+	if err != nil {
+		t.Fatalf("Check: %s", err)
+	}
+
+	if !r.ReadOnly() {
+		t.Fatal("not in recovery mode")
+	}
+
+	files, err := filepath.Glob(filename + ".corrupt-*")
+	if err != nil || len(files) != 1 || string(readTestFile(t, files[0])) != "MGRV garbage" {
+		t.Fatalf("damaged file was not kept: %v", files)
+	}
+
+	err = r.Open([]byte("secret"))
+	if err != nil {
+		t.Fatalf("Open: %s", err)
+	}
+	defer r.Close()
+
+	storage, _ := r.GetAll()
+	if password(storage, "mail", "alice") != "one" || password(storage, "mail", "bob") != "" {
+		t.Fatalf("the previous generation is not served: %v", storage)
+	}
+
+	_, err = r.Apply(domain.Operation{Op: domain.OpDeleteService, Service: "mail"})
+	if !errors.Is(err, domain.ErrReadOnly) {
+		t.Fatalf("Apply in recovery mode: got %v", err)
+	}
+
+	err = r.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// nothing was written in place of the damaged file
+	_, err = os.Stat(filename)
+	if !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("a storage file was written in recovery mode: %v", err)
+	}
+}
+
+func TestMissingFileWithBackup(t *testing.T) {
+	filename := testFile(t)
+	writeGenerations(t, filename)
+
+	err := os.Remove(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := newTestRepository(filename, true)
+
+	err = r.Open([]byte("secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	if !r.ReadOnly() {
+		t.Fatal("a new vault was started next to the previous generation")
+	}
+
+	storage, _ := r.GetAll()
+	if password(storage, "mail", "alice") != "one" {
+		t.Fatalf("the previous generation is not served: %v", storage)
+	}
+}
+
+func TestSalvage(t *testing.T) {
+	filename := testFile(t)
+
+	r := openTestRepository(t, filename, "secret", false)
+	addLogin(t, r, "mail", "alice", "one")
+	addLogin(t, r, "zoo", "bob", "two")
+
+	err := r.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data := readTestFile(t, filename)
+
+	// cut off in the middle of the password of the second service
+	cut := bytes.Index(data, []byte(`"two"`)) + 2
+
+	storage, key, err := Salvage(data[:cut], []byte("secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if key != nil || password(storage, "mail", "alice") != "one" {
+		t.Fatalf("got %v", storage)
+	}
+
+	if zoo, ok := storage["zoo"]; !ok || zoo.Type != "password" || len(zoo.Elements) != 0 {
+		t.Fatalf("the truncated service is not salvaged without its logins: %v", storage["zoo"])
+	}
+}
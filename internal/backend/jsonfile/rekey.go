@@ -0,0 +1,133 @@
+package jsonfile
+
+import (
+	"errors"
+	"fmt"
+
+	"manager/internal/domain"
+	"manager/internal/vault"
+)
+
+var errReadBack = errors.New("storage file does not read back as written")
+
+// Rekey protects the storage with a new master password, a new data key and the current key
+// derivation parameters. The new file is read back with the new password before it replaces the
+// old one. The previous generation is kept and opens with the old password, but its data key no
+// longer opens the storage.
+func (r *Repository) Rekey(current, password []byte) error {
+	if r.key == nil {
+		return fmt.Errorf("storage is closed")
+	}
+
+	if r.recovery || r.stale {
+		return domain.ErrReadOnly
+	}
+
+	err := r.key.Verify(current)
+	if errors.Is(err, vault.ErrWrongPassword) {
+		return domain.ErrWrongPassword
+	}
+	if err != nil {
+		return err
+	}
+
+	r.fileMutex.Lock()
+	defer r.fileMutex.Unlock()
+
+	return r.rekey(password)
+}
+
+func (r *Repository) rekey(password []byte) error {
+	key, err := r.key.Rotate(password, r.kdf)
+	if err != nil {
+		return fmt.Errorf("failed to create vault key: %s", err.Error())
+	}
+
+	return r.compactWith(key, readBack(passwordOpener(password)))
+}
+
+// Key returns the key the storage is open with.
+func (r *Repository) Key() *vault.Key {
+	return r.key
+}
+
+// SetKey writes the storage under a key with the same data key and other slots, like new recovery
+// codes.
+func (r *Repository) SetKey(key *vault.Key) error {
+	if r.key == nil {
+		return fmt.Errorf("storage is closed")
+	}
+
+	if r.recovery || r.stale {
+		return domain.ErrReadOnly
+	}
+
+	r.fileMutex.Lock()
+	defer r.fileMutex.Unlock()
+
+	return r.compactWith(key, readBack(keyOpener{key}))
+}
+
+// Recover opens the storage with a recovery code instead of the master password and protects it
+// with a new password and a new data key right away. A recovery code is used up by that, the
+// recovery key is not, and copies of the storage made before, which still hold the slot of the
+// code, do not lead to the records written from then on.
+func (r *Repository) Recover(code, password []byte) error {
+	if r.recovery {
+		return domain.ErrReadOnly
+	}
+
+	snap, err := readFile(r.filename, recoveryOpener(code))
+
+	switch {
+	case errors.Is(err, vault.ErrInvalidCode):
+		return domain.ErrInvalidCode
+	case err != nil:
+		return err
+	case snap.tamper != nil:
+		return snap.tamper
+	}
+
+	err = r.open(snap, password)
+	if err != nil {
+		return err
+	}
+
+	err = r.rekey(password)
+	if err != nil {
+		r.closeJournal()
+		r.key = nil
+		r.repo.Reset()
+
+		return err
+	}
+
+	return nil
+}
+
+// readBack checks a new storage file before it replaces the current one: it has to open with o and
+// hold the storage it was written from.
+func readBack(o opener) func(data []byte, storage domain.Storage) error {
+	return func(data []byte, storage domain.Storage) error {
+		snap, err := loadSnapshot(data, o)
+		if err != nil {
+			return err
+		}
+
+		if snap.tamper != nil {
+			return snap.tamper
+		}
+
+		if len(snap.storage) != len(storage) {
+			return errReadBack
+		}
+
+		for name := range storage {
+			if !sameService(serviceIn(snap.storage, name), serviceIn(storage, name)) {
+				return errReadBack
+			}
+		}
+
+		return nil
+	}
+}
@@ -0,0 +1,207 @@
+package jsonfile
+
+import (
+	"errors"
+	"testing"
+
+	"manager/internal/disk"
+	"manager/internal/domain"
+	repo "manager/internal/repository"
+	"manager/internal/vault"
+)
+
+func TestRekey(t *testing.T) {
+	filename := testFile(t)
+
+	r := openTestRepository(t, filename, "old", true)
+	addLogin(t, r, "mail", "bob", "first")
+
+	snapshot, err := r.Snapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = r.Rekey([]byte("wrong"), []byte("new"))
+	if !errors.Is(err, domain.ErrWrongPassword) {
+		t.Fatalf("Rekey with a wrong password: got %v", err)
+	}
+
+	err = r.Rekey([]byte("old"), []byte("new"))
+	if err != nil {
+		t.Fatalf("Rekey: %s", err)
+	}
+
+	addLogin(t, r, "mail", "alice", "second")
+
+	// versions written before, like those in the history, still open
+	storage, err := r.Decode(snapshot)
+	if err != nil || password(storage, "mail", "bob") != "first" {
+		t.Fatalf("Decode of an older version: %v", err)
+	}
+
+	err = r.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	current := readTestFile(t, filename)
+
+	_, _, err = vault.Decrypt(current, []byte("old"))
+	if !errors.Is(err, vault.ErrWrongPassword) {
+		t.Fatalf("old password on the storage: got %v", err)
+	}
+
+	// the previous generation opens with the old password, but its key does not open the storage
+	key, _, err := vault.Decrypt(readTestFile(t, filename+disk.BackupSuffix), []byte("old"))
+	if err != nil {
+		t.Fatalf("old password on the previous generation: %s", err)
+	}
+
+	_, err = key.Decrypt(current)
+	if !errors.Is(err, vault.ErrCorrupted) {
+		t.Fatalf("old data key on the storage: got %v", err)
+	}
+
+	r = openTestRepository(t, filename, "new", true)
+
+	storage, _ = r.GetAll()
+	if password(storage, "mail", "bob") != "first" || password(storage, "mail", "alice") != "second" {
+		t.Fatalf("records after rekey: %v", storage)
+	}
+}
+
+// A slot made with cheaper parameters is upgraded on Open, the storage moves to a new data key.
+func TestKDFUpgrade(t *testing.T) {
+	filename := testFile(t)
+
+	r := openTestRepository(t, filename, "secret", true)
+	addLogin(t, r, "mail", "bob", "first")
+
+	err := r.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cheap, _, err := vault.Decrypt(readTestFile(t, filename), []byte("secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stronger := vault.KDFParams{Time: testKDF.Time + 1, Memory: testKDF.Memory, Threads: testKDF.Threads}
+
+	r = New(repo.New(), filename, 1<<20, true, stronger)
+
+	err = r.Open([]byte("secret"))
+	if err != nil {
+		t.Fatalf("Open: %s", err)
+	}
+	defer r.Close()
+
+	if got := r.Key().KDF(); got != stronger {
+		t.Fatalf("got %+v, want %+v", got, stronger)
+	}
+
+	_, err = cheap.Decrypt(readTestFile(t, filename))
+	if !errors.Is(err, vault.ErrCorrupted) {
+		t.Fatalf("the cheaper slot on the storage: got %v", err)
+	}
+
+	storage, err := r.GetAll()
+	if err != nil || password(storage, "mail", "bob") != "first" {
+		t.Fatalf("got %v, %v", storage, err)
+	}
+}
+
+// ProbeKey reads the recovery slots while the storage is open elsewhere.
+func TestProbeKey(t *testing.T) {
+	filename := testFile(t)
+
+	r := openTestRepository(t, filename, "old", true)
+
+	next, _, _, err := r.Key().WithRecovery(3, false)
+	if err == nil {
+		err = r.SetKey(next)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	key, err := newTestRepository(filename, true).ProbeKey([]byte("old"))
+	if err != nil {
+		t.Fatalf("ProbeKey: %s", err)
+	}
+
+	if codes, withKey := key.Recovery(); codes != 3 || withKey {
+		t.Fatalf("got %d codes and a key %v", codes, withKey)
+	}
+
+	_, err = newTestRepository(filename, true).ProbeKey([]byte("guess"))
+	if !errors.Is(err, domain.ErrWrongPassword) {
+		t.Fatalf("wrong password: got %v", err)
+	}
+}
+
+func TestRecoverUsesUpCode(t *testing.T) {
+	filename := testFile(t)
+
+	r := openTestRepository(t, filename, "old", true)
+	addLogin(t, r, "mail", "bob", "first")
+
+	next, codes, recoveryKey, err := r.Key().WithRecovery(2, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = r.SetKey(next)
+	if err == nil {
+		err = r.Close()
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r = newTestRepository(filename, true)
+
+	err = r.Recover([]byte(codes[0]), []byte("new"))
+	if err != nil {
+		t.Fatalf("Recover: %s", err)
+	}
+
+	addLogin(t, r, "mail", "alice", "second")
+
+	err = r.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	current := readTestFile(t, filename)
+
+	_, _, err = vault.DecryptRecovery(current, []byte(codes[0]))
+	if !errors.Is(err, vault.ErrInvalidCode) {
+		t.Fatalf("used code on the storage: got %v", err)
+	}
+
+	// the used code still opens the previous generation, which must not lead to the storage
+	key, _, err := vault.DecryptRecovery(readTestFile(t, filename+disk.BackupSuffix), []byte(codes[0]))
+	if err != nil {
+		t.Fatalf("used code on the previous generation: %s", err)
+	}
+
+	_, err = key.Decrypt(current)
+	if !errors.Is(err, vault.ErrCorrupted) {
+		t.Fatalf("data key of the used code on the storage: got %v", err)
+	}
+
+	err = newTestRepository(filename, true).Recover([]byte(codes[0]), []byte("other"))
+	if !errors.Is(err, domain.ErrInvalidCode) {
+		t.Fatalf("Recover with a used code: got %v", err)
+	}
+
+	// the codes left and the recovery key follow the new data key
+	for _, code := range []string{codes[1], recoveryKey} {
+		_, plaintext, err := vault.DecryptRecovery(current, []byte(code))
+		if err != nil || len(plaintext) == 0 {
+			t.Fatalf("unused code on the storage: %v", err)
+		}
+	}
+}
@@ -0,0 +1,236 @@
+package jsonfile
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"manager/internal/disk"
+	"manager/internal/domain"
+	"manager/internal/secmem"
+)
+
+// Changed reports whether the storage file on disk is no longer the one this process read or
+// wrote last, for example because a sync tool replaced it.
+func (r *Repository) Changed() bool {
+	r.fileMutex.Lock()
+	defer r.fileMutex.Unlock()
+
+	if r.key == nil || r.recovery || r.stale || r.info == nil {
+		return false
+	}
+
+	info, err := os.Stat(r.filename)
+	if err != nil {
+		// a missing file is written again on the next compaction
+		return false
+	}
+
+	return !os.SameFile(info, r.info) || info.Size() != r.info.Size() || !info.ModTime().Equal(r.info.ModTime())
+}
+
+// Reload replaces the storage with the file on disk and applies the changes that are not part of
+// the previous file yet on top of it. A service changed on both sides keeps the version of the new
+// file, and the state before the reload is kept in a conflict file. A file that cannot be loaded
+// with the open key, or that is neither encrypted nor signed, leaves the previous state read-only
+// until the next Open. Reload must not run concurrently with the other methods.
+func (r *Repository) Reload() error {
+	if r.key == nil || r.recovery || r.stale {
+		return nil
+	}
+
+	info, err := os.Stat(r.filename)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read file: %s", err.Error())
+	}
+
+	raw, err := os.ReadFile(r.filename)
+	if err != nil {
+		return fmt.Errorf("failed to read file: %s", err.Error())
+	}
+
+	sum := sha256.Sum256(raw)
+	if bytes.Equal(sum[:], r.sum) {
+		r.info = info
+
+		return nil
+	}
+
+	local := append(append([]domain.Operation(nil), r.unsaved...), r.pending...)
+	before := r.repo.GetAll()
+
+	// a file from before signatures and encryption carries no key at all, it is not vouched for by
+	// the open one
+	snap, err := loadSnapshot(raw, keyOpener{r.key})
+	switch {
+	case err != nil:
+	case snap.legacy:
+		err = ErrDowngrade
+	case snap.tamper != nil:
+		err = snap.tamper
+	}
+
+	if err != nil {
+		r.stale = true
+		log.Printf("storage file was replaced on disk but cannot be loaded (%s), serving the previous state read-only until the next unlock", err.Error())
+
+		if len(local) > 0 {
+			return r.saveConflict(before, servicesOf(local))
+		}
+
+		return nil
+	}
+
+	if snap.migration.Needed() {
+		err = r.backupBeforeMigration(snap)
+		if err != nil {
+			return err
+		}
+	}
+
+	base := r.base
+
+	r.closeJournal()
+	r.repo.SetStorage(snap.storage)
+	r.sum = snap.sum
+	r.info = info
+	r.replay(snap.sum)
+
+	var conflicts []string
+
+	skip := make(map[string]bool)
+
+	for _, name := range servicesOf(local) {
+		remote := r.service(name)
+
+		switch {
+		case sameService(remote, base[name]):
+			// only changed here
+		case sameService(remote, serviceIn(before, name)):
+			// the new file has the same change already
+			skip[name] = true
+		default:
+			skip[name] = true
+			conflicts = append(conflicts, name)
+		}
+	}
+
+	applied := 0
+
+	for _, op := range local {
+		if skip[op.Service] {
+			continue
+		}
+
+		r.remember(op.Service)
+
+		if r.repo.Apply(op) {
+			r.pending = append(r.pending, op)
+			applied++
+		}
+	}
+
+	log.Printf("storage file was replaced on disk, reloaded it and applied %d local changes again", applied)
+
+	if len(conflicts) > 0 {
+		err = r.saveConflict(before, conflicts)
+		if err != nil {
+			return err
+		}
+	}
+
+	r.fileMutex.Lock()
+	defer r.fileMutex.Unlock()
+
+	if snap.migration.Needed() || snap.encrypted != r.encrypt {
+		return r.compact()
+	}
+
+	// writing the file back would make the sync tool carry it around again, the journal is enough
+	if r.journal == nil {
+		r.journal, err = disk.CreateJournal(r.filename+journalSuffix, snap.sum)
+		if err != nil {
+			return fmt.Errorf("failed to create journal: %s", err.Error())
+		}
+	}
+
+	return nil
+}
+
+// saveConflict writes the state before a reload next to the storage file, so local changes that
+// the new file overrides can be recovered from it.
+func (r *Repository) saveConflict(storage domain.Storage, services []string) error {
+	data, err := r.encode(storage, r.key)
+	if err == nil && r.encrypt {
+		plain := data
+		data, err = r.key.Encrypt(plain)
+		secmem.Zero(plain)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to encode conflicting state: %s", err.Error())
+	}
+
+	path := r.filename + ".conflict-" + time.Now().UTC().Format("20060102T150405Z")
+
+	err = disk.WriteFile(path, data, 0600)
+	if err != nil {
+		return fmt.Errorf("failed to write conflicting state: %s", err.Error())
+	}
+
+	log.Printf("local changes to %s conflict with the file on disk, the state before the reload is kept in %s", strings.Join(services, ", "), path)
+
+	return nil
+}
+
+func (r *Repository) service(name string) *domain.Service {
+	service, ok := r.repo.Get(name)
+	if !ok {
+		return nil
+	}
+
+	return &service
+}
+
+func serviceIn(storage domain.Storage, name string) *domain.Service {
+	service, ok := storage[name]
+	if !ok {
+		return nil
+	}
+
+	return &service
+}
+
+// sameService compares services, a missing service is nil and no logins equals empty logins.
+func sameService(a, b *domain.Service) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+
+	return a.Equal(*b)
+}
+
+func servicesOf(ops []domain.Operation) []string {
+	seen := make(map[string]bool)
+
+	var names []string
+
+	for _, op := range ops {
+		if !seen[op.Service] {
+			seen[op.Service] = true
+			names = append(names, op.Service)
+		}
+	}
+
+	sort.Strings(names)
+
+	return names
+}
@@ -0,0 +1,349 @@
+package jsonfile
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"manager/internal/domain"
+	repo "manager/internal/repository"
+)
+
+// A repository that compacts on every flush leaves everything in the storage file, like a copy of
+// the vault edited on another machine.
+func openCompacting(t *testing.T, filename string, encrypt bool) *Repository {
+	t.Helper()
+
+	r := New(repo.New(), filename, 1, encrypt, testKDF)
+	r.Create()
+
+	err := r.Open([]byte("secret"))
+	if err != nil {
+		t.Fatalf("Open: %s", err)
+	}
+
+	return r
+}
+
+func closeRepository(t *testing.T, r *Repository) {
+	t.Helper()
+
+	err := r.Close()
+	if err != nil {
+		t.Fatalf("Close: %s", err)
+	}
+}
+
+// syncFile replaces dst with src the way sync tools do, by renaming a new file over it.
+func syncFile(t *testing.T, src, dst string) {
+	t.Helper()
+
+	err := os.WriteFile(dst+".sync", readTestFile(t, src), 0600)
+	if err == nil {
+		err = os.Rename(dst+".sync", dst)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func flush(t *testing.T, r *Repository) {
+	t.Helper()
+
+	err := r.Flush()
+	if err != nil {
+		t.Fatalf("Flush: %s", err)
+	}
+}
+
+func setPassword(t *testing.T, r *Repository, service, login, password string) {
+	t.Helper()
+
+	apply(t, r, domain.Operation{
+		Op:      domain.OpUpdateLogin,
+		Service: service,
+		Login:   login,
+		Element: &domain.Element{Password: domain.NewSecret([]byte(password))},
+	})
+}
+
+// newReplica writes a storage file with two services and a copy of it in another directory.
+func newReplica(t *testing.T, encrypt bool) (string, string) {
+	t.Helper()
+
+	filename := testFile(t)
+
+	w := openCompacting(t, filename, encrypt)
+	addLogin(t, w, "mail", "alice", "one")
+	addLogin(t, w, "bank", "bob", "1")
+	closeRepository(t, w)
+
+	replica := testFile(t)
+	syncFile(t, filename, replica)
+
+	return filename, replica
+}
+
+func conflictFiles(t *testing.T, filename string) []string {
+	t.Helper()
+
+	matches, err := filepath.Glob(filename + ".conflict-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return matches
+}
+
+func reload(t *testing.T, r *Repository) {
+	t.Helper()
+
+	if !r.Changed() {
+		t.Fatal("the replaced file is not noticed")
+	}
+
+	err := r.Reload()
+	if err != nil {
+		t.Fatalf("Reload: %s", err)
+	}
+
+	if r.Changed() {
+		t.Fatal("the file is still reported as changed after reloading it")
+	}
+}
+
+func forEachMode(t *testing.T, test func(t *testing.T, encrypt bool)) {
+	for _, encrypt := range []bool{true, false} {
+		t.Run(map[bool]string{true: "encrypted", false: "plain"}[encrypt], func(t *testing.T) {
+			test(t, encrypt)
+		})
+	}
+}
+
+func TestReloadMergesLocalChanges(t *testing.T) {
+	forEachMode(t, func(t *testing.T, encrypt bool) {
+		filename, replica := newReplica(t, encrypt)
+
+		r := openTestRepository(t, filename, "secret", encrypt)
+
+		if r.Changed() {
+			t.Fatal("the file is reported as changed right after opening it")
+		}
+
+		// one change in the journal and one still pending
+		addLogin(t, r, "mail", "carol", "two")
+		flush(t, r)
+		addLogin(t, r, "local", "dave", "three")
+
+		other := openCompacting(t, replica, encrypt)
+		setPassword(t, other, "bank", "bob", "2")
+		addLogin(t, other, "remote", "erin", "four")
+		closeRepository(t, other)
+
+		syncFile(t, replica, filename)
+		reload(t, r)
+
+		check := func(storage domain.Storage) {
+			t.Helper()
+
+			want := map[[2]string]string{
+				{"mail", "alice"}:  "one",
+				{"mail", "carol"}:  "two",
+				{"local", "dave"}:  "three",
+				{"bank", "bob"}:    "2",
+				{"remote", "erin"}: "four",
+			}
+
+			for key, value := range want {
+				if got := password(storage, key[0], key[1]); got != value {
+					t.Fatalf("%s/%s: got %q, want %q", key[0], key[1], got, value)
+				}
+			}
+		}
+
+		storage, err := r.GetAll()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		check(storage)
+
+		if files := conflictFiles(t, filename); len(files) != 0 {
+			t.Fatalf("got conflict files %v without a conflict", files)
+		}
+
+		closeRepository(t, r)
+
+		storage, err = openTestRepository(t, filename, "secret", encrypt).GetAll()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		check(storage)
+	})
+}
+
+func TestReloadConflict(t *testing.T) {
+	forEachMode(t, func(t *testing.T, encrypt bool) {
+		filename, replica := newReplica(t, encrypt)
+
+		r := openTestRepository(t, filename, "secret", encrypt)
+		setPassword(t, r, "bank", "bob", "local")
+		setPassword(t, r, "mail", "alice", "local")
+
+		other := openCompacting(t, replica, encrypt)
+		setPassword(t, other, "bank", "bob", "remote")
+		closeRepository(t, other)
+
+		syncFile(t, replica, filename)
+		reload(t, r)
+
+		storage, err := r.GetAll()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// the new file wins, changes to other services stay
+		if password(storage, "bank", "bob") != "remote" || password(storage, "mail", "alice") != "local" {
+			t.Fatalf("got bank %q, mail %q", password(storage, "bank", "bob"), password(storage, "mail", "alice"))
+		}
+
+		files := conflictFiles(t, filename)
+		if len(files) != 1 {
+			t.Fatalf("got conflict files %v", files)
+		}
+
+		snap, err := readFile(files[0], passwordOpener("secret"))
+		if err != nil {
+			t.Fatalf("conflict file: %s", err)
+		}
+
+		if password(snap.storage, "bank", "bob") != "local" {
+			t.Fatalf("the conflict file holds %q", password(snap.storage, "bank", "bob"))
+		}
+	})
+}
+
+func TestReloadSameChange(t *testing.T) {
+	filename, replica := newReplica(t, true)
+
+	r := openTestRepository(t, filename, "secret", true)
+	setPassword(t, r, "bank", "bob", "2")
+
+	other := openCompacting(t, replica, true)
+	setPassword(t, other, "bank", "bob", "2")
+	closeRepository(t, other)
+
+	syncFile(t, replica, filename)
+	reload(t, r)
+
+	storage, err := r.GetAll()
+	if err != nil || password(storage, "bank", "bob") != "2" {
+		t.Fatalf("got %+v, %v", storage, err)
+	}
+
+	if files := conflictFiles(t, filename); len(files) != 0 {
+		t.Fatalf("got conflict files %v for the same change", files)
+	}
+}
+
+func TestReloadSameContent(t *testing.T) {
+	filename, _ := newReplica(t, true)
+
+	r := openTestRepository(t, filename, "secret", true)
+	addLogin(t, r, "mail", "carol", "two")
+
+	// touched, but the content is the same
+	syncFile(t, filename, filename)
+	reload(t, r)
+
+	storage, err := r.GetAll()
+	if err != nil || password(storage, "mail", "carol") != "two" {
+		t.Fatalf("got %+v, %v", storage, err)
+	}
+}
+
+func TestReloadUnreadableFile(t *testing.T) {
+	forEachMode(t, func(t *testing.T, encrypt bool) {
+		filename, _ := newReplica(t, encrypt)
+
+		r := openTestRepository(t, filename, "secret", encrypt)
+		setPassword(t, r, "bank", "bob", "local")
+
+		// a vault of another password
+		stranger := New(repo.New(), testFile(t), 1, encrypt, testKDF)
+		stranger.Create()
+
+		err := stranger.Open([]byte("another password"))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		addLogin(t, stranger, "other", "frank", "x")
+		closeRepository(t, stranger)
+
+		syncFile(t, stranger.filename, filename)
+
+		err = r.Reload()
+		if err != nil {
+			t.Fatalf("Reload: %s", err)
+		}
+
+		storage, err := r.GetAll()
+		if err != nil || password(storage, "bank", "bob") != "local" {
+			t.Fatalf("the previous state is not served: %+v, %v", storage, err)
+		}
+
+		_, err = r.Apply(domain.Operation{Op: domain.OpAppendService, Service: "new", Type: "password"})
+		if !errors.Is(err, domain.ErrReadOnly) {
+			t.Fatalf("got %v, want ErrReadOnly", err)
+		}
+
+		if files := conflictFiles(t, filename); len(files) != 1 {
+			t.Fatalf("the unsaved change is not kept aside: %v", files)
+		}
+
+		closeRepository(t, r)
+
+		// the file on disk is left as it is
+		err = newTestRepository(filename, encrypt).Open([]byte("another password"))
+		if err != nil {
+			t.Fatalf("the new file was overwritten: %s", err)
+		}
+	})
+}
+
+// A bare file put in place of the vault would be accepted with no key at all.
+func TestReloadLegacyFile(t *testing.T) {
+	forEachMode(t, func(t *testing.T, encrypt bool) {
+		filename, _ := newReplica(t, encrypt)
+
+		r := openTestRepository(t, filename, "secret", encrypt)
+
+		err := os.WriteFile(filename, []byte(bareStorage), 0600)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = r.Reload()
+		if err != nil {
+			t.Fatalf("Reload: %s", err)
+		}
+
+		if !r.ReadOnly() {
+			t.Fatal("the legacy file was accepted")
+		}
+
+		storage, err := r.GetAll()
+		if err != nil || password(storage, "mail", "alice") != "one" || password(storage, "bank", "bob") != "1" {
+			t.Fatalf("the previous state is not served: %+v, %v", storage, err)
+		}
+
+		closeRepository(t, r)
+
+		if string(readTestFile(t, filename)) != bareStorage {
+			t.Fatal("the legacy file was overwritten")
+		}
+	})
+}
@@ -0,0 +1,133 @@
+package jsonfile
+
+import (
+	"crypto/hmac"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+
+	"manager/internal/domain"
+	"manager/internal/vault"
+)
+
+// signature authenticates the records of a storage file written without encryption, so hand edits
+// and bit rot are reported per record. The key slot ties the signatures to the master password.
+type signature struct {
+	Key     json.RawMessage   `json:"key"`
+	Records map[string][]byte `json:"records"`
+
+	// Index covers the names of all records, it catches a record removed together with its signature
+	Index []byte `json:"index"`
+}
+
+// TamperError lists what fails verification in an unencrypted storage file.
+type TamperError struct {
+	Records []string
+	Index   bool
+}
+
+func (e *TamperError) Error() string {
+	var problems []string
+
+	if len(e.Records) > 0 {
+		problems = append(problems, "records failing verification: "+strings.Join(e.Records, ", "))
+	}
+
+	if e.Index {
+		problems = append(problems, "the list of records was changed")
+	}
+
+	return fmt.Sprintf("%s: %s", domain.ErrTampered.Error(), strings.Join(problems, "; "))
+}
+
+func (e *TamperError) Is(target error) bool {
+	return target == domain.ErrTampered
+}
+
+func sign(storage domain.Storage, key *vault.Key) (*signature, error) {
+	slot, err := key.Slot()
+	if err != nil {
+		return nil, err
+	}
+
+	sig := &signature{
+		Key:     slot,
+		Records: make(map[string][]byte, len(storage)),
+		Index:   key.MAC(indexMessage(storage)),
+	}
+
+	for name, service := range storage {
+		message, err := recordMessage(name, service)
+		if err != nil {
+			return nil, err
+		}
+
+		sig.Records[name] = key.MAC(message)
+	}
+
+	return sig, nil
+}
+
+// verify returns nil when every record and the list of records match the signature.
+func verify(storage domain.Storage, sig *signature, key *vault.Key) *TamperError {
+	e := &TamperError{Index: !hmac.Equal(key.MAC(indexMessage(storage)), sig.Index)}
+
+	for name, service := range storage {
+		message, err := recordMessage(name, service)
+		if err != nil || !hmac.Equal(key.MAC(message), sig.Records[name]) {
+			e.Records = append(e.Records, name)
+		}
+	}
+
+	for name := range sig.Records {
+		if _, ok := storage[name]; !ok {
+			e.Records = append(e.Records, name)
+		}
+	}
+
+	if len(e.Records) == 0 && !e.Index {
+		return nil
+	}
+
+	sort.Strings(e.Records)
+
+	return e
+}
+
+// unsigned reports every record of a file that should have been signed but was not.
+func unsigned(storage domain.Storage) *TamperError {
+	e := &TamperError{Index: true}
+
+	for name := range storage {
+		e.Records = append(e.Records, name)
+	}
+
+	sort.Strings(e.Records)
+
+	return e
+}
+
+// recordMessage is signed for every service. Its JSON is canonical because struct fields and map
+// keys are always marshaled in the same order, so formatting changes made by hand do not matter.
+func recordMessage(name string, service domain.Service) ([]byte, error) {
+	return json.Marshal(struct {
+		Record  string         `json:"record"`
+		Service domain.Service `json:"service"`
+	}{name, service})
+}
+
+func indexMessage(storage domain.Storage) []byte {
+	names := make([]string, 0, len(storage))
+	for name := range storage {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+
+	message, _ := json.Marshal(struct {
+		Index []string `json:"index"`
+	}{names})
+
+	return message
+}
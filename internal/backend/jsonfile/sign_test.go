@@ -0,0 +1,266 @@
+package jsonfile
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"os"
+	"reflect"
+	"testing"
+
+	"manager/internal/domain"
+)
+
+// writePlainFile writes a signed unencrypted storage with two services.
+func writePlainFile(t *testing.T) string {
+	t.Helper()
+
+	filename := testFile(t)
+
+	r := openTestRepository(t, filename, "secret", false)
+	addLogin(t, r, "mail", "alice", "hunter2")
+	addLogin(t, r, "bank", "bob", "1234")
+
+	err := r.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return filename
+}
+
+// editFile changes the storage file the way a hand edit would.
+func editFile(t *testing.T, filename string, edit func(doc map[string]any)) {
+	t.Helper()
+
+	var file struct {
+		Version int            `json:"version"`
+		Data    map[string]any `json:"data"`
+	}
+
+	err := json.Unmarshal(readTestFile(t, filename), &file)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	edit(file.Data)
+
+	data, err := json.MarshalIndent(file, "", "    ")
+	if err == nil {
+		err = os.WriteFile(filename, data, 0600)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func services(doc map[string]any) map[string]any {
+	return doc["services"].(map[string]any)
+}
+
+func openTampered(t *testing.T, filename string) *TamperError {
+	t.Helper()
+
+	before := readTestFile(t, filename)
+
+	err := newTestRepository(filename, false).Open([]byte("secret"))
+	if !errors.Is(err, domain.ErrTampered) {
+		t.Fatalf("got %v, want ErrTampered", err)
+	}
+
+	if !bytes.Equal(readTestFile(t, filename), before) {
+		t.Fatal("a file failing verification was changed")
+	}
+
+	var e *TamperError
+	if !errors.As(err, &e) {
+		t.Fatalf("got %T, want *TamperError", err)
+	}
+
+	return e
+}
+
+func TestSignedFileOpens(t *testing.T) {
+	filename := writePlainFile(t)
+
+	e, err := Verify(readTestFile(t, filename), []byte("secret"))
+	if err != nil || e != nil {
+		t.Fatalf("got %v, %v", e, err)
+	}
+
+	// formatting does not matter
+	editFile(t, filename, func(doc map[string]any) {})
+
+	r := openTestRepository(t, filename, "secret", false)
+
+	storage, err := r.GetAll()
+	if err != nil || password(storage, "mail", "alice") != "hunter2" {
+		t.Fatalf("got %+v, %v", storage, err)
+	}
+}
+
+func TestChangedRecord(t *testing.T) {
+	filename := writePlainFile(t)
+
+	editFile(t, filename, func(doc map[string]any) {
+		mail := services(doc)["mail"].(map[string]any)
+		mail["favorite"] = true
+	})
+
+	e := openTampered(t, filename)
+	if !reflect.DeepEqual(e.Records, []string{"mail"}) || e.Index {
+		t.Fatalf("got %+v", e)
+	}
+}
+
+func TestAddedRecord(t *testing.T) {
+	filename := writePlainFile(t)
+
+	editFile(t, filename, func(doc map[string]any) {
+		services(doc)["new"] = map[string]any{"type": "password", "favorite": false, "elements": map[string]any{}}
+	})
+
+	e := openTampered(t, filename)
+	if !reflect.DeepEqual(e.Records, []string{"new"}) || !e.Index {
+		t.Fatalf("got %+v", e)
+	}
+}
+
+func TestRemovedRecord(t *testing.T) {
+	filename := writePlainFile(t)
+
+	editFile(t, filename, func(doc map[string]any) {
+		delete(services(doc), "bank")
+		delete(doc["signature"].(map[string]any)["records"].(map[string]any), "bank")
+	})
+
+	e := openTampered(t, filename)
+	if len(e.Records) != 0 || !e.Index {
+		t.Fatalf("got %+v", e)
+	}
+}
+
+func TestRemovedSignature(t *testing.T) {
+	filename := writePlainFile(t)
+
+	editFile(t, filename, func(doc map[string]any) {
+		delete(doc, "signature")
+	})
+
+	e := openTampered(t, filename)
+	if !reflect.DeepEqual(e.Records, []string{"bank", "mail"}) || !e.Index {
+		t.Fatalf("got %+v", e)
+	}
+}
+
+func TestSignatureWrongPassword(t *testing.T) {
+	filename := writePlainFile(t)
+
+	err := newTestRepository(filename, false).Open([]byte("guess"))
+	if err != domain.ErrWrongPassword {
+		t.Fatalf("got %v, want ErrWrongPassword", err)
+	}
+}
+
+// A bare file put in place of a vault opens with no password at all.
+func TestLegacyFileRefused(t *testing.T) {
+	for _, encrypt := range []bool{true, false} {
+		filename := testFile(t)
+
+		r := openTestRepository(t, filename, "secret", encrypt)
+		addLogin(t, r, "mail", "alice", "hunter2")
+
+		err := r.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for version, data := range olderVersions {
+			err = os.WriteFile(filename, []byte(data), 0600)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			for _, password := range []string{"secret", "guess"} {
+				err = newTestRepository(filename, encrypt).Open([]byte(password))
+				if !errors.Is(err, ErrDowngrade) || !errors.Is(err, domain.ErrTampered) {
+					t.Fatalf("version %d, encrypted %v, password %s: got %v, want ErrDowngrade", version, encrypt, password, err)
+				}
+			}
+
+			if string(readTestFile(t, filename)) != data {
+				t.Fatalf("version %d: a refused file was changed", version)
+			}
+
+			r = newTestRepository(filename, encrypt)
+			r.AcceptLegacy()
+
+			err = r.Open([]byte("secret"))
+			if err == nil {
+				err = r.Close()
+			}
+			if err != nil {
+				t.Fatalf("version %d: accepted legacy file: %v", version, err)
+			}
+		}
+	}
+}
+
+func TestAcknowledge(t *testing.T) {
+	filename := writePlainFile(t)
+
+	editFile(t, filename, func(doc map[string]any) {
+		alice := services(doc)["mail"].(map[string]any)["elements"].(map[string]any)["alice"].(map[string]any)
+		alice["description"] = "edited by hand"
+	})
+
+	r := newTestRepository(filename, false)
+	r.Acknowledge()
+
+	err := r.Open([]byte("secret"))
+	if err != nil {
+		t.Fatalf("Open: %s", err)
+	}
+
+	storage, err := r.GetAll()
+	if err != nil || storage["mail"].Elements["alice"].Description != "edited by hand" {
+		t.Fatalf("got %+v, %v", storage, err)
+	}
+
+	err = r.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	e, err := Verify(readTestFile(t, filename), []byte("secret"))
+	if err != nil || e != nil {
+		t.Fatalf("the file was not signed again: %v, %v", e, err)
+	}
+
+	// acknowledging covers a single open
+	editFile(t, filename, func(doc map[string]any) {
+		services(doc)["mail"].(map[string]any)["type"] = "card"
+	})
+
+	err = r.Open([]byte("secret"))
+	if !errors.Is(err, domain.ErrTampered) {
+		t.Fatalf("got %v, want ErrTampered", err)
+	}
+}
+
+func TestVerifyEncrypted(t *testing.T) {
+	filename := testFile(t)
+
+	r := openTestRepository(t, filename, "secret", true)
+	addLogin(t, r, "mail", "alice", "hunter2")
+
+	err := r.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	e, err := Verify(readTestFile(t, filename), []byte("secret"))
+	if err != nil || e != nil {
+		t.Fatalf("got %v, %v", e, err)
+	}
+}
@@ -0,0 +1,276 @@
+package kdbx
+
+import (
+	"encoding/binary"
+	"hash"
+	"sync"
+
+	"golang.org/x/crypto/blake2b"
+)
+
+// golang.org/x/crypto/argon2 only exports Argon2i and Argon2id, while KeePass uses Argon2d by
+// default. This is the reference algorithm (RFC 9106, version 0x13) restricted to Argon2d.
+const (
+	argon2Version    = 0x13
+	argon2dType      = 0
+	argon2BlockWords = 128
+	argon2SyncPoints = 4
+)
+
+type argon2Block [argon2BlockWords]uint64
+
+func argon2d(password, salt []byte, time, memory uint32, threads uint32, keyLen uint32) []byte {
+	h0 := argon2InitHash(password, salt, time, memory, threads, keyLen)
+
+	memory = memory / (argon2SyncPoints * threads) * (argon2SyncPoints * threads)
+	if memory < 2*argon2SyncPoints*threads {
+		memory = 2 * argon2SyncPoints * threads
+	}
+
+	blocks := argon2InitBlocks(&h0, memory, threads)
+	argon2ProcessBlocks(blocks, time, memory, threads)
+
+	return argon2ExtractKey(blocks, memory, threads, keyLen)
+}
+
+func argon2InitHash(password, salt []byte, time, memory, threads, keyLen uint32) [blake2b.Size + 8]byte {
+	var h0 [blake2b.Size + 8]byte
+	var params [24]byte
+	var length [4]byte
+
+	b2, _ := blake2b.New512(nil)
+
+	binary.LittleEndian.PutUint32(params[0:4], threads)
+	binary.LittleEndian.PutUint32(params[4:8], keyLen)
+	binary.LittleEndian.PutUint32(params[8:12], memory)
+	binary.LittleEndian.PutUint32(params[12:16], time)
+	binary.LittleEndian.PutUint32(params[16:20], argon2Version)
+	binary.LittleEndian.PutUint32(params[20:24], argon2dType)
+	b2.Write(params[:])
+
+	// password, salt, secret and associated data, the last two are not used by KeePass
+	for _, input := range [][]byte{password, salt, nil, nil} {
+		binary.LittleEndian.PutUint32(length[:], uint32(len(input)))
+		b2.Write(length[:])
+		b2.Write(input)
+	}
+
+	b2.Sum(h0[:0])
+
+	return h0
+}
+
+func argon2InitBlocks(h0 *[blake2b.Size + 8]byte, memory, threads uint32) []argon2Block {
+	var block [1024]byte
+
+	blocks := make([]argon2Block, memory)
+
+	for lane := uint32(0); lane < threads; lane++ {
+		j := lane * (memory / threads)
+		binary.LittleEndian.PutUint32(h0[blake2b.Size+4:], lane)
+
+		for i := uint32(0); i < 2; i++ {
+			binary.LittleEndian.PutUint32(h0[blake2b.Size:], i)
+			argon2Hash(block[:], h0[:])
+
+			for k := range blocks[j+i] {
+				blocks[j+i][k] = binary.LittleEndian.Uint64(block[k*8:])
+			}
+		}
+	}
+
+	return blocks
+}
+
+func argon2ProcessBlocks(blocks []argon2Block, time, memory, threads uint32) {
+	lanes := memory / threads
+	segments := lanes / argon2SyncPoints
+
+	processSegment := func(n, slice, lane uint32, wg *sync.WaitGroup) {
+		defer wg.Done()
+
+		index := uint32(0)
+		if n == 0 && slice == 0 {
+			// the first two blocks of every lane are already set
+			index = 2
+		}
+
+		offset := lane*lanes + slice*segments + index
+
+		for index < segments {
+			prev := offset - 1
+			if index == 0 && slice == 0 {
+				prev += lanes
+			}
+
+			random := blocks[prev][0]
+			ref := argon2IndexAlpha(random, lanes, segments, threads, n, slice, lane, index)
+			argon2ProcessBlock(&blocks[offset], &blocks[prev], &blocks[ref])
+
+			index, offset = index+1, offset+1
+		}
+	}
+
+	for n := uint32(0); n < time; n++ {
+		for slice := uint32(0); slice < argon2SyncPoints; slice++ {
+			wg := new(sync.WaitGroup)
+
+			for lane := uint32(0); lane < threads; lane++ {
+				wg.Add(1)
+				go processSegment(n, slice, lane, wg)
+			}
+
+			wg.Wait()
+		}
+	}
+}
+
+func argon2ExtractKey(blocks []argon2Block, memory, threads, keyLen uint32) []byte {
+	lanes := memory / threads
+
+	for lane := uint32(0); lane < threads-1; lane++ {
+		for i, v := range blocks[lane*lanes+lanes-1] {
+			blocks[memory-1][i] ^= v
+		}
+	}
+
+	var block [1024]byte
+	for i, v := range blocks[memory-1] {
+		binary.LittleEndian.PutUint64(block[i*8:], v)
+	}
+
+	key := make([]byte, keyLen)
+	argon2Hash(key, block[:])
+
+	return key
+}
+
+func argon2IndexAlpha(random uint64, lanes, segments, threads, n, slice, lane, index uint32) uint32 {
+	refLane := uint32(random>>32) % threads
+	if n == 0 && slice == 0 {
+		refLane = lane
+	}
+
+	m, s := 3*segments, ((slice+1)%argon2SyncPoints)*segments
+	if lane == refLane {
+		m += index
+	}
+
+	if n == 0 {
+		m, s = slice*segments, 0
+		if slice == 0 || lane == refLane {
+			m += index
+		}
+	}
+
+	if index == 0 || lane == refLane {
+		m--
+	}
+
+	p := random & 0xFFFFFFFF
+	p = (p * p) >> 32
+	p = (p * uint64(m)) >> 32
+
+	return refLane*lanes + uint32((uint64(s)+uint64(m)-(p+1))%uint64(lanes))
+}
+
+// argon2ProcessBlock XORs the compression of in1 and in2 into out. Blocks of the first pass start
+// zeroed, so this is also correct for them.
+func argon2ProcessBlock(out, in1, in2 *argon2Block) {
+	var t argon2Block
+	for i := range t {
+		t[i] = in1[i] ^ in2[i]
+	}
+
+	for i := 0; i < argon2BlockWords; i += 16 {
+		blamka(&t, i, i+1, i+2, i+3, i+4, i+5, i+6, i+7, i+8, i+9, i+10, i+11, i+12, i+13, i+14, i+15)
+	}
+
+	for i := 0; i < argon2BlockWords/8; i += 2 {
+		blamka(&t, i, i+1, 16+i, 16+i+1, 32+i, 32+i+1, 48+i, 48+i+1,
+			64+i, 64+i+1, 80+i, 80+i+1, 96+i, 96+i+1, 112+i, 112+i+1)
+	}
+
+	for i := range t {
+		out[i] ^= in1[i] ^ in2[i] ^ t[i]
+	}
+}
+
+// blamka applies the BLAKE2b round with multiplication to the 16 words of t at the given indexes.
+func blamka(t *argon2Block, i ...int) {
+	var v [16]uint64
+	for k := range v {
+		v[k] = t[i[k]]
+	}
+
+	g := func(a, b, c, d int) {
+		v[a] += v[b] + 2*uint64(uint32(v[a]))*uint64(uint32(v[b]))
+		v[d] ^= v[a]
+		v[d] = v[d]>>32 | v[d]<<32
+		v[c] += v[d] + 2*uint64(uint32(v[c]))*uint64(uint32(v[d]))
+		v[b] ^= v[c]
+		v[b] = v[b]>>24 | v[b]<<40
+		v[a] += v[b] + 2*uint64(uint32(v[a]))*uint64(uint32(v[b]))
+		v[d] ^= v[a]
+		v[d] = v[d]>>16 | v[d]<<48
+		v[c] += v[d] + 2*uint64(uint32(v[c]))*uint64(uint32(v[d]))
+		v[b] ^= v[c]
+		v[b] = v[b]<<1 | v[b]>>63
+	}
+
+	g(0, 4, 8, 12)
+	g(1, 5, 9, 13)
+	g(2, 6, 10, 14)
+	g(3, 7, 11, 15)
+	g(0, 5, 10, 15)
+	g(1, 6, 11, 12)
+	g(2, 7, 8, 13)
+	g(3, 4, 9, 14)
+
+	for k := range v {
+		t[i[k]] = v[k]
+	}
+}
+
+// argon2Hash is the variable length hash function H' of Argon2.
+func argon2Hash(out []byte, in []byte) {
+	var b2 hash.Hash
+	if n := len(out); n < blake2b.Size {
+		b2, _ = blake2b.New(n, nil)
+	} else {
+		b2, _ = blake2b.New512(nil)
+	}
+
+	var buffer [blake2b.Size]byte
+	binary.LittleEndian.PutUint32(buffer[:4], uint32(len(out)))
+	b2.Write(buffer[:4])
+	b2.Write(in)
+
+	if len(out) <= blake2b.Size {
+		b2.Sum(out[:0])
+
+		return
+	}
+
+	outLen := len(out)
+	b2.Sum(buffer[:0])
+	b2.Reset()
+	copy(out, buffer[:32])
+	out = out[32:]
+
+	for len(out) > blake2b.Size {
+		b2.Write(buffer[:])
+		b2.Sum(buffer[:0])
+		copy(out, buffer[:32])
+		out = out[32:]
+		b2.Reset()
+	}
+
+	if outLen%blake2b.Size > 0 {
+		r := ((outLen + 31) / 32) - 2
+		b2, _ = blake2b.New(outLen-32*r, nil)
+	}
+
+	b2.Write(buffer[:])
+	b2.Sum(out[:0])
+}
@@ -0,0 +1,560 @@
+package kdbx
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/chacha20"
+)
+
+// KDBX 4 file layout:
+//
+//	signature (8 bytes) | version (uint32) | header fields | SHA-256 of the header | HMAC of the header | blocks
+//
+// Every header field is its id (1 byte) and size (uint32) followed by the data, the header ends with
+// field 0. Every block is its HMAC, size (int32) and data, the blocks end with an empty one. The data
+// of all blocks together is the encrypted and optionally gzipped inner header followed by the XML
+// document. All integers are little endian.
+const (
+	signature1   = 0x9AA2D903
+	signature2   = 0xB54BFB67
+	version4     = 0x00040000
+	versionMajor = 0xFFFF0000
+
+	fieldEnd         = 0
+	fieldCipherID    = 2
+	fieldCompression = 3
+	fieldMasterSeed  = 4
+	fieldIV          = 7
+	fieldKDF         = 11
+
+	innerFieldEnd       = 0
+	innerFieldStreamID  = 1
+	innerFieldStreamKey = 2
+	innerFieldBinary    = 3
+
+	compressionNone = 0
+	compressionGzip = 1
+
+	streamChaCha20 = 3
+
+	blockSize = 1 << 20
+
+	// the key derivation runs before the file is authenticated, so its cost is bounded like that of
+	// the other backends
+	maxArgon2Memory     = 1 << 30
+	maxArgon2Iterations = 64
+)
+
+var (
+	cipherAES256   = []byte{0x31, 0xc1, 0xf2, 0xe6, 0xbf, 0x71, 0x43, 0x50, 0xbe, 0x58, 0x05, 0x21, 0x6a, 0xfc, 0x5a, 0xff}
+	cipherChaCha20 = []byte{0xd6, 0x03, 0x8a, 0x2b, 0x8b, 0x6f, 0x4c, 0xb5, 0xa5, 0x24, 0x33, 0x9a, 0x31, 0xdb, 0xb5, 0x9a}
+
+	kdfAESKDBX3 = []byte{0xc9, 0xd9, 0xf3, 0x9a, 0x62, 0x8a, 0x44, 0x60, 0xbf, 0x74, 0x0d, 0x08, 0xc1, 0x8a, 0x4f, 0xea}
+	kdfAESKDBX4 = []byte{0x7c, 0x02, 0xbb, 0x82, 0x79, 0xa7, 0x4a, 0xc0, 0x92, 0x7d, 0x11, 0x4a, 0x00, 0x64, 0x82, 0x38}
+	kdfArgon2d  = []byte{0xef, 0x63, 0x6d, 0xdf, 0x8c, 0x29, 0x44, 0x4b, 0x91, 0xf7, 0xa9, 0xa4, 0x03, 0xe3, 0x0a, 0x0c}
+	kdfArgon2id = []byte{0x9e, 0x29, 0x8b, 0x19, 0x56, 0xdb, 0x47, 0x73, 0xb2, 0x3d, 0xfc, 0x3e, 0xc6, 0xf0, 0xa1, 0xe6}
+
+	headerEnd = []byte("\r\n\r\n")
+)
+
+var (
+	errCorrupted     = errors.New("kdbx file is corrupted")
+	errWrongPassword = errors.New("wrong master password")
+)
+
+type field struct {
+	id   byte
+	data []byte
+}
+
+// container is a decrypted KDBX file. The outer header fields and the binaries of the inner header
+// are kept as they are, so saving the file doesn't lose anything the manager doesn't understand.
+type container struct {
+	version  uint32
+	fields   []field
+	binaries [][]byte
+	innerKey []byte
+	stream   *chacha20.Cipher
+	xml      []byte
+}
+
+func (c *container) field(id byte) []byte {
+	for _, f := range c.fields {
+		if f.id == id {
+			return f.data
+		}
+	}
+
+	return nil
+}
+
+func (c *container) setField(id byte, data []byte) {
+	for i, f := range c.fields {
+		if f.id == id {
+			c.fields[i].data = data
+
+			return
+		}
+	}
+
+	c.fields = append(c.fields, field{id: id, data: data})
+}
+
+// parseHeader checks the signature and the header checksum and returns the header fields together
+// with the raw header and the rest of the file.
+func parseHeader(data []byte) (uint32, []field, []byte, []byte, error) {
+	if len(data) < 12 || binary.LittleEndian.Uint32(data) != signature1 || binary.LittleEndian.Uint32(data[4:]) != signature2 {
+		return 0, nil, nil, nil, fmt.Errorf("%w: not a KeePass database", errCorrupted)
+	}
+
+	version := binary.LittleEndian.Uint32(data[8:])
+	if version&versionMajor != version4 {
+		return 0, nil, nil, nil, fmt.Errorf("unsupported KDBX version %d.%d", version>>16, version&0xFFFF)
+	}
+
+	var fields []field
+
+	offset := 12
+	for {
+		if offset+5 > len(data) {
+			return 0, nil, nil, nil, fmt.Errorf("%w: truncated header", errCorrupted)
+		}
+
+		id := data[offset]
+		size := int(binary.LittleEndian.Uint32(data[offset+1:]))
+		offset += 5
+
+		if size > len(data)-offset {
+			return 0, nil, nil, nil, fmt.Errorf("%w: truncated header", errCorrupted)
+		}
+
+		value := data[offset : offset+size]
+		offset += size
+
+		if id == fieldEnd {
+			break
+		}
+
+		fields = append(fields, field{id: id, data: value})
+	}
+
+	if offset+2*sha256.Size > len(data) {
+		return 0, nil, nil, nil, fmt.Errorf("%w: truncated header", errCorrupted)
+	}
+
+	header := data[:offset]
+	sum := sha256.Sum256(header)
+
+	if !bytes.Equal(sum[:], data[offset:offset+sha256.Size]) {
+		return 0, nil, nil, nil, fmt.Errorf("%w: header checksum mismatch", errCorrupted)
+	}
+
+	return version, fields, header, data[offset+sha256.Size:], nil
+}
+
+// compositeKey is the key made of the password alone, the only key type the manager supports.
+func compositeKey(password []byte) []byte {
+	passwordHash := sha256.Sum256(password)
+	key := sha256.Sum256(passwordHash[:])
+
+	return key[:]
+}
+
+// transformKey runs the key derivation function described by the header parameters.
+func transformKey(composite []byte, params variants) ([]byte, error) {
+	uuid, _ := params.get("$UUID")
+	salt, _ := params.get("S")
+
+	switch {
+	case bytes.Equal(uuid, kdfAESKDBX3), bytes.Equal(uuid, kdfAESKDBX4):
+		rounds, ok := params.uint("R")
+		if !ok || len(salt) != 32 {
+			return nil, fmt.Errorf("%w: invalid AES-KDF parameters", errCorrupted)
+		}
+
+		block, err := aes.NewCipher(salt)
+		if err != nil {
+			return nil, err
+		}
+
+		key := append([]byte(nil), composite...)
+		for i := uint64(0); i < rounds; i++ {
+			block.Encrypt(key[:16], key[:16])
+			block.Encrypt(key[16:], key[16:])
+		}
+
+		sum := sha256.Sum256(key)
+
+		return sum[:], nil
+	case bytes.Equal(uuid, kdfArgon2d), bytes.Equal(uuid, kdfArgon2id):
+		iterations, ok1 := params.uint("I")
+		memory, ok2 := params.uint("M")
+		parallelism, ok3 := params.uint("P")
+		if !ok1 || !ok2 || !ok3 || iterations == 0 || iterations > maxArgon2Iterations || parallelism == 0 || parallelism > 255 || memory < 8*1024*parallelism || memory > maxArgon2Memory {
+			return nil, fmt.Errorf("%w: invalid Argon2 parameters", errCorrupted)
+		}
+
+		if bytes.Equal(uuid, kdfArgon2id) {
+			return argon2.IDKey(composite, salt, uint32(iterations), uint32(memory/1024), uint8(parallelism), 32), nil
+		}
+
+		return argon2d(composite, salt, uint32(iterations), uint32(memory/1024), uint32(parallelism), 32), nil
+	}
+
+	return nil, fmt.Errorf("unsupported key derivation function %x", uuid)
+}
+
+// keys returns the encryption key and the HMAC base key for the given master seed.
+func keys(masterSeed, transformedKey []byte) ([]byte, []byte) {
+	h := sha256.New()
+	h.Write(masterSeed)
+	h.Write(transformedKey)
+	encryptionKey := h.Sum(nil)
+
+	h512 := sha512.New()
+	h512.Write(masterSeed)
+	h512.Write(transformedKey)
+	h512.Write([]byte{1})
+	hmacKey := h512.Sum(nil)
+
+	return encryptionKey, hmacKey
+}
+
+func blockHMAC(hmacKey []byte, index uint64, data []byte) []byte {
+	var prefix [12]byte
+	binary.LittleEndian.PutUint64(prefix[:], index)
+
+	h512 := sha512.New()
+	h512.Write(prefix[:8])
+	h512.Write(hmacKey)
+
+	mac := hmac.New(sha256.New, h512.Sum(nil))
+	if index != ^uint64(0) {
+		binary.LittleEndian.PutUint32(prefix[8:], uint32(len(data)))
+		mac.Write(prefix[:])
+	}
+	mac.Write(data)
+
+	return mac.Sum(nil)
+}
+
+// checkKey tells whether the transformed key is the one of the database from the header HMAC,
+// without reading the payload.
+func checkKey(data []byte, transformedKey []byte) error {
+	_, fields, header, rest, err := parseHeader(data)
+	if err != nil {
+		return err
+	}
+
+	_, hmacKey := keys((&container{fields: fields}).field(fieldMasterSeed), transformedKey)
+
+	if !headerAuthentic(header, rest, hmacKey) {
+		return errWrongPassword
+	}
+
+	return nil
+}
+
+// headerAuthentic checks the HMAC that follows the header.
+func headerAuthentic(header, rest, hmacKey []byte) bool {
+	return len(rest) >= sha256.Size && hmac.Equal(rest[:sha256.Size], blockHMAC(hmacKey, ^uint64(0), header))
+}
+
+// decrypt opens a KDBX 4 file with the transformed key. errWrongPassword is returned when the
+// header HMAC doesn't match, damage anywhere after that is reported as errCorrupted.
+func decrypt(data []byte, transformedKey []byte) (*container, error) {
+	version, fields, header, rest, err := parseHeader(data)
+	if err != nil {
+		return nil, err
+	}
+
+	c := &container{version: version, fields: fields}
+
+	encryptionKey, hmacKey := keys(c.field(fieldMasterSeed), transformedKey)
+
+	if !headerAuthentic(header, rest, hmacKey) {
+		return nil, errWrongPassword
+	}
+
+	rest = rest[sha256.Size:]
+
+	var payload []byte
+
+	for index := uint64(0); ; index++ {
+		if len(rest) < sha256.Size+4 {
+			return nil, fmt.Errorf("%w: truncated block %d", errCorrupted, index)
+		}
+
+		size := int(int32(binary.LittleEndian.Uint32(rest[sha256.Size:])))
+		if size < 0 || size > len(rest)-sha256.Size-4 {
+			return nil, fmt.Errorf("%w: truncated block %d", errCorrupted, index)
+		}
+
+		block := rest[sha256.Size+4 : sha256.Size+4+size]
+		if !hmac.Equal(rest[:sha256.Size], blockHMAC(hmacKey, index, block)) {
+			return nil, fmt.Errorf("%w: block %d failed authentication", errCorrupted, index)
+		}
+
+		if size == 0 {
+			break
+		}
+
+		payload = append(payload, block...)
+		rest = rest[sha256.Size+4+size:]
+	}
+
+	payload, err = crypt(c.field(fieldCipherID), encryptionKey, c.field(fieldIV), payload, false)
+	if err != nil {
+		return nil, err
+	}
+
+	if compression := c.field(fieldCompression); len(compression) == 4 && binary.LittleEndian.Uint32(compression) == compressionGzip {
+		reader, err := gzip.NewReader(bytes.NewReader(payload))
+		if err != nil {
+			return nil, fmt.Errorf("%w: %s", errCorrupted, err.Error())
+		}
+
+		payload, err = io.ReadAll(reader)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %s", errCorrupted, err.Error())
+		}
+	}
+
+	err = c.parseInnerHeader(payload)
+	if err != nil {
+		return nil, err
+	}
+
+	return c, nil
+}
+
+func (c *container) parseInnerHeader(payload []byte) error {
+	var streamID uint32
+	var streamKey []byte
+
+	for {
+		if len(payload) < 5 {
+			return fmt.Errorf("%w: truncated inner header", errCorrupted)
+		}
+
+		id := payload[0]
+		size := int(binary.LittleEndian.Uint32(payload[1:]))
+		if size > len(payload)-5 {
+			return fmt.Errorf("%w: truncated inner header", errCorrupted)
+		}
+
+		value := payload[5 : 5+size]
+		payload = payload[5+size:]
+
+		switch id {
+		case innerFieldStreamID:
+			if len(value) == 4 {
+				streamID = binary.LittleEndian.Uint32(value)
+			}
+		case innerFieldStreamKey:
+			streamKey = value
+		case innerFieldBinary:
+			c.binaries = append(c.binaries, value)
+		}
+
+		if id == innerFieldEnd {
+			break
+		}
+	}
+
+	if streamID != streamChaCha20 {
+		return fmt.Errorf("unsupported inner stream cipher %d", streamID)
+	}
+
+	stream, err := newStream(streamKey)
+	if err != nil {
+		return err
+	}
+
+	c.innerKey = streamKey
+	c.stream = stream
+	c.xml = payload
+
+	return nil
+}
+
+// newStream returns the cipher that protects values such as passwords inside the XML document.
+func newStream(key []byte) (*chacha20.Cipher, error) {
+	sum := sha512.Sum512(key)
+
+	return chacha20.NewUnauthenticatedCipher(sum[:32], sum[32:44])
+}
+
+// encrypt writes the container as a KDBX 4 file with a fresh master seed and IV.
+func (c *container) encrypt(transformedKey []byte) ([]byte, error) {
+	masterSeed := make([]byte, 32)
+	if _, err := rand.Read(masterSeed); err != nil {
+		return nil, err
+	}
+
+	c.setField(fieldMasterSeed, masterSeed)
+
+	iv := make([]byte, len(c.field(fieldIV)))
+	if _, err := rand.Read(iv); err != nil {
+		return nil, err
+	}
+
+	c.setField(fieldIV, iv)
+
+	var out []byte
+	out = binary.LittleEndian.AppendUint32(out, signature1)
+	out = binary.LittleEndian.AppendUint32(out, signature2)
+	out = binary.LittleEndian.AppendUint32(out, c.version)
+
+	for _, f := range c.fields {
+		out = appendField(out, f.id, f.data)
+	}
+
+	out = appendField(out, fieldEnd, headerEnd)
+	header := out
+
+	encryptionKey, hmacKey := keys(masterSeed, transformedKey)
+
+	sum := sha256.Sum256(header)
+	out = append(out, sum[:]...)
+	out = append(out, blockHMAC(hmacKey, ^uint64(0), header)...)
+
+	payload := c.innerHeader()
+	payload = append(payload, c.xml...)
+
+	if compression := c.field(fieldCompression); len(compression) == 4 && binary.LittleEndian.Uint32(compression) == compressionGzip {
+		buf := new(bytes.Buffer)
+		writer := gzip.NewWriter(buf)
+		writer.Write(payload)
+
+		err := writer.Close()
+		if err != nil {
+			return nil, err
+		}
+
+		payload = buf.Bytes()
+	}
+
+	payload, err := crypt(c.field(fieldCipherID), encryptionKey, iv, payload, true)
+	if err != nil {
+		return nil, err
+	}
+
+	for index := uint64(0); ; index++ {
+		size := len(payload)
+		if size > blockSize {
+			size = blockSize
+		}
+
+		out = append(out, blockHMAC(hmacKey, index, payload[:size])...)
+		out = binary.LittleEndian.AppendUint32(out, uint32(size))
+		out = append(out, payload[:size]...)
+		payload = payload[size:]
+
+		if size == 0 {
+			break
+		}
+	}
+
+	return out, nil
+}
+
+// resetStream starts a new inner stream with a random key, it has to be called before the XML is
+// serialized for encrypt.
+func (c *container) resetStream() error {
+	key := make([]byte, 64)
+	if _, err := rand.Read(key); err != nil {
+		return err
+	}
+
+	stream, err := newStream(key)
+	if err != nil {
+		return err
+	}
+
+	c.innerKey = key
+	c.stream = stream
+
+	return nil
+}
+
+func (c *container) innerHeader() []byte {
+	var out []byte
+
+	out = appendField(out, innerFieldStreamID, binary.LittleEndian.AppendUint32(nil, streamChaCha20))
+	out = appendField(out, innerFieldStreamKey, c.innerKey)
+
+	for _, data := range c.binaries {
+		out = appendField(out, innerFieldBinary, data)
+	}
+
+	return appendField(out, innerFieldEnd, nil)
+}
+
+func appendField(out []byte, id byte, data []byte) []byte {
+	out = append(out, id)
+	out = binary.LittleEndian.AppendUint32(out, uint32(len(data)))
+
+	return append(out, data...)
+}
+
+// crypt encrypts or decrypts the payload with the outer cipher of the file.
+func crypt(cipherID, key, iv, payload []byte, encrypt bool) ([]byte, error) {
+	switch {
+	case bytes.Equal(cipherID, cipherAES256):
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return nil, err
+		}
+
+		if len(iv) != aes.BlockSize {
+			return nil, fmt.Errorf("%w: invalid IV", errCorrupted)
+		}
+
+		if encrypt {
+			padding := aes.BlockSize - len(payload)%aes.BlockSize
+			out := append(append([]byte(nil), payload...), bytes.Repeat([]byte{byte(padding)}, padding)...)
+			cipher.NewCBCEncrypter(block, iv).CryptBlocks(out, out)
+
+			return out, nil
+		}
+
+		if len(payload) == 0 || len(payload)%aes.BlockSize != 0 {
+			return nil, fmt.Errorf("%w: invalid payload size", errCorrupted)
+		}
+
+		out := make([]byte, len(payload))
+		cipher.NewCBCDecrypter(block, iv).CryptBlocks(out, payload)
+
+		padding := int(out[len(out)-1])
+		if padding == 0 || padding > aes.BlockSize {
+			return nil, fmt.Errorf("%w: invalid padding", errCorrupted)
+		}
+
+		return out[:len(out)-padding], nil
+	case bytes.Equal(cipherID, cipherChaCha20):
+		stream, err := chacha20.NewUnauthenticatedCipher(key, iv)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %s", errCorrupted, err.Error())
+		}
+
+		out := make([]byte, len(payload))
+		stream.XORKeyStream(out, payload)
+
+		return out, nil
+	}
+
+	return nil, fmt.Errorf("unsupported cipher %x", cipherID)
+}
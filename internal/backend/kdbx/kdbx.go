@@ -0,0 +1,805 @@
+package kdbx
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"runtime"
+	"strconv"
+	"sync"
+	"time"
+
+	"manager/internal/disk"
+	"manager/internal/domain"
+	"manager/internal/secmem"
+	"manager/internal/vault"
+)
+
+// Mapping of the storage to the KeePass document: every service is a group directly below the root
+// group, with the record type and the favorite flag kept in the custom data of the group. Every
+// login is an entry of that group, with the login as UserName, the description as Title and the
+// additional information as Notes. Everything else in the document, including nested groups, entry
+// history and attachments, is left as it is.
+const (
+	customType     = "manager.type"
+	customFavorite = "manager.favorite"
+
+	fieldTitle    = "Title"
+	fieldUserName = "UserName"
+	fieldPassword = "Password"
+	fieldURL      = "URL"
+	fieldNotes    = "Notes"
+
+	groupIcon           = "48"
+	defaultHistoryItems = 10
+)
+
+var (
+	emptyUUID = base64.StdEncoding.EncodeToString(make([]byte, 16))
+
+	// KeePass times are seconds since 0001-01-01
+	timeEpoch = time.Date(1, 1, 1, 0, 0, 0, 0, time.UTC).Unix()
+)
+
+// Repository keeps a KeePass KDBX 4 database in memory and writes the whole file on Flush, so the
+// same file can be used by KeePassXC or KeePass while the manager is locked.
+type Repository struct {
+	path  string
+	mutex *sync.RWMutex
+
+	// kdf are the Argon2id parameters a new database is made with
+	kdf vault.KDFParams
+
+	// file and document are nil while the repository is closed
+	file           *container
+	document       *node
+	transformedKey []byte
+	dirty          bool
+}
+
+func New(path string, kdf vault.KDFParams) *Repository {
+	return &Repository{
+		path:  path,
+		mutex: new(sync.RWMutex),
+		kdf:   kdf,
+	}
+}
+
+// Check verifies the header of an existing database at startup.
+func (r *Repository) Check() error {
+	data, err := os.ReadFile(r.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read file: %s", err.Error())
+	}
+
+	_, _, _, _, err = parseHeader(data)
+
+	return err
+}
+
+func (r *Repository) Open(password []byte) error {
+	data, err := os.ReadFile(r.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return r.create(password)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read file: %s", err.Error())
+	}
+
+	transformedKey, err := fileKey(data, password)
+	if err != nil {
+		return err
+	}
+
+	file, err := decrypt(data, transformedKey)
+	if errors.Is(err, errWrongPassword) {
+		return domain.ErrWrongPassword
+	}
+	if err != nil {
+		return err
+	}
+
+	document, err := parseXML(file.xml, file.stream)
+	secmem.Zero(file.xml)
+	file.xml = nil
+	if err != nil {
+		return err
+	}
+
+	r.file = file
+	r.document = document
+	r.transformedKey = transformedKey
+	r.dirty = false
+
+	return nil
+}
+
+// Probe tells whether Open would accept the password, checking it against the header only. A
+// missing database accepts any password.
+func (r *Repository) Probe(password []byte) error {
+	data, err := os.ReadFile(r.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read file: %s", err.Error())
+	}
+
+	transformedKey, err := fileKey(data, password)
+	if err != nil {
+		return err
+	}
+
+	err = checkKey(data, transformedKey)
+	if errors.Is(err, errWrongPassword) {
+		return domain.ErrWrongPassword
+	}
+
+	return err
+}
+
+// fileKey derives the transformed key with the parameters in the header of the database.
+func fileKey(data, password []byte) ([]byte, error) {
+	_, fields, _, _, err := parseHeader(data)
+	if err != nil {
+		return nil, err
+	}
+
+	params, err := parseVariants((&container{fields: fields}).field(fieldKDF))
+	if err != nil {
+		return nil, err
+	}
+
+	return transformKey(compositeKey(password), params)
+}
+
+// create writes a new database protected by the password, with the same Argon2id parameters as
+// the other backends.
+func (r *Repository) create(password []byte) error {
+	salt := make([]byte, 32)
+	if _, err := rand.Read(salt); err != nil {
+		return fmt.Errorf("failed to generate salt: %s", err.Error())
+	}
+
+	params := r.kdf
+	kdf := variants{
+		{kind: variantByteArray, key: "$UUID", value: kdfArgon2id},
+		{kind: variantByteArray, key: "S", value: salt},
+		{kind: variantUInt32, key: "P", value: binary.LittleEndian.AppendUint32(nil, uint32(params.Threads))},
+		{kind: variantUInt64, key: "M", value: binary.LittleEndian.AppendUint64(nil, uint64(params.Memory)*1024)},
+		{kind: variantUInt64, key: "I", value: binary.LittleEndian.AppendUint64(nil, uint64(params.Time))},
+		{kind: variantUInt32, key: "V", value: binary.LittleEndian.AppendUint32(nil, argon2Version)},
+	}
+
+	transformedKey, err := transformKey(compositeKey(password), kdf)
+	if err != nil {
+		return err
+	}
+
+	r.file = &container{
+		version: version4,
+		fields: []field{
+			{id: fieldCipherID, data: cipherAES256},
+			{id: fieldCompression, data: binary.LittleEndian.AppendUint32(nil, compressionGzip)},
+			{id: fieldMasterSeed, data: make([]byte, 32)},
+			{id: fieldIV, data: make([]byte, 16)},
+			{id: fieldKDF, data: kdf.bytes()},
+		},
+	}
+	r.document = newDocument()
+	r.transformedKey = transformedKey
+	r.dirty = true
+
+	err = r.Flush()
+	if err != nil {
+		r.file = nil
+		r.document = nil
+		r.transformedKey = nil
+
+		return err
+	}
+
+	return nil
+}
+
+func (r *Repository) Close() error {
+	if r.file == nil {
+		return nil
+	}
+
+	err := r.Flush()
+	if err != nil {
+		return err
+	}
+
+	r.file = nil
+	r.document = nil
+	r.transformedKey = nil
+
+	return nil
+}
+
+// Flush writes the whole database if it changed since the last flush.
+func (r *Repository) Flush() error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if !r.dirty {
+		return nil
+	}
+
+	err := r.file.resetStream()
+	if err != nil {
+		return fmt.Errorf("failed to generate inner stream key: %s", err.Error())
+	}
+
+	r.file.xml, err = marshalXML(r.document, r.file.stream)
+	if err != nil {
+		return err
+	}
+
+	data, err := r.file.encrypt(r.transformedKey)
+	secmem.Zero(r.file.xml)
+	r.file.xml = nil
+	if err != nil {
+		return fmt.Errorf("failed to encrypt database: %s", err.Error())
+	}
+
+	err = disk.WriteFile(r.path, data, 0600)
+	if err != nil {
+		return err
+	}
+
+	r.dirty = false
+
+	return nil
+}
+
+// Snapshot returns the database file with every change written.
+func (r *Repository) Snapshot() ([]byte, error) {
+	err := r.Flush()
+	if err != nil {
+		return nil, err
+	}
+
+	return os.ReadFile(r.path)
+}
+
+// Restore replaces the database file while the repository is closed.
+func (r *Repository) Restore(data []byte) error {
+	if r.file != nil {
+		return fmt.Errorf("database is open")
+	}
+
+	return disk.WriteFile(r.path, data, 0600)
+}
+
+func (r *Repository) ReadOnly() bool {
+	return false
+}
+
+func (r *Repository) GetAll() (domain.Storage, error) {
+	return r.get(func(domain.Service) bool { return true }), nil
+}
+
+func (r *Repository) GetByType(recordType string) (domain.Storage, error) {
+	return r.get(func(service domain.Service) bool { return service.Type == recordType }), nil
+}
+
+func (r *Repository) GetFavorites() (domain.Storage, error) {
+	return r.get(func(service domain.Service) bool { return service.Favorite }), nil
+}
+
+func (r *Repository) get(match func(service domain.Service) bool) domain.Storage {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+
+	storage := make(domain.Storage)
+
+	for _, group := range r.groups() {
+		name := group.childText("Name")
+		if _, ok := storage[name]; ok {
+			continue
+		}
+
+		service := domain.Service{
+			Type:     customData(group, customType),
+			Favorite: customData(group, customFavorite) == "true",
+		}
+		if !match(service) {
+			continue
+		}
+
+		for _, entry := range group.childrenNamed("Entry") {
+			login := entryString(entry, fieldUserName)
+			if login == "" {
+				continue
+			}
+
+			if service.Elements == nil {
+				service.Elements = make(map[string]domain.Element)
+			}
+
+			if _, ok := service.Elements[login]; ok {
+				continue
+			}
+
+			service.Elements[login] = domain.Element{
+				Password:    domain.NewSecret(entrySecret(entry, fieldPassword)),
+				Description: entryString(entry, fieldTitle),
+				Additional:  entryString(entry, fieldNotes),
+			}
+		}
+
+		storage[name] = service
+	}
+
+	return storage
+}
+
+// Apply changes the document, it reports false when the service or login the operation refers to
+// does not exist or already exists.
+func (r *Repository) Apply(op domain.Operation) (bool, error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	root := r.rootGroup()
+	if root == nil {
+		return false, fmt.Errorf("%w: root group is missing", errCorrupted)
+	}
+
+	group := r.group(op.Service)
+	now := formatTime(time.Now())
+
+	switch op.Op {
+	case domain.OpAppendService:
+		if group != nil {
+			return false, nil
+		}
+
+		group = newGroup(op.Service, now)
+		setCustomData(group, customType, op.Type)
+		setCustomData(group, customFavorite, strconv.FormatBool(op.Favorite))
+		root.children = append(root.children, group)
+	case domain.OpUpdateService:
+		if group == nil {
+			return false, nil
+		}
+
+		setCustomData(group, customType, op.Type)
+		setCustomData(group, customFavorite, strconv.FormatBool(op.Favorite))
+		touch(group, now)
+	case domain.OpDeleteService:
+		if group == nil {
+			return false, nil
+		}
+
+		root.remove(group)
+		r.recordDeleted(group, now)
+	default:
+		if group == nil {
+			return false, nil
+		}
+
+		ok, err := r.applyLogin(group, op, now)
+		if !ok || err != nil {
+			return ok, err
+		}
+	}
+
+	r.dirty = true
+
+	return true, nil
+}
+
+func (r *Repository) applyLogin(group *node, op domain.Operation, now string) (bool, error) {
+	entry := findEntry(group, op.Login)
+
+	var elem domain.Element
+	if op.Element != nil {
+		elem = *op.Element
+	}
+
+	switch op.Op {
+	case domain.OpAppendLogin:
+		if entry != nil {
+			return false, nil
+		}
+
+		entry = newEntry(now)
+		r.setEntryString(entry, fieldTitle, elem.Description)
+		r.setEntryString(entry, fieldUserName, op.Login)
+		r.setEntrySecret(entry, fieldPassword, elem.Password)
+		r.setEntryString(entry, fieldURL, "")
+		r.setEntryString(entry, fieldNotes, elem.Additional)
+		entry.children = append(entry.children, newNode("AutoType",
+			newLeaf("Enabled", "True"),
+			newLeaf("DataTransferObfuscation", "0"),
+		), newNode("History"))
+
+		insertEntry(group, entry)
+	case domain.OpUpdateLogin:
+		if entry == nil {
+			return false, nil
+		}
+
+		r.pushHistory(entry)
+		r.setEntryString(entry, fieldTitle, elem.Description)
+		r.setEntrySecret(entry, fieldPassword, elem.Password)
+		r.setEntryString(entry, fieldNotes, elem.Additional)
+		touch(entry, now)
+	case domain.OpDeleteLogin:
+		if entry == nil {
+			return false, nil
+		}
+
+		group.remove(entry)
+		r.recordDeleted(entry, now)
+	default:
+		return false, fmt.Errorf("unknown operation %q", op.Op)
+	}
+
+	return true, nil
+}
+
+func (r *Repository) rootGroup() *node {
+	return r.document.path("Root", "Group")
+}
+
+// groups returns the groups that represent services, the recycle bin is not one of them.
+func (r *Repository) groups() []*node {
+	root := r.rootGroup()
+	if root == nil {
+		return nil
+	}
+
+	recycleBin := ""
+	if r.meta("RecycleBinEnabled") == "True" {
+		recycleBin = r.meta("RecycleBinUUID")
+	}
+
+	var groups []*node
+
+	for _, group := range root.childrenNamed("Group") {
+		if recycleBin != "" && group.childText("UUID") == recycleBin {
+			continue
+		}
+
+		groups = append(groups, group)
+	}
+
+	return groups
+}
+
+func (r *Repository) meta(name string) string {
+	meta := r.document.child("Meta")
+	if meta == nil {
+		return ""
+	}
+
+	return meta.childText(name)
+}
+
+func (r *Repository) group(name string) *node {
+	for _, group := range r.groups() {
+		if group.childText("Name") == name {
+			return group
+		}
+	}
+
+	return nil
+}
+
+// setEntryString sets a standard field.
+func (r *Repository) setEntryString(entry *node, key, value string) {
+	n := r.entryValue(entry, key)
+	if n.protected() {
+		n.text = ""
+		n.secret = secmem.CopyBuffer([]byte(value))
+
+		return
+	}
+
+	n.text = value
+	n.secret = nil
+}
+
+// setEntrySecret sets a standard field without passing the value through a string.
+func (r *Repository) setEntrySecret(entry *node, key string, value domain.Secret) {
+	n := r.entryValue(entry, key)
+	n.text = ""
+	n.secret = secmem.CopyBuffer(value.Bytes())
+	runtime.KeepAlive(value)
+}
+
+// entryValue returns the value node of a standard field, adding the field if needed and protecting
+// it as the database settings ask for.
+func (r *Repository) entryValue(entry *node, key string) *node {
+	for _, s := range entry.childrenNamed("String") {
+		if s.childText("Key") == key {
+			value := s.child("Value")
+			if value == nil {
+				value = newLeaf("Value", "")
+				s.children = append(s.children, value)
+			}
+
+			return value
+		}
+	}
+
+	valueNode := newLeaf("Value", "")
+
+	protect := r.document.path("Meta", "MemoryProtection", "Protect"+key)
+	if protect != nil && protect.text == "True" || protect == nil && key == fieldPassword {
+		valueNode.setAttr("Protected", "True")
+	}
+
+	s := newNode("String", newLeaf("Key", key), valueNode)
+
+	// strings go right after the times, before AutoType and History
+	for i, c := range entry.children {
+		if c.name == "AutoType" || c.name == "History" {
+			entry.children = append(entry.children[:i], append([]*node{s}, entry.children[i:]...)...)
+
+			return valueNode
+		}
+	}
+
+	entry.children = append(entry.children, s)
+
+	return valueNode
+}
+
+// pushHistory keeps a copy of the entry before it is changed, as KeePass does.
+func (r *Repository) pushHistory(entry *node) {
+	history := entry.child("History")
+	if history == nil {
+		history = newNode("History")
+		entry.children = append(entry.children, history)
+	}
+
+	snapshot := &node{name: entry.name, attrs: entry.attrs}
+	for _, c := range entry.children {
+		if c.name != "History" {
+			snapshot.children = append(snapshot.children, c.clone())
+		}
+	}
+
+	history.children = append(history.children, snapshot)
+
+	maxItems := defaultHistoryItems
+	if n, err := strconv.Atoi(r.meta("HistoryMaxItems")); err == nil {
+		maxItems = n
+	}
+
+	if maxItems >= 0 && len(history.children) > maxItems {
+		history.children = history.children[len(history.children)-maxItems:]
+	}
+}
+
+// recordDeleted lists the removed group or entry and everything in it as deleted objects, so
+// synchronizing with another copy of the database doesn't bring them back.
+func (r *Repository) recordDeleted(n *node, now string) {
+	root := r.document.child("Root")
+
+	deleted := root.child("DeletedObjects")
+	if deleted == nil {
+		deleted = newNode("DeletedObjects")
+		root.children = append(root.children, deleted)
+	}
+
+	var add func(n *node)
+	add = func(n *node) {
+		deleted.children = append(deleted.children, newNode("DeletedObject",
+			newLeaf("UUID", n.childText("UUID")),
+			newLeaf("DeletionTime", now),
+		))
+
+		for _, c := range n.children {
+			if c.name == "Group" || c.name == "Entry" {
+				add(c)
+			}
+		}
+	}
+
+	add(n)
+}
+
+func findEntry(group *node, login string) *node {
+	for _, entry := range group.childrenNamed("Entry") {
+		if entryString(entry, fieldUserName) == login {
+			return entry
+		}
+	}
+
+	return nil
+}
+
+// insertEntry adds the entry after the other entries of the group, before its subgroups.
+func insertEntry(group *node, entry *node) {
+	for i, c := range group.children {
+		if c.name == "Group" {
+			group.children = append(group.children[:i], append([]*node{entry}, group.children[i:]...)...)
+
+			return
+		}
+	}
+
+	group.children = append(group.children, entry)
+}
+
+// entryString returns a standard field that is not a secret.
+func entryString(entry *node, key string) string {
+	return string(entrySecret(entry, key))
+}
+
+// entrySecret returns a standard field that may be protected, the bytes belong to the document.
+func entrySecret(entry *node, key string) []byte {
+	for _, s := range entry.childrenNamed("String") {
+		if s.childText("Key") != key {
+			continue
+		}
+
+		value := s.child("Value")
+		if value == nil {
+			return nil
+		}
+
+		if value.secret != nil {
+			return value.secret.Bytes()
+		}
+
+		return []byte(value.text)
+	}
+
+	return nil
+}
+
+func customData(n *node, key string) string {
+	data := n.child("CustomData")
+	if data == nil {
+		return ""
+	}
+
+	for _, item := range data.childrenNamed("Item") {
+		if item.childText("Key") == key {
+			return item.childText("Value")
+		}
+	}
+
+	return ""
+}
+
+func setCustomData(n *node, key, value string) {
+	data := n.child("CustomData")
+	if data == nil {
+		data = newNode("CustomData")
+
+		// custom data comes before the entries and subgroups
+		i := 0
+		for i < len(n.children) && n.children[i].name != "Entry" && n.children[i].name != "Group" {
+			i++
+		}
+
+		n.children = append(n.children[:i], append([]*node{data}, n.children[i:]...)...)
+	}
+
+	for _, item := range data.childrenNamed("Item") {
+		if item.childText("Key") == key {
+			item.setChild("Value", value)
+
+			return
+		}
+	}
+
+	data.children = append(data.children, newNode("Item", newLeaf("Key", key), newLeaf("Value", value)))
+}
+
+func touch(n *node, now string) {
+	times := n.child("Times")
+	if times == nil {
+		return
+	}
+
+	times.setChild("LastModificationTime", now)
+}
+
+func newUUID() string {
+	uuid := make([]byte, 16)
+	rand.Read(uuid)
+
+	return base64.StdEncoding.EncodeToString(uuid)
+}
+
+func formatTime(t time.Time) string {
+	return base64.StdEncoding.EncodeToString(binary.LittleEndian.AppendUint64(nil, uint64(t.Unix()-timeEpoch)))
+}
+
+func newTimes(now string) *node {
+	return newNode("Times",
+		newLeaf("LastModificationTime", now),
+		newLeaf("CreationTime", now),
+		newLeaf("LastAccessTime", now),
+		newLeaf("ExpiryTime", now),
+		newLeaf("Expires", "False"),
+		newLeaf("UsageCount", "0"),
+		newLeaf("LocationChanged", now),
+	)
+}
+
+func newGroup(name, now string) *node {
+	return newNode("Group",
+		newLeaf("UUID", newUUID()),
+		newLeaf("Name", name),
+		newLeaf("Notes", ""),
+		newLeaf("IconID", groupIcon),
+		newTimes(now),
+		newLeaf("IsExpanded", "True"),
+		newLeaf("DefaultAutoTypeSequence", ""),
+		newLeaf("EnableAutoType", "null"),
+		newLeaf("EnableSearching", "null"),
+		newLeaf("LastTopVisibleEntry", emptyUUID),
+	)
+}
+
+func newEntry(now string) *node {
+	return newNode("Entry",
+		newLeaf("UUID", newUUID()),
+		newLeaf("IconID", "0"),
+		newLeaf("ForegroundColor", ""),
+		newLeaf("BackgroundColor", ""),
+		newLeaf("OverrideURL", ""),
+		newLeaf("Tags", ""),
+		newTimes(now),
+	)
+}
+
+func newDocument() *node {
+	now := formatTime(time.Now())
+
+	root := newGroup("Root", now)
+	root.setChild("IconID", "49")
+
+	return newNode("KeePassFile",
+		newNode("Meta",
+			newLeaf("Generator", "manager"),
+			newLeaf("DatabaseName", "manager"),
+			newLeaf("DatabaseNameChanged", now),
+			newLeaf("DatabaseDescription", ""),
+			newLeaf("DatabaseDescriptionChanged", now),
+			newLeaf("DefaultUserName", ""),
+			newLeaf("DefaultUserNameChanged", now),
+			newLeaf("MaintenanceHistoryDays", "365"),
+			newLeaf("Color", ""),
+			newLeaf("MasterKeyChanged", now),
+			newLeaf("MasterKeyChangeRec", "-1"),
+			newLeaf("MasterKeyChangeForce", "-1"),
+			newNode("MemoryProtection",
+				newLeaf("ProtectTitle", "False"),
+				newLeaf("ProtectUserName", "False"),
+				newLeaf("ProtectPassword", "True"),
+				newLeaf("ProtectURL", "False"),
+				newLeaf("ProtectNotes", "False"),
+			),
+			newLeaf("RecycleBinEnabled", "False"),
+			newLeaf("RecycleBinUUID", emptyUUID),
+			newLeaf("RecycleBinChanged", now),
+			newLeaf("EntryTemplatesGroup", emptyUUID),
+			newLeaf("EntryTemplatesGroupChanged", now),
+			newLeaf("HistoryMaxItems", strconv.Itoa(defaultHistoryItems)),
+			newLeaf("HistoryMaxSize", "6291456"),
+			newLeaf("LastSelectedGroup", emptyUUID),
+			newLeaf("LastTopVisibleGroup", emptyUUID),
+		),
+		newNode("Root",
+			root,
+			newNode("DeletedObjects"),
+		),
+	)
+}
@@ -0,0 +1,329 @@
+package kdbx
+
+import (
+	"encoding/binary"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"manager/internal/backend/backendtest"
+	"manager/internal/domain"
+	"manager/internal/vault"
+)
+
+// The fixtures in testdata are written by fixture.py from the file format specification, not by
+// this package. Their password is fixturePassword.
+const fixturePassword = "correct horse"
+
+var fixtures = []string{"argon2d-chacha20.kdbx", "aeskdf-aes256.kdbx"}
+
+var testKDF = vault.KDFParams{Time: 1, Memory: 64, Threads: 1}
+
+func TestConformance(t *testing.T) {
+	backendtest.Run(t, func(path string) backendtest.Repository {
+		return New(path, testKDF)
+	})
+}
+
+// openFixture opens a copy of a fixture, so it can be changed.
+func openFixture(t *testing.T, name string) (*Repository, string) {
+	t.Helper()
+
+	data, err := os.ReadFile(filepath.Join("testdata", name))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	path := filepath.Join(t.TempDir(), name)
+
+	err = os.WriteFile(path, data, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := New(path, testKDF)
+
+	err = r.Check()
+	if err == nil {
+		err = r.Open([]byte(fixturePassword))
+	}
+	if err != nil {
+		t.Fatalf("Open %s: %s", name, err)
+	}
+
+	t.Cleanup(func() {
+		r.Close()
+	})
+
+	return r, path
+}
+
+func checkLogin(t *testing.T, storage domain.Storage, service, login, password, description, additional string) {
+	t.Helper()
+
+	elem, ok := storage[service].Elements[login]
+	if !ok {
+		t.Fatalf("%s/%s is missing", service, login)
+	}
+
+	if string(elem.Password.Bytes()) != password || elem.Description != description || elem.Additional != additional {
+		t.Fatalf("%s/%s: got %q %q %q", service, login, elem.Password.Bytes(), elem.Description, elem.Additional)
+	}
+}
+
+func TestReadFixture(t *testing.T) {
+	for _, name := range fixtures {
+		t.Run(name, func(t *testing.T) {
+			r, _ := openFixture(t, name)
+
+			storage, err := r.GetAll()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// groups below the root are services, the recycle bin is not
+			if len(storage) != 2 {
+				t.Fatalf("got services %v", storage)
+			}
+
+			mail := storage["mail"]
+			if mail.Type != "password" || !mail.Favorite || len(mail.Elements) != 2 {
+				t.Fatalf("mail: %+v", mail)
+			}
+
+			checkLogin(t, storage, "mail", "alice", "pässwörd", "work mail", "first line\nsecond line")
+			checkLogin(t, storage, "mail", "bob", "two", "", "")
+
+			// a group made in KeePassXC has no record type
+			bank := storage["bank"]
+			if bank.Type != "" || bank.Favorite {
+				t.Fatalf("bank: %+v", bank)
+			}
+
+			checkLogin(t, storage, "bank", "visa", "1234", "", "")
+
+			favorites, err := r.GetFavorites()
+			if err != nil || len(favorites) != 1 {
+				t.Fatalf("favorites: %v, %v", favorites, err)
+			}
+		})
+	}
+}
+
+func TestFixtureWrongPassword(t *testing.T) {
+	for _, name := range fixtures {
+		err := New(filepath.Join("testdata", name), testKDF).Open([]byte("guess"))
+		if !errors.Is(err, domain.ErrWrongPassword) {
+			t.Fatalf("%s: got %v, want ErrWrongPassword", name, err)
+		}
+	}
+}
+
+// Protected values and passwords are kept in locked memory, never as text of the document.
+func TestPasswordsStayOutOfStrings(t *testing.T) {
+	r, _ := openFixture(t, fixtures[0])
+
+	_, err := r.Apply(domain.Operation{Op: domain.OpUpdateLogin, Service: "mail", Login: "alice", Element: &domain.Element{Password: domain.NewSecret([]byte("new"))}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r.document.walk(func(n *node) error {
+		if n.protected() && n.text != "" {
+			t.Errorf("a protected value is held as text")
+		}
+
+		return nil
+	})
+
+	alice := findEntry(r.group("mail"), "alice")
+	if string(entrySecret(alice, fieldPassword)) != "new" || entryValueText(alice, fieldPassword) != "" {
+		t.Fatal("the new password is not held in locked memory")
+	}
+}
+
+// entryValueText returns the text of a standard field as the document holds it.
+func entryValueText(entry *node, key string) string {
+	for _, s := range entry.childrenNamed("String") {
+		if s.childText("Key") == key {
+			return s.childText("Value")
+		}
+	}
+
+	return ""
+}
+
+// Saving a file written elsewhere keeps everything the manager does not use.
+func TestFixtureRoundTrip(t *testing.T) {
+	for _, name := range fixtures {
+		t.Run(name, func(t *testing.T) {
+			r, path := openFixture(t, name)
+
+			for _, op := range []domain.Operation{
+				{Op: domain.OpUpdateLogin, Service: "mail", Login: "alice", Element: &domain.Element{Password: domain.NewSecret([]byte("new")), Description: "work mail"}},
+				{Op: domain.OpAppendLogin, Service: "bank", Login: "master", Element: &domain.Element{Password: domain.NewSecret([]byte("5678"))}},
+				{Op: domain.OpAppendService, Service: "shop", Type: "password"},
+			} {
+				ok, err := r.Apply(op)
+				if err != nil || !ok {
+					t.Fatalf("Apply %s: %v, %v", op.Op, ok, err)
+				}
+			}
+
+			err := r.Close()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			err = r.Open([]byte(fixturePassword))
+			if err != nil {
+				t.Fatalf("reopen: %s", err)
+			}
+
+			storage, err := r.GetAll()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			checkLogin(t, storage, "mail", "alice", "new", "work mail", "")
+			checkLogin(t, storage, "mail", "bob", "two", "", "")
+			checkLogin(t, storage, "bank", "master", "5678", "", "")
+
+			if _, ok := storage["shop"]; !ok || len(storage) != 3 {
+				t.Fatalf("got services %v", storage)
+			}
+
+			if got := r.meta("Generator"); got != "KeePassXC" {
+				t.Fatalf("generator changed to %q", got)
+			}
+
+			mail := r.group("mail")
+
+			nested := mail.child("Group")
+			if nested == nil || nested.childText("Name") != "nested" || string(entrySecret(nested.child("Entry"), fieldPassword)) != "three" {
+				t.Fatal("the nested group was lost")
+			}
+
+			alice := findEntry(mail, "alice")
+
+			if entryString(alice, "PIN") != "4321" {
+				t.Fatalf("the custom field was lost: %q", entryString(alice, "PIN"))
+			}
+
+			if alice.child("Binary") == nil || len(r.file.binaries) != 1 || string(r.file.binaries[0]) != "\x00attached file\n" {
+				t.Fatal("the attachment was lost")
+			}
+
+			history := alice.path("History")
+			if history == nil || len(history.childrenNamed("Entry")) != 2 {
+				t.Fatal("the entry history was not kept")
+			}
+
+			for i, want := range []string{"old password", "pässwörd"} {
+				if got := string(entrySecret(history.childrenNamed("Entry")[i], fieldPassword)); got != want {
+					t.Fatalf("history item %d holds %q, want %q", i, got, want)
+				}
+			}
+
+			root := r.rootGroup()
+			if findEntry(root, "dave") == nil {
+				t.Fatal("the entry in the root group was lost")
+			}
+
+			var recycleBin bool
+			for _, group := range root.childrenNamed("Group") {
+				recycleBin = recycleBin || group.childText("Name") == "Recycle Bin" && findEntry(group, "mallory") != nil
+			}
+
+			if !recycleBin {
+				t.Fatal("the recycle bin was lost")
+			}
+
+			// the file is rewritten with the parameters it came with
+			data, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			_, fields, _, _, err := parseHeader(data)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			original, err := os.ReadFile(filepath.Join("testdata", name))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			_, originalFields, _, _, err := parseHeader(original)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			for _, id := range []byte{fieldCipherID, fieldCompression, fieldKDF} {
+				file := &container{fields: fields}
+				if string(file.field(id)) != string((&container{fields: originalFields}).field(id)) {
+					t.Fatalf("header field %d changed", id)
+				}
+			}
+		})
+	}
+}
+
+func TestTampered(t *testing.T) {
+	data, err := os.ReadFile(filepath.Join("testdata", fixtures[0]))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, offset := range []int{20, len(data) - 50} {
+		tampered := append([]byte(nil), data...)
+		tampered[offset] ^= 1
+
+		path := filepath.Join(t.TempDir(), "tampered.kdbx")
+
+		err = os.WriteFile(path, tampered, 0600)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = New(path, testKDF).Open([]byte(fixturePassword))
+		if !errors.Is(err, errCorrupted) {
+			t.Fatalf("byte %d flipped: got %v, want errCorrupted", offset, err)
+		}
+	}
+}
+
+func TestArgon2Bounds(t *testing.T) {
+	params := func(iterations, memory uint64, parallelism uint32) variants {
+		return variants{
+			{kind: variantByteArray, key: "$UUID", value: kdfArgon2d},
+			{kind: variantByteArray, key: "S", value: make([]byte, 32)},
+			{kind: variantUInt32, key: "P", value: binary.LittleEndian.AppendUint32(nil, parallelism)},
+			{kind: variantUInt64, key: "M", value: binary.LittleEndian.AppendUint64(nil, memory)},
+			{kind: variantUInt64, key: "I", value: binary.LittleEndian.AppendUint64(nil, iterations)},
+		}
+	}
+
+	tests := map[string]variants{
+		"zero iterations":    params(0, 64*1024, 1),
+		"huge iterations":    params(1<<40, 64*1024, 1),
+		"zero parallelism":   params(1, 64*1024, 0),
+		"memory below lanes": params(1, 8*1024, 4),
+		"huge memory":        params(1, 1<<40, 1),
+		"memory overflow":    params(1, 1<<52, 1),
+	}
+
+	for name, kdf := range tests {
+		_, err := transformKey(compositeKey([]byte("secret")), kdf)
+		if !errors.Is(err, errCorrupted) {
+			t.Fatalf("%s: got %v, want errCorrupted", name, err)
+		}
+	}
+
+	_, err := transformKey(compositeKey([]byte("secret")), params(1, 64*1024, 2))
+	if err != nil {
+		t.Fatalf("valid parameters: %s", err)
+	}
+}
@@ -0,0 +1,138 @@
+"""Argon2d (RFC 9106, version 0x13) in plain Python, for writing the test fixtures."""
+
+import hashlib
+import struct
+
+MASK = (1 << 64) - 1
+
+
+def le32(n):
+    return struct.pack("<I", n)
+
+
+def blake2b_long(length, data):
+    if length <= 64:
+        return hashlib.blake2b(le32(length) + data, digest_size=length).digest()
+
+    out = b""
+    v = hashlib.blake2b(le32(length) + data, digest_size=64).digest()
+    out += v[:32]
+    for _ in range((length + 31) // 32 - 3):
+        v = hashlib.blake2b(v, digest_size=64).digest()
+        out += v[:32]
+    rest = length - len(out)
+    return out + hashlib.blake2b(v, digest_size=rest).digest()
+
+
+def rotr(x, n):
+    return ((x >> n) | (x << (64 - n))) & MASK
+
+
+def gb(v, a, b, c, d):
+    def f(x, y):
+        return (x + y + 2 * (x & 0xFFFFFFFF) * (y & 0xFFFFFFFF)) & MASK
+
+    v[a] = f(v[a], v[b])
+    v[d] = rotr(v[d] ^ v[a], 32)
+    v[c] = f(v[c], v[d])
+    v[b] = rotr(v[b] ^ v[c], 24)
+    v[a] = f(v[a], v[b])
+    v[d] = rotr(v[d] ^ v[a], 16)
+    v[c] = f(v[c], v[d])
+    v[b] = rotr(v[b] ^ v[c], 63)
+
+
+def permute(v, idx):
+    w = [v[i] for i in idx]
+    gb(w, 0, 4, 8, 12)
+    gb(w, 1, 5, 9, 13)
+    gb(w, 2, 6, 10, 14)
+    gb(w, 3, 7, 11, 15)
+    gb(w, 0, 5, 10, 15)
+    gb(w, 1, 6, 11, 12)
+    gb(w, 2, 7, 8, 13)
+    gb(w, 3, 4, 9, 14)
+    for i, k in enumerate(idx):
+        v[k] = w[i]
+
+
+def compress(x, y):
+    r = [a ^ b for a, b in zip(x, y)]
+    q = list(r)
+    for row in range(8):
+        permute(q, list(range(16 * row, 16 * row + 16)))
+    for col in range(8):
+        idx = []
+        for row in range(8):
+            idx += [16 * row + 2 * col, 16 * row + 2 * col + 1]
+        permute(q, idx)
+    return [a ^ b for a, b in zip(q, r)]
+
+
+def to_words(data):
+    return list(struct.unpack("<128Q", data))
+
+
+def argon2d(password, salt, time, memory, lanes, length, secret=b"", data=b""):
+    h0 = hashlib.blake2b(
+        le32(lanes) + le32(length) + le32(memory) + le32(time) + le32(0x13) + le32(0)
+        + le32(len(password)) + password + le32(len(salt)) + salt
+        + le32(len(secret)) + secret + le32(len(data)) + data,
+        digest_size=64,
+    ).digest()
+
+    memory = max(memory, 8 * lanes) // (4 * lanes) * (4 * lanes)
+    lane_length = memory // lanes
+    segment_length = lane_length // 4
+
+    blocks = [[None] * lane_length for _ in range(lanes)]
+    for lane in range(lanes):
+        for i in range(2):
+            blocks[lane][i] = to_words(blake2b_long(1024, h0 + le32(i) + le32(lane)))
+
+    for n in range(time):
+        for s in range(4):
+            for lane in range(lanes):
+                start = 2 if n == 0 and s == 0 else 0
+                for i in range(start, segment_length):
+                    index = s * segment_length + i
+                    prev = blocks[lane][index - 1 if index > 0 else lane_length - 1]
+
+                    j1 = prev[0] & 0xFFFFFFFF
+                    j2 = prev[0] >> 32
+
+                    ref_lane = lane if n == 0 and s == 0 else j2 % lanes
+                    same = ref_lane == lane
+
+                    if n == 0:
+                        if s == 0:
+                            area = i - 1
+                        elif same:
+                            area = s * segment_length + i - 1
+                        else:
+                            area = s * segment_length - (1 if i == 0 else 0)
+                    elif same:
+                        area = lane_length - segment_length + i - 1
+                    else:
+                        area = lane_length - segment_length - (1 if i == 0 else 0)
+
+                    rel = area - 1 - ((area * ((j1 * j1) >> 32)) >> 32)
+                    begin = 0 if n == 0 or s == 3 else (s + 1) * segment_length
+                    ref = blocks[ref_lane][(begin + rel) % lane_length]
+
+                    new = compress(prev, ref)
+                    if n > 0:
+                        new = [a ^ b for a, b in zip(new, blocks[lane][index])]
+                    blocks[lane][index] = new
+
+    final = blocks[0][lane_length - 1]
+    for lane in range(1, lanes):
+        final = [a ^ b for a, b in zip(final, blocks[lane][lane_length - 1])]
+
+    return blake2b_long(length, struct.pack("<128Q", *final))
+
+
+if __name__ == "__main__":
+    tag = argon2d(b"\x01" * 32, b"\x02" * 16, 3, 32, 4, 32, b"\x03" * 8, b"\x04" * 12)
+    assert tag.hex() == "512b391b6f1162975371d3091973429" "4f868e3be3984f3c1a13a4db9fabe4acb", tag.hex()
+    print("RFC 9106 Argon2d test vector ok")
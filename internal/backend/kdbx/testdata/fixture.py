@@ -0,0 +1,251 @@
+"""Writes the KDBX 4 test fixtures from the KeePass file format specification, independently of the
+Go code, so the reader is checked against a file it did not write.
+
+    python3 fixture.py
+
+needs only the Python standard library, and the openssl command for AES.
+"""
+
+import base64
+import gzip
+import hashlib
+import hmac
+import struct
+import subprocess
+
+from argon2d import argon2d
+
+PASSWORD = b"correct horse"
+
+CIPHER_AES256 = bytes.fromhex("31c1f2e6bf714350be5805216afc5aff")
+CIPHER_CHACHA20 = bytes.fromhex("d6038a2b8b6f4cb5a524339a31dbb59a")
+KDF_AES = bytes.fromhex("7c02bb8279a74ac0927d114a00648238")
+KDF_ARGON2D = bytes.fromhex("ef636ddf8c29444b91f7a9a403e30a0c")
+
+# fixed, so the fixtures are reproducible
+MASTER_SEED = bytes(range(32))
+SALT = bytes(range(100, 132))
+INNER_KEY = bytes(range(64))
+
+
+def chacha20(key, nonce, data):
+    def rotl(x, n):
+        return ((x << n) | (x >> (32 - n))) & 0xFFFFFFFF
+
+    def quarter(s, a, b, c, d):
+        s[a] = (s[a] + s[b]) & 0xFFFFFFFF
+        s[d] = rotl(s[d] ^ s[a], 16)
+        s[c] = (s[c] + s[d]) & 0xFFFFFFFF
+        s[b] = rotl(s[b] ^ s[c], 12)
+        s[a] = (s[a] + s[b]) & 0xFFFFFFFF
+        s[d] = rotl(s[d] ^ s[a], 8)
+        s[c] = (s[c] + s[d]) & 0xFFFFFFFF
+        s[b] = rotl(s[b] ^ s[c], 7)
+
+    out = bytearray()
+    for counter in range((len(data) + 63) // 64):
+        state = [0x61707865, 0x3320646E, 0x79622D32, 0x6B206574]
+        state += list(struct.unpack("<8I", key)) + [counter] + list(struct.unpack("<3I", nonce))
+        s = list(state)
+        for _ in range(10):
+            quarter(s, 0, 4, 8, 12)
+            quarter(s, 1, 5, 9, 13)
+            quarter(s, 2, 6, 10, 14)
+            quarter(s, 3, 7, 11, 15)
+            quarter(s, 0, 5, 10, 15)
+            quarter(s, 1, 6, 11, 12)
+            quarter(s, 2, 7, 8, 13)
+            quarter(s, 3, 4, 9, 14)
+        stream = struct.pack("<16I", *[(a + b) & 0xFFFFFFFF for a, b in zip(s, state)])
+        chunk = data[64 * counter:64 * counter + 64]
+        out += bytes(a ^ b for a, b in zip(chunk, stream))
+    return bytes(out)
+
+
+def openssl_aes(mode, key, data, iv=None):
+    args = ["openssl", "enc", "-" + mode, "-K", key.hex()]
+    if iv is not None:
+        args += ["-iv", iv.hex()]
+    else:
+        args += ["-nopad"]
+    return subprocess.run(args, input=data, capture_output=True, check=True).stdout
+
+
+class InnerStream:
+    def __init__(self, key):
+        digest = hashlib.sha512(key).digest()
+        self.key, self.nonce = digest[:32], digest[32:44]
+        self.offset = 0
+
+    def protect(self, value):
+        data = value.encode()
+        # the keystream continues from value to value
+        stream = chacha20(self.key, self.nonce, bytes(self.offset + len(data)))[self.offset:]
+        self.offset += len(data)
+        return base64.b64encode(bytes(a ^ b for a, b in zip(data, stream))).decode()
+
+
+def variants(items):
+    out = struct.pack("<H", 0x0100)
+    for kind, key, value in items:
+        out += bytes([kind]) + struct.pack("<i", len(key)) + key.encode() + struct.pack("<i", len(value)) + value
+    return out + b"\x00"
+
+
+def field(kind, data):
+    return bytes([kind]) + struct.pack("<I", len(data)) + data
+
+
+def block_hmac(key, index, data):
+    block_key = hashlib.sha512(struct.pack("<Q", index) + key).digest()
+    if index == 0xFFFFFFFFFFFFFFFF:
+        return hmac.new(block_key, data, hashlib.sha256).digest()
+    return hmac.new(block_key, struct.pack("<QI", index, len(data)) + data, hashlib.sha256).digest()
+
+
+def uuid(n):
+    return base64.b64encode(bytes([n]) * 16).decode()
+
+
+def times():
+    t = base64.b64encode(struct.pack("<Q", 63_800_000_000)).decode()
+    return (f"<Times><LastModificationTime>{t}</LastModificationTime><CreationTime>{t}</CreationTime>"
+            f"<LastAccessTime>{t}</LastAccessTime><ExpiryTime>{t}</ExpiryTime><Expires>False</Expires>"
+            f"<UsageCount>0</UsageCount><LocationChanged>{t}</LocationChanged></Times>")
+
+
+def entry(stream, n, title, user, password, notes, extra=lambda: "", history=lambda: ""):
+    # extra and history are called in document order, after the password is protected
+    out = (f"<Entry><UUID>{uuid(n)}</UUID><IconID>0</IconID>{times()}"
+           f"<String><Key>Notes</Key><Value>{notes}</Value></String>"
+           f"<String><Key>Password</Key><Value Protected=\"True\">{stream.protect(password)}</Value></String>"
+           f"<String><Key>Title</Key><Value>{title}</Value></String>"
+           f"<String><Key>URL</Key><Value>https://example.com</Value></String>"
+           f"<String><Key>UserName</Key><Value>{user}</Value></String>")
+    out += extra()
+    out += "<AutoType><Enabled>True</Enabled><DataTransferObfuscation>0</DataTransferObfuscation></AutoType>"
+    out += history()
+    return out + "</Entry>"
+
+
+def document(stream):
+    # the order of the protected values in the document is the order of the inner stream
+    loose = entry(stream, 15, "loose", "dave", "four", "")
+    alice = entry(stream, 10, "work mail", "alice", "pässwörd", "first line&#10;second line",
+                  lambda: '<String><Key>PIN</Key><Value Protected="True">' + stream.protect("4321") + "</Value></String>"
+                  '<Binary><Key>key.txt</Key><Value Ref="0"/></Binary>',
+                  lambda: "<History>" + entry(stream, 10, "work mail", "alice", "old password", "") + "</History>")
+    bob = entry(stream, 11, "", "bob", "two", "")
+    nested = entry(stream, 12, "nested", "carol", "three", "")
+    card = entry(stream, 13, "", "visa", "1234", "")
+    deleted = entry(stream, 14, "", "mallory", "gone", "")
+
+    return f"""<?xml version="1.0" encoding="utf-8" standalone="yes"?>
+<KeePassFile>
+	<Meta>
+		<Generator>KeePassXC</Generator>
+		<DatabaseName>fixture</DatabaseName>
+		<MemoryProtection><ProtectTitle>False</ProtectTitle><ProtectUserName>False</ProtectUserName><ProtectPassword>True</ProtectPassword><ProtectURL>False</ProtectURL><ProtectNotes>False</ProtectNotes></MemoryProtection>
+		<CustomIcons/>
+		<RecycleBinEnabled>True</RecycleBinEnabled>
+		<RecycleBinUUID>{uuid(4)}</RecycleBinUUID>
+		<HistoryMaxItems>10</HistoryMaxItems>
+		<CustomData><Item><Key>KPXC_DECRYPTION_TIME_PREFERENCE</Key><Value>1000</Value></Item></CustomData>
+	</Meta>
+	<Root>
+		<Group>
+			<UUID>{uuid(1)}</UUID><Name>Root</Name><IconID>48</IconID>{times()}
+			{loose}
+			<Group>
+				<UUID>{uuid(2)}</UUID><Name>mail</Name><IconID>48</IconID>{times()}
+				<CustomData><Item><Key>manager.type</Key><Value>password</Value></Item><Item><Key>manager.favorite</Key><Value>true</Value></Item></CustomData>
+				{alice}
+				{bob}
+				<Group><UUID>{uuid(5)}</UUID><Name>nested</Name><IconID>48</IconID>{times()}{nested}</Group>
+			</Group>
+			<Group>
+				<UUID>{uuid(3)}</UUID><Name>bank</Name><IconID>48</IconID>{times()}
+				{card}
+			</Group>
+			<Group>
+				<UUID>{uuid(4)}</UUID><Name>Recycle Bin</Name><IconID>43</IconID>{times()}
+				{deleted}
+			</Group>
+		</Group>
+		<DeletedObjects/>
+	</Root>
+</KeePassFile>
+""".encode()
+
+
+def write(path, cipher, kdf, transform, compress):
+    composite = hashlib.sha256(hashlib.sha256(PASSWORD).digest()).digest()
+    transformed = transform(composite)
+
+    iv = bytes(range(200, 200 + (16 if cipher == CIPHER_AES256 else 12)))
+
+    header = struct.pack("<III", 0x9AA2D903, 0xB54BFB67, 0x00040001)
+    header += field(2, cipher)
+    header += field(3, struct.pack("<I", 1 if compress else 0))
+    header += field(4, MASTER_SEED)
+    header += field(7, iv)
+    header += field(11, kdf)
+    header += field(0, b"\r\n\r\n")
+
+    encryption_key = hashlib.sha256(MASTER_SEED + transformed).digest()
+    hmac_key = hashlib.sha512(MASTER_SEED + transformed + b"\x01").digest()
+
+    inner = field(1, struct.pack("<I", 3)) + field(2, INNER_KEY)
+    inner += field(3, b"\x00attached file\n")
+    inner += field(0, b"")
+    payload = inner + document(InnerStream(INNER_KEY))
+    if compress:
+        payload = gzip.compress(payload, mtime=0)
+
+    if cipher == CIPHER_AES256:
+        payload = openssl_aes("aes-256-cbc", encryption_key, payload, iv)
+    else:
+        payload = chacha20(encryption_key, iv, payload)
+
+    out = header + hashlib.sha256(header).digest() + block_hmac(hmac_key, 0xFFFFFFFFFFFFFFFF, header)
+    out += block_hmac(hmac_key, 0, payload) + struct.pack("<i", len(payload)) + payload
+    out += block_hmac(hmac_key, 1, b"") + struct.pack("<i", 0)
+
+    with open(path, "wb") as f:
+        f.write(out)
+
+
+def argon2d_kdf(iterations, memory, lanes):
+    params = variants([
+        (0x42, "$UUID", KDF_ARGON2D),
+        (0x42, "S", SALT),
+        (0x04, "P", struct.pack("<I", lanes)),
+        (0x05, "M", struct.pack("<Q", memory * 1024)),
+        (0x05, "I", struct.pack("<Q", iterations)),
+        (0x04, "V", struct.pack("<I", 0x13)),
+    ])
+    return params, lambda composite: argon2d(composite, SALT, iterations, memory, lanes, 32)
+
+
+def aes_kdf(rounds):
+    params = variants([
+        (0x42, "$UUID", KDF_AES),
+        (0x42, "S", SALT),
+        (0x05, "R", struct.pack("<Q", rounds)),
+    ])
+
+    def transform(composite):
+        key = composite
+        for _ in range(rounds):
+            key = openssl_aes("aes-256-ecb", SALT, key)
+        return hashlib.sha256(key).digest()
+
+    return params, transform
+
+
+if __name__ == "__main__":
+    params, transform = argon2d_kdf(2, 64, 2)
+    write("argon2d-chacha20.kdbx", CIPHER_CHACHA20, params, transform, True)
+
+    params, transform = aes_kdf(5)
+    write("aeskdf-aes256.kdbx", CIPHER_AES256, params, transform, False)
@@ -0,0 +1,111 @@
+package kdbx
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// Variant dictionary layout, used for the KDF parameters:
+//
+//	version (uint16) | items | 0
+//
+// where every item is its type (1 byte), key size (int32), key, value size (int32) and value.
+const (
+	variantsVersion = 0x0100
+
+	variantUInt32    = 0x04
+	variantUInt64    = 0x05
+	variantBool      = 0x08
+	variantInt32     = 0x0C
+	variantInt64     = 0x0D
+	variantString    = 0x18
+	variantByteArray = 0x42
+)
+
+type variant struct {
+	kind  byte
+	key   string
+	value []byte
+}
+
+type variants []variant
+
+func parseVariants(data []byte) (variants, error) {
+	if len(data) < 2 || binary.LittleEndian.Uint16(data)&0xFF00 != variantsVersion&0xFF00 {
+		return nil, fmt.Errorf("%w: invalid variant dictionary", errCorrupted)
+	}
+
+	data = data[2:]
+
+	var items variants
+
+	for {
+		if len(data) < 1 {
+			return nil, fmt.Errorf("%w: truncated variant dictionary", errCorrupted)
+		}
+
+		kind := data[0]
+		if kind == 0 {
+			return items, nil
+		}
+
+		if len(data) < 5 {
+			return nil, fmt.Errorf("%w: truncated variant dictionary", errCorrupted)
+		}
+
+		keySize := int(int32(binary.LittleEndian.Uint32(data[1:])))
+		data = data[5:]
+		if keySize < 0 || keySize+4 > len(data) {
+			return nil, fmt.Errorf("%w: truncated variant dictionary", errCorrupted)
+		}
+
+		key := string(data[:keySize])
+		valueSize := int(int32(binary.LittleEndian.Uint32(data[keySize:])))
+		data = data[keySize+4:]
+		if valueSize < 0 || valueSize > len(data) {
+			return nil, fmt.Errorf("%w: truncated variant dictionary", errCorrupted)
+		}
+
+		items = append(items, variant{kind: kind, key: key, value: data[:valueSize]})
+		data = data[valueSize:]
+	}
+}
+
+func (v variants) bytes() []byte {
+	out := binary.LittleEndian.AppendUint16(nil, variantsVersion)
+
+	for _, item := range v {
+		out = append(out, item.kind)
+		out = binary.LittleEndian.AppendUint32(out, uint32(len(item.key)))
+		out = append(out, item.key...)
+		out = binary.LittleEndian.AppendUint32(out, uint32(len(item.value)))
+		out = append(out, item.value...)
+	}
+
+	return append(out, 0)
+}
+
+func (v variants) get(key string) ([]byte, bool) {
+	for _, item := range v {
+		if item.key == key {
+			return item.value, true
+		}
+	}
+
+	return nil, false
+}
+
+func (v variants) uint(key string) (uint64, bool) {
+	value, ok := v.get(key)
+
+	switch {
+	case !ok:
+		return 0, false
+	case len(value) == 4:
+		return uint64(binary.LittleEndian.Uint32(value)), true
+	case len(value) == 8:
+		return binary.LittleEndian.Uint64(value), true
+	}
+
+	return 0, false
+}
@@ -0,0 +1,290 @@
+package kdbx
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"runtime"
+	"strings"
+
+	"golang.org/x/crypto/chacha20"
+
+	"manager/internal/secmem"
+)
+
+// node is an element of the KeePass XML document. The document is kept as a generic tree, so the
+// elements the manager doesn't know about survive a round-trip. KeePass never mixes text and child
+// elements, so an element has either text or children.
+type node struct {
+	name     string
+	attrs    []xml.Attr
+	children []*node
+	text     string
+
+	// secret holds the text of protected values and passwords instead of text, it is replaced and
+	// never changed in place, so clones share it
+	secret *secmem.Buffer
+}
+
+func newNode(name string, children ...*node) *node {
+	return &node{name: name, children: children}
+}
+
+func newLeaf(name, text string) *node {
+	return &node{name: name, text: text}
+}
+
+func (n *node) child(name string) *node {
+	for _, c := range n.children {
+		if c.name == name {
+			return c
+		}
+	}
+
+	return nil
+}
+
+func (n *node) childrenNamed(name string) []*node {
+	var nodes []*node
+
+	for _, c := range n.children {
+		if c.name == name {
+			nodes = append(nodes, c)
+		}
+	}
+
+	return nodes
+}
+
+// path follows the chain of first children with the given names, it returns nil if one is missing.
+func (n *node) path(names ...string) *node {
+	for _, name := range names {
+		if n == nil {
+			return nil
+		}
+
+		n = n.child(name)
+	}
+
+	return n
+}
+
+func (n *node) childText(name string) string {
+	c := n.child(name)
+	if c == nil {
+		return ""
+	}
+
+	return c.text
+}
+
+// setChild sets the text of the first child with the given name, appending the child if needed.
+func (n *node) setChild(name, text string) {
+	c := n.child(name)
+	if c == nil {
+		n.children = append(n.children, newLeaf(name, text))
+
+		return
+	}
+
+	c.text = text
+}
+
+func (n *node) clone() *node {
+	c := &node{
+		name:   n.name,
+		attrs:  append([]xml.Attr(nil), n.attrs...),
+		text:   n.text,
+		secret: n.secret,
+	}
+
+	for _, child := range n.children {
+		c.children = append(c.children, child.clone())
+	}
+
+	return c
+}
+
+func (n *node) remove(child *node) {
+	for i, c := range n.children {
+		if c == child {
+			n.children = append(n.children[:i], n.children[i+1:]...)
+
+			return
+		}
+	}
+}
+
+func (n *node) attr(name string) string {
+	for _, a := range n.attrs {
+		if a.Name.Local == name {
+			return a.Value
+		}
+	}
+
+	return ""
+}
+
+func (n *node) setAttr(name, value string) {
+	for i, a := range n.attrs {
+		if a.Name.Local == name {
+			n.attrs[i].Value = value
+
+			return
+		}
+	}
+
+	n.attrs = append(n.attrs, xml.Attr{Name: xml.Name{Local: name}, Value: value})
+}
+
+func (n *node) protected() bool {
+	return n.name == "Value" && strings.EqualFold(n.attr("Protected"), "True")
+}
+
+// walk visits the nodes in document order, which is the order of protected values in the stream.
+func (n *node) walk(visit func(*node) error) error {
+	err := visit(n)
+	if err != nil {
+		return err
+	}
+
+	for _, c := range n.children {
+		err = c.walk(visit)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// parseXML reads the document and decrypts the protected values with the inner stream.
+func parseXML(data []byte, stream *chacha20.Cipher) (*node, error) {
+	decoder := xml.NewDecoder(bytes.NewReader(data))
+
+	var root *node
+	var stack []*node
+
+	for {
+		token, err := decoder.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%w: invalid XML: %s", errCorrupted, err.Error())
+		}
+
+		switch t := token.(type) {
+		case xml.StartElement:
+			n := &node{name: t.Name.Local, attrs: t.Copy().Attr}
+
+			if len(stack) == 0 {
+				root = n
+			} else {
+				parent := stack[len(stack)-1]
+				parent.children = append(parent.children, n)
+			}
+
+			stack = append(stack, n)
+		case xml.EndElement:
+			stack = stack[:len(stack)-1]
+		case xml.CharData:
+			if len(stack) > 0 {
+				stack[len(stack)-1].text += string(t)
+			}
+		}
+	}
+
+	if root == nil || root.name != "KeePassFile" {
+		return nil, fmt.Errorf("%w: not a KeePass document", errCorrupted)
+	}
+
+	err := root.walk(func(n *node) error {
+		if len(n.children) > 0 {
+			n.text = ""
+		}
+
+		if !n.protected() {
+			return nil
+		}
+
+		// decrypted in locked memory only
+		decoded := secmem.NewBuffer(base64.StdEncoding.DecodedLen(len(n.text)))
+
+		size, err := base64.StdEncoding.Decode(decoded.Bytes(), []byte(n.text))
+		if err != nil {
+			return fmt.Errorf("%w: invalid protected value", errCorrupted)
+		}
+
+		value := decoded.Bytes()[:size]
+		stream.XORKeyStream(value, value)
+
+		n.secret = secmem.CopyBuffer(value)
+		n.text = ""
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return root, nil
+}
+
+// marshalXML writes the document, the protected values are encrypted with the inner stream.
+func marshalXML(root *node, stream *chacha20.Cipher) ([]byte, error) {
+	buf := new(bytes.Buffer)
+	buf.WriteString(`<?xml version="1.0" encoding="utf-8" standalone="yes"?>` + "\n")
+
+	encoder := xml.NewEncoder(buf)
+	encoder.Indent("", "\t")
+
+	var encode func(n *node) error
+	encode = func(n *node) error {
+		start := xml.StartElement{Name: xml.Name{Local: n.name}, Attr: n.attrs}
+
+		err := encoder.EncodeToken(start)
+		if err != nil {
+			return err
+		}
+
+		switch {
+		case len(n.children) > 0:
+			for _, c := range n.children {
+				err = encode(c)
+				if err != nil {
+					return err
+				}
+			}
+		case n.protected():
+			// only the encrypted value leaves locked memory
+			value := make([]byte, len(n.secret.Bytes()))
+			stream.XORKeyStream(value, n.secret.Bytes())
+			runtime.KeepAlive(n.secret)
+
+			err = encoder.EncodeToken(xml.CharData(base64.StdEncoding.EncodeToString(value)))
+		case n.secret != nil:
+			err = encoder.EncodeToken(xml.CharData(n.secret.Bytes()))
+			runtime.KeepAlive(n.secret)
+		case n.text != "":
+			err = encoder.EncodeToken(xml.CharData(n.text))
+		}
+		if err != nil {
+			return err
+		}
+
+		return encoder.EncodeToken(start.End())
+	}
+
+	err := encode(root)
+	if err == nil {
+		err = encoder.Flush()
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal XML: %s", err.Error())
+	}
+
+	return buf.Bytes(), nil
+}
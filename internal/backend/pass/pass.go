@@ -0,0 +1,639 @@
+package pass
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"filippo.io/age"
+
+	"manager/internal/disk"
+	"manager/internal/domain"
+	"manager/internal/secmem"
+)
+
+// Store layout, compatible with passage, the age based fork of pass:
+//
+//	.age-recipients       public keys every file is encrypted to, one per line
+//	.age-identity         the private key of the manager, encrypted with the master password
+//	<service>/.service    record type and favorite flag of the service
+//	<service>/<login>.age password on the first line, then "description: ..." and the additional text
+//
+// A .age-recipients file in a subdirectory overrides the one above it, like .gpg-id does in pass.
+const (
+	recipientsFile = ".age-recipients"
+	identityFile   = ".age-identity"
+	serviceFile    = ".service"
+	entrySuffix    = ".age"
+
+	descriptionPrefix = "description: "
+)
+
+var errInvalidName = errors.New("name cannot be used as a file name")
+
+type serviceMeta struct {
+	Type     string `json:"type"`
+	Favorite bool   `json:"favorite"`
+}
+
+// Repository keeps every login in its own age encrypted file, so the store can be shared and
+// versioned with the usual pass tooling. Changes are written as they are applied, without keeping
+// the previous versions of the files next to them.
+type Repository struct {
+	dir   string
+	mutex *sync.RWMutex
+
+	// identities is nil while the repository is closed
+	identities []age.Identity
+
+	// workFactor is the scrypt work factor the identity is encrypted with, zero uses the age default
+	workFactor int
+}
+
+func New(dir string) *Repository {
+	return &Repository{
+		dir:   dir,
+		mutex: new(sync.RWMutex),
+	}
+}
+
+// Check verifies that the store, if it already exists, is a directory.
+func (r *Repository) Check() error {
+	info, err := os.Stat(r.dir)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to open store: %s", err.Error())
+	}
+
+	if !info.IsDir() {
+		return fmt.Errorf("store %s is not a directory", r.dir)
+	}
+
+	return nil
+}
+
+// Open decrypts the identity of the manager. A store without one gets a new identity, a plain
+// identity file, as used by passage, is encrypted with the password on the first unlock.
+func (r *Repository) Open(password []byte) error {
+	path := filepath.Join(r.dir, identityFile)
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return r.create(password)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read identity: %s", err.Error())
+	}
+
+	if !bytes.HasPrefix(data, []byte("age-encryption.org/")) {
+		identities, err := age.ParseIdentities(bytes.NewReader(data))
+		if err != nil {
+			return fmt.Errorf("failed to parse identity: %s", err.Error())
+		}
+
+		err = r.writeIdentity(path, data, password)
+		secmem.Zero(data)
+		if err != nil {
+			return err
+		}
+
+		r.identities = identities
+
+		return nil
+	}
+
+	scrypt, err := age.NewScryptIdentity(string(password))
+	if err != nil {
+		return err
+	}
+
+	reader, err := age.Decrypt(bytes.NewReader(data), scrypt)
+
+	var noMatch *age.NoIdentityMatchError
+	if errors.As(err, &noMatch) {
+		return domain.ErrWrongPassword
+	}
+	if err != nil {
+		return fmt.Errorf("failed to decrypt identity: %s", err.Error())
+	}
+
+	data, err = io.ReadAll(reader)
+	if err != nil {
+		return fmt.Errorf("failed to decrypt identity: %s", err.Error())
+	}
+
+	identities, err := age.ParseIdentities(bytes.NewReader(data))
+	secmem.Zero(data)
+	if err != nil {
+		return fmt.Errorf("failed to parse identity: %s", err.Error())
+	}
+
+	r.identities = identities
+
+	return nil
+}
+
+// Probe tells whether Open would accept the password, unwrapping the file key of the identity
+// without decrypting it. A store without an encrypted identity accepts any password.
+func (r *Repository) Probe(password []byte) error {
+	data, err := os.ReadFile(filepath.Join(r.dir, identityFile))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read identity: %s", err.Error())
+	}
+
+	if !bytes.HasPrefix(data, []byte("age-encryption.org/")) {
+		secmem.Zero(data)
+
+		return nil
+	}
+
+	scrypt, err := age.NewScryptIdentity(string(password))
+	if err != nil {
+		return err
+	}
+
+	_, err = age.Decrypt(bytes.NewReader(data), scrypt)
+
+	var noMatch *age.NoIdentityMatchError
+	if errors.As(err, &noMatch) {
+		return domain.ErrWrongPassword
+	}
+	if err != nil {
+		return fmt.Errorf("failed to decrypt identity: %s", err.Error())
+	}
+
+	return nil
+}
+
+func (r *Repository) create(password []byte) error {
+	identity, err := age.GenerateX25519Identity()
+	if err != nil {
+		return fmt.Errorf("failed to generate identity: %s", err.Error())
+	}
+
+	err = os.MkdirAll(r.dir, 0700)
+	if err != nil {
+		return fmt.Errorf("failed to create store: %s", err.Error())
+	}
+
+	err = r.writeIdentity(filepath.Join(r.dir, identityFile), []byte(identity.String()+"\n"), password)
+	if err != nil {
+		return err
+	}
+
+	// an existing store gets the new key added, so the manager can read what it writes
+	path := filepath.Join(r.dir, recipientsFile)
+
+	recipients, err := os.ReadFile(path)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("failed to read recipients: %s", err.Error())
+	}
+
+	if len(recipients) > 0 {
+		log.Printf("adding the manager key %s to %s, existing entries have to be re-encrypted to it", identity.Recipient(), path)
+
+		if !bytes.HasSuffix(recipients, []byte("\n")) {
+			recipients = append(recipients, '\n')
+		}
+	}
+
+	err = disk.ReplaceFile(path, append(recipients, identity.Recipient().String()+"\n"...), 0600)
+	if err != nil {
+		return err
+	}
+
+	r.identities = []age.Identity{identity}
+
+	return nil
+}
+
+func (r *Repository) writeIdentity(path string, identity []byte, password []byte) error {
+	recipient, err := age.NewScryptRecipient(string(password))
+	if err != nil {
+		return err
+	}
+
+	if r.workFactor != 0 {
+		recipient.SetWorkFactor(r.workFactor)
+	}
+
+	buf := new(bytes.Buffer)
+
+	writer, err := age.Encrypt(buf, recipient)
+	if err != nil {
+		return fmt.Errorf("failed to encrypt identity: %s", err.Error())
+	}
+
+	writer.Write(identity)
+
+	err = writer.Close()
+	if err != nil {
+		return fmt.Errorf("failed to encrypt identity: %s", err.Error())
+	}
+
+	return disk.ReplaceFile(path, buf.Bytes(), 0600)
+}
+
+func (r *Repository) Close() error {
+	r.identities = nil
+
+	return nil
+}
+
+// Flush has nothing to do, every change is written as it is applied.
+func (r *Repository) Flush() error {
+	return nil
+}
+
+func (r *Repository) ReadOnly() bool {
+	return false
+}
+
+func (r *Repository) GetAll() (domain.Storage, error) {
+	return r.get(func(domain.Service) bool { return true })
+}
+
+func (r *Repository) GetByType(recordType string) (domain.Storage, error) {
+	return r.get(func(service domain.Service) bool { return service.Type == recordType })
+}
+
+func (r *Repository) GetFavorites() (domain.Storage, error) {
+	return r.get(func(service domain.Service) bool { return service.Favorite })
+}
+
+// get reads every directory with a .service file or entries as a service named by its path
+// relative to the store. Entries of services of other types are not decrypted.
+func (r *Repository) get(match func(service domain.Service) bool) (domain.Storage, error) {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+
+	storage := make(domain.Storage)
+
+	err := filepath.WalkDir(r.dir, func(path string, d os.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if !d.IsDir() || path == r.dir {
+			return nil
+		}
+
+		if strings.HasPrefix(d.Name(), ".") {
+			return filepath.SkipDir
+		}
+
+		name, err := filepath.Rel(r.dir, path)
+		if err != nil {
+			return err
+		}
+
+		service, ok, err := r.readService(path, match)
+		if err != nil {
+			return err
+		}
+
+		if ok {
+			storage[filepath.ToSlash(name)] = service
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to read store: %s", err.Error())
+	}
+
+	return storage, nil
+}
+
+func (r *Repository) readService(dir string, match func(service domain.Service) bool) (domain.Service, bool, error) {
+	meta, hasMeta, err := readMeta(dir)
+	if err != nil {
+		return domain.Service{}, false, err
+	}
+
+	files, err := os.ReadDir(dir)
+	if err != nil {
+		return domain.Service{}, false, err
+	}
+
+	service := domain.Service{
+		Type:     meta.Type,
+		Favorite: meta.Favorite,
+	}
+
+	if !match(service) {
+		return domain.Service{}, false, nil
+	}
+
+	for _, file := range files {
+		login, ok := strings.CutSuffix(file.Name(), entrySuffix)
+		if !ok || file.IsDir() || strings.HasPrefix(login, ".") {
+			continue
+		}
+
+		elem, err := r.readEntry(filepath.Join(dir, file.Name()))
+		if err != nil {
+			return domain.Service{}, false, err
+		}
+
+		if service.Elements == nil {
+			service.Elements = make(map[string]domain.Element)
+		}
+
+		service.Elements[login] = elem
+	}
+
+	return service, hasMeta || service.Elements != nil, nil
+}
+
+func readMeta(dir string) (serviceMeta, bool, error) {
+	data, err := os.ReadFile(filepath.Join(dir, serviceFile))
+	if errors.Is(err, os.ErrNotExist) {
+		return serviceMeta{}, false, nil
+	}
+	if err != nil {
+		return serviceMeta{}, false, err
+	}
+
+	var meta serviceMeta
+
+	err = json.Unmarshal(data, &meta)
+	if err != nil {
+		return serviceMeta{}, false, fmt.Errorf("invalid %s: %s", filepath.Join(dir, serviceFile), err.Error())
+	}
+
+	return meta, true, nil
+}
+
+func (r *Repository) readEntry(path string) (domain.Element, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return domain.Element{}, err
+	}
+	defer file.Close()
+
+	reader, err := age.Decrypt(file, r.identities...)
+	if err != nil {
+		return domain.Element{}, fmt.Errorf("failed to decrypt %s: %s", path, err.Error())
+	}
+
+	data, err := io.ReadAll(reader)
+	if err != nil {
+		return domain.Element{}, fmt.Errorf("failed to decrypt %s: %s", path, err.Error())
+	}
+
+	elem := parseEntry(data)
+	secmem.Zero(data)
+
+	return elem, nil
+}
+
+// parseEntry reads the pass format. Lines that are neither the password nor the description, such
+// as the "login:" or "url:" lines of other pass clients, are kept in the additional text.
+func parseEntry(data []byte) domain.Element {
+	password, after, _ := bytes.Cut(data, []byte("\n"))
+	rest := string(after)
+
+	elem := domain.Element{
+		Password: domain.NewSecret(password),
+	}
+
+	if line, after, _ := strings.Cut(rest, "\n"); strings.HasPrefix(line, descriptionPrefix) {
+		elem.Description = strings.TrimPrefix(line, descriptionPrefix)
+		rest = after
+	}
+
+	elem.Additional = strings.TrimSuffix(rest, "\n")
+
+	return elem
+}
+
+// formatEntry writes the pass format. The description has to fit on one line, line breaks in it
+// are replaced with spaces.
+func formatEntry(elem domain.Element) []byte {
+	var buf bytes.Buffer
+
+	buf.Write(elem.Password.Bytes())
+	buf.WriteByte('\n')
+
+	if elem.Description != "" {
+		buf.WriteString(descriptionPrefix + strings.ReplaceAll(elem.Description, "\n", " ") + "\n")
+	}
+
+	if elem.Additional != "" {
+		buf.WriteString(elem.Additional + "\n")
+	}
+
+	return buf.Bytes()
+}
+
+// Apply changes the files of the store, it reports false when the service or login the operation
+// refers to does not exist or already exists.
+func (r *Repository) Apply(op domain.Operation) (bool, error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	dir, err := r.servicePath(op.Service)
+	if err != nil {
+		return false, err
+	}
+
+	exists, err := serviceExists(dir)
+	if err != nil {
+		return false, err
+	}
+
+	switch op.Op {
+	case domain.OpAppendService, domain.OpUpdateService:
+		if exists != (op.Op == domain.OpUpdateService) {
+			return false, nil
+		}
+
+		err = os.MkdirAll(dir, 0700)
+		if err != nil {
+			return false, fmt.Errorf("failed to create service: %s", err.Error())
+		}
+
+		data, err := json.Marshal(serviceMeta{Type: op.Type, Favorite: op.Favorite})
+		if err != nil {
+			return false, err
+		}
+
+		return true, disk.ReplaceFile(filepath.Join(dir, serviceFile), data, 0600)
+	case domain.OpDeleteService:
+		if !exists {
+			return false, nil
+		}
+
+		return true, deleteService(dir)
+	}
+
+	if !exists {
+		return false, nil
+	}
+
+	path, err := entryPath(dir, op.Login)
+	if err != nil {
+		return false, err
+	}
+
+	_, err = os.Stat(path)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return false, err
+	}
+
+	entryExists := err == nil
+
+	switch op.Op {
+	case domain.OpAppendLogin, domain.OpUpdateLogin:
+		if entryExists != (op.Op == domain.OpUpdateLogin) {
+			return false, nil
+		}
+
+		var elem domain.Element
+		if op.Element != nil {
+			elem = *op.Element
+		}
+
+		return true, r.writeEntry(path, elem)
+	case domain.OpDeleteLogin:
+		if !entryExists {
+			return false, nil
+		}
+
+		err = os.Remove(path)
+		if err != nil {
+			return false, err
+		}
+
+		return true, disk.SyncDir(dir)
+	}
+
+	return false, fmt.Errorf("unknown operation %q", op.Op)
+}
+
+func (r *Repository) writeEntry(path string, elem domain.Element) error {
+	recipients, err := r.recipients(filepath.Dir(path))
+	if err != nil {
+		return err
+	}
+
+	buf := new(bytes.Buffer)
+
+	writer, err := age.Encrypt(buf, recipients...)
+	if err != nil {
+		return fmt.Errorf("failed to encrypt entry: %s", err.Error())
+	}
+
+	data := formatEntry(elem)
+	writer.Write(data)
+	secmem.Zero(data)
+
+	err = writer.Close()
+	if err != nil {
+		return fmt.Errorf("failed to encrypt entry: %s", err.Error())
+	}
+
+	return disk.ReplaceFile(path, buf.Bytes(), 0600)
+}
+
+// recipients reads the nearest recipients file from dir up to the root of the store.
+func (r *Repository) recipients(dir string) ([]age.Recipient, error) {
+	for {
+		file, err := os.Open(filepath.Join(dir, recipientsFile))
+		if err == nil {
+			defer file.Close()
+
+			recipients, err := age.ParseRecipients(file)
+			if err != nil {
+				return nil, fmt.Errorf("failed to parse %s: %s", file.Name(), err.Error())
+			}
+
+			return recipients, nil
+		}
+		if !errors.Is(err, os.ErrNotExist) {
+			return nil, fmt.Errorf("failed to read recipients: %s", err.Error())
+		}
+
+		if dir == r.dir {
+			return nil, fmt.Errorf("no %s in the store", recipientsFile)
+		}
+
+		dir = filepath.Dir(dir)
+	}
+}
+
+// servicePath maps a service name to its directory, a name may contain slashes to nest services.
+func (r *Repository) servicePath(name string) (string, error) {
+	for _, part := range strings.Split(name, "/") {
+		if part == "" || strings.HasPrefix(part, ".") || strings.ContainsAny(part, "\\\x00") {
+			return "", fmt.Errorf("%w: %q", errInvalidName, name)
+		}
+	}
+
+	return filepath.Join(r.dir, filepath.FromSlash(name)), nil
+}
+
+func entryPath(dir, login string) (string, error) {
+	if strings.HasPrefix(login, ".") || strings.ContainsAny(login, "/\\\x00") {
+		return "", fmt.Errorf("%w: %q", errInvalidName, login)
+	}
+
+	return filepath.Join(dir, login+entrySuffix), nil
+}
+
+func serviceExists(dir string) (bool, error) {
+	files, err := os.ReadDir(dir)
+	if errors.Is(err, os.ErrNotExist) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	for _, file := range files {
+		if file.Name() == serviceFile || !file.IsDir() && strings.HasSuffix(file.Name(), entrySuffix) {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+// deleteService removes the entries of the service, nested services and other files are kept.
+func deleteService(dir string) error {
+	files, err := os.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+
+	for _, file := range files {
+		if file.IsDir() || file.Name() != serviceFile && !strings.HasSuffix(file.Name(), entrySuffix) {
+			continue
+		}
+
+		err = os.Remove(filepath.Join(dir, file.Name()))
+		if err != nil {
+			return err
+		}
+	}
+
+	// the directory goes away once nothing else is left in it
+	if os.Remove(dir) == nil {
+		return disk.SyncDir(filepath.Dir(dir))
+	}
+
+	return disk.SyncDir(dir)
+}
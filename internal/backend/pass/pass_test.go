@@ -0,0 +1,268 @@
+package pass
+
+import (
+	"bytes"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"filippo.io/age"
+
+	"manager/internal/backend/backendtest"
+	"manager/internal/disk"
+	"manager/internal/domain"
+)
+
+// newTestRepository returns a repository that encrypts its identity with a cheap scrypt work factor.
+func newTestRepository(dir string) *Repository {
+	r := New(dir)
+	r.workFactor = 10
+
+	return r
+}
+
+func TestConformance(t *testing.T) {
+	backendtest.Run(t, func(path string) backendtest.Repository {
+		return newTestRepository(path)
+	})
+}
+
+// newPassageStore makes a store as passage leaves it, with the identity in plain text.
+func newPassageStore(t *testing.T) (string, *age.X25519Identity) {
+	t.Helper()
+
+	dir := t.TempDir()
+
+	identity, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = os.WriteFile(filepath.Join(dir, identityFile), []byte(identity.String()+"\n"), 0600)
+	if err == nil {
+		err = os.WriteFile(filepath.Join(dir, recipientsFile), []byte(identity.Recipient().String()+"\n"), 0600)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return dir, identity
+}
+
+func apply(t *testing.T, r *Repository, op domain.Operation) {
+	t.Helper()
+
+	ok, err := r.Apply(op)
+	if err != nil || !ok {
+		t.Fatalf("Apply %s %s/%s: %v, %v", op.Op, op.Service, op.Login, ok, err)
+	}
+}
+
+// files returns the names of all files in the store relative to it.
+func files(t *testing.T, dir string) []string {
+	t.Helper()
+
+	var names []string
+
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err == nil && !d.IsDir() {
+			name, _ := filepath.Rel(dir, path)
+			names = append(names, name)
+		}
+
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return names
+}
+
+func TestPlainIdentityIsEncrypted(t *testing.T) {
+	dir, _ := newPassageStore(t)
+
+	r := newTestRepository(dir)
+
+	err := r.Open([]byte("secret"))
+	if err != nil {
+		t.Fatalf("Open: %s", err)
+	}
+
+	for _, name := range files(t, dir) {
+		data, err := os.ReadFile(filepath.Join(dir, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if bytes.Contains(data, []byte("AGE-SECRET-KEY-")) {
+			t.Fatalf("%s holds the identity in plain text", name)
+		}
+	}
+
+	err = r.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = newTestRepository(dir).Open([]byte("guess"))
+	if err != domain.ErrWrongPassword {
+		t.Fatalf("got %v, want ErrWrongPassword", err)
+	}
+
+	err = newTestRepository(dir).Open([]byte("secret"))
+	if err != nil {
+		t.Fatalf("reopen: %s", err)
+	}
+}
+
+func TestNoPreviousVersionsAreKept(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "store")
+
+	r := newTestRepository(dir)
+
+	err := r.Open([]byte("secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	apply(t, r, domain.Operation{Op: domain.OpAppendService, Service: "mail", Type: "password"})
+	apply(t, r, domain.Operation{Op: domain.OpUpdateService, Service: "mail", Type: "password", Favorite: true})
+
+	for _, password := range []string{"one", "two", "three"} {
+		op := domain.OpUpdateLogin
+		if password == "one" {
+			op = domain.OpAppendLogin
+		}
+
+		apply(t, r, domain.Operation{Op: op, Service: "mail", Login: "alice", Element: &domain.Element{Password: domain.NewSecret([]byte(password))}})
+	}
+
+	for _, name := range files(t, dir) {
+		if strings.HasSuffix(name, disk.BackupSuffix) {
+			t.Fatalf("%s was kept", name)
+		}
+	}
+}
+
+func TestDeleteService(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "store")
+
+	r := newTestRepository(dir)
+
+	err := r.Open([]byte("secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	apply(t, r, domain.Operation{Op: domain.OpAppendService, Service: "mail", Type: "password"})
+	apply(t, r, domain.Operation{Op: domain.OpAppendLogin, Service: "mail", Login: "alice", Element: &domain.Element{}})
+	apply(t, r, domain.Operation{Op: domain.OpAppendLogin, Service: "mail", Login: "bob", Element: &domain.Element{}})
+
+	apply(t, r, domain.Operation{Op: domain.OpDeleteLogin, Service: "mail", Login: "alice"})
+
+	_, err = os.Stat(filepath.Join(dir, "mail", "alice"+entrySuffix))
+	if !os.IsNotExist(err) {
+		t.Fatal("the entry of a deleted login is left")
+	}
+
+	apply(t, r, domain.Operation{Op: domain.OpDeleteService, Service: "mail"})
+
+	_, err = os.Stat(filepath.Join(dir, "mail"))
+	if !os.IsNotExist(err) {
+		t.Fatalf("the directory of a deleted service is left with %v", files(t, filepath.Join(dir, "mail")))
+	}
+}
+
+// Entries written by passage are read, and entries written by the manager open with its identity.
+func TestPassageCompatibility(t *testing.T) {
+	dir, identity := newPassageStore(t)
+
+	err := os.MkdirAll(filepath.Join(dir, "web", "mail"), 0700)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	buf := new(bytes.Buffer)
+
+	writer, err := age.Encrypt(buf, identity.Recipient())
+	if err == nil {
+		_, err = io.WriteString(writer, "hunter2\ndescription: personal\nlogin: alice\nurl: https://mail.example.com\n")
+	}
+	if err == nil {
+		err = writer.Close()
+	}
+	if err == nil {
+		err = os.WriteFile(filepath.Join(dir, "web", "mail", "alice.age"), buf.Bytes(), 0600)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := newTestRepository(dir)
+
+	err = r.Open([]byte("secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	storage, err := r.GetAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	elem := storage["web/mail"].Elements["alice"]
+	if string(elem.Password.Bytes()) != "hunter2" || elem.Description != "personal" || elem.Additional != "login: alice\nurl: https://mail.example.com" {
+		t.Fatalf("got %q %q %q", elem.Password.Bytes(), elem.Description, elem.Additional)
+	}
+
+	apply(t, r, domain.Operation{Op: domain.OpAppendLogin, Service: "web/mail", Login: "bob", Element: &domain.Element{Password: domain.NewSecret([]byte("two"))}})
+
+	file, err := os.Open(filepath.Join(dir, "web", "mail", "bob.age"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+
+	reader, err := age.Decrypt(file, identity)
+	if err != nil {
+		t.Fatalf("passage cannot read the entry: %s", err)
+	}
+
+	data, err := io.ReadAll(reader)
+	if err != nil || string(data) != "two\n" {
+		t.Fatalf("got %q, %v", data, err)
+	}
+}
+
+func TestInvalidNames(t *testing.T) {
+	r := newTestRepository(filepath.Join(t.TempDir(), "store"))
+
+	err := r.Open([]byte("secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	for _, name := range []string{"../escape", ".hidden", "a//b", "back\\slash"} {
+		_, err = r.Apply(domain.Operation{Op: domain.OpAppendService, Service: name, Type: "password"})
+		if err == nil {
+			t.Fatalf("service %q was accepted", name)
+		}
+	}
+
+	apply(t, r, domain.Operation{Op: domain.OpAppendService, Service: "mail", Type: "password"})
+
+	for _, login := range []string{"../escape", ".hidden", "a/b"} {
+		_, err = r.Apply(domain.Operation{Op: domain.OpAppendLogin, Service: "mail", Login: login, Element: &domain.Element{}})
+		if err == nil {
+			t.Fatalf("login %q was accepted", login)
+		}
+	}
+}
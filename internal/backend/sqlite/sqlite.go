@@ -0,0 +1,643 @@
+package sqlite
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"manager/internal/disk"
+	"manager/internal/domain"
+	"manager/internal/secmem"
+	"manager/internal/vault"
+
+	_ "modernc.org/sqlite"
+)
+
+const keySlot = "key_slot"
+
+var schema = []string{
+	`CREATE TABLE IF NOT EXISTS meta (
+		key TEXT PRIMARY KEY,
+		value BLOB NOT NULL
+	)`,
+	`CREATE TABLE IF NOT EXISTS services (
+		name TEXT PRIMARY KEY,
+		type TEXT NOT NULL,
+		favorite INTEGER NOT NULL DEFAULT 0
+	)`,
+	`CREATE INDEX IF NOT EXISTS services_type ON services (type)`,
+	`CREATE INDEX IF NOT EXISTS services_favorite ON services (name) WHERE favorite`,
+	`CREATE TABLE IF NOT EXISTS logins (
+		service TEXT NOT NULL REFERENCES services (name) ON DELETE CASCADE,
+		login TEXT NOT NULL,
+		element BLOB NOT NULL,
+		PRIMARY KEY (service, login)
+	)`,
+}
+
+// Repository keeps the storage in an SQLite database, so only the requested records are loaded
+// into memory. Service names, types and logins are stored in plain text to be indexed, the
+// elements are encrypted with the vault key. Every change is committed right away.
+type Repository struct {
+	path string
+	db   *sql.DB
+
+	// kdf is the cost new password slots are made with and cheaper ones are upgraded to
+	kdf vault.KDFParams
+
+	// key is nil while the repository is closed
+	key *vault.Key
+}
+
+func New(path string, kdf vault.KDFParams) *Repository {
+	return &Repository{
+		path: path,
+		kdf:  kdf,
+	}
+}
+
+func openDB(path string) (*sql.DB, error) {
+	db, err := sql.Open("sqlite", "file:"+path+"?_pragma=foreign_keys(1)&_pragma=journal_mode(WAL)&_pragma=synchronous(FULL)&_pragma=busy_timeout(5000)")
+	if err != nil {
+		return nil, fmt.Errorf("failed to open database: %s", err.Error())
+	}
+
+	return db, nil
+}
+
+// Check verifies the integrity of an existing database at startup.
+func (r *Repository) Check() error {
+	_, err := os.Stat(r.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+
+	db, err := openDB(r.path)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	var result string
+
+	err = db.QueryRow("PRAGMA quick_check").Scan(&result)
+	if err != nil {
+		return fmt.Errorf("failed to check database: %s", err.Error())
+	}
+
+	if result != "ok" {
+		return fmt.Errorf("database is corrupted: %s", result)
+	}
+
+	return nil
+}
+
+// Probe tells whether Open would accept the password, reading the key slot over a read-only
+// connection. A new database accepts any password.
+func (r *Repository) Probe(password []byte) error {
+	_, err := r.ProbeKey(password)
+
+	return err
+}
+
+// ProbeKey returns the key the password opens, read like Probe does. It is nil for a new database.
+func (r *Repository) ProbeKey(password []byte) (*vault.Key, error) {
+	_, err := os.Stat(r.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+
+	db, err := sql.Open("sqlite", "file:"+r.path+"?mode=ro&_pragma=busy_timeout(5000)")
+	if err != nil {
+		return nil, fmt.Errorf("failed to open database: %s", err.Error())
+	}
+	defer db.Close()
+
+	var slot []byte
+
+	err = db.QueryRow("SELECT value FROM meta WHERE key = ?", keySlot).Scan(&slot)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read key slot: %s", err.Error())
+	}
+
+	key, err := vault.UnlockSlot(slot, password)
+	if errors.Is(err, vault.ErrWrongPassword) {
+		return nil, domain.ErrWrongPassword
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return key, nil
+}
+
+func (r *Repository) Open(password []byte) error {
+	return r.openWith(func(db *sql.DB) (*vault.Key, error) {
+		return unlock(db, password, r.kdf)
+	})
+}
+
+// Recover opens the database with a recovery code instead of the master password and protects it
+// with a new password and a new data key right away. A recovery code is used up by that, the
+// recovery key is not.
+func (r *Repository) Recover(code, password []byte) error {
+	return r.openWith(func(db *sql.DB) (*vault.Key, error) {
+		var slot []byte
+
+		err := db.QueryRow("SELECT value FROM meta WHERE key = ?", keySlot).Scan(&slot)
+		if err != nil {
+			return nil, domain.ErrInvalidCode
+		}
+
+		old, err := vault.UnlockSlotRecovery(slot, code)
+		if errors.Is(err, vault.ErrInvalidCode) {
+			return nil, domain.ErrInvalidCode
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		key, err := old.Rotate(password, r.kdf)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create vault key: %s", err.Error())
+		}
+
+		tx, err := db.Begin()
+		if err != nil {
+			return nil, err
+		}
+		defer tx.Rollback()
+
+		key, err = rekey(tx, old, key, password)
+		if err != nil {
+			return nil, err
+		}
+
+		return key, tx.Commit()
+	})
+}
+
+// openWith opens the database and takes the key from unlock.
+func (r *Repository) openWith(unlock func(db *sql.DB) (*vault.Key, error)) error {
+	db, err := openDB(r.path)
+	if err != nil {
+		return err
+	}
+
+	key, err := unlock(db)
+	if err != nil {
+		db.Close()
+
+		return err
+	}
+
+	r.db = db
+	r.key = key
+
+	return nil
+}
+
+// unlock creates the schema if needed and opens the key slot, a new database gets a new key made
+// with params.
+func unlock(db *sql.DB, password []byte, params vault.KDFParams) (*vault.Key, error) {
+	for _, query := range schema {
+		_, err := db.Exec(query)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create schema: %s", err.Error())
+		}
+	}
+
+	var slot []byte
+
+	err := db.QueryRow("SELECT value FROM meta WHERE key = ?", keySlot).Scan(&slot)
+	if err == nil {
+		key, err := vault.UnlockSlot(slot, password)
+		if errors.Is(err, vault.ErrWrongPassword) {
+			return nil, domain.ErrWrongPassword
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		// a slot made with cheaper parameters than the configured ones is upgraded right away, the
+		// elements are sealed under the new data key in the same transaction
+		upgraded, err := key.Upgrade(password, params)
+		if err != nil {
+			return nil, fmt.Errorf("failed to upgrade vault key: %s", err.Error())
+		}
+		if upgraded == nil {
+			return key, nil
+		}
+
+		tx, err := db.Begin()
+		if err != nil {
+			return nil, fmt.Errorf("failed to upgrade vault key: %s", err.Error())
+		}
+		defer tx.Rollback()
+
+		upgraded, err = rekey(tx, key, upgraded, password)
+		if err != nil {
+			return nil, fmt.Errorf("failed to upgrade vault key: %s", err.Error())
+		}
+
+		return upgraded, tx.Commit()
+	}
+	if !errors.Is(err, sql.ErrNoRows) {
+		return nil, fmt.Errorf("failed to read key slot: %s", err.Error())
+	}
+
+	key, err := vault.NewKey(password, params)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create vault key: %s", err.Error())
+	}
+
+	slot, err = key.Slot()
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = db.Exec("INSERT INTO meta (key, value) VALUES (?, ?)", keySlot, slot)
+	if err != nil {
+		return nil, fmt.Errorf("failed to write key slot: %s", err.Error())
+	}
+
+	return key, nil
+}
+
+// writeSlot replaces the slot of an existing key.
+func writeSlot(db *sql.DB, key *vault.Key) error {
+	slot, err := key.Slot()
+	if err != nil {
+		return err
+	}
+
+	_, err = db.Exec("UPDATE meta SET value = ? WHERE key = ?", slot, keySlot)
+	if err != nil {
+		return fmt.Errorf("failed to write key slot: %s", err.Error())
+	}
+
+	return nil
+}
+
+// Key returns the key the database is open with.
+func (r *Repository) Key() *vault.Key {
+	return r.key
+}
+
+// SetKey writes the slot of a key with the same data key and other slots, like new recovery codes.
+func (r *Repository) SetKey(key *vault.Key) error {
+	err := writeSlot(r.db, key)
+	if err != nil {
+		return err
+	}
+
+	r.key = key
+
+	return nil
+}
+
+// Rekey protects the database with a new master password and the current key derivation
+// parameters. The elements are encrypted under a new data key in the same transaction as the new
+// slot, so the database holds either the old key or the new one.
+func (r *Repository) Rekey(current, password []byte) error {
+	err := r.key.Verify(current)
+	if errors.Is(err, vault.ErrWrongPassword) {
+		return domain.ErrWrongPassword
+	}
+	if err != nil {
+		return err
+	}
+
+	key, err := r.key.Rotate(password, r.kdf)
+	if err != nil {
+		return fmt.Errorf("failed to create vault key: %s", err.Error())
+	}
+
+	tx, err := r.db.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to change key: %s", err.Error())
+	}
+	defer tx.Rollback()
+
+	key, err = rekey(tx, r.key, key, password)
+	if err != nil {
+		return fmt.Errorf("failed to change key: %s", err.Error())
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return fmt.Errorf("failed to change key: %s", err.Error())
+	}
+
+	r.key = key
+
+	return nil
+}
+
+// rekey writes the slot of the new key, encrypts the elements under it and returns the key as it
+// opens from the written slot.
+func rekey(tx *sql.Tx, old, key *vault.Key, password []byte) (*vault.Key, error) {
+	slot, err := key.Slot()
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = tx.Exec("UPDATE meta SET value = ? WHERE key = ?", slot, keySlot)
+	if err != nil {
+		return nil, err
+	}
+
+	// the slot as written has to open with the new password before anything depends on it
+	err = tx.QueryRow("SELECT value FROM meta WHERE key = ?", keySlot).Scan(&slot)
+	if err != nil {
+		return nil, err
+	}
+
+	key, err = vault.UnlockSlot(slot, password)
+	if err != nil {
+		return nil, fmt.Errorf("failed to verify key slot: %s", err.Error())
+	}
+
+	rows, err := tx.Query("SELECT service, login, element FROM logins")
+	if err != nil {
+		return nil, err
+	}
+
+	type row struct {
+		service, login string
+		element        []byte
+	}
+
+	var sealed []row
+
+	for rows.Next() {
+		var r row
+
+		err = rows.Scan(&r.service, &r.login, &r.element)
+		if err != nil {
+			rows.Close()
+
+			return nil, err
+		}
+
+		ad := elementAD(r.service, r.login)
+
+		data, err := old.Open(r.element, ad)
+		if err != nil {
+			rows.Close()
+
+			return nil, fmt.Errorf("failed to decrypt element %s/%s: %s", r.service, r.login, err.Error())
+		}
+
+		r.element, err = key.Seal(data, ad)
+		secmem.Zero(data)
+		if err != nil {
+			rows.Close()
+
+			return nil, err
+		}
+
+		sealed = append(sealed, r)
+	}
+
+	err = rows.Err()
+	rows.Close()
+
+	if err != nil {
+		return nil, err
+	}
+
+	for _, r := range sealed {
+		_, err = tx.Exec("UPDATE logins SET element = ? WHERE service = ? AND login = ?", r.element, r.service, r.login)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return key, nil
+}
+
+func (r *Repository) Close() error {
+	if r.db == nil {
+		return nil
+	}
+
+	err := r.db.Close()
+	r.db = nil
+	r.key = nil
+
+	if err != nil {
+		return fmt.Errorf("failed to close database: %s", err.Error())
+	}
+
+	return nil
+}
+
+// Snapshot returns a consistent copy of the database file, without the write-ahead log.
+func (r *Repository) Snapshot() ([]byte, error) {
+	tmp, err := os.CreateTemp(filepath.Dir(r.path), "."+filepath.Base(r.path)+".snapshot-*")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create temporary file: %s", err.Error())
+	}
+
+	tmp.Close()
+	os.Remove(tmp.Name())
+	defer os.Remove(tmp.Name())
+
+	_, err = r.db.Exec("VACUUM INTO ?", tmp.Name())
+	if err != nil {
+		return nil, fmt.Errorf("failed to copy database: %s", err.Error())
+	}
+
+	return os.ReadFile(tmp.Name())
+}
+
+// Restore replaces the database file while the repository is closed.
+func (r *Repository) Restore(data []byte) error {
+	if r.db != nil {
+		return fmt.Errorf("database is open")
+	}
+
+	// a log left behind would be applied to the restored database
+	for _, suffix := range []string{"-wal", "-shm"} {
+		err := os.Remove(r.path + suffix)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return fmt.Errorf("failed to remove write-ahead log: %s", err.Error())
+		}
+	}
+
+	return disk.WriteFile(r.path, data, 0600)
+}
+
+// Flush has nothing to do, changes are committed as they are applied.
+func (r *Repository) Flush() error {
+	return nil
+}
+
+func (r *Repository) ReadOnly() bool {
+	return false
+}
+
+func (r *Repository) GetAll() (domain.Storage, error) {
+	return r.query(`SELECT s.name, s.type, s.favorite, l.login, l.element
+		FROM services s LEFT JOIN logins l ON l.service = s.name`)
+}
+
+func (r *Repository) GetByType(recordType string) (domain.Storage, error) {
+	return r.query(`SELECT s.name, s.type, s.favorite, l.login, l.element
+		FROM services s LEFT JOIN logins l ON l.service = s.name
+		WHERE s.type = ?`, recordType)
+}
+
+func (r *Repository) GetFavorites() (domain.Storage, error) {
+	return r.query(`SELECT s.name, s.type, s.favorite, l.login, l.element
+		FROM services s LEFT JOIN logins l ON l.service = s.name
+		WHERE s.favorite`)
+}
+
+func (r *Repository) query(query string, args ...any) (domain.Storage, error) {
+	rows, err := r.db.Query(query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query storage: %s", err.Error())
+	}
+	defer rows.Close()
+
+	storage := make(domain.Storage)
+
+	for rows.Next() {
+		var name, serviceType string
+		var favorite bool
+		var login sql.NullString
+		var sealed []byte
+
+		err = rows.Scan(&name, &serviceType, &favorite, &login, &sealed)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan storage: %s", err.Error())
+		}
+
+		service, ok := storage[name]
+		if !ok {
+			service = domain.Service{
+				Type:     serviceType,
+				Favorite: favorite,
+			}
+		}
+
+		if login.Valid {
+			elem, err := r.openElement(name, login.String, sealed)
+			if err != nil {
+				return nil, err
+			}
+
+			if service.Elements == nil {
+				service.Elements = make(map[string]domain.Element)
+			}
+
+			service.Elements[login.String] = elem
+		}
+
+		storage[name] = service
+	}
+
+	err = rows.Err()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read storage: %s", err.Error())
+	}
+
+	return storage, nil
+}
+
+// Apply executes the operation, it reports false when the service or login it refers to
+// does not exist or already exists.
+func (r *Repository) Apply(op domain.Operation) (bool, error) {
+	var result sql.Result
+	var err error
+
+	switch op.Op {
+	case domain.OpAppendService:
+		result, err = r.db.Exec(`INSERT INTO services (name, type, favorite) VALUES (?, ?, ?)
+			ON CONFLICT DO NOTHING`, op.Service, op.Type, op.Favorite)
+	case domain.OpUpdateService:
+		result, err = r.db.Exec("UPDATE services SET type = ?, favorite = ? WHERE name = ?",
+			op.Type, op.Favorite, op.Service)
+	case domain.OpDeleteService:
+		result, err = r.db.Exec("DELETE FROM services WHERE name = ?", op.Service)
+	case domain.OpAppendLogin, domain.OpUpdateLogin:
+		var elem domain.Element
+		if op.Element != nil {
+			elem = *op.Element
+		}
+
+		sealed, sealErr := r.sealElement(op.Service, op.Login, elem)
+		if sealErr != nil {
+			return false, sealErr
+		}
+
+		if op.Op == domain.OpAppendLogin {
+			result, err = r.db.Exec(`INSERT INTO logins (service, login, element)
+				SELECT ?, ?, ? WHERE EXISTS (SELECT 1 FROM services WHERE name = ?)
+				ON CONFLICT DO NOTHING`, op.Service, op.Login, sealed, op.Service)
+		} else {
+			result, err = r.db.Exec("UPDATE logins SET element = ? WHERE service = ? AND login = ?",
+				sealed, op.Service, op.Login)
+		}
+	case domain.OpDeleteLogin:
+		result, err = r.db.Exec("DELETE FROM logins WHERE service = ? AND login = ?", op.Service, op.Login)
+	default:
+		return false, fmt.Errorf("unknown operation %q", op.Op)
+	}
+
+	if err != nil {
+		return false, fmt.Errorf("failed to apply %s: %s", op.Op, err.Error())
+	}
+
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return false, fmt.Errorf("failed to apply %s: %s", op.Op, err.Error())
+	}
+
+	return affected > 0, nil
+}
+
+// elementAD binds an encrypted element to its row, so elements cannot be swapped between logins.
+func elementAD(service, login string) []byte {
+	return []byte(service + "\x00" + login)
+}
+
+func (r *Repository) sealElement(service, login string, elem domain.Element) ([]byte, error) {
+	data, err := json.Marshal(elem)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal element: %s", err.Error())
+	}
+
+	sealed, err := r.key.Seal(data, elementAD(service, login))
+	secmem.Zero(data)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encrypt element: %s", err.Error())
+	}
+
+	return sealed, nil
+}
+
+func (r *Repository) openElement(service, login string, sealed []byte) (domain.Element, error) {
+	data, err := r.key.Open(sealed, elementAD(service, login))
+	if err != nil {
+		return domain.Element{}, fmt.Errorf("failed to decrypt element %s/%s: %s", service, login, err.Error())
+	}
+
+	var elem domain.Element
+
+	err = json.Unmarshal(data, &elem)
+	secmem.Zero(data)
+	if err != nil {
+		return domain.Element{}, fmt.Errorf("failed to unmarshal element: %s", err.Error())
+	}
+
+	return elem, nil
+}
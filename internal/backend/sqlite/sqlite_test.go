@@ -0,0 +1,139 @@
+package sqlite
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"manager/internal/backend/backendtest"
+	"manager/internal/domain"
+	"manager/internal/vault"
+)
+
+var testKDF = vault.KDFParams{Time: 1, Memory: 64, Threads: 1}
+
+func TestConformance(t *testing.T) {
+	backendtest.Run(t, func(path string) backendtest.Repository {
+		return New(path, testKDF)
+	})
+}
+
+// An element moved to another login does not decrypt there.
+func TestElementsAreBoundToTheirLogin(t *testing.T) {
+	r := New(filepath.Join(t.TempDir(), "storage.db"), testKDF)
+
+	err := r.Open([]byte("secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	for _, op := range []domain.Operation{
+		{Op: domain.OpAppendService, Service: "mail", Type: "password"},
+		{Op: domain.OpAppendLogin, Service: "mail", Login: "alice", Element: &domain.Element{Password: domain.NewSecret([]byte("one"))}},
+		{Op: domain.OpAppendLogin, Service: "mail", Login: "bob", Element: &domain.Element{Password: domain.NewSecret([]byte("two"))}},
+	} {
+		ok, err := r.Apply(op)
+		if err != nil || !ok {
+			t.Fatalf("Apply %s: %v, %v", op.Op, ok, err)
+		}
+	}
+
+	_, err = r.db.Exec(`UPDATE logins SET element = (SELECT element FROM logins WHERE login = 'alice') WHERE login = 'bob'`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = r.GetAll()
+	if err == nil {
+		t.Fatal("a swapped element was decrypted")
+	}
+}
+
+func TestElementsAreEncrypted(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "storage.db")
+	r := New(path, testKDF)
+
+	err := r.Open([]byte("secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = r.Apply(domain.Operation{Op: domain.OpAppendService, Service: "mail", Type: "password"})
+	if err == nil {
+		_, err = r.Apply(domain.Operation{Op: domain.OpAppendLogin, Service: "mail", Login: "alice", Element: &domain.Element{Password: domain.NewSecret([]byte("hunter2-secret"))}})
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = r.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, suffix := range []string{"", "-wal"} {
+		data, err := os.ReadFile(path + suffix)
+		if err == nil && bytes.Contains(data, []byte("hunter2-secret")) {
+			t.Fatalf("the password is in %s in plain text", filepath.Base(path+suffix))
+		}
+	}
+}
+
+// A slot made with cheaper parameters is upgraded on Open, the elements move to a new data key.
+func TestKDFUpgrade(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "storage.db")
+	r := New(path, testKDF)
+
+	err := r.Open([]byte("secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = r.Apply(domain.Operation{Op: domain.OpAppendService, Service: "mail", Type: "password"})
+	if err == nil {
+		_, err = r.Apply(domain.Operation{Op: domain.OpAppendLogin, Service: "mail", Login: "alice", Element: &domain.Element{Password: domain.NewSecret([]byte("one"))}})
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cheap := r.Key()
+
+	err = r.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stronger := vault.KDFParams{Time: testKDF.Time + 1, Memory: testKDF.Memory, Threads: testKDF.Threads}
+
+	r = New(path, stronger)
+
+	err = r.Open([]byte("secret"))
+	if err != nil {
+		t.Fatalf("Open: %s", err)
+	}
+	defer r.Close()
+
+	if got := r.Key().KDF(); got != stronger {
+		t.Fatalf("got %+v, want %+v", got, stronger)
+	}
+
+	var element []byte
+
+	err = r.db.QueryRow("SELECT element FROM logins WHERE service = 'mail' AND login = 'alice'").Scan(&element)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = cheap.Open(element, elementAD("mail", "alice"))
+	if err == nil {
+		t.Fatal("the cheaper slot still reaches the elements")
+	}
+
+	storage, err := r.GetAll()
+	if err != nil || string(storage["mail"].Elements["alice"].Password.Bytes()) != "one" {
+		t.Fatalf("got %v, %v", storage, err)
+	}
+}
@@ -0,0 +1,345 @@
+package backup
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"manager/internal/disk"
+	"manager/internal/domain"
+)
+
+const timeFormat = "20060102T150405.000Z"
+
+var ErrNotFound = errors.New("backup not found")
+
+var errListOnly = errors.New("backups are open for listing only")
+
+// vault is the storage that is backed up. Snapshot returns a complete storage file, encrypted
+// like the storage itself, and Generation changes whenever the storage does.
+type vault interface {
+	Snapshot() ([]byte, error)
+	Restore(data []byte) error
+	Generation() uint64
+}
+
+// Retention is a grandfather-father-son policy: the newest backup of each of the last Hourly hours,
+// Daily days and Weekly weeks is kept. The newest backup is always kept.
+type Retention struct {
+	Hourly int
+	Daily  int
+	Weekly int
+}
+
+type Backup struct {
+	Name string    `json:"name"`
+	Time time.Time `json:"time"`
+	Size int64     `json:"size"`
+	// Targets lists the off-host targets that have a copy of the backup
+	Targets []string `json:"targets,omitempty"`
+}
+
+// Manager keeps snapshots of the storage file in a directory, named after the file and the time
+// they were taken, and copies them to the remote targets.
+type Manager struct {
+	vault     vault
+	dir       string
+	base      string
+	retention Retention
+	remote    Remote
+
+	mutex   *sync.Mutex
+	saved   bool
+	lastGen uint64
+	// unsent maps targets to the backup that failed to upload to them
+	unsent map[string]string
+}
+
+func New(v vault, dir, filename string, retention Retention, remote Remote) *Manager {
+	return &Manager{
+		vault:     v,
+		dir:       dir,
+		base:      filepath.Base(filename),
+		retention: retention,
+		remote:    remote,
+		mutex:     new(sync.Mutex),
+		unsent:    make(map[string]string),
+	}
+}
+
+// NewList returns a Manager without a storage, for listing the backups only. Create and Restore
+// fail on it.
+func NewList(dir, filename string, remote Remote) *Manager {
+	return New(nil, dir, filename, Retention{}, remote)
+}
+
+// Create takes a backup of the storage now, it needs the storage to be unlocked.
+func (m *Manager) Create() (Backup, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	return m.create(time.Now().UTC())
+}
+
+func (m *Manager) create(now time.Time) (Backup, error) {
+	if m.vault == nil {
+		return Backup{}, errListOnly
+	}
+
+	gen := m.vault.Generation()
+
+	data, err := m.vault.Snapshot()
+	if err != nil {
+		return Backup{}, err
+	}
+
+	err = os.MkdirAll(m.dir, 0700)
+	if err != nil {
+		return Backup{}, fmt.Errorf("failed to create backup directory: %s", err.Error())
+	}
+
+	b := Backup{
+		Name: m.base + "-" + now.Format(timeFormat),
+		Time: now.Truncate(time.Millisecond),
+		Size: int64(len(data)),
+	}
+
+	err = disk.CreateFile(m.path(b.Name), data, 0600)
+	if err != nil {
+		return Backup{}, fmt.Errorf("failed to write backup: %s", err.Error())
+	}
+
+	m.saved = true
+	m.lastGen = gen
+
+	m.prune()
+
+	b.Targets = m.upload(b.Name, data, m.remote.Targets)
+
+	return b, nil
+}
+
+// List returns the backups in the directory, or on the remote target with the name, the newest first.
+func (m *Manager) List(target string) ([]Backup, error) {
+	if target != "" {
+		t, err := m.target(target)
+		if err != nil {
+			return nil, err
+		}
+
+		backups, err := m.listRemote(t)
+		if err != nil {
+			return nil, err
+		}
+
+		return sortBackups(backups), nil
+	}
+
+	entries, err := os.ReadDir(m.dir)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read backup directory: %s", err.Error())
+	}
+
+	var backups []Backup
+
+	for _, entry := range entries {
+		t, ok := m.parseName(entry.Name())
+		if !ok || !entry.Type().IsRegular() {
+			continue
+		}
+
+		info, err := entry.Info()
+		if err != nil {
+			continue
+		}
+
+		backups = append(backups, Backup{Name: entry.Name(), Time: t, Size: info.Size()})
+	}
+
+	return sortBackups(backups), nil
+}
+
+// Restore replaces the storage with a backup from the directory, or downloaded from the remote
+// target with the name. The current state is backed up first when the storage is unlocked, and the
+// storage is locked afterwards.
+func (m *Manager) Restore(target, name string) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if m.vault == nil {
+		return errListOnly
+	}
+
+	if _, ok := m.parseName(name); !ok {
+		return ErrNotFound
+	}
+
+	data, err := m.read(target, name)
+	if err != nil {
+		return err
+	}
+
+	current, err := m.create(time.Now().UTC())
+	if err == nil {
+		log.Printf("backed up the current storage to %s before restoring %s", current.Name, name)
+	} else if !errors.Is(err, domain.ErrSealed) {
+		return fmt.Errorf("failed to back up the current storage: %s", err.Error())
+	}
+
+	err = m.vault.Restore(data)
+	if err != nil {
+		return err
+	}
+
+	if target != "" {
+		name += " on " + target
+	}
+
+	log.Printf("restored storage from backup %s", name)
+
+	return nil
+}
+
+// Run takes a backup every interval while the storage is unlocked and has changed since the last one,
+// and retries uploads that failed.
+func (m *Manager) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			m.mutex.Lock()
+
+			if !m.saved || m.vault.Generation() != m.lastGen {
+				_, err := m.create(time.Now().UTC())
+				if err != nil && !errors.Is(err, domain.ErrSealed) {
+					log.Printf("failed to back up storage: %s", err.Error())
+				}
+			} else {
+				m.retryUploads()
+			}
+
+			m.mutex.Unlock()
+		}
+	}
+}
+
+func (m *Manager) prune() {
+	backups, err := m.List("")
+	if err != nil {
+		log.Print(err.Error())
+
+		return
+	}
+
+	keep := m.retention.keep(backups)
+
+	for _, b := range backups {
+		if keep[b.Name] {
+			continue
+		}
+
+		err = os.Remove(m.path(b.Name))
+		if err != nil {
+			log.Printf("failed to remove old backup: %s", err.Error())
+		}
+	}
+}
+
+func (m *Manager) read(target, name string) ([]byte, error) {
+	if target != "" {
+		return m.fetch(target, name)
+	}
+
+	data, err := os.ReadFile(m.path(name))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read backup: %s", err.Error())
+	}
+
+	return data, nil
+}
+
+func (m *Manager) path(name string) string {
+	return filepath.Join(m.dir, name)
+}
+
+// parseName accepts only names of backups of this storage, so no path can sneak in.
+func (m *Manager) parseName(name string) (time.Time, bool) {
+	stamp, ok := strings.CutPrefix(name, m.base+"-")
+	if !ok {
+		return time.Time{}, false
+	}
+
+	t, err := time.Parse(timeFormat, stamp)
+	if err != nil {
+		return time.Time{}, false
+	}
+
+	return t, true
+}
+
+func sortBackups(backups []Backup) []Backup {
+	sort.Slice(backups, func(i, j int) bool {
+		return backups[i].Time.After(backups[j].Time)
+	})
+
+	return backups
+}
+
+// keep picks the backups to keep from a list sorted newest first.
+func (r Retention) keep(backups []Backup) map[string]bool {
+	keep := make(map[string]bool)
+
+	if len(backups) > 0 {
+		keep[backups[0].Name] = true
+	}
+
+	buckets := []struct {
+		count int
+		key   func(t time.Time) string
+	}{
+		{r.Hourly, func(t time.Time) string { return t.Format("2006-01-02T15") }},
+		{r.Daily, func(t time.Time) string { return t.Format("2006-01-02") }},
+		{r.Weekly, func(t time.Time) string {
+			year, week := t.ISOWeek()
+
+			return fmt.Sprintf("%d-W%02d", year, week)
+		}},
+	}
+
+	for _, bucket := range buckets {
+		seen := make(map[string]bool)
+
+		for _, b := range backups {
+			if len(seen) >= bucket.count {
+				break
+			}
+
+			key := bucket.key(b.Time)
+			if seen[key] {
+				continue
+			}
+
+			seen[key] = true
+			keep[b.Name] = true
+		}
+	}
+
+	return keep
+}
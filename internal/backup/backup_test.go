@@ -0,0 +1,590 @@
+package backup
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"filippo.io/age"
+
+	"manager/internal/domain"
+)
+
+type memVault struct {
+	mutex    sync.Mutex
+	data     []byte
+	gen      uint64
+	sealed   bool
+	restored []byte
+}
+
+func (v *memVault) Snapshot() ([]byte, error) {
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+
+	if v.sealed {
+		return nil, domain.ErrSealed
+	}
+
+	return append([]byte(nil), v.data...), nil
+}
+
+func (v *memVault) Restore(data []byte) error {
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+
+	v.restored = data
+
+	return nil
+}
+
+func (v *memVault) Generation() uint64 {
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+
+	return v.gen
+}
+
+func (v *memVault) change(data string) {
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+
+	v.data = []byte(data)
+	v.gen++
+}
+
+// memTarget keeps objects in memory, corrupt makes it return damaged copies.
+type memTarget struct {
+	mutex   sync.Mutex
+	objects map[string][]byte
+	corrupt bool
+}
+
+func newMemTarget() *memTarget {
+	return &memTarget{objects: make(map[string][]byte)}
+}
+
+func (t *memTarget) Name() string {
+	return "mem"
+}
+
+func (t *memTarget) Put(name string, data []byte) error {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	t.objects[name] = append([]byte(nil), data...)
+
+	return nil
+}
+
+func (t *memTarget) Get(name string) ([]byte, error) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	data, ok := t.objects[name]
+	if !ok {
+		return nil, ErrNotFound
+	}
+
+	if t.corrupt {
+		return append([]byte("damaged"), data...), nil
+	}
+
+	return data, nil
+}
+
+func (t *memTarget) List() ([]Object, error) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	var objects []Object
+
+	for name, data := range t.objects {
+		objects = append(objects, Object{Name: name, Size: int64(len(data))})
+	}
+
+	return objects, nil
+}
+
+func (t *memTarget) Delete(name string) error {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	delete(t.objects, name)
+
+	return nil
+}
+
+func (t *memTarget) names() []string {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	var names []string
+
+	for name := range t.objects {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+
+	return names
+}
+
+func at(value string) time.Time {
+	t, err := time.Parse("2006-01-02 15:04", value)
+	if err != nil {
+		panic(err)
+	}
+
+	return t
+}
+
+// schedule lists backups newest first. 2026-03-16 is the Monday starting ISO week 12.
+var schedule = []struct {
+	name string
+	time time.Time
+}{
+	{"a", at("2026-03-18 10:50")},
+	{"b", at("2026-03-18 10:10")},
+	{"c", at("2026-03-18 09:30")},
+	{"d", at("2026-03-17 23:00")},
+	{"e", at("2026-03-17 08:00")},
+	{"f", at("2026-03-16 12:00")},
+	{"g", at("2026-03-15 12:00")},
+	{"h", at("2026-03-08 12:00")},
+	{"i", at("2026-03-01 12:00")},
+}
+
+var testRetention = Retention{Hourly: 2, Daily: 3, Weekly: 3}
+
+// hourly a and c, daily a, d and f, weekly a, g and h
+var kept = []string{"a", "c", "d", "f", "g", "h"}
+
+func TestRetentionKeep(t *testing.T) {
+	var backups []Backup
+
+	for _, s := range schedule {
+		backups = append(backups, Backup{Name: s.name, Time: s.time})
+	}
+
+	tests := []struct {
+		retention Retention
+		want      []string
+	}{
+		{testRetention, kept},
+		{Retention{}, []string{"a"}},
+		{Retention{Hourly: 100}, []string{"a", "c", "d", "e", "f", "g", "h", "i"}},
+		{Retention{Weekly: 1}, []string{"a"}},
+		{Retention{Daily: 5}, []string{"a", "d", "f", "g", "h"}},
+	}
+
+	for _, tt := range tests {
+		keep := tt.retention.keep(backups)
+
+		var got []string
+		for name := range keep {
+			got = append(got, name)
+		}
+
+		sort.Strings(got)
+
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%+v: got %v, want %v", tt.retention, got, tt.want)
+		}
+	}
+
+	if keep := testRetention.keep(nil); len(keep) != 0 {
+		t.Fatalf("got %v for no backups", keep)
+	}
+}
+
+func newTestManager(t *testing.T, v *memVault, remote Remote) *Manager {
+	return New(v, filepath.Join(t.TempDir(), "backups"), "/var/lib/manager/storage.txt", testRetention, remote)
+}
+
+// createSchedule takes the backups of the schedule oldest first and returns their names by letter.
+func createSchedule(t *testing.T, m *Manager, v *memVault) map[string]string {
+	t.Helper()
+
+	names := make(map[string]string)
+
+	for i := len(schedule) - 1; i >= 0; i-- {
+		v.change(schedule[i].name)
+
+		b, err := m.create(schedule[i].time)
+		if err != nil {
+			t.Fatalf("create %s: %s", schedule[i].name, err)
+		}
+
+		names[schedule[i].name] = b.Name
+	}
+
+	return names
+}
+
+func wantNames(names map[string]string, letters []string, suffix string) []string {
+	var want []string
+
+	for _, letter := range letters {
+		want = append(want, names[letter]+suffix)
+	}
+
+	sort.Strings(want)
+
+	return want
+}
+
+func TestPrune(t *testing.T) {
+	v := new(memVault)
+	m := newTestManager(t, v, Remote{})
+
+	// files that are not backups of this storage are left alone
+	err := os.MkdirAll(m.dir, 0700)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	others := []string{"other.txt-20200101T000000.000Z", "storage.txt-notes", "storage.txt.bak"}
+	for _, name := range others {
+		err = os.WriteFile(filepath.Join(m.dir, name), nil, 0600)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	names := createSchedule(t, m, v)
+
+	backups, err := m.List("")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var got []string
+	for i, b := range backups {
+		got = append(got, b.Name)
+
+		if i > 0 && !b.Time.Before(backups[i-1].Time) {
+			t.Fatal("backups are not listed newest first")
+		}
+	}
+
+	sort.Strings(got)
+
+	if want := wantNames(names, kept, ""); !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+
+	if data, err := os.ReadFile(m.path(names["h"])); err != nil || string(data) != "h" {
+		t.Fatalf("backup h holds %q, %v", data, err)
+	}
+
+	for _, name := range others {
+		_, err = os.Stat(filepath.Join(m.dir, name))
+		if err != nil {
+			t.Fatalf("%s was removed: %s", name, err)
+		}
+	}
+}
+
+func TestCreateSealed(t *testing.T) {
+	v := &memVault{sealed: true}
+	m := newTestManager(t, v, Remote{})
+
+	_, err := m.Create()
+	if !errors.Is(err, domain.ErrSealed) {
+		t.Fatalf("got %v, want ErrSealed", err)
+	}
+}
+
+// A Manager for listing sees the backups of the storage but takes and restores none.
+func TestListOnly(t *testing.T) {
+	v := &memVault{}
+	m := newTestManager(t, v, Remote{})
+	createSchedule(t, m, v)
+
+	want, err := m.List("")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	list := NewList(m.dir, "/var/lib/manager/storage.txt", Remote{})
+
+	backups, err := list.List("")
+	if err != nil || !reflect.DeepEqual(backups, want) {
+		t.Fatalf("got %v, %v, want %v", backups, err, want)
+	}
+
+	_, err = list.Create()
+	if !errors.Is(err, errListOnly) {
+		t.Fatalf("Create: got %v", err)
+	}
+
+	err = list.Restore("", backups[0].Name)
+	if !errors.Is(err, errListOnly) {
+		t.Fatalf("Restore: got %v", err)
+	}
+}
+
+func TestRunSkipsUnchangedStorage(t *testing.T) {
+	v := new(memVault)
+	v.change("one")
+
+	m := newTestManager(t, v, Remote{})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+
+	go func() {
+		m.Run(ctx, 5*time.Millisecond)
+		close(done)
+	}()
+
+	time.Sleep(100 * time.Millisecond)
+	cancel()
+	<-done
+
+	backups, err := m.List("")
+	if err != nil || len(backups) != 1 {
+		t.Fatalf("got %d backups of an unchanged storage, %v", len(backups), err)
+	}
+}
+
+func TestRestore(t *testing.T) {
+	v := new(memVault)
+	m := newTestManager(t, v, Remote{})
+
+	v.change("old")
+
+	b, err := m.create(at("2026-03-18 10:00"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	v.change("current")
+
+	err = m.Restore("", b.Name)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if string(v.restored) != "old" {
+		t.Fatalf("restored %q", v.restored)
+	}
+
+	// the state before the restore is backed up
+	backups, err := m.List("")
+	if err != nil || len(backups) != 2 {
+		t.Fatalf("got %v, %v", backups, err)
+	}
+
+	if data, err := os.ReadFile(m.path(backups[0].Name)); err != nil || string(data) != "current" {
+		t.Fatalf("the newest backup holds %q, %v", data, err)
+	}
+
+	for _, name := range []string{"../storage.txt-20260318T100000.000Z", "storage.txt", "storage.txt-20200101T000000.000Z"} {
+		err = m.Restore("", name)
+		if !errors.Is(err, ErrNotFound) {
+			t.Errorf("%s: got %v, want ErrNotFound", name, err)
+		}
+	}
+}
+
+func newRemote(t *testing.T, target Target) Remote {
+	t.Helper()
+
+	identity, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	identityFile := filepath.Join(t.TempDir(), "identity")
+
+	err = os.WriteFile(identityFile, []byte(identity.String()+"\n"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return Remote{Targets: []Target{target}, Recipients: []age.Recipient{identity.Recipient()}, IdentityFile: identityFile}
+}
+
+func TestRemote(t *testing.T) {
+	target := newMemTarget()
+	v := new(memVault)
+	m := newTestManager(t, v, newRemote(t, target))
+
+	names := createSchedule(t, m, v)
+
+	if got, want := target.names(), wantNames(names, kept, remoteSuffix); !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+
+	for _, data := range target.objects {
+		if !bytes.HasPrefix(data, []byte("age-encryption.org/")) {
+			t.Fatal("a backup left the host unencrypted")
+		}
+	}
+
+	backups, err := m.List("mem")
+	if err != nil || len(backups) != len(kept) || backups[0].Name != names["a"] {
+		t.Fatalf("got %v, %v", backups, err)
+	}
+
+	err = m.Restore("mem", names["g"])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if string(v.restored) != "g" {
+		t.Fatalf("restored %q", v.restored)
+	}
+
+	_, err = m.List("elsewhere")
+	if !errors.Is(err, ErrNotFound) {
+		t.Fatalf("got %v for an unknown target", err)
+	}
+}
+
+// Two managers with the same names share a target through a prefix, neither prunes the other.
+func TestPrefixedTarget(t *testing.T) {
+	target := newMemTarget()
+	v, other := new(memVault), new(memVault)
+	m := newTestManager(t, v, newRemote(t, target))
+	prefixed := newTestManager(t, other, newRemote(t, Prefixed(target, "other-")))
+
+	names := createSchedule(t, m, v)
+	otherNames := createSchedule(t, prefixed, other)
+
+	want := wantNames(names, kept, remoteSuffix)
+	for _, name := range wantNames(otherNames, kept, remoteSuffix) {
+		want = append(want, "other-"+name)
+	}
+
+	sort.Strings(want)
+
+	if got := target.names(); !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+
+	for _, manager := range []*Manager{m, prefixed} {
+		backups, err := manager.List("mem")
+		if err != nil || len(backups) != len(kept) {
+			t.Fatalf("got %v, %v", backups, err)
+		}
+	}
+
+	err := prefixed.Restore("mem", otherNames["g"])
+	if err != nil || string(other.restored) != "g" || v.restored != nil {
+		t.Fatalf("restored %q, %q, %v", other.restored, v.restored, err)
+	}
+}
+
+func TestRetryUpload(t *testing.T) {
+	target := newMemTarget()
+	target.corrupt = true
+
+	v := new(memVault)
+	v.change("one")
+
+	m := newTestManager(t, v, newRemote(t, target))
+
+	b, err := m.Create()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(b.Targets) != 0 || len(target.names()) != 0 {
+		t.Fatalf("a damaged upload counts: %v, %v", b.Targets, target.names())
+	}
+
+	target.corrupt = false
+	m.retryUploads()
+
+	if got := target.names(); !reflect.DeepEqual(got, []string{b.Name + remoteSuffix}) {
+		t.Fatalf("got %v after retrying", got)
+	}
+
+	if len(m.unsent) != 0 {
+		t.Fatalf("still unsent: %v", m.unsent)
+	}
+}
+
+// testTarget puts, lists, reads and deletes objects on a target that starts empty.
+func testTarget(t *testing.T, target Target) {
+	t.Helper()
+
+	objects, err := target.List()
+	if err != nil || len(objects) != 0 {
+		t.Fatalf("List on an empty target: got %v, %v", objects, err)
+	}
+
+	_, err = target.Get("missing")
+	if !errors.Is(err, ErrNotFound) {
+		t.Fatalf("Get of a missing object: got %v, want ErrNotFound", err)
+	}
+
+	for name, data := range map[string]string{"first": "one", "second": "three"} {
+		err = target.Put(name, []byte(data))
+		if err != nil {
+			t.Fatalf("Put %s: %s", name, err)
+		}
+	}
+
+	data, err := target.Get("second")
+	if err != nil || string(data) != "three" {
+		t.Fatalf("Get: got %q, %v", data, err)
+	}
+
+	objects, err = target.List()
+	sort.Slice(objects, func(i, j int) bool { return objects[i].Name < objects[j].Name })
+	if want := []Object{{Name: "first", Size: 3}, {Name: "second", Size: 5}}; err != nil || !reflect.DeepEqual(objects, want) {
+		t.Fatalf("List: got %v, %v, want %v", objects, err, want)
+	}
+
+	err = target.Delete("first")
+	if err != nil {
+		t.Fatalf("Delete: %s", err)
+	}
+
+	_, err = target.Get("first")
+	if !errors.Is(err, ErrNotFound) {
+		t.Fatalf("Get of a deleted object: got %v, want ErrNotFound", err)
+	}
+
+	objects, err = target.List()
+	if err != nil || len(objects) != 1 || objects[0].Name != "second" {
+		t.Fatalf("List after Delete: got %v, %v", objects, err)
+	}
+}
+
+// testTargetDenied checks that a target with wrong credentials fails without passing the refusal
+// off as a missing object.
+func testTargetDenied(t *testing.T, target Target) {
+	t.Helper()
+
+	err := target.Put("first", []byte("one"))
+	if err == nil {
+		t.Fatal("Put with wrong credentials succeeded")
+	}
+
+	_, err = target.Get("first")
+	if err == nil || errors.Is(err, ErrNotFound) {
+		t.Fatalf("Get with wrong credentials: got %v", err)
+	}
+
+	_, err = target.List()
+	if err == nil {
+		t.Fatal("List with wrong credentials succeeded")
+	}
+
+	err = target.Delete("first")
+	if err == nil {
+		t.Fatal("Delete with wrong credentials succeeded")
+	}
+}
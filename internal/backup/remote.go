@@ -0,0 +1,318 @@
+package backup
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+
+	"filippo.io/age"
+)
+
+const remoteSuffix = ".age"
+
+// Target is an off-host location backups are copied to.
+type Target interface {
+	Name() string
+	Put(name string, data []byte) error
+	// Get returns ErrNotFound when there is no object with the name
+	Get(name string) ([]byte, error)
+	List() ([]Object, error)
+	Delete(name string) error
+}
+
+type Object struct {
+	Name string
+	Size int64
+}
+
+// Remote describes where backups are copied to. Backups leave the host only encrypted to
+// Recipients, the identities to restore them are read from IdentityFile when they are needed.
+type Remote struct {
+	Targets      []Target
+	Recipients   []age.Recipient
+	IdentityFile string
+}
+
+func (m *Manager) target(name string) (Target, error) {
+	for _, t := range m.remote.Targets {
+		if t.Name() == name {
+			return t, nil
+		}
+	}
+
+	return nil, fmt.Errorf("%w: unknown target %q", ErrNotFound, name)
+}
+
+// upload copies a backup to every target and returns the names of the targets that have it.
+// Failed uploads are tried again by Run.
+func (m *Manager) upload(name string, data []byte, targets []Target) []string {
+	if len(targets) == 0 {
+		return nil
+	}
+
+	sealed, err := m.remote.seal(data)
+	if err != nil {
+		log.Printf("failed to encrypt backup %s for upload: %s", name, err.Error())
+
+		for _, t := range targets {
+			m.unsent[t.Name()] = name
+		}
+
+		return nil
+	}
+
+	var done []string
+
+	for _, t := range targets {
+		err = put(t, name+remoteSuffix, sealed)
+		if err != nil {
+			log.Printf("failed to upload backup %s to %s: %s", name, t.Name(), err.Error())
+			m.unsent[t.Name()] = name
+
+			continue
+		}
+
+		delete(m.unsent, t.Name())
+		done = append(done, t.Name())
+
+		m.pruneRemote(t)
+	}
+
+	return done
+}
+
+// retryUploads uploads the newest backup again to the targets where it failed.
+func (m *Manager) retryUploads() {
+	byName := make(map[string][]Target)
+
+	for target, name := range m.unsent {
+		t, err := m.target(target)
+		if err != nil {
+			delete(m.unsent, target)
+
+			continue
+		}
+
+		byName[name] = append(byName[name], t)
+	}
+
+	for name, targets := range byName {
+		data, err := os.ReadFile(m.path(name))
+		if err != nil {
+			log.Printf("failed to read backup %s for upload: %s", name, err.Error())
+
+			for _, t := range targets {
+				delete(m.unsent, t.Name())
+			}
+
+			continue
+		}
+
+		m.upload(name, data, targets)
+	}
+}
+
+// put uploads an object and reads it back, so a backup only counts once the target returns it intact.
+func put(t Target, name string, data []byte) error {
+	err := t.Put(name, data)
+	if err != nil {
+		return err
+	}
+
+	stored, err := t.Get(name)
+	if err != nil {
+		return fmt.Errorf("failed to read back upload: %s", err.Error())
+	}
+
+	if sha256.Sum256(stored) != sha256.Sum256(data) {
+		err = t.Delete(name)
+		if err != nil {
+			log.Printf("failed to remove corrupted upload %s from %s: %s", name, t.Name(), err.Error())
+		}
+
+		return errors.New("uploaded backup does not match the local one")
+	}
+
+	return nil
+}
+
+func (m *Manager) listRemote(t Target) ([]Backup, error) {
+	objects, err := t.List()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list backups on %s: %s", t.Name(), err.Error())
+	}
+
+	var backups []Backup
+
+	for _, o := range objects {
+		name, ok := strings.CutSuffix(o.Name, remoteSuffix)
+		if !ok {
+			continue
+		}
+
+		at, ok := m.parseName(name)
+		if !ok {
+			continue
+		}
+
+		backups = append(backups, Backup{Name: name, Time: at, Size: o.Size, Targets: []string{t.Name()}})
+	}
+
+	return backups, nil
+}
+
+func (m *Manager) fetch(target, name string) ([]byte, error) {
+	t, err := m.target(target)
+	if err != nil {
+		return nil, err
+	}
+
+	sealed, err := t.Get(name + remoteSuffix)
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := m.remote.open(sealed)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt backup: %s", err.Error())
+	}
+
+	return data, nil
+}
+
+func (m *Manager) pruneRemote(t Target) {
+	backups, err := m.listRemote(t)
+	if err != nil {
+		log.Print(err.Error())
+
+		return
+	}
+
+	keep := m.retention.keep(sortBackups(backups))
+
+	for _, b := range backups {
+		if keep[b.Name] {
+			continue
+		}
+
+		err = t.Delete(b.Name + remoteSuffix)
+		if err != nil {
+			log.Printf("failed to remove old backup from %s: %s", t.Name(), err.Error())
+		}
+	}
+}
+
+func (r Remote) seal(data []byte) ([]byte, error) {
+	if len(r.Recipients) == 0 {
+		return nil, errors.New("no recipients to encrypt backups to")
+	}
+
+	buf := new(bytes.Buffer)
+
+	w, err := age.Encrypt(buf, r.Recipients...)
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = w.Write(data)
+	if err != nil {
+		return nil, err
+	}
+
+	err = w.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+func (r Remote) open(sealed []byte) ([]byte, error) {
+	if r.IdentityFile == "" {
+		return nil, errors.New("no identity file to decrypt backups with")
+	}
+
+	f, err := os.Open(r.IdentityFile)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	identities, err := age.ParseIdentities(f)
+	if err != nil {
+		return nil, err
+	}
+
+	rd, err := age.Decrypt(bytes.NewReader(sealed), identities...)
+	if err != nil {
+		return nil, err
+	}
+
+	return io.ReadAll(rd)
+}
+
+// ParseRecipients parses age public keys, one per entry.
+func ParseRecipients(keys []string) ([]age.Recipient, error) {
+	var recipients []age.Recipient
+
+	for _, key := range keys {
+		r, err := age.ParseX25519Recipient(strings.TrimSpace(key))
+		if err != nil {
+			return nil, fmt.Errorf("invalid backup recipient %q: %s", key, err.Error())
+		}
+
+		recipients = append(recipients, r)
+	}
+
+	return recipients, nil
+}
+
+// Prefixed stores the objects of a target under a prefix, so two managers can share the target
+// without seeing or pruning the backups of each other. The target keeps its name.
+func Prefixed(t Target, prefix string) Target {
+	return prefixed{t: t, prefix: prefix}
+}
+
+type prefixed struct {
+	t      Target
+	prefix string
+}
+
+func (p prefixed) Name() string {
+	return p.t.Name()
+}
+
+func (p prefixed) Put(name string, data []byte) error {
+	return p.t.Put(p.prefix+name, data)
+}
+
+func (p prefixed) Get(name string) ([]byte, error) {
+	return p.t.Get(p.prefix + name)
+}
+
+func (p prefixed) Delete(name string) error {
+	return p.t.Delete(p.prefix + name)
+}
+
+func (p prefixed) List() ([]Object, error) {
+	objects, err := p.t.List()
+	if err != nil {
+		return nil, err
+	}
+
+	var own []Object
+
+	for _, o := range objects {
+		name, ok := strings.CutPrefix(o.Name, p.prefix)
+		if ok {
+			own = append(own, Object{Name: name, Size: o.Size})
+		}
+	}
+
+	return own, nil
+}
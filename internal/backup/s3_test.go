@@ -0,0 +1,188 @@
+package backup
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// s3Server answers the requests the S3 target sends for a single bucket. It checks the access key
+// of a request, not its signature.
+type s3Server struct {
+	mutex     sync.Mutex
+	bucket    string
+	accessKey string
+	objects   map[string][]byte
+}
+
+func (s *s3Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !strings.Contains(r.Header.Get("Authorization"), "Credential="+s.accessKey+"/") {
+		s3Error(w, http.StatusForbidden, "AccessDenied")
+		return
+	}
+
+	bucket, key, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/"), "/")
+	if bucket != s.bucket {
+		s3Error(w, http.StatusNotFound, "NoSuchBucket")
+		return
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	query := r.URL.Query()
+
+	switch {
+	case key == "" && query.Has("location"):
+		w.Write([]byte(`<LocationConstraint xmlns="http://s3.amazonaws.com/doc/2006-03-01/"></LocationConstraint>`))
+	case key == "" && r.Method == http.MethodGet:
+		s.list(w, query.Get("prefix"))
+	case r.Method == http.MethodPut:
+		data, err := readChunked(r)
+		if err != nil {
+			s3Error(w, http.StatusBadRequest, "IncompleteBody")
+			return
+		}
+
+		s.objects[key] = data
+		w.Header().Set("ETag", `"etag"`)
+	case r.Method == http.MethodGet:
+		data, ok := s.objects[key]
+		if !ok {
+			s3Error(w, http.StatusNotFound, "NoSuchKey")
+			return
+		}
+
+		w.Header().Set("ETag", `"etag"`)
+		w.Header().Set("Last-Modified", time.Now().UTC().Format(http.TimeFormat))
+		w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+		w.Write(data)
+	case r.Method == http.MethodDelete:
+		delete(s.objects, key)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		s3Error(w, http.StatusNotImplemented, "NotImplemented")
+	}
+}
+
+func (s *s3Server) list(w http.ResponseWriter, prefix string) {
+	type content struct {
+		Key          string
+		Size         int64
+		LastModified string
+		ETag         string
+	}
+
+	result := struct {
+		XMLName  xml.Name `xml:"ListBucketResult"`
+		Name     string
+		Prefix   string
+		KeyCount int
+		Contents []content
+	}{Name: s.bucket, Prefix: prefix}
+
+	for key, data := range s.objects {
+		if strings.HasPrefix(key, prefix) && !strings.Contains(key[len(prefix):], "/") {
+			result.Contents = append(result.Contents, content{
+				Key:          key,
+				Size:         int64(len(data)),
+				LastModified: time.Now().UTC().Format(time.RFC3339),
+				ETag:         `"etag"`,
+			})
+		}
+	}
+
+	sort.Slice(result.Contents, func(i, j int) bool { return result.Contents[i].Key < result.Contents[j].Key })
+	result.KeyCount = len(result.Contents)
+
+	xml.NewEncoder(w).Encode(result)
+}
+
+func s3Error(w http.ResponseWriter, status int, code string) {
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(status)
+	fmt.Fprintf(w, "<Error><Code>%s</Code><Message>%s</Message></Error>", code, code)
+}
+
+// readChunked reads the body of an upload, which over plain http comes in aws-chunked encoding.
+func readChunked(r *http.Request) ([]byte, error) {
+	if r.Header.Get("X-Amz-Decoded-Content-Length") == "" {
+		return io.ReadAll(r.Body)
+	}
+
+	var data []byte
+
+	body := bufio.NewReader(r.Body)
+
+	for {
+		line, err := body.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+
+		size, _, _ := strings.Cut(strings.TrimSpace(line), ";")
+
+		n, err := strconv.ParseInt(size, 16, 64)
+		if err != nil {
+			return nil, err
+		}
+
+		chunk := make([]byte, n+2)
+
+		_, err = io.ReadFull(body, chunk)
+		if err != nil {
+			return nil, err
+		}
+
+		if n == 0 {
+			return data, nil
+		}
+
+		data = append(data, chunk[:n]...)
+	}
+}
+
+func newTestS3(t *testing.T, server *s3Server, accessKey string) *S3 {
+	t.Helper()
+
+	httpServer := httptest.NewServer(server)
+	t.Cleanup(httpServer.Close)
+
+	target, err := NewS3(strings.TrimPrefix(httpServer.URL, "http://"), server.bucket, "/backups/", accessKey, "secret", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return target
+}
+
+func TestS3(t *testing.T) {
+	server := &s3Server{bucket: "vault", accessKey: "manager", objects: make(map[string][]byte)}
+	server.objects["elsewhere"] = []byte("outside the prefix")
+
+	testTarget(t, newTestS3(t, server, "manager"))
+
+	if !bytes.Equal(server.objects["backups/second"], []byte("three")) || len(server.objects) != 2 {
+		t.Fatalf("objects outside of the prefix: %v", server.objects)
+	}
+}
+
+func TestS3Denied(t *testing.T) {
+	server := &s3Server{bucket: "vault", accessKey: "manager", objects: make(map[string][]byte)}
+
+	testTargetDenied(t, newTestS3(t, server, "stranger"))
+
+	if len(server.objects) != 0 {
+		t.Fatalf("a refused upload was stored: %v", server.objects)
+	}
+}
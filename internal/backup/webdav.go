@@ -0,0 +1,87 @@
+package backup
+
+import (
+	"fmt"
+	"path"
+	"strings"
+
+	"github.com/studio-b12/gowebdav"
+)
+
+// WebDAV stores backups in a directory of a WebDAV share, like Nextcloud or a plain web server.
+type WebDAV struct {
+	client *gowebdav.Client
+	dir    string
+}
+
+// NewWebDAV takes the URL of the share and the directory in it to keep the backups in.
+func NewWebDAV(url, dir, user, password string) *WebDAV {
+	client := gowebdav.NewClient(url, user, password)
+	client.SetTimeout(requestTimeout)
+
+	return &WebDAV{
+		client: client,
+		dir:    "/" + strings.Trim(dir, "/"),
+	}
+}
+
+func (w *WebDAV) Name() string {
+	return "webdav"
+}
+
+func (w *WebDAV) Put(name string, data []byte) error {
+	err := w.client.MkdirAll(w.dir, 0700)
+	if err != nil {
+		return fmt.Errorf("failed to create directory %s: %s", w.dir, err.Error())
+	}
+
+	err = w.client.Write(path.Join(w.dir, name), data, 0600)
+	if err != nil {
+		return fmt.Errorf("failed to upload %s: %s", name, err.Error())
+	}
+
+	return nil
+}
+
+func (w *WebDAV) Get(name string) ([]byte, error) {
+	data, err := w.client.Read(path.Join(w.dir, name))
+	if gowebdav.IsErrNotFound(err) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to download %s: %s", name, err.Error())
+	}
+
+	return data, nil
+}
+
+func (w *WebDAV) List() ([]Object, error) {
+	files, err := w.client.ReadDir(w.dir)
+	if gowebdav.IsErrNotFound(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var objects []Object
+
+	for _, file := range files {
+		if file.IsDir() {
+			continue
+		}
+
+		objects = append(objects, Object{Name: file.Name(), Size: file.Size()})
+	}
+
+	return objects, nil
+}
+
+func (w *WebDAV) Delete(name string) error {
+	err := w.client.Remove(path.Join(w.dir, name))
+	if err != nil {
+		return fmt.Errorf("failed to remove %s: %s", name, err.Error())
+	}
+
+	return nil
+}
@@ -0,0 +1,55 @@
+package backup
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"golang.org/x/net/webdav"
+)
+
+// newWebDAVServer serves an in-memory share behind basic authentication.
+func newWebDAVServer(t *testing.T, user, password string) (string, webdav.FileSystem) {
+	t.Helper()
+
+	fs := webdav.NewMemFS()
+	handler := &webdav.Handler{FileSystem: fs, LockSystem: webdav.NewMemLS()}
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		u, p, ok := r.BasicAuth()
+		if !ok || u != user || p != password {
+			w.Header().Set("WWW-Authenticate", `Basic realm="backups"`)
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		handler.ServeHTTP(w, r)
+	}))
+	t.Cleanup(server.Close)
+
+	return server.URL, fs
+}
+
+func TestWebDAV(t *testing.T) {
+	url, fs := newWebDAVServer(t, "manager", "secret")
+
+	testTarget(t, NewWebDAV(url, "/vault/backups/", "manager", "secret"))
+
+	_, err := fs.Stat(context.Background(), "/vault/backups/second")
+	if err != nil {
+		t.Fatalf("the backup is not in the directory: %s", err)
+	}
+}
+
+func TestWebDAVDenied(t *testing.T) {
+	url, fs := newWebDAVServer(t, "manager", "secret")
+
+	testTargetDenied(t, NewWebDAV(url, "backups", "manager", "guess"))
+
+	_, err := fs.Stat(context.Background(), "/backups")
+	if !os.IsNotExist(err) {
+		t.Fatalf("a refused upload created the directory: %v", err)
+	}
+}
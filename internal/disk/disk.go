@@ -0,0 +1,187 @@
+package disk
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+const BackupSuffix = ".bak"
+
+// WriteFile replaces the file at path with data so that a crash at any point leaves either the old
+// or the new version in place. The previous version is kept next to it with the BackupSuffix.
+func WriteFile(path string, data []byte, perm os.FileMode) error {
+	return replaceFile(path, data, perm, true)
+}
+
+// ReplaceFile replaces the file at path like WriteFile does, without keeping the previous version.
+func ReplaceFile(path string, data []byte, perm os.FileMode) error {
+	return replaceFile(path, data, perm, false)
+}
+
+func replaceFile(path string, data []byte, perm os.FileMode, keep bool) error {
+	dir := filepath.Dir(path)
+
+	tmp, err := os.CreateTemp(dir, "."+filepath.Base(path)+".tmp-*")
+	if err != nil {
+		return fmt.Errorf("failed to create temporary file: %s", err.Error())
+	}
+	defer os.Remove(tmp.Name())
+
+	err = writeAndSync(tmp, data, perm)
+	if err != nil {
+		return err
+	}
+
+	if keep {
+		err = backup(path)
+		if err != nil {
+			return fmt.Errorf("failed to keep previous version: %s", err.Error())
+		}
+	}
+
+	err = os.Rename(tmp.Name(), path)
+	if err != nil {
+		return fmt.Errorf("failed to replace file: %s", err.Error())
+	}
+
+	return SyncDir(dir)
+}
+
+// CreateFile atomically writes a new file at path, it fails with os.ErrExist when there is one.
+func CreateFile(path string, data []byte, perm os.FileMode) error {
+	dir := filepath.Dir(path)
+
+	tmp, err := os.CreateTemp(dir, "."+filepath.Base(path)+".tmp-*")
+	if err != nil {
+		return fmt.Errorf("failed to create temporary file: %s", err.Error())
+	}
+	defer os.Remove(tmp.Name())
+
+	err = writeAndSync(tmp, data, perm)
+	if err != nil {
+		return err
+	}
+
+	err = os.Link(tmp.Name(), path)
+	if err != nil {
+		return fmt.Errorf("failed to create file: %w", err)
+	}
+
+	return SyncDir(dir)
+}
+
+// SyncDir makes renames and unlinks inside dir durable.
+func SyncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return fmt.Errorf("failed to open directory: %s", err.Error())
+	}
+	defer d.Close()
+
+	err = d.Sync()
+	if err != nil {
+		return fmt.Errorf("failed to sync directory: %s", err.Error())
+	}
+
+	return nil
+}
+
+func writeAndSync(file *os.File, data []byte, perm os.FileMode) error {
+	_, err := file.Write(data)
+	if err != nil {
+		file.Close()
+
+		return fmt.Errorf("failed to write temporary file: %s", err.Error())
+	}
+
+	err = file.Chmod(perm)
+	if err != nil {
+		file.Close()
+
+		return fmt.Errorf("failed to set file permissions: %s", err.Error())
+	}
+
+	err = file.Sync()
+	if err != nil {
+		file.Close()
+
+		return fmt.Errorf("failed to sync temporary file: %s", err.Error())
+	}
+
+	return file.Close()
+}
+
+// backup atomically points path+BackupSuffix at the current generation of path.
+func backup(path string) error {
+	bak := path + BackupSuffix
+	tmp := bak + ".tmp"
+
+	os.Remove(tmp)
+
+	err := os.Link(path, tmp)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		// hard links are not supported everywhere, fall back to a copy
+		err = copyFile(path, tmp)
+		if err != nil {
+			return err
+		}
+	}
+
+	return os.Rename(tmp, bak)
+}
+
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	info, err := in.Stat()
+	if err != nil {
+		return err
+	}
+
+	out, err := os.OpenFile(dst, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, info.Mode().Perm())
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(out, in)
+	if err != nil {
+		out.Close()
+
+		return err
+	}
+
+	err = out.Sync()
+	if err != nil {
+		out.Close()
+
+		return err
+	}
+
+	return out.Close()
+}
+
+// Quarantine moves a damaged file out of the way under a timestamped name and returns that name.
+func Quarantine(path string) (string, error) {
+	quarantined := quarantineName(path)
+
+	err := os.Rename(path, quarantined)
+	if err != nil {
+		return "", fmt.Errorf("failed to quarantine file: %s", err.Error())
+	}
+
+	return quarantined, SyncDir(filepath.Dir(path))
+}
+
+func quarantineName(path string) string {
+	return path + ".corrupt-" + time.Now().UTC().Format("20060102T150405Z")
+}
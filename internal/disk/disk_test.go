@@ -0,0 +1,153 @@
+package disk
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func readFile(t *testing.T, path string) string {
+	t.Helper()
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return string(data)
+}
+
+func TestWriteFileKeepsPreviousGeneration(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "storage.txt")
+
+	for _, content := range []string{"one", "two", "three"} {
+		err := WriteFile(path, []byte(content), 0600)
+		if err != nil {
+			t.Fatalf("WriteFile %s: %s", content, err)
+		}
+	}
+
+	if got := readFile(t, path); got != "three" {
+		t.Fatalf("file holds %q", got)
+	}
+
+	if got := readFile(t, path+BackupSuffix); got != "two" {
+		t.Fatalf("backup holds %q", got)
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if info.Mode().Perm() != 0600 {
+		t.Fatalf("file mode %v", info.Mode().Perm())
+	}
+
+	// no temporary files are left behind
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, entry := range entries {
+		if strings.Contains(entry.Name(), ".tmp") {
+			t.Fatalf("temporary file %s left behind", entry.Name())
+		}
+	}
+}
+
+func TestWriteFileFirstGeneration(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "storage.txt")
+
+	err := WriteFile(path, []byte("one"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = os.Stat(path + BackupSuffix)
+	if !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("a backup of nothing was made: %v", err)
+	}
+}
+
+func TestWriteFileFailureKeepsFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "missing", "storage.txt")
+
+	err := WriteFile(path, []byte("one"), 0600)
+	if err == nil {
+		t.Fatal("WriteFile into a missing directory succeeded")
+	}
+
+	dir := t.TempDir()
+	path = filepath.Join(dir, "storage.txt")
+
+	err = WriteFile(path, []byte("one"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if os.Geteuid() == 0 {
+		t.Skip("permissions do not apply to root")
+	}
+
+	// the temporary file cannot be created next to it
+	err = os.Chmod(dir, 0500)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chmod(dir, 0700)
+
+	err = WriteFile(path, []byte("two"), 0600)
+	if err == nil {
+		t.Fatal("WriteFile into a read-only directory succeeded")
+	}
+
+	if got := readFile(t, path); got != "one" {
+		t.Fatalf("file holds %q after a failed write", got)
+	}
+}
+
+func TestCreateFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "storage.txt")
+
+	err := CreateFile(path, []byte("one"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = CreateFile(path, []byte("two"), 0600)
+	if !errors.Is(err, os.ErrExist) {
+		t.Fatalf("got %v, want os.ErrExist", err)
+	}
+
+	if got := readFile(t, path); got != "one" {
+		t.Fatalf("file holds %q", got)
+	}
+}
+
+func TestQuarantine(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "storage.txt")
+
+	err := WriteFile(path, []byte("damaged"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	quarantined, err := Quarantine(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !strings.HasPrefix(quarantined, path+".corrupt-") || readFile(t, quarantined) != "damaged" {
+		t.Fatalf("quarantined as %s", quarantined)
+	}
+
+	_, err = os.Stat(path)
+	if !errors.Is(err, os.ErrNotExist) {
+		t.Fatal("the damaged file is still in place")
+	}
+}
@@ -0,0 +1,232 @@
+package disk
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"log"
+	"os"
+)
+
+// Journal file layout:
+//
+//	magic "MGRJ" | version (1 byte) | base (32 bytes) | entries
+//
+// where every entry is its payload length and CRC-32C (both uint32, big endian) followed by the
+// payload. The base identifies the snapshot the entries have to be replayed on top of.
+const (
+	journalMagic      = "MGRJ"
+	journalVersion1   = 1
+	BaseSize          = 32
+	journalHeaderSize = len(journalMagic) + 1 + BaseSize
+	entryHeaderSize   = 8
+	maxEntrySize      = 16 << 20
+)
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+var ErrInvalidJournal = errors.New("invalid journal")
+
+type Journal struct {
+	file *os.File
+	base []byte
+	size int64
+}
+
+// CreateJournal atomically replaces the journal at path with an empty one following base.
+func CreateJournal(path string, base []byte) (*Journal, error) {
+	if len(base) != BaseSize {
+		return nil, fmt.Errorf("invalid journal base size %d", len(base))
+	}
+
+	header := make([]byte, 0, journalHeaderSize)
+	header = append(header, journalMagic...)
+	header = append(header, journalVersion1)
+	header = append(header, base...)
+
+	err := WriteFile(path, header, 0600)
+	if err != nil {
+		return nil, err
+	}
+
+	// the previous generation of a journal is useless once a new snapshot is written
+	os.Remove(path + BackupSuffix)
+
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open journal: %s", err.Error())
+	}
+
+	return &Journal{
+		file: file,
+		base: base,
+		size: int64(len(header)),
+	}, nil
+}
+
+// OpenJournal reads all intact entries of the journal at path and opens it for appending.
+// A torn or damaged tail, as left by a crash in the middle of an append, is cut off. A damaged
+// entry followed by others is cut off together with them, the journal is kept aside before that.
+func OpenJournal(path string) (*Journal, [][]byte, error) {
+	file, err := os.OpenFile(path, os.O_RDWR, 0600)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	data, err := io.ReadAll(file)
+	if err != nil {
+		file.Close()
+
+		return nil, nil, fmt.Errorf("failed to read journal: %s", err.Error())
+	}
+
+	if len(data) < journalHeaderSize || !bytes.HasPrefix(data, []byte(journalMagic)) || data[len(journalMagic)] != journalVersion1 {
+		file.Close()
+
+		return nil, nil, ErrInvalidJournal
+	}
+
+	base := append([]byte(nil), data[len(journalMagic)+1:journalHeaderSize]...)
+
+	var entries [][]byte
+
+	offset := journalHeaderSize
+	for offset+entryHeaderSize <= len(data) {
+		size := int(binary.BigEndian.Uint32(data[offset:]))
+		sum := binary.BigEndian.Uint32(data[offset+4:])
+
+		end := offset + entryHeaderSize + size
+		if size > maxEntrySize || end > len(data) {
+			break
+		}
+
+		payload := data[offset+entryHeaderSize : end]
+		if crc32.Checksum(payload, crcTable) != sum {
+			break
+		}
+
+		entries = append(entries, payload)
+		offset = end
+	}
+
+	if dropped := countEntries(data, offset); dropped > 0 {
+		quarantined := quarantineName(path)
+
+		err = CreateFile(quarantined, data, 0600)
+		if err != nil {
+			file.Close()
+
+			return nil, nil, fmt.Errorf("failed to keep damaged journal: %s", err.Error())
+		}
+
+		log.Printf("journal %s is damaged after entry %d, dropping %d intact entries after it, the journal is kept in %s", path, len(entries), dropped, quarantined)
+	} else if offset < len(data) {
+		log.Printf("journal %s has a damaged tail of %d bytes, truncating", path, len(data)-offset)
+	}
+
+	if offset < len(data) {
+		err = file.Truncate(int64(offset))
+		if err == nil {
+			err = file.Sync()
+		}
+		if err != nil {
+			file.Close()
+
+			return nil, nil, fmt.Errorf("failed to truncate journal: %s", err.Error())
+		}
+	}
+
+	_, err = file.Seek(int64(offset), io.SeekStart)
+	if err != nil {
+		file.Close()
+
+		return nil, nil, fmt.Errorf("failed to seek journal: %s", err.Error())
+	}
+
+	return &Journal{
+		file: file,
+		base: base,
+		size: int64(offset),
+	}, entries, nil
+}
+
+// countEntries counts the intact entries after the damaged one at offset. There are none after a
+// torn append, which only leaves a damaged tail.
+func countEntries(data []byte, offset int) int {
+	if offset+entryHeaderSize > len(data) {
+		return 0
+	}
+
+	size := int(binary.BigEndian.Uint32(data[offset:]))
+	if size > maxEntrySize || offset+entryHeaderSize+size >= len(data) {
+		return 0
+	}
+
+	count := 0
+
+	offset += entryHeaderSize + size
+	for offset+entryHeaderSize <= len(data) {
+		size = int(binary.BigEndian.Uint32(data[offset:]))
+
+		end := offset + entryHeaderSize + size
+		if size > maxEntrySize || end > len(data) {
+			break
+		}
+
+		if crc32.Checksum(data[offset+entryHeaderSize:end], crcTable) == binary.BigEndian.Uint32(data[offset+4:]) {
+			count++
+		}
+
+		offset = end
+	}
+
+	return count
+}
+
+// Append writes the payloads as one batch and syncs them to disk.
+func (j *Journal) Append(payloads [][]byte) error {
+	if len(payloads) == 0 {
+		return nil
+	}
+
+	var buf []byte
+
+	for _, payload := range payloads {
+		buf = binary.BigEndian.AppendUint32(buf, uint32(len(payload)))
+		buf = binary.BigEndian.AppendUint32(buf, crc32.Checksum(payload, crcTable))
+		buf = append(buf, payload...)
+	}
+
+	_, err := j.file.Write(buf)
+	if err == nil {
+		err = j.file.Sync()
+	}
+
+	if err != nil {
+		// drop the batch so it can be retried without leaving garbage or duplicates behind
+		j.file.Truncate(j.size)
+		j.file.Seek(j.size, io.SeekStart)
+
+		return fmt.Errorf("failed to append to journal: %s", err.Error())
+	}
+
+	j.size += int64(len(buf))
+
+	return nil
+}
+
+// Base identifies the snapshot the journal follows.
+func (j *Journal) Base() []byte {
+	return j.base
+}
+
+func (j *Journal) Size() int64 {
+	return j.size
+}
+
+func (j *Journal) Close() error {
+	return j.file.Close()
+}
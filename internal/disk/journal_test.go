@@ -0,0 +1,216 @@
+package disk
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+var testBase = bytes.Repeat([]byte{7}, BaseSize)
+
+// writeTestJournal creates a journal with n entries, one per append, and returns its path.
+func writeTestJournal(t *testing.T, n int) string {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), "storage.txt.journal")
+
+	j, err := CreateJournal(path, testBase)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer j.Close()
+
+	for i := 0; i < n; i++ {
+		err = j.Append([][]byte{entryPayload(i)})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	return path
+}
+
+func entryPayload(i int) []byte {
+	return []byte(fmt.Sprintf("entry %d", i))
+}
+
+// entryOffset returns where entry i of a journal written by writeTestJournal starts.
+func entryOffset(i int) int {
+	offset := journalHeaderSize
+	for k := 0; k < i; k++ {
+		offset += entryHeaderSize + len(entryPayload(k))
+	}
+
+	return offset
+}
+
+func openTestJournal(t *testing.T, path string) [][]byte {
+	t.Helper()
+
+	j, entries, err := OpenJournal(path)
+	if err != nil {
+		t.Fatalf("OpenJournal: %s", err)
+	}
+	j.Close()
+
+	return entries
+}
+
+func checkEntries(t *testing.T, entries [][]byte, n int) {
+	t.Helper()
+
+	if len(entries) != n {
+		t.Fatalf("got %d entries, want %d", len(entries), n)
+	}
+
+	for i, entry := range entries {
+		if !bytes.Equal(entry, entryPayload(i)) {
+			t.Fatalf("entry %d is %q", i, entry)
+		}
+	}
+}
+
+func corruptFiles(t *testing.T, path string) []string {
+	t.Helper()
+
+	matches, err := filepath.Glob(path + ".corrupt-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return matches
+}
+
+func TestJournalRoundTrip(t *testing.T) {
+	path := writeTestJournal(t, 5)
+
+	j, entries, err := OpenJournal(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	checkEntries(t, entries, 5)
+
+	if !bytes.Equal(j.Base(), testBase) {
+		t.Fatal("base differs")
+	}
+
+	// appending continues after the last entry
+	err = j.Append([][]byte{entryPayload(5), entryPayload(6)})
+	j.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	checkEntries(t, openTestJournal(t, path), 7)
+}
+
+func TestJournalTruncatedTail(t *testing.T) {
+	for _, cut := range []int{1, entryHeaderSize, entryHeaderSize + 2} {
+		t.Run(fmt.Sprintf("%d bytes of the last entry", cut), func(t *testing.T) {
+			path := writeTestJournal(t, 3)
+
+			err := os.Truncate(path, int64(entryOffset(2)+cut))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			checkEntries(t, openTestJournal(t, path), 2)
+
+			info, err := os.Stat(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if info.Size() != int64(entryOffset(2)) {
+				t.Fatalf("torn tail was not cut off, size %d", info.Size())
+			}
+
+			if files := corruptFiles(t, path); len(files) != 0 {
+				t.Fatalf("a torn tail was quarantined: %v", files)
+			}
+		})
+	}
+}
+
+func TestJournalDamagedLastEntry(t *testing.T) {
+	path := writeTestJournal(t, 3)
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data[len(data)-1] ^= 1
+
+	err = os.WriteFile(path, data, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	checkEntries(t, openTestJournal(t, path), 2)
+
+	if files := corruptFiles(t, path); len(files) != 0 {
+		t.Fatalf("a damaged tail was quarantined: %v", files)
+	}
+}
+
+func TestJournalCorruptMiddle(t *testing.T) {
+	path := writeTestJournal(t, 5)
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data[entryOffset(2)+entryHeaderSize] ^= 1
+
+	err = os.WriteFile(path, data, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	checkEntries(t, openTestJournal(t, path), 2)
+
+	files := corruptFiles(t, path)
+	if len(files) != 1 {
+		t.Fatalf("got quarantined files %v", files)
+	}
+
+	kept, err := os.ReadFile(files[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(kept, data) {
+		t.Fatal("the quarantined journal differs from the damaged one")
+	}
+
+	if got := countEntries(data, entryOffset(2)); got != 2 {
+		t.Fatalf("counted %d entries after the damaged one, want 2", got)
+	}
+}
+
+func TestJournalInvalidHeader(t *testing.T) {
+	path := writeTestJournal(t, 1)
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data[0] = 'X'
+
+	err = os.WriteFile(path, data, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, _, err = OpenJournal(path)
+	if !errors.Is(err, ErrInvalidJournal) {
+		t.Fatalf("got %v, want ErrInvalidJournal", err)
+	}
+}
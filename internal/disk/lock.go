@@ -0,0 +1,126 @@
+package disk
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+)
+
+type LockMode int
+
+const (
+	// LockShared reads the file next to the writer and other readers, writes replace it atomically
+	LockShared LockMode = iota
+	// LockWriter is the only process writing the file, readers are welcome
+	LockWriter
+	// LockExclusive rewrites the file outside of the writer, nobody else may use it meanwhile
+	LockExclusive
+)
+
+var ErrLocked = errors.New("storage file is locked")
+
+var errBusy = errors.New("lock is held by another process")
+
+// Lock is an advisory lock on a storage file held until Release, usually for the lifetime of the
+// process. The writer slot is <path>.lock, it holds the PID of its owner, and <path>.readers is
+// locked shared by everyone using the file.
+type Lock struct {
+	files []*os.File
+}
+
+func AcquireLock(path string, mode LockMode) (*Lock, error) {
+	l := new(Lock)
+
+	if mode != LockShared {
+		writer, err := l.open(path + ".lock")
+		if err != nil {
+			return nil, err
+		}
+
+		err = tryLock(writer, true)
+		if err != nil {
+			l.Release()
+
+			return nil, lockError(err, path)
+		}
+
+		err = writePID(writer)
+		if err != nil {
+			l.Release()
+
+			return nil, err
+		}
+	}
+
+	readers, err := l.open(path + ".readers")
+	if err != nil {
+		l.Release()
+
+		return nil, err
+	}
+
+	err = tryLock(readers, mode == LockExclusive)
+	if err != nil {
+		l.Release()
+
+		if errors.Is(err, errBusy) && mode == LockExclusive {
+			return nil, fmt.Errorf("%w: %s is being read by another process", ErrLocked, path)
+		}
+
+		return nil, lockError(err, path)
+	}
+
+	return l, nil
+}
+
+func (l *Lock) open(path string) (*os.File, error) {
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open lock file: %s", err.Error())
+	}
+
+	l.files = append(l.files, file)
+
+	return file, nil
+}
+
+// Release drops the lock. The lock files stay, removing them would race with the next owner.
+func (l *Lock) Release() {
+	for _, file := range l.files {
+		unlock(file)
+		file.Close()
+	}
+
+	l.files = nil
+}
+
+func writePID(file *os.File) error {
+	err := file.Truncate(0)
+	if err == nil {
+		_, err = file.WriteAt([]byte(strconv.Itoa(os.Getpid())+"\n"), 0)
+	}
+
+	if err != nil {
+		return fmt.Errorf("failed to write lock file: %s", err.Error())
+	}
+
+	return nil
+}
+
+// lockError names the process owning the writer slot when the lock is busy.
+func lockError(err error, path string) error {
+	if !errors.Is(err, errBusy) {
+		return err
+	}
+
+	data, err := os.ReadFile(path + ".lock")
+
+	pid, convErr := strconv.Atoi(string(bytes.TrimSpace(data)))
+	if err != nil || convErr != nil {
+		return fmt.Errorf("%w: %s is in use by another process", ErrLocked, path)
+	}
+
+	return fmt.Errorf("%w: %s is in use by process %d", ErrLocked, path, pid)
+}
@@ -0,0 +1,12 @@
+//go:build !unix
+
+package disk
+
+import "os"
+
+// advisory locks are not implemented here, every lock is granted
+func tryLock(file *os.File, exclusive bool) error {
+	return nil
+}
+
+func unlock(file *os.File) {}
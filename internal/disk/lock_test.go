@@ -0,0 +1,185 @@
+//go:build unix
+
+package disk
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// flock conflicts between open files of the same process too, so most cases run in one process.
+func TestLockModes(t *testing.T) {
+	tests := []struct {
+		held, wanted LockMode
+		granted      bool
+	}{
+		{LockShared, LockShared, true},
+		{LockShared, LockWriter, true},
+		{LockShared, LockExclusive, false},
+		{LockWriter, LockShared, true},
+		{LockWriter, LockWriter, false},
+		{LockWriter, LockExclusive, false},
+		{LockExclusive, LockShared, false},
+		{LockExclusive, LockWriter, false},
+		{LockExclusive, LockExclusive, false},
+	}
+
+	for _, tt := range tests {
+		path := filepath.Join(t.TempDir(), "storage.txt")
+
+		held, err := AcquireLock(path, tt.held)
+		if err != nil {
+			t.Fatalf("mode %d: %s", tt.held, err)
+		}
+
+		lock, err := AcquireLock(path, tt.wanted)
+
+		if tt.granted && err != nil {
+			t.Errorf("mode %d after %d: %s", tt.wanted, tt.held, err)
+		}
+
+		if !tt.granted && !errors.Is(err, ErrLocked) {
+			t.Errorf("mode %d after %d: got %v, want ErrLocked", tt.wanted, tt.held, err)
+		}
+
+		if lock != nil {
+			lock.Release()
+		}
+
+		held.Release()
+	}
+}
+
+func TestLockRelease(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "storage.txt")
+
+	for i := 0; i < 3; i++ {
+		lock, err := AcquireLock(path, LockExclusive)
+		if err != nil {
+			t.Fatalf("round %d: %s", i, err)
+		}
+
+		lock.Release()
+	}
+}
+
+func TestLockNamesOwner(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "storage.txt")
+
+	held, err := AcquireLock(path, LockWriter)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer held.Release()
+
+	if got := strings.TrimSpace(readFile(t, path+".lock")); got != strconv.Itoa(os.Getpid()) {
+		t.Fatalf("lock file holds %q", got)
+	}
+
+	_, err = AcquireLock(path, LockWriter)
+	if err == nil || !strings.Contains(err.Error(), fmt.Sprintf("process %d", os.Getpid())) {
+		t.Fatalf("got %v", err)
+	}
+}
+
+// TestHelperLock holds a lock for the parent test until its stdin is closed.
+func TestHelperLock(t *testing.T) {
+	path := os.Getenv("DISK_TEST_LOCK_PATH")
+	if path == "" {
+		t.Skip("run by TestLockAcrossProcesses")
+	}
+
+	mode, _ := strconv.Atoi(os.Getenv("DISK_TEST_LOCK_MODE"))
+
+	lock, err := AcquireLock(path, LockMode(mode))
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	fmt.Println("locked")
+	bufio.NewReader(os.Stdin).ReadString('\n')
+
+	lock.Release()
+	os.Exit(0)
+}
+
+// lockInProcess acquires a lock in another process and returns the function that ends it.
+func lockInProcess(t *testing.T, path string, mode LockMode) (int, func()) {
+	t.Helper()
+
+	cmd := exec.Command(os.Args[0], "-test.run=^TestHelperLock$")
+	cmd.Env = append(os.Environ(), "DISK_TEST_LOCK_PATH="+path, fmt.Sprintf("DISK_TEST_LOCK_MODE=%d", mode))
+
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = cmd.Start()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	line, _ := bufio.NewReader(stdout).ReadString('\n')
+	if line != "locked\n" {
+		stdin.Close()
+		cmd.Wait()
+		t.Fatalf("helper process: %q", line)
+	}
+
+	return cmd.Process.Pid, func() {
+		stdin.Close()
+		cmd.Wait()
+	}
+}
+
+func TestLockAcrossProcesses(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "storage.txt")
+
+	pid, stop := lockInProcess(t, path, LockWriter)
+
+	_, err := AcquireLock(path, LockWriter)
+	if !errors.Is(err, ErrLocked) || !strings.Contains(err.Error(), fmt.Sprintf("process %d", pid)) {
+		stop()
+		t.Fatalf("got %v, want ErrLocked naming process %d", err, pid)
+	}
+
+	reader, err := AcquireLock(path, LockShared)
+	if err != nil {
+		stop()
+		t.Fatalf("reader next to the writer: %s", err)
+	}
+
+	reader.Release()
+
+	// the lock ends with the process holding it
+	stop()
+
+	lock, err := AcquireLock(path, LockExclusive)
+	if err != nil {
+		t.Fatalf("after the other process ended: %s", err)
+	}
+
+	lock.Release()
+
+	_, stop = lockInProcess(t, path, LockShared)
+	defer stop()
+
+	_, err = AcquireLock(path, LockExclusive)
+	if !errors.Is(err, ErrLocked) || !strings.Contains(err.Error(), "being read") {
+		t.Fatalf("got %v, want ErrLocked while another process reads", err)
+	}
+}
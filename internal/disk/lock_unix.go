@@ -0,0 +1,34 @@
+//go:build unix
+
+package disk
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+)
+
+func tryLock(file *os.File, exclusive bool) error {
+	how := syscall.LOCK_SH
+	if exclusive {
+		how = syscall.LOCK_EX
+	}
+
+	for {
+		err := syscall.Flock(int(file.Fd()), how|syscall.LOCK_NB)
+		switch err {
+		case nil:
+			return nil
+		case syscall.EWOULDBLOCK:
+			return errBusy
+		case syscall.EINTR:
+			continue
+		}
+
+		return fmt.Errorf("failed to lock %s: %s", file.Name(), err.Error())
+	}
+}
+
+func unlock(file *os.File) {
+	syscall.Flock(int(file.Fd()), syscall.LOCK_UN)
+}
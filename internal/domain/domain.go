@@ -1,5 +1,7 @@
 package domain
 
+import "time"
+
 type Storage map[string]Service
 
 type Service struct {
@@ -9,11 +11,46 @@ type Service struct {
 }
 
 type Element struct {
-	Password    string `json:"password"`
+	Password    Secret `json:"password"`
 	Description string `json:"description"`
 	Additional  string `json:"additional"`
 }
 
+// Equal compares services by value, no logins equals empty logins.
+func (s Service) Equal(t Service) bool {
+	if s.Type != t.Type || s.Favorite != t.Favorite || len(s.Elements) != len(t.Elements) {
+		return false
+	}
+
+	for login, e := range s.Elements {
+		f, ok := t.Elements[login]
+		if !ok || e.Description != f.Description || e.Additional != f.Additional || !e.Password.Equal(f.Password) {
+			return false
+		}
+	}
+
+	return true
+}
+
+const (
+	OpAppendService = "append-service"
+	OpUpdateService = "update-service"
+	OpDeleteService = "delete-service"
+	OpAppendLogin   = "append-login"
+	OpUpdateLogin   = "update-login"
+	OpDeleteLogin   = "delete-login"
+)
+
+// Operation is a single change of the storage as it is recorded in the journal.
+type Operation struct {
+	Op       string   `json:"op"`
+	Service  string   `json:"service"`
+	Type     string   `json:"type,omitempty"`
+	Favorite bool     `json:"favorite,omitempty"`
+	Login    string   `json:"login,omitempty"`
+	Element  *Element `json:"element,omitempty"`
+}
+
 type LoginBody struct {
 	Login   string  `json:"login"`
 	Element Element `json:"element"`
@@ -21,3 +58,71 @@ type LoginBody struct {
 
 type ServiceBody struct {
 }
+
+// Health tells whether changes reach the disk.
+type Health struct {
+	Sealed   bool `json:"sealed"`
+	ReadOnly bool `json:"read_only"`
+	// Degraded is set after repeated failed flushes, changes are rejected until a flush succeeds
+	Degraded    bool       `json:"degraded"`
+	Failures    int        `json:"failures"`
+	LastError   string     `json:"last_error,omitempty"`
+	LastFailure *time.Time `json:"last_failure,omitempty"`
+}
+
+type UnlockBody struct {
+	Password string `json:"password"`
+}
+
+// UnsealProgress tells how many key shares were given towards the threshold, which is known once
+// the first share is in.
+type UnsealProgress struct {
+	Sealed    bool `json:"sealed"`
+	Threshold int  `json:"threshold"`
+	Progress  int  `json:"progress"`
+}
+
+type UnsealBody struct {
+	Share string `json:"share"`
+	Reset bool   `json:"reset"`
+}
+
+type InitSharesBody struct {
+	Password  string `json:"password"`
+	Shares    int    `json:"shares"`
+	Threshold int    `json:"threshold"`
+}
+
+type RekeySharesBody struct {
+	Shares    []string `json:"shares"`
+	NewShares int      `json:"new_shares"`
+	Threshold int      `json:"threshold"`
+}
+
+// Recovery tells how many recovery codes are left and whether there is a recovery key.
+type Recovery struct {
+	Codes int  `json:"codes"`
+	Key   bool `json:"key"`
+}
+
+// RecoveryCodes are shown once when they are generated.
+type RecoveryCodes struct {
+	Codes []string `json:"codes"`
+	Key   string   `json:"key,omitempty"`
+}
+
+type GenerateRecoveryBody struct {
+	Password string `json:"password"`
+	Codes    int    `json:"codes"`
+	Key      bool   `json:"key"`
+}
+
+type RecoverBody struct {
+	Code        string `json:"code"`
+	NewPassword string `json:"new_password"`
+}
+
+type RekeyBody struct {
+	Password    string `json:"password"`
+	NewPassword string `json:"new_password"`
+}
@@ -0,0 +1,14 @@
+package domain
+
+import "errors"
+
+var (
+	ErrSealed        = errors.New("storage is sealed")
+	ErrUnsealed      = errors.New("storage is already unsealed")
+	ErrWrongPassword = errors.New("wrong master password")
+	ErrReadOnly      = errors.New("storage is read-only")
+	ErrTampered      = errors.New("storage file was modified outside the manager")
+	ErrDegraded      = errors.New("storage cannot be written, changes are rejected until it can")
+	ErrInvalidShare  = errors.New("invalid key share")
+	ErrInvalidCode   = errors.New("invalid recovery code")
+)
@@ -0,0 +1,334 @@
+package domain
+
+import (
+	"crypto/subtle"
+	"errors"
+	"runtime"
+	"sort"
+	"strconv"
+	"unicode/utf16"
+	"unicode/utf8"
+
+	"manager/internal/secmem"
+)
+
+var errSecretNotString = errors.New("secret must be a string")
+
+// Secret is a value kept in locked memory instead of a string, see secmem. Copies share the
+// memory, which is wiped when the vault is locked, so a Secret must not be kept past that. The
+// memory is reused once no copy is left.
+type Secret struct {
+	buf *secmem.Buffer
+}
+
+// NewSecret copies b into locked memory.
+func NewSecret(b []byte) Secret {
+	return Secret{buf: secmem.CopyBuffer(b)}
+}
+
+// Bytes returns the secret itself, not a copy. The Secret has to stay in use for as long as they are.
+func (s Secret) Bytes() []byte {
+	return s.buf.Bytes()
+}
+
+func (s Secret) Empty() bool {
+	return len(s.buf.Bytes()) == 0
+}
+
+// Equal compares the secrets in constant time, they may be in different buffers.
+func (s Secret) Equal(t Secret) bool {
+	defer runtime.KeepAlive(s.buf)
+	defer runtime.KeepAlive(t.buf)
+
+	return subtle.ConstantTimeCompare(s.buf.Bytes(), t.buf.Bytes()) == 1
+}
+
+// MarshalJSON quotes the secret without passing it through a string. encoding/json keeps copies of
+// the result in its buffers, so responses are encoded with EncodeStorage instead.
+func (s Secret) MarshalJSON() ([]byte, error) {
+	b := s.buf.Bytes()
+	defer runtime.KeepAlive(s.buf)
+
+	buf := make([]byte, quote(nil, b))
+	quote(buf, b)
+
+	return buf, nil
+}
+
+// EncodeStorage marshals the storage the way encoding/json does. The passwords are quoted straight
+// into the result, which is the only copy made of them, and the caller wipes it once it is written.
+func EncodeStorage(storage Storage) []byte {
+	w := new(jsonWriter)
+	w.storage(storage)
+
+	w.dst = make([]byte, w.n)
+	w.n = 0
+	w.storage(storage)
+
+	return w.dst
+}
+
+// jsonWriter writes JSON into dst, or only counts the bytes while dst is nil.
+type jsonWriter struct {
+	dst []byte
+	n   int
+}
+
+func (w *jsonWriter) raw(s string) {
+	if w.dst != nil {
+		copy(w.dst[w.n:], s)
+	}
+	w.n += len(s)
+}
+
+func (w *jsonWriter) quote(b []byte) {
+	if w.dst != nil {
+		w.n += quote(w.dst[w.n:], b)
+	} else {
+		w.n += quote(nil, b)
+	}
+}
+
+// object writes the members of a map in the order of their keys.
+func object[V any](w *jsonWriter, m map[string]V, member func(V)) {
+	if m == nil {
+		w.raw("null")
+
+		return
+	}
+
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	w.raw("{")
+
+	for i, key := range keys {
+		if i > 0 {
+			w.raw(",")
+		}
+
+		w.quote([]byte(key))
+		w.raw(":")
+		member(m[key])
+	}
+
+	w.raw("}")
+}
+
+func (w *jsonWriter) storage(storage Storage) {
+	object(w, storage, func(service Service) {
+		w.raw(`{"type":`)
+		w.quote([]byte(service.Type))
+		w.raw(`,"favorite":` + strconv.FormatBool(service.Favorite) + `,"elements":`)
+
+		object(w, service.Elements, func(elem Element) {
+			w.raw(`{"password":`)
+			w.quote(elem.Password.Bytes())
+			runtime.KeepAlive(elem.Password.buf)
+			w.raw(`,"description":`)
+			w.quote([]byte(elem.Description))
+			w.raw(`,"additional":`)
+			w.quote([]byte(elem.Additional))
+			w.raw("}")
+		})
+
+		w.raw("}")
+	})
+}
+
+// quote writes b as a JSON string into dst, or only counts the bytes if dst is nil. It escapes like
+// encoding/json without HTML escaping, invalid UTF-8 is replaced.
+func quote(dst, b []byte) int {
+	const hex = "0123456789abcdef"
+
+	n := 0
+	put := func(s ...byte) {
+		if dst != nil {
+			copy(dst[n:], s)
+		}
+		n += len(s)
+	}
+
+	put('"')
+
+	for i := 0; i < len(b); {
+		c := b[i]
+		if c >= utf8.RuneSelf {
+			r, size := utf8.DecodeRune(b[i:])
+			switch {
+			case r == utf8.RuneError && size == 1:
+				// U+FFFD in UTF-8
+				put(0xef, 0xbf, 0xbd)
+			case r == '\u2028' || r == '\u2029':
+				put('\\', 'u', '2', '0', '2', hex[r&0xf])
+			default:
+				put(b[i : i+size]...)
+			}
+
+			i += size
+			continue
+		}
+
+		switch {
+		case c == '"' || c == '\\':
+			put('\\', c)
+		case c == '\b':
+			put('\\', 'b')
+		case c == '\f':
+			put('\\', 'f')
+		case c == '\n':
+			put('\\', 'n')
+		case c == '\r':
+			put('\\', 'r')
+		case c == '\t':
+			put('\\', 't')
+		case c < 0x20:
+			put('\\', 'u', '0', '0', hex[c>>4], hex[c&0xf])
+		default:
+			put(c)
+		}
+
+		i++
+	}
+
+	put('"')
+
+	return n
+}
+
+// UnmarshalJSON unquotes the secret straight into locked memory.
+func (s *Secret) UnmarshalJSON(data []byte) error {
+	if string(data) == "null" {
+		return nil
+	}
+
+	if len(data) < 2 || data[0] != '"' || data[len(data)-1] != '"' {
+		return errSecretNotString
+	}
+
+	data = data[1 : len(data)-1]
+
+	// the first pass only measures
+	n, err := unquote(nil, data)
+	if err != nil {
+		return err
+	}
+
+	buf := secmem.NewBuffer(n)
+	unquote(buf.Bytes(), data)
+	s.buf = buf
+
+	return nil
+}
+
+// unquote decodes the contents of a JSON string into dst, or only counts the bytes if dst is nil.
+// Invalid UTF-8 is replaced like encoding/json does.
+func unquote(dst, src []byte) (int, error) {
+	n := 0
+	put := func(r rune) {
+		if dst != nil {
+			utf8.EncodeRune(dst[n:], r)
+		}
+		n += utf8.RuneLen(r)
+	}
+
+	for i := 0; i < len(src); {
+		c := src[i]
+		switch {
+		case c == '\\':
+			if i+1 >= len(src) {
+				return 0, errSecretNotString
+			}
+
+			switch src[i+1] {
+			case '"', '\\', '/':
+				put(rune(src[i+1]))
+			case 'b':
+				put('\b')
+			case 'f':
+				put('\f')
+			case 'n':
+				put('\n')
+			case 'r':
+				put('\r')
+			case 't':
+				put('\t')
+			case 'u':
+				r, ok := hexRune(src[i+2:])
+				if !ok {
+					return 0, errSecretNotString
+				}
+
+				i += 6
+
+				if utf16.IsSurrogate(r) {
+					if i+1 < len(src) && src[i] == '\\' && src[i+1] == 'u' {
+						r2, ok := hexRune(src[i+2:])
+						if dec := utf16.DecodeRune(r, r2); ok && dec != utf8.RuneError {
+							put(dec)
+							i += 6
+							continue
+						}
+					}
+
+					r = utf8.RuneError
+				}
+
+				put(r)
+				continue
+			default:
+				return 0, errSecretNotString
+			}
+
+			i += 2
+		case c < utf8.RuneSelf:
+			if dst != nil {
+				dst[n] = c
+			}
+			n++
+			i++
+		default:
+			r, size := utf8.DecodeRune(src[i:])
+			if r == utf8.RuneError && size == 1 {
+				put(r)
+			} else {
+				if dst != nil {
+					copy(dst[n:], src[i:i+size])
+				}
+				n += size
+			}
+
+			i += size
+		}
+	}
+
+	return n, nil
+}
+
+// hexRune reads the four hex digits of a \u escape.
+func hexRune(b []byte) (rune, bool) {
+	if len(b) < 4 {
+		return 0, false
+	}
+
+	var r rune
+	for _, c := range b[:4] {
+		switch {
+		case '0' <= c && c <= '9':
+			c -= '0'
+		case 'a' <= c && c <= 'f':
+			c = c - 'a' + 10
+		case 'A' <= c && c <= 'F':
+			c = c - 'A' + 10
+		default:
+			return 0, false
+		}
+
+		r = r*16 + rune(c)
+	}
+
+	return r, true
+}
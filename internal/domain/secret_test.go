@@ -0,0 +1,61 @@
+package domain
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+)
+
+func TestEncodeStorage(t *testing.T) {
+	odd := "quote \" backslash \\ controls \b\f\n\r\t\x01 html <&> separators    invalid \xff umlaut ü"
+
+	for _, storage := range []Storage{
+		nil,
+		{},
+		{
+			"mail": {Type: "password", Favorite: true, Elements: map[string]Element{
+				"alice": {Password: NewSecret([]byte(odd)), Description: odd, Additional: ""},
+				"bob":   {Password: NewSecret(nil)},
+			}},
+			odd:    {Type: "card"},
+			"bank": {Type: "card", Elements: map[string]Element{}},
+		},
+	} {
+		buf := new(bytes.Buffer)
+		encoder := json.NewEncoder(buf)
+		encoder.SetEscapeHTML(false)
+
+		err := encoder.Encode(storage)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		want := bytes.TrimSuffix(buf.Bytes(), []byte("\n"))
+
+		got := EncodeStorage(storage)
+		if !bytes.Equal(got, want) {
+			t.Fatalf("got  %s\nwant %s", got, want)
+		}
+	}
+}
+
+// Equal services hold their passwords in different buffers.
+func TestServiceEqual(t *testing.T) {
+	service := func(password string) Service {
+		return Service{Type: "password", Elements: map[string]Element{
+			"alice": {Password: NewSecret([]byte(password)), Description: "mail"},
+		}}
+	}
+
+	if !service("one").Equal(service("one")) {
+		t.Fatal("the same service is not equal")
+	}
+
+	if service("one").Equal(service("two")) {
+		t.Fatal("a different password is equal")
+	}
+
+	if !(Service{Type: "card"}).Equal(Service{Type: "card", Elements: map[string]Element{}}) {
+		t.Fatal("no logins is not equal to empty logins")
+	}
+}
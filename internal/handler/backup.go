@@ -0,0 +1,95 @@
+package handler
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+
+	"manager/internal/backup"
+)
+
+func (h *Handler) listBackups() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if err := r.ParseForm(); err != nil {
+			log.Print("failed to parse parameters")
+			http.Error(w, "bad Request", http.StatusBadRequest)
+
+			return
+		}
+
+		list, err := h.b.List(r.Form.Get("target"))
+
+		switch {
+		case errors.Is(err, backup.ErrNotFound):
+			http.Error(w, err.Error(), http.StatusNotFound)
+
+			return
+		case err != nil:
+			log.Printf("failed to list backups: %s", err.Error())
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+
+			return
+		}
+
+		if list == nil {
+			list = []backup.Backup{}
+		}
+
+		writeJSON(w, list)
+	}
+}
+
+func (h *Handler) createBackup() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		b, err := h.b.Create()
+		if err != nil {
+			log.Printf("failed to create backup: %s", err.Error())
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+
+			return
+		}
+
+		writeJSON(w, b)
+	}
+}
+
+func (h *Handler) restoreBackup() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if err := r.ParseForm(); err != nil {
+			log.Print("failed to parse parameters")
+			http.Error(w, "bad Request", http.StatusBadRequest)
+
+			return
+		}
+
+		err := h.b.Restore(r.Form.Get("target"), r.Form.Get("name"))
+
+		switch {
+		case errors.Is(err, backup.ErrNotFound):
+			http.Error(w, err.Error(), http.StatusNotFound)
+
+			return
+		case err != nil:
+			log.Printf("failed to restore backup: %s", err.Error())
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+
+			return
+		}
+
+		w.WriteHeader(http.StatusOK)
+	}
+}
+
+func writeJSON(w http.ResponseWriter, v any) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		log.Printf("failed to marshal response: %s", err.Error())
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(data)
+}
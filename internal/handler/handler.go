@@ -2,55 +2,191 @@ package handler
 
 import (
 	"encoding/json"
+	"errors"
 	"io/ioutil"
 	"log"
+	"manager/internal/backup"
 	"manager/internal/domain"
+	"manager/internal/history"
+	"manager/internal/secmem"
 	"net/http"
 	"strconv"
 )
 
 type service interface {
-	WriteStorageFromFile() error
+	Sealed() bool
+	Unlock(password string) error
+	Lock() error
+	Rekey(actor, current, password string) error
+	Unseal(share string) (domain.UnsealProgress, error)
+	ResetUnseal()
+	UnsealProgress() domain.UnsealProgress
+	InitShares(actor, password string, shares, threshold int) ([]string, error)
+	RekeyShares(actor string, current []string, shares, threshold int) ([]string, error)
+	Recovery() (domain.Recovery, error)
+	GenerateRecovery(actor, password string, codes int, withKey bool) (domain.RecoveryCodes, error)
+	Recover(code, password string) error
+	Health() domain.Health
+	Failing() bool
+
 	UpdateFile() error
-	GetAll() domain.Storage
-	GetByType(recordType string) (domain.Storage, error)
+	Sync() error
+	GetAllJSON() ([]byte, uint64, error)
+	GetByTypeJSON(recordType string) ([]byte, uint64, error)
+	GetFavoritesJSON() ([]byte, uint64, error)
+
+	AppendService(actor, serviceName string, serviceType string, favorite bool) error
+	UpdateService(actor, serviceName string, serviceType string, favorite bool) error
+	DeleteService(actor, serviceName string) error
 
-	AppendService(serviceName string, serviceType string, favorite bool) error
-	UpdateService(serviceName string, serviceType string, favorite bool) error
-	DeleteService(serviceName string) error
+	AppendLogin(actor, serviceName string, login string, elem domain.Element) error
+	UpdateLogin(actor, serviceName string, login string, elem domain.Element) error
+	DeleteLogin(actor, serviceName string, login string) error
 
-	AppendLogin(serviceName string, login string, elem domain.Element) error
-	UpdateLogin(serviceName string, login string, elem domain.Element) error
-	DeleteLogin(serviceName string, login string) error
+	History(serviceName string) ([]history.Version, error)
+	RestoreVersion(actor, serviceName, commit string) error
+}
+
+type backups interface {
+	Create() (backup.Backup, error)
+	List(target string) ([]backup.Backup, error)
+	Restore(target, name string) error
 }
 
 type Handler struct {
 	s service
+	b backups
 }
 
-func New(s service) *Handler {
+func New(s service, b backups) *Handler {
 	return &Handler{
 		s: s,
+		b: b,
 	}
 }
 
 func (h *Handler) InitRouter() http.Handler {
 	router := http.NewServeMux()
 
-	router.Handle("/get-by-type", h.getByType())
-	router.Handle("/get-all", h.getAll())
+	router.Handle("/health", h.health())
+	router.Handle("/unlock", h.unlock())
+	router.Handle("/lock", h.unsealed(h.lock()))
+	router.Handle("/rekey", h.unsealed(h.rekey()))
+	router.Handle("/unseal", h.unseal())
+	router.Handle("/init-shares", h.unsealed(h.initShares()))
+	router.Handle("/rekey-shares", h.unsealed(h.rekeyShares()))
+	router.Handle("/recovery", h.unsealed(h.recovery()))
+	router.Handle("/recover", h.recover())
+
+	router.Handle("/get-by-type", h.unsealed(h.getByType()))
+	router.Handle("/get-all", h.unsealed(h.getAll()))
+	router.Handle("/get-favorites", h.unsealed(h.getFavorites()))
 
-	router.Handle("/add-login", h.addLogin())
-	router.Handle("/update-login", h.updateLogin())
-	router.Handle("/delete-login", h.deleteLogin())
+	router.Handle("/add-login", h.unsealed(h.addLogin()))
+	router.Handle("/update-login", h.unsealed(h.updateLogin()))
+	router.Handle("/delete-login", h.unsealed(h.deleteLogin()))
 
-	router.Handle("/add-service", h.addService())
-	router.Handle("/update-service", h.updateService())
-	router.Handle("/delete-service", h.deleteService())
+	router.Handle("/add-service", h.unsealed(h.addService()))
+	router.Handle("/update-service", h.unsealed(h.updateService()))
+	router.Handle("/delete-service", h.unsealed(h.deleteService()))
+
+	router.Handle("/history", h.unsealed(h.history()))
+	router.Handle("/restore-version", h.unsealed(h.restoreVersion()))
+
+	router.Handle("/backups", h.unsealed(h.listBackups()))
+	router.Handle("/create-backup", h.unsealed(h.createBackup()))
+	router.Handle("/restore-backup", h.unsealed(h.restoreBackup()))
 
 	return router
 }
 
+// versionHeader tells readers the version of the storage they got, it grows with every change while
+// the server runs.
+const versionHeader = "X-Storage-Version"
+
+// setVersion leaves the header out for backends without versions.
+func setVersion(w http.ResponseWriter, version uint64) {
+	if version != 0 {
+		w.Header().Set(versionHeader, strconv.FormatUint(version, 10))
+	}
+}
+
+// writeStorage sends the encoded storage and wipes it, the secrets in it are plaintext. What net/http
+// buffers on the way to the connection is out of reach.
+func writeStorage(w http.ResponseWriter, storageJSON []byte, version uint64) {
+	setVersion(w, version)
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(storageJSON)
+	secmem.Zero(storageJSON)
+}
+
+func (h *Handler) unsealed(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if h.s.Sealed() {
+			http.Error(w, domain.ErrSealed.Error(), http.StatusLocked)
+
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (h *Handler) unlock() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		body, err := ioutil.ReadAll(r.Body)
+		defer r.Body.Close()
+		if err != nil {
+			http.Error(w, "error reading request body", http.StatusInternalServerError)
+
+			return
+		}
+
+		var requestBody domain.UnlockBody
+		err = json.Unmarshal(body, &requestBody)
+		secmem.Zero(body)
+		if err != nil {
+			http.Error(w, "Error unmarshalling JSON", http.StatusBadRequest)
+
+			return
+		}
+
+		err = h.s.Unlock(requestBody.Password)
+
+		switch {
+		case errors.Is(err, domain.ErrWrongPassword):
+			http.Error(w, err.Error(), http.StatusUnauthorized)
+
+			return
+		case errors.Is(err, domain.ErrUnsealed), errors.Is(err, domain.ErrTampered):
+			http.Error(w, err.Error(), http.StatusConflict)
+
+			return
+		case err != nil:
+			log.Printf("failed to unlock storage: %s", err.Error())
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+
+			return
+		}
+
+		w.WriteHeader(http.StatusOK)
+	}
+}
+
+func (h *Handler) lock() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		err := h.s.Lock()
+		if err != nil {
+			log.Printf("failed to lock storage: %s", err.Error())
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+
+			return
+		}
+
+		w.WriteHeader(http.StatusOK)
+	}
+}
+
 func (h *Handler) getByType() http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		if err := r.ParseForm(); err != nil {
@@ -62,7 +198,7 @@ func (h *Handler) getByType() http.HandlerFunc {
 
 		recordType := r.Form.Get("type")
 
-		storage, err := h.s.GetByType(recordType)
+		storageJSON, version, err := h.s.GetByTypeJSON(recordType)
 		if err != nil {
 			log.Printf("bad request: %s", err.Error())
 			http.Error(w, err.Error(), http.StatusBadRequest)
@@ -70,33 +206,35 @@ func (h *Handler) getByType() http.HandlerFunc {
 			return
 		}
 
-		storageJSON, err := json.Marshal(storage)
+		writeStorage(w, storageJSON, version)
+	}
+}
+
+func (h *Handler) getAll() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		storageJSON, version, err := h.s.GetAllJSON()
 		if err != nil {
-			log.Printf("failed to marshal storage: %s", err.Error())
+			log.Printf("failed to get storage: %s", err.Error())
 			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
 
 			return
 		}
 
-		w.Header().Set("Content-Type", "application/json")
-		w.Write(storageJSON)
+		writeStorage(w, storageJSON, version)
 	}
 }
 
-func (h *Handler) getAll() http.HandlerFunc {
+func (h *Handler) getFavorites() http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		storage := h.s.GetAll()
-
-		storageJSON, err := json.Marshal(storage)
+		storageJSON, version, err := h.s.GetFavoritesJSON()
 		if err != nil {
-			log.Printf("failed to marshal storage: %s", err.Error())
+			log.Printf("failed to get storage: %s", err.Error())
 			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
 
 			return
 		}
 
-		w.Header().Set("Content-Type", "application/json")
-		w.Write(storageJSON)
+		writeStorage(w, storageJSON, version)
 	}
 }
 
@@ -121,19 +259,24 @@ func (h *Handler) addLogin() http.HandlerFunc {
 
 		var requestBody domain.LoginBody
 		err = json.Unmarshal(body, &requestBody)
+		secmem.Zero(body)
 		if err != nil {
 			http.Error(w, "Error unmarshalling JSON", http.StatusBadRequest)
 
 			return
 		}
 
-		err = h.s.AppendLogin(serviceName, requestBody.Login, requestBody.Element)
+		err = h.s.AppendLogin(actor(r), serviceName, requestBody.Login, requestBody.Element)
 		if err != nil {
-			http.Error(w, err.Error(), http.StatusBadRequest)
+			http.Error(w, err.Error(), errorStatus(err))
 
 			return
 		}
 
+		if !h.sync(w, r) {
+			return
+		}
+
 		w.WriteHeader(http.StatusOK)
 	}
 }
@@ -159,16 +302,21 @@ func (h *Handler) updateLogin() http.HandlerFunc {
 
 		var requestBody domain.LoginBody
 		err = json.Unmarshal(body, &requestBody)
+		secmem.Zero(body)
 		if err != nil {
 			http.Error(w, "Error unmarshalling JSON", http.StatusBadRequest)
 
 			return
 		}
 
-		err = h.s.UpdateLogin(serviceName, requestBody.Login, requestBody.Element)
+		err = h.s.UpdateLogin(actor(r), serviceName, requestBody.Login, requestBody.Element)
 		if err != nil {
-			http.Error(w, err.Error(), http.StatusBadRequest)
+			http.Error(w, err.Error(), errorStatus(err))
+
+			return
+		}
 
+		if !h.sync(w, r) {
 			return
 		}
 
@@ -188,13 +336,17 @@ func (h *Handler) deleteLogin() http.HandlerFunc {
 		serviceName := r.Form.Get("name")
 		login := r.Form.Get("login")
 
-		err := h.s.DeleteLogin(serviceName, login)
+		err := h.s.DeleteLogin(actor(r), serviceName, login)
 		if err != nil {
-			http.Error(w, err.Error(), http.StatusBadRequest)
+			http.Error(w, err.Error(), errorStatus(err))
 
 			return
 		}
 
+		if !h.sync(w, r) {
+			return
+		}
+
 		w.WriteHeader(http.StatusOK)
 	}
 }
@@ -219,26 +371,49 @@ func (h *Handler) addService() http.HandlerFunc {
 			return
 		}
 
-		body, err := ioutil.ReadAll(r.Body)
-		defer r.Body.Close()
+		err = h.s.AppendService(actor(r), serviceName, serviceType, serviceFavorite)
 		if err != nil {
-			http.Error(w, "error reading request body", http.StatusInternalServerError)
+			http.Error(w, err.Error(), errorStatus(err))
+
+			return
+		}
+
+		if !h.sync(w, r) {
+			return
+		}
+
+		w.WriteHeader(http.StatusOK)
+	}
+}
+
+func (h *Handler) updateService() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if err := r.ParseForm(); err != nil {
+			log.Print("failed to parse parameters")
+			http.Error(w, "bad Request", http.StatusBadRequest)
 
 			return
 		}
 
-		var elem domain.Service
-		err = json.Unmarshal(body, &elem)
+		serviceName := r.Form.Get("name")
+		serviceType := r.Form.Get("type")
+		serviceFavoriteStr := r.Form.Get("favorite")
+
+		serviceFavorite, err := strconv.ParseBool(serviceFavoriteStr)
 		if err != nil {
-			http.Error(w, "Error unmarshalling JSON", http.StatusBadRequest)
+			http.Error(w, "Error parsing favorite to bool", http.StatusBadRequest)
 
 			return
 		}
 
-		err = h.s.AppendService(serviceName, serviceType, serviceFavorite)
+		err = h.s.UpdateService(actor(r), serviceName, serviceType, serviceFavorite)
 		if err != nil {
-			http.Error(w, err.Error(), http.StatusBadRequest)
+			http.Error(w, err.Error(), errorStatus(err))
+
+			return
+		}
 
+		if !h.sync(w, r) {
 			return
 		}
 
@@ -246,7 +421,7 @@ func (h *Handler) addService() http.HandlerFunc {
 	}
 }
 
-func (h *Handler) updateService() http.HandlerFunc {
+func (h *Handler) deleteService() http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		if err := r.ParseForm(); err != nil {
 			log.Print("failed to parse parameters")
@@ -255,17 +430,25 @@ func (h *Handler) updateService() http.HandlerFunc {
 			return
 		}
 
-		serviceName := r.Form.Get("name")
-		serviceType := r.Form.Get("type")
-		serviceFavoriteStr := r.Form.Get("favorite")
+		name := r.Form.Get("name")
 
-		serviceFavorite, err := strconv.ParseBool(serviceFavoriteStr)
+		err := h.s.DeleteService(actor(r), name)
 		if err != nil {
-			http.Error(w, "Error parsing favorite to bool", http.StatusBadRequest)
+			http.Error(w, err.Error(), errorStatus(err))
 
 			return
 		}
 
+		if !h.sync(w, r) {
+			return
+		}
+
+		w.WriteHeader(http.StatusOK)
+	}
+}
+
+func (h *Handler) rekey() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
 		body, err := ioutil.ReadAll(r.Body)
 		defer r.Body.Close()
 		if err != nil {
@@ -274,17 +457,25 @@ func (h *Handler) updateService() http.HandlerFunc {
 			return
 		}
 
-		var elem domain.Service
-		err = json.Unmarshal(body, &elem)
+		var requestBody domain.RekeyBody
+		err = json.Unmarshal(body, &requestBody)
+		secmem.Zero(body)
 		if err != nil {
 			http.Error(w, "Error unmarshalling JSON", http.StatusBadRequest)
 
 			return
 		}
 
-		err = h.s.UpdateService(serviceName, serviceType, serviceFavorite)
-		if err != nil {
-			http.Error(w, err.Error(), http.StatusBadRequest)
+		err = h.s.Rekey(actor(r), requestBody.Password, requestBody.NewPassword)
+
+		switch {
+		case errors.Is(err, domain.ErrWrongPassword):
+			http.Error(w, err.Error(), http.StatusUnauthorized)
+
+			return
+		case err != nil:
+			log.Printf("failed to change master password: %s", err.Error())
+			http.Error(w, err.Error(), errorStatus(err))
 
 			return
 		}
@@ -293,24 +484,66 @@ func (h *Handler) updateService() http.HandlerFunc {
 	}
 }
 
-func (h *Handler) deleteService() http.HandlerFunc {
+// sync waits for the change to reach the disk when the request asks for it with sync=true, or when
+// the last flush failed and the change may not reach the disk either.
+func (h *Handler) sync(w http.ResponseWriter, r *http.Request) bool {
+	wait, _ := strconv.ParseBool(r.Form.Get("sync"))
+	if !wait && !h.s.Failing() {
+		return true
+	}
+
+	err := h.s.Sync()
+	if err != nil {
+		log.Printf("failed to sync storage: %s", err.Error())
+		http.Error(w, "failed to persist changes: "+err.Error(), http.StatusServiceUnavailable)
+
+		return false
+	}
+
+	return true
+}
+
+func errorStatus(err error) int {
+	if errors.Is(err, domain.ErrReadOnly) || errors.Is(err, domain.ErrDegraded) {
+		return http.StatusServiceUnavailable
+	}
+
+	return http.StatusBadRequest
+}
+
+// health answers 503 while changes cannot be written, so a load balancer can route writes elsewhere.
+func (h *Handler) health() http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		if err := r.ParseForm(); err != nil {
-			log.Print("failed to parse parameters")
-			http.Error(w, "bad Request", http.StatusBadRequest)
+		health := h.s.Health()
 
-			return
-		}
+		status := "ok"
 
-		name := r.Form.Get("name")
+		switch {
+		case health.Sealed:
+			status = "sealed"
+		case health.Degraded:
+			status = "degraded"
+		case health.ReadOnly:
+			status = "read-only"
+		}
 
-		err := h.s.DeleteService(name)
+		data, err := json.Marshal(struct {
+			Status string `json:"status"`
+			domain.Health
+		}{status, health})
 		if err != nil {
-			http.Error(w, err.Error(), http.StatusBadRequest)
+			log.Printf("failed to marshal response: %s", err.Error())
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
 
 			return
 		}
 
-		w.WriteHeader(http.StatusOK)
+		w.Header().Set("Content-Type", "application/json")
+
+		if health.Degraded || health.ReadOnly {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+
+		w.Write(data)
 	}
 }
@@ -0,0 +1,244 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"manager/internal/backend/jsonfile"
+	"manager/internal/domain"
+	repo "manager/internal/repository"
+	svc "manager/internal/service"
+	"manager/internal/vault"
+)
+
+var testKDF = vault.KDFParams{Time: 1, Memory: 64, Threads: 1}
+
+// newTestRepository returns an encrypted storage in a new file with a cheap key derivation.
+func newTestRepository(t *testing.T) *jsonfile.Repository {
+	t.Helper()
+
+	r := jsonfile.New(repo.New(), filepath.Join(t.TempDir(), "storage.txt"), 1<<20, true, testKDF)
+	r.Create()
+
+	return r
+}
+
+// request sends a request to the router and returns the recorded response.
+func request(router http.Handler, method, target, body string) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest(method, target, strings.NewReader(body)))
+
+	return w
+}
+
+func wantStatus(t *testing.T, w *httptest.ResponseRecorder, status int) {
+	t.Helper()
+
+	if w.Code != status {
+		t.Fatalf("got %d %q, want %d", w.Code, w.Body.String(), status)
+	}
+}
+
+func TestSealedRequests(t *testing.T) {
+	router := New(svc.New(newTestRepository(t), []string{"web"}), nil).InitRouter()
+
+	for _, target := range []string{"/get-all", "/lock", "/add-service?name=mail&type=web&favorite=false", "/backups"} {
+		w := request(router, http.MethodPost, target, "")
+		wantStatus(t, w, http.StatusLocked)
+
+		if !strings.Contains(w.Body.String(), domain.ErrSealed.Error()) {
+			t.Fatalf("%s: got %q", target, w.Body.String())
+		}
+	}
+
+	wantStatus(t, request(router, http.MethodPost, "/unlock", `{"password":"secret"}`), http.StatusOK)
+	wantStatus(t, request(router, http.MethodPost, "/unlock", `{"password":"secret"}`), http.StatusConflict)
+
+	wantStatus(t, request(router, http.MethodPost, "/add-service?name=mail&type=web&favorite=false", ""), http.StatusOK)
+
+	w := request(router, http.MethodGet, "/get-all", "")
+	wantStatus(t, w, http.StatusOK)
+
+	var storage map[string]any
+	if err := json.Unmarshal(w.Body.Bytes(), &storage); err != nil || storage["mail"] == nil {
+		t.Fatalf("got %q, %v", w.Body.String(), err)
+	}
+
+	wantStatus(t, request(router, http.MethodPost, "/lock", ""), http.StatusOK)
+	wantStatus(t, request(router, http.MethodGet, "/get-all", ""), http.StatusLocked)
+	wantStatus(t, request(router, http.MethodPost, "/lock", ""), http.StatusLocked)
+
+	wantStatus(t, request(router, http.MethodPost, "/unlock", `{"password":"guess"}`), http.StatusUnauthorized)
+	wantStatus(t, request(router, http.MethodGet, "/get-all", ""), http.StatusLocked)
+	wantStatus(t, request(router, http.MethodPost, "/unlock", `{"password":"secret"}`), http.StatusOK)
+	wantStatus(t, request(router, http.MethodGet, "/get-all", ""), http.StatusOK)
+}
+
+func TestUnsealRequests(t *testing.T) {
+	router := New(svc.New(newTestRepository(t), []string{"web"}), nil).InitRouter()
+
+	wantStatus(t, request(router, http.MethodPost, "/unlock", `{"password":"secret"}`), http.StatusOK)
+
+	w := request(router, http.MethodPost, "/init-shares", `{"password":"secret","shares":3,"threshold":2}`)
+	wantStatus(t, w, http.StatusOK)
+
+	var split struct {
+		Shares []string `json:"shares"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &split); err != nil || len(split.Shares) != 3 {
+		t.Fatalf("got %q, %v", w.Body.String(), err)
+	}
+
+	wantStatus(t, request(router, http.MethodPost, "/lock", ""), http.StatusOK)
+	wantStatus(t, request(router, http.MethodGet, "/get-all", ""), http.StatusLocked)
+
+	wantStatus(t, request(router, http.MethodPost, "/unseal", `{"share":"not a share"}`), http.StatusBadRequest)
+
+	progress := func(w *httptest.ResponseRecorder) domain.UnsealProgress {
+		t.Helper()
+
+		wantStatus(t, w, http.StatusOK)
+
+		var progress domain.UnsealProgress
+		if err := json.Unmarshal(w.Body.Bytes(), &progress); err != nil {
+			t.Fatalf("got %q, %v", w.Body.String(), err)
+		}
+
+		return progress
+	}
+
+	got := progress(request(router, http.MethodPost, "/unseal", `{"share":"`+split.Shares[0]+`"}`))
+	if want := (domain.UnsealProgress{Sealed: true, Threshold: 2, Progress: 1}); got != want {
+		t.Fatalf("one share: got %+v, want %+v", got, want)
+	}
+
+	if got = progress(request(router, http.MethodGet, "/unseal", "")); got.Progress != 1 {
+		t.Fatalf("progress: got %+v", got)
+	}
+
+	wantStatus(t, request(router, http.MethodGet, "/get-all", ""), http.StatusLocked)
+
+	got = progress(request(router, http.MethodPost, "/unseal", `{"share":"`+split.Shares[2]+`"}`))
+	if got.Sealed {
+		t.Fatalf("two shares: got %+v", got)
+	}
+
+	wantStatus(t, request(router, http.MethodGet, "/get-all", ""), http.StatusOK)
+	wantStatus(t, request(router, http.MethodPost, "/unseal", `{"share":"`+split.Shares[1]+`"}`), http.StatusConflict)
+
+	wantStatus(t, request(router, http.MethodPost, "/lock", ""), http.StatusOK)
+	wantStatus(t, request(router, http.MethodGet, "/get-all", ""), http.StatusLocked)
+}
+
+// failingRepository fails its flushes while err is set, like a full disk would.
+type failingRepository struct {
+	*jsonfile.Repository
+
+	mutex sync.Mutex
+	err   error
+}
+
+func (r *failingRepository) Flush() error {
+	r.mutex.Lock()
+	err := r.err
+	r.mutex.Unlock()
+
+	if err != nil {
+		return err
+	}
+
+	return r.Repository.Flush()
+}
+
+func (r *failingRepository) fail(err error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	r.err = err
+}
+
+// health requests /health and decodes the answer.
+func health(t *testing.T, router http.Handler, status int) (string, domain.Health) {
+	t.Helper()
+
+	w := request(router, http.MethodGet, "/health", "")
+	wantStatus(t, w, status)
+
+	var body struct {
+		Status string `json:"status"`
+		domain.Health
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+		t.Fatalf("got %q, %v", w.Body.String(), err)
+	}
+
+	return body.Status, body.Health
+}
+
+func TestHealthDegraded(t *testing.T) {
+	r := &failingRepository{Repository: newTestRepository(t)}
+	s := svc.New(r, []string{"web"})
+	router := New(s, nil).InitRouter()
+
+	if status, _ := health(t, router, http.StatusOK); status != "sealed" {
+		t.Fatalf("got status %s, want sealed", status)
+	}
+
+	wantStatus(t, request(router, http.MethodPost, "/unlock", `{"password":"secret"}`), http.StatusOK)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go s.RunPersister(ctx, time.Hour, time.Hour, 2)
+
+	// once locked the persister has nothing left to write into the test directory
+	t.Cleanup(func() {
+		cancel()
+		s.Lock()
+	})
+
+	if status, _ := health(t, router, http.StatusOK); status != "ok" {
+		t.Fatalf("got status %s, want ok", status)
+	}
+
+	diskFull := errors.New("no space left on device")
+	r.fail(diskFull)
+
+	for _, name := range []string{"mail", "bank"} {
+		w := request(router, http.MethodPost, "/add-service?sync=true&type=web&favorite=false&name="+name, "")
+		wantStatus(t, w, http.StatusServiceUnavailable)
+
+		if !strings.Contains(w.Body.String(), diskFull.Error()) {
+			t.Fatalf("got %q", w.Body.String())
+		}
+	}
+
+	status, got := health(t, router, http.StatusServiceUnavailable)
+	if status != "degraded" || !got.Degraded || got.Failures != 2 || got.LastError != diskFull.Error() || got.LastFailure == nil {
+		t.Fatalf("got status %s, %+v", status, got)
+	}
+
+	w := request(router, http.MethodPost, "/add-service?type=web&favorite=false&name=shop", "")
+	wantStatus(t, w, http.StatusServiceUnavailable)
+
+	if !strings.Contains(w.Body.String(), domain.ErrDegraded.Error()) {
+		t.Fatalf("got %q", w.Body.String())
+	}
+
+	r.fail(nil)
+
+	if err := s.Sync(); err != nil {
+		t.Fatalf("Sync after the disk recovered: %s", err)
+	}
+
+	status, got = health(t, router, http.StatusOK)
+	if status != "ok" || got.Degraded || got.Failures != 0 || got.LastError != "" {
+		t.Fatalf("got status %s, %+v", status, got)
+	}
+}
@@ -0,0 +1,78 @@
+package handler
+
+import (
+	"errors"
+	"log"
+	"net/http"
+
+	"manager/internal/history"
+)
+
+// actorHeader names who makes a change, it ends up in the history. The client sets it and nothing
+// checks it, so the name is a label for the log and not proof of who made the change.
+const actorHeader = "X-Actor"
+
+// actor returns the name from actorHeader as it was sent, or "api" without one.
+func actor(r *http.Request) string {
+	name := r.Header.Get(actorHeader)
+	if name == "" {
+		return "api"
+	}
+
+	return name
+}
+
+func (h *Handler) history() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if err := r.ParseForm(); err != nil {
+			log.Print("failed to parse parameters")
+			http.Error(w, "bad Request", http.StatusBadRequest)
+
+			return
+		}
+
+		versions, err := h.s.History(r.Form.Get("name"))
+		if err != nil {
+			log.Printf("failed to read history: %s", err.Error())
+			http.Error(w, err.Error(), errorStatus(err))
+
+			return
+		}
+
+		if versions == nil {
+			versions = []history.Version{}
+		}
+
+		writeJSON(w, versions)
+	}
+}
+
+func (h *Handler) restoreVersion() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if err := r.ParseForm(); err != nil {
+			log.Print("failed to parse parameters")
+			http.Error(w, "bad Request", http.StatusBadRequest)
+
+			return
+		}
+
+		err := h.s.RestoreVersion(actor(r), r.Form.Get("name"), r.Form.Get("commit"))
+
+		switch {
+		case errors.Is(err, history.ErrNotFound):
+			http.Error(w, err.Error(), http.StatusNotFound)
+
+			return
+		case err != nil:
+			http.Error(w, err.Error(), errorStatus(err))
+
+			return
+		}
+
+		if !h.sync(w, r) {
+			return
+		}
+
+		w.WriteHeader(http.StatusOK)
+	}
+}
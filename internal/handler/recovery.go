@@ -0,0 +1,78 @@
+package handler
+
+import (
+	"errors"
+	"log"
+	"net/http"
+
+	"manager/internal/domain"
+)
+
+// recovery reports how many recovery codes are left on GET and generates new ones on POST.
+func (h *Handler) recovery() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet {
+			recovery, err := h.s.Recovery()
+			if err != nil {
+				http.Error(w, err.Error(), errorStatus(err))
+
+				return
+			}
+
+			writeJSON(w, recovery)
+
+			return
+		}
+
+		var requestBody domain.GenerateRecoveryBody
+		if !readJSON(w, r, &requestBody) {
+			return
+		}
+
+		codes, err := h.s.GenerateRecovery(actor(r), requestBody.Password, requestBody.Codes, requestBody.Key)
+
+		switch {
+		case errors.Is(err, domain.ErrWrongPassword):
+			http.Error(w, err.Error(), http.StatusUnauthorized)
+
+			return
+		case err != nil:
+			log.Printf("failed to generate recovery codes: %s", err.Error())
+			http.Error(w, err.Error(), errorStatus(err))
+
+			return
+		}
+
+		writeJSON(w, codes)
+	}
+}
+
+// recover unlocks a sealed storage with a recovery code, the new password is set at the same time.
+func (h *Handler) recover() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var requestBody domain.RecoverBody
+		if !readJSON(w, r, &requestBody) {
+			return
+		}
+
+		err := h.s.Recover(requestBody.Code, requestBody.NewPassword)
+
+		switch {
+		case errors.Is(err, domain.ErrInvalidCode):
+			http.Error(w, err.Error(), http.StatusUnauthorized)
+
+			return
+		case errors.Is(err, domain.ErrUnsealed), errors.Is(err, domain.ErrTampered):
+			http.Error(w, err.Error(), http.StatusConflict)
+
+			return
+		case err != nil:
+			log.Printf("failed to recover storage: %s", err.Error())
+			http.Error(w, err.Error(), errorStatus(err))
+
+			return
+		}
+
+		w.WriteHeader(http.StatusOK)
+	}
+}
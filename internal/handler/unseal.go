@@ -0,0 +1,121 @@
+package handler
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"log"
+	"net/http"
+
+	"manager/internal/domain"
+	"manager/internal/secmem"
+)
+
+// unseal reports the progress on GET and takes a key share, or a reset, on POST.
+func (h *Handler) unseal() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet {
+			writeJSON(w, h.s.UnsealProgress())
+
+			return
+		}
+
+		var requestBody domain.UnsealBody
+		if !readJSON(w, r, &requestBody) {
+			return
+		}
+
+		if requestBody.Reset {
+			h.s.ResetUnseal()
+			writeJSON(w, h.s.UnsealProgress())
+
+			return
+		}
+
+		progress, err := h.s.Unseal(requestBody.Share)
+
+		switch {
+		case errors.Is(err, domain.ErrWrongPassword):
+			http.Error(w, "key shares do not unseal the storage", http.StatusUnauthorized)
+
+			return
+		case errors.Is(err, domain.ErrUnsealed), errors.Is(err, domain.ErrTampered):
+			http.Error(w, err.Error(), http.StatusConflict)
+
+			return
+		case errors.Is(err, domain.ErrInvalidShare):
+			http.Error(w, err.Error(), http.StatusBadRequest)
+
+			return
+		case err != nil:
+			log.Printf("failed to unseal storage: %s", err.Error())
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+
+			return
+		}
+
+		writeJSON(w, progress)
+	}
+}
+
+func (h *Handler) initShares() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var requestBody domain.InitSharesBody
+		if !readJSON(w, r, &requestBody) {
+			return
+		}
+
+		shares, err := h.s.InitShares(actor(r), requestBody.Password, requestBody.Shares, requestBody.Threshold)
+		writeShares(w, shares, err)
+	}
+}
+
+func (h *Handler) rekeyShares() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var requestBody domain.RekeySharesBody
+		if !readJSON(w, r, &requestBody) {
+			return
+		}
+
+		shares, err := h.s.RekeyShares(actor(r), requestBody.Shares, requestBody.NewShares, requestBody.Threshold)
+		writeShares(w, shares, err)
+	}
+}
+
+func writeShares(w http.ResponseWriter, shares []string, err error) {
+	switch {
+	case errors.Is(err, domain.ErrWrongPassword):
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+
+		return
+	case err != nil:
+		log.Printf("failed to split storage key: %s", err.Error())
+		http.Error(w, err.Error(), errorStatus(err))
+
+		return
+	}
+
+	writeJSON(w, struct {
+		Shares []string `json:"shares"`
+	}{shares})
+}
+
+func readJSON(w http.ResponseWriter, r *http.Request, v any) bool {
+	body, err := ioutil.ReadAll(r.Body)
+	defer r.Body.Close()
+	if err != nil {
+		http.Error(w, "error reading request body", http.StatusInternalServerError)
+
+		return false
+	}
+
+	err = json.Unmarshal(body, v)
+	secmem.Zero(body)
+	if err != nil {
+		http.Error(w, "Error unmarshalling JSON", http.StatusBadRequest)
+
+		return false
+	}
+
+	return true
+}
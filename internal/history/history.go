@@ -0,0 +1,329 @@
+package history
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	ErrNotFound = errors.New("version not found")
+	ErrEmpty    = errors.New("history is empty")
+)
+
+var commitPattern = regexp.MustCompile(`^[0-9a-f]{4,64}$`)
+
+// Change describes a commit. It never holds secrets, only names.
+type Change struct {
+	Op      string
+	Service string
+	Login   string
+	Actor   string
+	// From is the commit a restored record was taken from
+	From string
+}
+
+type Version struct {
+	Commit  string    `json:"commit"`
+	Time    time.Time `json:"time"`
+	Op      string    `json:"op"`
+	Service string    `json:"service,omitempty"`
+	Login   string    `json:"login,omitempty"`
+	Actor   string    `json:"actor"`
+	From    string    `json:"from,omitempty"`
+}
+
+// Repo keeps the versions of the storage as commits of a bare git repository next to the storage
+// file, <file>.history.git. Every commit holds a complete storage file, encrypted like the storage,
+// under the name of the storage file. A repository the vault directory happens to be part of is
+// never used, and the history can be pushed elsewhere with git --git-dir.
+type Repo struct {
+	gitDir string
+	name   string
+
+	mutex *sync.Mutex
+}
+
+func New(filename string) *Repo {
+	return &Repo{
+		gitDir: filename + ".history.git",
+		name:   filepath.Base(filename),
+		mutex:  new(sync.Mutex),
+	}
+}
+
+// Init creates the repository unless it exists already.
+func (r *Repo) Init() error {
+	_, err := exec.LookPath("git")
+	if err != nil {
+		return fmt.Errorf("git is needed for the history: %s", err.Error())
+	}
+
+	_, err = os.Stat(r.gitDir)
+	if errors.Is(err, os.ErrNotExist) {
+		_, err = r.git(nil, "init", "--bare", "--quiet")
+
+		return err
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read history: %s", err.Error())
+	}
+
+	bare, err := r.git(nil, "rev-parse", "--is-bare-repository")
+	if err != nil || bare != "true" {
+		return fmt.Errorf("%s is not a history repository", r.gitDir)
+	}
+
+	return nil
+}
+
+// Commit records a version of the storage.
+func (r *Repo) Commit(change Change, snapshot []byte) error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	blob, err := r.git(snapshot, "hash-object", "-w", "--stdin")
+	if err != nil {
+		return err
+	}
+
+	tree, err := r.git([]byte(fmt.Sprintf("100644 blob %s\t%s\n", blob, r.name)), "mktree")
+	if err != nil {
+		return err
+	}
+
+	parent, err := r.head()
+	if err != nil {
+		return err
+	}
+
+	args := []string{"commit-tree", tree, "-F", "-"}
+	if parent != "" {
+		args = append(args, "-p", parent)
+	}
+
+	commit, err := r.gitAs(change.Actor, []byte(change.message()), args...)
+	if err != nil {
+		return err
+	}
+
+	// the old value makes the update fail if another process committed in between
+	_, err = r.git(nil, "update-ref", "-m", change.Op, "HEAD", commit, parent)
+
+	return err
+}
+
+// Log returns the versions that changed the service, or all versions for an empty name, the
+// newest first.
+func (r *Repo) Log(service string) ([]Version, error) {
+	head, err := r.head()
+	if err != nil || head == "" {
+		return nil, err
+	}
+
+	out, err := r.git(nil, "log", "--format=%H%x1f%at%x1f%B%x1e", head)
+	if err != nil {
+		return nil, err
+	}
+
+	var versions []Version
+
+	for _, entry := range strings.Split(out, "\x1e") {
+		fields := strings.SplitN(strings.TrimSpace(entry), "\x1f", 3)
+		if len(fields) != 3 {
+			continue
+		}
+
+		at, err := strconv.ParseInt(fields[1], 10, 64)
+		if err != nil {
+			continue
+		}
+
+		v := parseMessage(fields[2])
+		v.Commit = fields[0]
+		v.Time = time.Unix(at, 0).UTC()
+
+		if service != "" && v.Service != service {
+			continue
+		}
+
+		versions = append(versions, v)
+	}
+
+	return versions, nil
+}
+
+// Show returns the storage file as it was committed, ErrEmpty when there is no commit yet.
+func (r *Repo) Show(commit string) ([]byte, error) {
+	if commit == "HEAD" {
+		head, err := r.head()
+		if err != nil {
+			return nil, err
+		}
+
+		if head == "" {
+			return nil, ErrEmpty
+		}
+
+		commit = head
+	}
+
+	if !commitPattern.MatchString(commit) {
+		return nil, ErrNotFound
+	}
+
+	_, err := r.git(nil, "cat-file", "-e", commit+"^{commit}")
+	if err != nil {
+		return nil, ErrNotFound
+	}
+
+	cmd := r.command("cat-file", "blob", commit+":"+r.name)
+
+	data, err := cmd.Output()
+	if err != nil {
+		return nil, ErrNotFound
+	}
+
+	return data, nil
+}
+
+func (r *Repo) head() (string, error) {
+	out, err := r.git(nil, "rev-parse", "--verify", "--quiet", "HEAD")
+
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		// no commit yet
+		return "", nil
+	}
+
+	return out, err
+}
+
+func (r *Repo) git(stdin []byte, args ...string) (string, error) {
+	return r.gitAs("manager", stdin, args...)
+}
+
+func (r *Repo) gitAs(actor string, stdin []byte, args ...string) (string, error) {
+	cmd := r.command(args...)
+	cmd.Env = append(os.Environ(),
+		"GIT_AUTHOR_NAME="+actor,
+		"GIT_AUTHOR_EMAIL=",
+		"GIT_COMMITTER_NAME=manager",
+		"GIT_COMMITTER_EMAIL=",
+	)
+
+	if stdin != nil {
+		cmd.Stdin = bytes.NewReader(stdin)
+	}
+
+	stderr := new(bytes.Buffer)
+	cmd.Stderr = stderr
+
+	out, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("git %s: %w: %s", args[0], err, strings.TrimSpace(stderr.String()))
+	}
+
+	return strings.TrimSpace(string(out)), nil
+}
+
+func (r *Repo) command(args ...string) *exec.Cmd {
+	cmd := exec.Command("git", append([]string{"--git-dir=" + r.gitDir}, args...)...)
+	cmd.Dir = filepath.Dir(r.gitDir)
+
+	return cmd
+}
+
+// message puts the names into trailers, quoted when they would break the line.
+func (c Change) message() string {
+	b := new(strings.Builder)
+
+	subject := c.Op
+	if c.Service != "" {
+		subject += " " + c.Service
+	}
+
+	fmt.Fprintf(b, "%s\n\n", quote(subject))
+
+	fmt.Fprintf(b, "Operation: %s\n", quote(c.Op))
+
+	if c.Service != "" {
+		fmt.Fprintf(b, "Service: %s\n", quote(c.Service))
+	}
+
+	if c.Login != "" {
+		fmt.Fprintf(b, "Login: %s\n", quote(c.Login))
+	}
+
+	if c.From != "" {
+		fmt.Fprintf(b, "Restored-From: %s\n", c.From)
+	}
+
+	fmt.Fprintf(b, "Actor: %s\n", quote(c.Actor))
+
+	return b.String()
+}
+
+func parseMessage(message string) Version {
+	var v Version
+
+	scanner := bufio.NewScanner(strings.NewReader(message))
+
+	// the subject repeats the trailers for git log --oneline
+	scanner.Scan()
+
+	for scanner.Scan() {
+		key, value, ok := strings.Cut(scanner.Text(), ": ")
+		if !ok {
+			continue
+		}
+
+		value = unquote(value)
+
+		switch key {
+		case "Operation":
+			v.Op = value
+		case "Service":
+			v.Service = value
+		case "Login":
+			v.Login = value
+		case "Actor":
+			v.Actor = value
+		case "Restored-From":
+			v.From = value
+		}
+	}
+
+	return v
+}
+
+func quote(s string) string {
+	q := strconv.Quote(s)
+	if q[1:len(q)-1] == s && !strings.HasPrefix(s, `"`) {
+		return s
+	}
+
+	return q
+}
+
+func unquote(s string) string {
+	if !strings.HasPrefix(s, `"`) {
+		return s
+	}
+
+	u, err := strconv.Unquote(s)
+	if err != nil {
+		return s
+	}
+
+	return u
+}
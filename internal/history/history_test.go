@@ -0,0 +1,208 @@
+package history
+
+import (
+	"errors"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func requireGit(t *testing.T) {
+	t.Helper()
+
+	_, err := exec.LookPath("git")
+	if err != nil {
+		t.Skip("git is not installed")
+	}
+}
+
+func run(t *testing.T, dir string, args ...string) string {
+	t.Helper()
+
+	cmd := exec.Command("git", args...)
+	cmd.Dir = dir
+	cmd.Env = append(os.Environ(), "GIT_AUTHOR_NAME=test", "GIT_AUTHOR_EMAIL=test@example.com", "GIT_COMMITTER_NAME=test", "GIT_COMMITTER_EMAIL=test@example.com")
+
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		t.Fatalf("git %s: %s: %s", strings.Join(args, " "), err, out)
+	}
+
+	return strings.TrimSpace(string(out))
+}
+
+func newTestRepo(t *testing.T) (*Repo, string) {
+	t.Helper()
+
+	requireGit(t)
+
+	filename := filepath.Join(t.TempDir(), "storage.txt")
+
+	r := New(filename)
+
+	err := r.Init()
+	if err != nil {
+		t.Fatalf("Init: %s", err)
+	}
+
+	return r, filename
+}
+
+func TestCommitLogShow(t *testing.T) {
+	r, _ := newTestRepo(t)
+
+	_, err := r.Show("HEAD")
+	if !errors.Is(err, ErrEmpty) {
+		t.Fatalf("got %v, want ErrEmpty", err)
+	}
+
+	changes := []struct {
+		change Change
+		data   string
+	}{
+		{Change{Op: "append-service", Service: "mail", Actor: "alice"}, "one"},
+		{Change{Op: "append-login", Service: "mail", Login: "bob\nsmith", Actor: "alice"}, "two"},
+		{Change{Op: "append-service", Service: `"quoted"`, Actor: "carol"}, "three"},
+		{Change{Op: "restore-service", Service: "mail", Actor: "alice", From: "0123abcd"}, "four"},
+	}
+
+	for _, c := range changes {
+		err = r.Commit(c.change, []byte(c.data))
+		if err != nil {
+			t.Fatalf("Commit %s: %s", c.change.Op, err)
+		}
+	}
+
+	versions, err := r.Log("")
+	if err != nil || len(versions) != len(changes) {
+		t.Fatalf("got %d versions, %v", len(versions), err)
+	}
+
+	for i, v := range versions {
+		c := changes[len(changes)-1-i]
+
+		if v.Op != c.change.Op || v.Service != c.change.Service || v.Login != c.change.Login || v.Actor != c.change.Actor || v.From != c.change.From {
+			t.Fatalf("version %d: got %+v, want %+v", i, v, c.change)
+		}
+
+		data, err := r.Show(v.Commit)
+		if err != nil || string(data) != c.data {
+			t.Fatalf("version %d holds %q, %v", i, data, err)
+		}
+	}
+
+	mail, err := r.Log("mail")
+	if err != nil || len(mail) != 3 {
+		t.Fatalf("got %d versions of mail, %v", len(mail), err)
+	}
+
+	data, err := r.Show("HEAD")
+	if err != nil || string(data) != "four" {
+		t.Fatalf("HEAD holds %q, %v", data, err)
+	}
+
+	for _, commit := range []string{"0000000000000000000000000000000000000000", "--output=x", "HEAD~1", "xyz"} {
+		_, err = r.Show(commit)
+		if !errors.Is(err, ErrNotFound) {
+			t.Fatalf("%s: got %v, want ErrNotFound", commit, err)
+		}
+	}
+}
+
+// A vault kept inside a project checkout leaves the branch and the index of that project alone.
+func TestInitInsideRepository(t *testing.T) {
+	requireGit(t)
+
+	project := t.TempDir()
+	run(t, project, "init", "--quiet")
+
+	err := os.WriteFile(filepath.Join(project, "main.go"), []byte("package main\n"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	run(t, project, "add", "main.go")
+	run(t, project, "commit", "--quiet", "-m", "initial")
+
+	head := run(t, project, "rev-parse", "HEAD")
+	index := run(t, project, "ls-files", "--stage")
+
+	r := New(filepath.Join(project, "storage.txt"))
+
+	err = r.Init()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = r.Commit(Change{Op: "append-service", Service: "mail", Actor: "alice"}, []byte("one"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got := run(t, project, "rev-parse", "HEAD"); got != head {
+		t.Fatalf("the project moved from %s to %s", head, got)
+	}
+
+	if got := run(t, project, "ls-files", "--stage"); got != index {
+		t.Fatalf("the index of the project changed to %q", got)
+	}
+
+	if got := run(t, project, "rev-parse", "--is-bare-repository"); got != "false" {
+		t.Fatal("the project became bare")
+	}
+
+	versions, err := r.Log("")
+	if err != nil || len(versions) != 1 {
+		t.Fatalf("got %v, %v", versions, err)
+	}
+
+	// the history can be pushed elsewhere
+	run(t, project, "--git-dir=storage.txt.history.git", "log", "--oneline")
+
+	// opening it again keeps the versions
+	err = New(filepath.Join(project, "storage.txt")).Init()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	versions, err = r.Log("")
+	if err != nil || len(versions) != 1 {
+		t.Fatalf("got %v, %v after opening again", versions, err)
+	}
+}
+
+func TestInitRefusesOtherDirectory(t *testing.T) {
+	requireGit(t)
+
+	filename := filepath.Join(t.TempDir(), "storage.txt")
+
+	err := os.Mkdir(filename+".history.git", 0700)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = New(filename).Init()
+	if err == nil {
+		t.Fatal("an unrelated directory was taken for the history")
+	}
+}
+
+func TestCommitMessageHasNoData(t *testing.T) {
+	r, _ := newTestRepo(t)
+
+	err := r.Commit(Change{Op: "update-login", Service: "mail", Login: "bob", Actor: "alice"}, []byte("hunter2"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	out, err := r.git(nil, "log", "--format=%B")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if strings.Contains(out, "hunter2") {
+		t.Fatal("the commit message holds the storage")
+	}
+}
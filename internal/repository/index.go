@@ -0,0 +1,123 @@
+package repository
+
+import (
+	"manager/internal/domain"
+)
+
+// indexer derives the keys a service is found under in an index.
+type indexer func(service domain.Service) []string
+
+const (
+	byType = iota
+	byFavorite
+)
+
+// indexers are kept in the order of the constants above.
+var indexers = []indexer{
+	byType: func(service domain.Service) []string {
+		return []string{service.Type}
+	},
+	byFavorite: func(service domain.Service) []string {
+		if !service.Favorite {
+			return nil
+		}
+
+		return []string{"true"}
+	},
+}
+
+// index maps keys to the names of the services that have them. Like the storage it is never
+// modified once published, a change copies only the paths to the keys and names it touches.
+type index struct {
+	keys trie[trie[struct{}]]
+}
+
+func buildIndexes(services trie[domain.Service]) []index {
+	indexes := make([]index, len(indexers))
+
+	for i, keys := range indexers {
+		var ix index
+
+		services.Each(func(name string, service domain.Service) {
+			ix = ix.move(name, nil, keys(service))
+		})
+
+		indexes[i] = ix
+	}
+
+	return indexes
+}
+
+// reindex returns the indexes with the service moved from the keys of before to the keys of after,
+// a nil service is one that does not exist.
+func reindex(indexes []index, name string, before, after *domain.Service) []index {
+	next := make([]index, len(indexes))
+
+	for i, keys := range indexers {
+		var removed, added []string
+
+		if before != nil {
+			removed = keys(*before)
+		}
+
+		if after != nil {
+			added = keys(*after)
+		}
+
+		next[i] = indexes[i].move(name, removed, added)
+	}
+
+	return next
+}
+
+func (ix index) move(name string, removed, added []string) index {
+	if sameKeys(removed, added) {
+		return ix
+	}
+
+	for _, key := range removed {
+		names, _ := ix.keys.Get(key)
+		names = names.Delete(name)
+
+		if names.Len() == 0 {
+			ix.keys = ix.keys.Delete(key)
+
+			continue
+		}
+
+		ix.keys = ix.keys.Set(key, names)
+	}
+
+	for _, key := range added {
+		names, _ := ix.keys.Get(key)
+		ix.keys = ix.keys.Set(key, names.Set(name, struct{}{}))
+	}
+
+	return ix
+}
+
+// lookup returns the services under the key, it takes time in the size of the result.
+func (s *Snapshot) lookup(i int, key string) domain.Storage {
+	names, _ := s.indexes[i].keys.Get(key)
+	storage := make(domain.Storage, names.Len())
+
+	names.Each(func(name string, _ struct{}) {
+		storage[name], _ = s.services.Get(name)
+	})
+
+	return storage
+}
+
+func sameKeys(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+
+	return true
+}
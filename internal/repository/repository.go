@@ -2,189 +2,361 @@ package repository
 
 import (
 	"sync"
+	"sync/atomic"
 
 	"manager/internal/domain"
 )
 
-type Repository struct {
+// Snapshot is a version of the storage. It is never modified once published, a change publishes
+// a new snapshot that shares everything but the path to the changed service with the previous one.
+type Snapshot struct {
+	Version uint64
+
+	services trie[domain.Service]
+
+	// indexes are published together with the storage they were built from
+	indexes []index
+
+	// storage is the map of the services, made once for the readers that ask for it
+	once    sync.Once
 	storage domain.Storage
-	mutex   *sync.RWMutex
+}
+
+// Storage returns all services of the version, it must not be modified.
+func (s *Snapshot) Storage() domain.Storage {
+	s.once.Do(func() {
+		storage := make(domain.Storage, s.services.Len())
+
+		s.services.Each(func(name string, service domain.Service) {
+			storage[name] = service
+		})
+
+		s.storage = storage
+	})
+
+	return s.storage
+}
+
+func (s *Snapshot) Get(name string) (domain.Service, bool) {
+	return s.services.Get(name)
+}
+
+func (s *Snapshot) GetByType(recordType string) domain.Storage {
+	return s.lookup(byType, recordType)
+}
+
+func (s *Snapshot) GetFavorites() domain.Storage {
+	return s.lookup(byFavorite, "true")
+}
+
+// Repository keeps the storage as copy-on-write snapshots. Readers take the current snapshot
+// without locking and keep a consistent view while writers publish new versions.
+type Repository struct {
+	current atomic.Pointer[Snapshot]
+
+	// mutex serializes writers
+	mutex *sync.Mutex
 }
 
 func New() *Repository {
-	return &Repository{
-		storage: make(domain.Storage),
-		mutex:   new(sync.RWMutex),
+	r := &Repository{
+		mutex: new(sync.Mutex),
 	}
+
+	r.current.Store(&Snapshot{indexes: buildIndexes(trie[domain.Service]{})})
+
+	return r
+}
+
+// Current returns the latest snapshot, it must not be modified.
+func (r *Repository) Current() *Snapshot {
+	return r.current.Load()
 }
 
 func (r *Repository) SetStorage(storage domain.Storage) {
-	copyStorage := make(domain.Storage, len(storage))
+	var services trie[domain.Service]
+
+	for name, service := range storage {
+		if service.Elements != nil {
+			service.Elements = cloneElements(service.Elements)
+		}
 
-	for name, elem := range storage {
-		copyStorage[name] = elem
+		services = services.Set(name, service)
 	}
 
-	r.mutex.RLock()
-	r.storage = copyStorage
-	r.mutex.RUnlock()
+	r.publish(services)
 }
 
 func (r *Repository) Get(name string) (domain.Service, bool) {
-	r.mutex.RLock()
-	service, ok := r.storage[name]
-	r.mutex.RUnlock()
-
-	if !ok {
-		return domain.Service{}, false
-	}
-
-	return service, true
+	return r.Current().Get(name)
 }
 
+// GetAll returns the storage of the current snapshot, it must not be modified.
 func (r *Repository) GetAll() domain.Storage {
-	r.mutex.RLock()
-	copyStorage := make(domain.Storage, len(r.storage))
-
-	for id, elem := range r.storage {
-		copyStorage[id] = elem
-	}
+	return r.Current().Storage()
+}
 
-	r.mutex.RUnlock()
+func (r *Repository) GetByType(recordType string) domain.Storage {
+	return r.Current().GetByType(recordType)
+}
 
-	return copyStorage
+func (r *Repository) GetFavorites() domain.Storage {
+	return r.Current().GetFavorites()
 }
 
 func (r *Repository) Reset() {
+	r.publish(trie[domain.Service]{})
+}
+
+func (r *Repository) publish(services trie[domain.Service]) {
 	r.mutex.Lock()
-	r.storage = make(domain.Storage)
-	r.mutex.Unlock()
+	defer r.mutex.Unlock()
+
+	r.current.Store(&Snapshot{
+		Version:  r.current.Load().Version + 1,
+		services: services,
+		indexes:  buildIndexes(services),
+	})
 }
 
-// login
+// change modifies the services, it returns false when it does not apply.
+type change func(services trie[domain.Service]) (trie[domain.Service], bool)
 
-func (r *Repository) AppendLogin(name, login string, elem domain.Element) bool {
+// update publishes a new version when the change of the service with the name succeeds.
+func (r *Repository) update(name string, c change) bool {
+	return r.updateAll([]string{name}, []change{c})
+}
+
+// updateAll publishes a single version when all changes succeed in order, names lists the services
+// they touch. Only those services and their index entries are copied.
+func (r *Repository) updateAll(names []string, changes []change) bool {
 	r.mutex.Lock()
+	defer r.mutex.Unlock()
 
-	_, ok := r.storage[name]
-	if ok {
-		r.mutex.Unlock()
+	current := r.current.Load()
+	services := current.services
 
-		return false
+	for _, c := range changes {
+		var ok bool
+
+		services, ok = c(services)
+		if !ok {
+			return false
+		}
 	}
 
-	_, ok = r.storage[name].Elements[login]
-	if ok {
-		r.mutex.Unlock()
+	indexes := current.indexes
+	reindexed := make(map[string]bool, len(names))
 
-		return false
+	for _, name := range names {
+		if !reindexed[name] {
+			reindexed[name] = true
+			indexes = reindex(indexes, name, lookupService(current.services, name), lookupService(services, name))
+		}
 	}
 
-	r.storage[name].Elements[login] = elem
-	r.mutex.Unlock()
+	r.current.Store(&Snapshot{
+		Version:  current.Version + 1,
+		services: services,
+		indexes:  indexes,
+	})
 
 	return true
 }
 
+// login
+
+func (r *Repository) AppendLogin(name, login string, elem domain.Element) bool {
+	return r.update(name, appendLogin(name, login, elem))
+}
+
 func (r *Repository) UpdateLogin(name, login string, elem domain.Element) bool {
-	r.mutex.Lock()
-	_, ok := r.storage[name]
-	if !ok {
-		r.mutex.Unlock()
+	return r.update(name, updateLogin(name, login, elem))
+}
 
-		return false
-	}
+func (r *Repository) DeleteLogin(name, login string) bool {
+	return r.update(name, deleteLogin(name, login))
+}
 
-	_, ok = r.storage[name].Elements[login]
-	if !ok {
-		r.mutex.Unlock()
+func appendLogin(name, login string, elem domain.Element) change {
+	return func(services trie[domain.Service]) (trie[domain.Service], bool) {
+		service, ok := services.Get(name)
+		if !ok {
+			return services, false
+		}
 
-		return false
-	}
+		_, ok = service.Elements[login]
+		if ok {
+			return services, false
+		}
 
-	r.storage[name].Elements[login] = elem
-	r.mutex.Unlock()
+		service.Elements = cloneElements(service.Elements)
+		service.Elements[login] = elem
 
-	return true
+		return services.Set(name, service), true
+	}
 }
 
-func (r *Repository) DeleteLogin(name, login string) bool {
-	r.mutex.Lock()
+func updateLogin(name, login string, elem domain.Element) change {
+	return func(services trie[domain.Service]) (trie[domain.Service], bool) {
+		service, ok := services.Get(name)
+		if !ok {
+			return services, false
+		}
 
-	_, ok := r.storage[name]
-	if !ok {
-		r.mutex.Unlock()
+		_, ok = service.Elements[login]
+		if !ok {
+			return services, false
+		}
 
-		return false
+		service.Elements = cloneElements(service.Elements)
+		service.Elements[login] = elem
+
+		return services.Set(name, service), true
 	}
+}
 
-	_, ok = r.storage[name].Elements[login]
-	if !ok {
-		r.mutex.Unlock()
+func deleteLogin(name, login string) change {
+	return func(services trie[domain.Service]) (trie[domain.Service], bool) {
+		service, ok := services.Get(name)
+		if !ok {
+			return services, false
+		}
 
-		return false
-	}
+		_, ok = service.Elements[login]
+		if !ok {
+			return services, false
+		}
 
-	delete(r.storage[name].Elements, login)
-	r.mutex.Unlock()
+		service.Elements = cloneElements(service.Elements)
+		delete(service.Elements, login)
 
-	return true
+		return services.Set(name, service), true
+	}
 }
 
 // service
 
 func (r *Repository) AppendService(name, serviceType string, favorite bool) bool {
-	r.mutex.Lock()
+	return r.update(name, appendService(name, serviceType, favorite))
+}
 
-	_, ok := r.storage[name]
-	if ok {
-		r.mutex.Unlock()
+func (r *Repository) UpdateService(name, serviceType string, favorite bool) bool {
+	return r.update(name, updateService(name, serviceType, favorite))
+}
 
-		return false
-	}
+func (r *Repository) DeleteService(name string) bool {
+	return r.update(name, deleteService(name))
+}
 
-	r.storage[name] = domain.Service{
-		Type:     serviceType,
-		Favorite: favorite,
-		Elements: nil,
+func appendService(name, serviceType string, favorite bool) change {
+	return func(services trie[domain.Service]) (trie[domain.Service], bool) {
+		_, ok := services.Get(name)
+		if ok {
+			return services, false
+		}
+
+		return services.Set(name, domain.Service{
+			Type:     serviceType,
+			Favorite: favorite,
+			Elements: nil,
+		}), true
 	}
-	r.mutex.Unlock()
+}
 
-	return true
+func updateService(name, serviceType string, favorite bool) change {
+	return func(services trie[domain.Service]) (trie[domain.Service], bool) {
+		service, ok := services.Get(name)
+		if !ok {
+			return services, false
+		}
+
+		return services.Set(name, domain.Service{
+			Type:     serviceType,
+			Favorite: favorite,
+			Elements: service.Elements,
+		}), true
+	}
 }
 
-func (r *Repository) UpdateService(name, serviceType string, favorite bool) bool {
-	r.mutex.Lock()
-	service, ok := r.storage[name]
-	if !ok {
-		r.mutex.Unlock()
+func deleteService(name string) change {
+	return func(services trie[domain.Service]) (trie[domain.Service], bool) {
+		_, ok := services.Get(name)
+		if !ok {
+			return services, false
+		}
 
-		return false
+		return services.Delete(name), true
 	}
+}
 
-	r.storage[name] = domain.Service{
-		Type:     serviceType,
-		Favorite: favorite,
-		Elements: service.Elements,
+// Apply replays an operation from the journal.
+func (r *Repository) Apply(op domain.Operation) bool {
+	c := operation(op)
+	if c == nil {
+		return false
 	}
 
-	r.mutex.Unlock()
+	return r.update(op.Service, c)
+}
 
-	return true
+// ApplyBatch applies the operations as a single version, or none of them when one fails.
+func (r *Repository) ApplyBatch(ops []domain.Operation) bool {
+	names := make([]string, 0, len(ops))
+	changes := make([]change, 0, len(ops))
+
+	for _, op := range ops {
+		c := operation(op)
+		if c == nil {
+			return false
+		}
+
+		names = append(names, op.Service)
+		changes = append(changes, c)
+	}
+
+	return r.updateAll(names, changes)
 }
 
-func (r *Repository) DeleteService(name string) bool {
-	r.mutex.Lock()
+func operation(op domain.Operation) change {
+	var elem domain.Element
+	if op.Element != nil {
+		elem = *op.Element
+	}
 
-	_, ok := r.storage[name]
-	if !ok {
-		r.mutex.Unlock()
+	switch op.Op {
+	case domain.OpAppendService:
+		return appendService(op.Service, op.Type, op.Favorite)
+	case domain.OpUpdateService:
+		return updateService(op.Service, op.Type, op.Favorite)
+	case domain.OpDeleteService:
+		return deleteService(op.Service)
+	case domain.OpAppendLogin:
+		return appendLogin(op.Service, op.Login, elem)
+	case domain.OpUpdateLogin:
+		return updateLogin(op.Service, op.Login, elem)
+	case domain.OpDeleteLogin:
+		return deleteLogin(op.Service, op.Login)
+	}
 
-		return false
+	return nil
+}
+
+func lookupService(services trie[domain.Service], name string) *domain.Service {
+	service, ok := services.Get(name)
+	if !ok {
+		return nil
 	}
 
-	delete(r.storage, name)
-	r.mutex.Unlock()
+	return &service
+}
 
-	return true
+func cloneElements(elements map[string]domain.Element) map[string]domain.Element {
+	clone := make(map[string]domain.Element, len(elements)+1)
+
+	for login, elem := range elements {
+		clone[login] = elem
+	}
+
+	return clone
 }
@@ -0,0 +1,319 @@
+package repository
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"reflect"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"manager/internal/domain"
+)
+
+func element(password string) *domain.Element {
+	return &domain.Element{Password: domain.NewSecret([]byte(password))}
+}
+
+func TestApplyBatch(t *testing.T) {
+	r := New()
+	r.AppendService("mail", "web", false)
+	r.AppendLogin("mail", "bob", *element("one"))
+
+	before := r.Current()
+
+	// the last operation fails, nothing is applied
+	ok := r.ApplyBatch([]domain.Operation{
+		{Op: domain.OpDeleteService, Service: "mail"},
+		{Op: domain.OpAppendService, Service: "mail", Type: "card", Favorite: true},
+		{Op: domain.OpUpdateLogin, Service: "mail", Login: "nobody", Element: element("x")},
+	})
+	if ok || r.Current() != before {
+		t.Fatal("a failed batch changed the storage")
+	}
+
+	ok = r.ApplyBatch([]domain.Operation{
+		{Op: domain.OpDeleteService, Service: "mail"},
+		{Op: domain.OpAppendService, Service: "mail", Type: "card", Favorite: true},
+		{Op: domain.OpAppendLogin, Service: "mail", Login: "carol", Element: element("two")},
+	})
+	if !ok {
+		t.Fatal("the batch failed")
+	}
+
+	after := r.Current()
+	if after.Version != before.Version+1 {
+		t.Fatalf("the batch made %d versions", after.Version-before.Version)
+	}
+
+	mail := after.Storage()["mail"]
+	if mail.Type != "card" || !mail.Favorite || len(mail.Elements) != 1 || string(mail.Elements["carol"].Password.Bytes()) != "two" {
+		t.Fatalf("got %+v", mail)
+	}
+
+	if len(r.GetByType("web")) != 0 || len(r.GetByType("card")) != 1 || len(r.GetFavorites()) != 1 {
+		t.Fatal("the indexes do not follow the batch")
+	}
+
+	// the previous version is left as it was
+	if len(before.Storage()["mail"].Elements) != 1 || before.Storage()["mail"].Type != "web" {
+		t.Fatalf("the previous version changed to %+v", before.Storage()["mail"])
+	}
+}
+
+func TestSnapshotIsolation(t *testing.T) {
+	r := New()
+	r.SetStorage(domain.Storage{
+		"mail": {Type: "web", Elements: map[string]domain.Element{"bob": *element("one")}},
+		"bank": {Type: "card", Favorite: true},
+	})
+
+	before := r.Current()
+	storage := before.Storage()
+
+	r.UpdateLogin("mail", "bob", *element("two"))
+	r.AppendLogin("mail", "carol", *element("three"))
+	r.UpdateService("bank", "web", false)
+	r.DeleteService("mail")
+	r.AppendService("news", "web", true)
+
+	if len(storage) != 2 || len(storage["mail"].Elements) != 1 || string(storage["mail"].Elements["bob"].Password.Bytes()) != "one" {
+		t.Fatalf("the earlier version changed to %+v", storage)
+	}
+
+	if len(before.GetByType("card")) != 1 || len(before.GetFavorites()) != 1 || len(before.GetByType("web")) != 1 {
+		t.Fatal("the indexes of the earlier version changed")
+	}
+
+	after := r.Current()
+	if after.Version != before.Version+5 {
+		t.Fatalf("got version %d after %d and five changes", after.Version, before.Version)
+	}
+
+	if len(after.GetByType("web")) != 2 || len(after.GetFavorites()) != 1 || len(after.GetByType("card")) != 0 {
+		t.Fatalf("got %v, %v", after.GetByType("web"), after.GetFavorites())
+	}
+}
+
+var testTypes = []string{"web", "card", "note"}
+
+// checkIndexes compares the type and favorite lookups of a version with a scan of its services.
+func checkIndexes(t *testing.T, snap *Snapshot) {
+	t.Helper()
+
+	scan := func(match func(domain.Service) bool) domain.Storage {
+		storage := make(domain.Storage)
+
+		for name, service := range snap.Storage() {
+			if match(service) {
+				storage[name] = service
+			}
+		}
+
+		return storage
+	}
+
+	for _, recordType := range testTypes {
+		want := scan(func(service domain.Service) bool { return service.Type == recordType })
+
+		if got := snap.GetByType(recordType); !reflect.DeepEqual(got, want) {
+			t.Fatalf("%s: got %v, want %v", recordType, got, want)
+		}
+	}
+
+	want := scan(func(service domain.Service) bool { return service.Favorite })
+
+	if got := snap.GetFavorites(); !reflect.DeepEqual(got, want) {
+		t.Fatalf("favorites: got %v, want %v", got, want)
+	}
+}
+
+func TestIndexes(t *testing.T) {
+	r := New()
+
+	steps := []struct {
+		name   string
+		change func() bool
+	}{
+		{"append", func() bool { return r.AppendService("mail", "web", false) }},
+		{"append favorite", func() bool { return r.AppendService("bank", "card", true) }},
+		{"append login", func() bool { return r.AppendLogin("mail", "bob", *element("one")) }},
+		{"update login", func() bool { return r.UpdateLogin("mail", "bob", *element("two")) }},
+		{"favorite", func() bool { return r.UpdateService("mail", "web", true) }},
+		{"type change", func() bool { return r.UpdateService("bank", "note", true) }},
+		{"unfavorite", func() bool { return r.UpdateService("bank", "note", false) }},
+		{"delete login", func() bool { return r.DeleteLogin("mail", "bob") }},
+		{"delete", func() bool { return r.DeleteService("mail") }},
+		{"delete last", func() bool { return r.DeleteService("bank") }},
+	}
+
+	for _, step := range steps {
+		if !step.change() {
+			t.Fatalf("%s failed", step.name)
+		}
+
+		t.Run(step.name, func(t *testing.T) {
+			checkIndexes(t, r.Current())
+		})
+	}
+
+	if len(r.GetByType("web")) != 0 || len(r.GetByType("note")) != 0 || len(r.GetFavorites()) != 0 {
+		t.Fatal("deleted services are still indexed")
+	}
+}
+
+// The indexes match the services after random changes.
+func TestIndexesRandom(t *testing.T) {
+	rnd := rand.New(rand.NewSource(1))
+	r := New()
+
+	for i := 0; i < 2000; i++ {
+		name := fmt.Sprintf("service-%d", rnd.Intn(100))
+
+		switch rnd.Intn(3) {
+		case 0:
+			r.AppendService(name, testTypes[rnd.Intn(len(testTypes))], rnd.Intn(2) == 0)
+		case 1:
+			r.UpdateService(name, testTypes[rnd.Intn(len(testTypes))], rnd.Intn(2) == 0)
+		case 2:
+			r.DeleteService(name)
+		}
+
+		if i%100 == 0 {
+			checkIndexes(t, r.Current())
+		}
+	}
+
+	checkIndexes(t, r.Current())
+}
+
+// Run with -race: readers take versions and read them through while writers keep changing the
+// storage. Logins only move between services in batches, so every version holds all of them.
+func TestConcurrentReadersAndWriters(t *testing.T) {
+	const (
+		services = 8
+		logins   = 16
+	)
+
+	r := New()
+
+	for i := 0; i < services; i++ {
+		r.AppendService(fmt.Sprintf("service-%d", i), "web", false)
+	}
+
+	for i := 0; i < logins; i++ {
+		r.AppendLogin("service-0", fmt.Sprintf("login-%d", i), *element("secret"))
+	}
+
+	var stop atomic.Bool
+	var wg sync.WaitGroup
+	errs := make(chan error, 16)
+
+	for w := 0; w < 4; w++ {
+		wg.Add(1)
+
+		go func(w int) {
+			defer wg.Done()
+
+			rnd := rand.New(rand.NewSource(int64(w)))
+
+			for i := 0; i < 500; i++ {
+				login := fmt.Sprintf("login-%d", rnd.Intn(logins))
+				from := r.findLogin(login)
+				to := fmt.Sprintf("service-%d", rnd.Intn(services))
+
+				if from == "" || from == to {
+					continue
+				}
+
+				elem := element(fmt.Sprintf("secret-%d-%d", w, i))
+
+				// fails when another writer moved the login first
+				r.ApplyBatch([]domain.Operation{
+					{Op: domain.OpDeleteLogin, Service: from, Login: login},
+					{Op: domain.OpAppendLogin, Service: to, Login: login, Element: elem},
+				})
+
+				r.UpdateService(to, []string{"web", "card"}[rnd.Intn(2)], rnd.Intn(2) == 0)
+			}
+		}(w)
+	}
+
+	for reader := 0; reader < 4; reader++ {
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+
+			var last uint64
+
+			for !stop.Load() {
+				snap := r.Current()
+				if snap.Version < last {
+					errs <- fmt.Errorf("version went back from %d to %d", last, snap.Version)
+
+					return
+				}
+
+				last = snap.Version
+
+				count := 0
+				for _, service := range snap.Storage() {
+					count += len(service.Elements)
+				}
+
+				if count != logins {
+					errs <- fmt.Errorf("version %d holds %d logins", snap.Version, count)
+
+					return
+				}
+
+				_, err := json.Marshal(snap.Storage())
+				if err != nil {
+					errs <- err
+
+					return
+				}
+
+				if len(snap.GetByType("web"))+len(snap.GetByType("card")) != services {
+					errs <- fmt.Errorf("version %d indexes a wrong number of services", snap.Version)
+
+					return
+				}
+			}
+		}()
+	}
+
+	// the writers end on their own, the readers once they are done
+	done := make(chan struct{})
+
+	go func() {
+		for r.Current().Version < uint64(services+logins+100) {
+			time.Sleep(time.Millisecond)
+		}
+
+		close(done)
+	}()
+
+	<-done
+	time.Sleep(50 * time.Millisecond)
+	stop.Store(true)
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		t.Fatal(err)
+	}
+}
+
+func (r *Repository) findLogin(login string) string {
+	for name, service := range r.GetAll() {
+		if _, ok := service.Elements[login]; ok {
+			return name
+		}
+	}
+
+	return ""
+}
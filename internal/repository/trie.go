@@ -0,0 +1,284 @@
+package repository
+
+import (
+	"hash/maphash"
+	"math/bits"
+)
+
+const (
+	trieBits  = 5
+	trieWidth = 1 << trieBits
+	hashBits  = 64
+)
+
+var trieSeed = maphash.MakeSeed()
+
+// trie is a persistent hash array mapped trie. A change returns a new trie that shares everything
+// but the path to the changed key with the previous one, which stays as it was. The zero value is
+// an empty trie.
+type trie[V any] struct {
+	root *trieNode[V]
+	len  int
+}
+
+// trieNode holds up to trieWidth slots selected by trieBits of the hash at its depth, the bitmap
+// tells which slots are present. Below the last bits of the hash, keys with the same hash are kept
+// in leaves.
+type trieNode[V any] struct {
+	bitmap uint32
+	slots  []trieSlot[V]
+	leaves []trieLeaf[V]
+}
+
+// trieSlot is either a leaf or a node further down.
+type trieSlot[V any] struct {
+	leaf *trieLeaf[V]
+	node *trieNode[V]
+}
+
+type trieLeaf[V any] struct {
+	hash  uint64
+	key   string
+	value V
+}
+
+// Len returns the number of keys.
+func (t trie[V]) Len() int {
+	return t.len
+}
+
+// Get returns the value of the key.
+func (t trie[V]) Get(key string) (V, bool) {
+	return t.get(maphash.String(trieSeed, key), key)
+}
+
+// Set returns the trie with the key set to the value.
+func (t trie[V]) Set(key string, value V) trie[V] {
+	return t.set(maphash.String(trieSeed, key), key, value)
+}
+
+// Delete returns the trie without the key, the same trie when it does not hold the key.
+func (t trie[V]) Delete(key string) trie[V] {
+	return t.delete(maphash.String(trieSeed, key), key)
+}
+
+// Each calls fn for every key in no particular order.
+func (t trie[V]) Each(fn func(key string, value V)) {
+	t.root.each(fn)
+}
+
+func (t trie[V]) get(hash uint64, key string) (V, bool) {
+	n := t.root
+
+	for shift := uint(0); n != nil; shift += trieBits {
+		if shift >= hashBits {
+			for _, l := range n.leaves {
+				if l.key == key {
+					return l.value, true
+				}
+			}
+
+			break
+		}
+
+		bit, i := n.position(hash, shift)
+		if n.bitmap&bit == 0 {
+			break
+		}
+
+		s := n.slots[i]
+		if s.leaf != nil {
+			if s.leaf.key == key {
+				return s.leaf.value, true
+			}
+
+			break
+		}
+
+		n = s.node
+	}
+
+	var zero V
+
+	return zero, false
+}
+
+func (t trie[V]) set(hash uint64, key string, value V) trie[V] {
+	added := false
+	root := t.root.set(&trieLeaf[V]{hash: hash, key: key, value: value}, 0, &added)
+
+	if added {
+		return trie[V]{root: root, len: t.len + 1}
+	}
+
+	return trie[V]{root: root, len: t.len}
+}
+
+func (t trie[V]) delete(hash uint64, key string) trie[V] {
+	root, removed := t.root.delete(hash, key, 0)
+	if !removed {
+		return t
+	}
+
+	return trie[V]{root: root, len: t.len - 1}
+}
+
+func (n *trieNode[V]) position(hash uint64, shift uint) (uint32, int) {
+	bit := uint32(1) << ((hash >> shift) & (trieWidth - 1))
+
+	return bit, bits.OnesCount32(n.bitmap & (bit - 1))
+}
+
+func (n *trieNode[V]) set(l *trieLeaf[V], shift uint, added *bool) *trieNode[V] {
+	if n == nil {
+		n = new(trieNode[V])
+	}
+
+	if shift >= hashBits {
+		next := &trieNode[V]{leaves: make([]trieLeaf[V], len(n.leaves), len(n.leaves)+1)}
+		copy(next.leaves, n.leaves)
+
+		for i := range next.leaves {
+			if next.leaves[i].key == l.key {
+				next.leaves[i] = *l
+
+				return next
+			}
+		}
+
+		next.leaves = append(next.leaves, *l)
+		*added = true
+
+		return next
+	}
+
+	bit, i := n.position(l.hash, shift)
+
+	if n.bitmap&bit == 0 {
+		next := &trieNode[V]{bitmap: n.bitmap | bit, slots: make([]trieSlot[V], len(n.slots)+1)}
+		copy(next.slots, n.slots[:i])
+		next.slots[i] = trieSlot[V]{leaf: l}
+		copy(next.slots[i+1:], n.slots[i:])
+		*added = true
+
+		return next
+	}
+
+	s := n.slots[i]
+
+	switch {
+	case s.node != nil:
+		s = trieSlot[V]{node: s.node.set(l, shift+trieBits, added)}
+	case s.leaf.key == l.key:
+		s = trieSlot[V]{leaf: l}
+	default:
+		// two keys share the bits so far, they move a level down
+		var existing bool
+		child := (*trieNode[V])(nil).set(s.leaf, shift+trieBits, &existing)
+		s = trieSlot[V]{node: child.set(l, shift+trieBits, added)}
+	}
+
+	return n.withSlot(i, s)
+}
+
+func (n *trieNode[V]) withSlot(i int, s trieSlot[V]) *trieNode[V] {
+	next := &trieNode[V]{bitmap: n.bitmap, slots: make([]trieSlot[V], len(n.slots))}
+	copy(next.slots, n.slots)
+	next.slots[i] = s
+
+	return next
+}
+
+func (n *trieNode[V]) withoutSlot(bit uint32, i int) *trieNode[V] {
+	if len(n.slots) == 1 {
+		return nil
+	}
+
+	next := &trieNode[V]{bitmap: n.bitmap &^ bit, slots: make([]trieSlot[V], 0, len(n.slots)-1)}
+	next.slots = append(next.slots, n.slots[:i]...)
+	next.slots = append(next.slots, n.slots[i+1:]...)
+
+	return next
+}
+
+// delete returns the node without the key, nil when it is left empty.
+func (n *trieNode[V]) delete(hash uint64, key string, shift uint) (*trieNode[V], bool) {
+	if n == nil {
+		return nil, false
+	}
+
+	if shift >= hashBits {
+		for i, l := range n.leaves {
+			if l.key != key {
+				continue
+			}
+
+			if len(n.leaves) == 1 {
+				return nil, true
+			}
+
+			next := &trieNode[V]{leaves: make([]trieLeaf[V], 0, len(n.leaves)-1)}
+			next.leaves = append(next.leaves, n.leaves[:i]...)
+			next.leaves = append(next.leaves, n.leaves[i+1:]...)
+
+			return next, true
+		}
+
+		return n, false
+	}
+
+	bit, i := n.position(hash, shift)
+	if n.bitmap&bit == 0 {
+		return n, false
+	}
+
+	s := n.slots[i]
+
+	if s.leaf != nil {
+		if s.leaf.key != key {
+			return n, false
+		}
+
+		return n.withoutSlot(bit, i), true
+	}
+
+	child, removed := s.node.delete(hash, key, shift+trieBits)
+	if !removed {
+		return n, false
+	}
+
+	if child == nil {
+		return n.withoutSlot(bit, i), true
+	}
+
+	// a single leaf left below moves up again
+	if len(child.slots) == 1 && child.slots[0].leaf != nil {
+		return n.withSlot(i, child.slots[0]), true
+	}
+
+	if len(child.leaves) == 1 {
+		l := child.leaves[0]
+
+		return n.withSlot(i, trieSlot[V]{leaf: &l}), true
+	}
+
+	return n.withSlot(i, trieSlot[V]{node: child}), true
+}
+
+func (n *trieNode[V]) each(fn func(key string, value V)) {
+	if n == nil {
+		return
+	}
+
+	for _, l := range n.leaves {
+		fn(l.key, l.value)
+	}
+
+	for _, s := range n.slots {
+		if s.leaf != nil {
+			fn(s.leaf.key, s.leaf.value)
+		} else {
+			s.node.each(fn)
+		}
+	}
+}
@@ -0,0 +1,149 @@
+package repository
+
+import (
+	"fmt"
+	"math/rand"
+	"testing"
+)
+
+// checkTrie compares a trie with the map it should hold.
+func checkTrie(t *testing.T, tr trie[int], want map[string]int) {
+	t.Helper()
+
+	if tr.Len() != len(want) {
+		t.Fatalf("got %d keys, want %d", tr.Len(), len(want))
+	}
+
+	for key, value := range want {
+		got, ok := tr.Get(key)
+		if !ok || got != value {
+			t.Fatalf("%s: got %d, %v, want %d", key, got, ok, value)
+		}
+	}
+
+	seen := make(map[string]bool)
+
+	tr.Each(func(key string, value int) {
+		if seen[key] {
+			t.Fatalf("%s is listed twice", key)
+		}
+
+		seen[key] = true
+
+		if want[key] != value {
+			t.Fatalf("%s: got %d, want %d", key, value, want[key])
+		}
+	})
+
+	if len(seen) != len(want) {
+		t.Fatalf("listed %d keys, want %d", len(seen), len(want))
+	}
+}
+
+func TestTrie(t *testing.T) {
+	rnd := rand.New(rand.NewSource(1))
+
+	var tr trie[int]
+	model := make(map[string]int)
+
+	type version struct {
+		tr    trie[int]
+		model map[string]int
+	}
+
+	var versions []version
+
+	for i := 0; i < 5000; i++ {
+		key := fmt.Sprintf("key-%d", rnd.Intn(500))
+
+		if rnd.Intn(3) == 0 {
+			tr = tr.Delete(key)
+			delete(model, key)
+		} else {
+			tr = tr.Set(key, i)
+			model[key] = i
+		}
+
+		if i%250 == 0 {
+			copied := make(map[string]int, len(model))
+			for k, v := range model {
+				copied[k] = v
+			}
+
+			versions = append(versions, version{tr, copied})
+		}
+	}
+
+	checkTrie(t, tr, model)
+
+	// earlier versions are left as they were
+	for _, v := range versions {
+		checkTrie(t, v.tr, v.model)
+	}
+
+	_, ok := tr.Get("missing")
+	if ok {
+		t.Fatal("found a missing key")
+	}
+
+	if same := tr.Delete("missing"); same.root != tr.root {
+		t.Fatal("deleting a missing key copied the trie")
+	}
+}
+
+// Keys with the same hash, or hashes sharing their low bits, are kept apart.
+func TestTrieCollisions(t *testing.T) {
+	hashes := map[string]uint64{
+		"a": 42,
+		"b": 42,
+		"c": 42,
+		"d": 42 | 1<<63,
+		"e": 42 | 1<<40,
+		"f": 7,
+	}
+
+	var tr trie[int]
+	model := make(map[string]int)
+
+	for i, key := range []string{"a", "b", "c", "d", "e", "f"} {
+		tr = tr.set(hashes[key], key, i)
+		model[key] = i
+	}
+
+	get := func(tr trie[int], key string) (int, bool) {
+		return tr.get(hashes[key], key)
+	}
+
+	for key, value := range model {
+		got, ok := get(tr, key)
+		if !ok || got != value {
+			t.Fatalf("%s: got %d, %v", key, got, ok)
+		}
+	}
+
+	before := tr
+
+	tr = tr.set(hashes["b"], "b", 100)
+	tr = tr.delete(hashes["a"], "a")
+	tr = tr.delete(hashes["c"], "c")
+
+	if got, ok := get(tr, "b"); !ok || got != 100 || tr.Len() != 4 {
+		t.Fatalf("got %d, %v with %d keys", got, ok, tr.Len())
+	}
+
+	if _, ok := get(tr, "a"); ok {
+		t.Fatal("a deleted key is found")
+	}
+
+	if got, ok := get(before, "a"); !ok || got != 0 || before.Len() != 6 {
+		t.Fatal("an earlier version changed")
+	}
+
+	for _, key := range []string{"b", "d", "e", "f"} {
+		tr = tr.delete(hashes[key], key)
+	}
+
+	if tr.Len() != 0 || tr.root != nil {
+		t.Fatalf("got %d keys left", tr.Len())
+	}
+}
@@ -0,0 +1,60 @@
+//go:build linux
+
+package secmem
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"sync"
+
+	"golang.org/x/sys/unix"
+)
+
+var (
+	pageSize = os.Getpagesize()
+	warnOnce sync.Once
+)
+
+// mapChunk maps memory outside of the Go heap, so the garbage collector never copies it, and locks
+// it. When the RLIMIT_MEMLOCK is too low the memory is used unlocked.
+func mapChunk(size int) []byte {
+	chunk, err := unix.Mmap(-1, 0, size, unix.PROT_READ|unix.PROT_WRITE, unix.MAP_PRIVATE|unix.MAP_ANONYMOUS)
+	if err != nil {
+		warn(err)
+
+		return make([]byte, size)
+	}
+
+	err = unix.Mlock(chunk)
+	if err != nil {
+		warn(err)
+	}
+
+	// the core dump filter is only a second line, dumps are disabled at startup as well
+	unix.Madvise(chunk, unix.MADV_DONTDUMP)
+
+	return chunk
+}
+
+func warn(err error) {
+	warnOnce.Do(func() {
+		log.Printf("failed to lock memory for secrets, they may be swapped to disk: %s", err.Error())
+	})
+}
+
+// DisableCoreDumps makes sure that a crash does not write the decrypted vault to disk and that
+// other processes of the same user cannot attach to this one and read its memory.
+func DisableCoreDumps() error {
+	err := unix.Setrlimit(unix.RLIMIT_CORE, &unix.Rlimit{})
+	if err != nil {
+		return fmt.Errorf("failed to disable core dumps: %s", err.Error())
+	}
+
+	err = unix.Prctl(unix.PR_SET_DUMPABLE, 0, 0, 0, 0)
+	if err != nil {
+		return fmt.Errorf("failed to disable core dumps: %s", err.Error())
+	}
+
+	return nil
+}
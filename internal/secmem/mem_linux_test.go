@@ -0,0 +1,111 @@
+//go:build linux
+
+package secmem
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// mappingOf returns the fields of /proc/self/smaps for the mapping that holds b.
+func mappingOf(t *testing.T, b []byte) map[string]string {
+	t.Helper()
+
+	f, err := os.Open("/proc/self/smaps")
+	if err != nil {
+		t.Skipf("smaps is not available: %s", err)
+	}
+	defer f.Close()
+
+	addr := uintptr(unsafe.Pointer(&b[0]))
+
+	var fields map[string]string
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := scanner.Text()
+
+		// a mapping starts with its address range, its fields follow as "Key: value"
+		key, value, isField := strings.Cut(line, ":")
+		if isField && !strings.Contains(key, " ") {
+			if fields != nil {
+				fields[key] = strings.TrimSpace(value)
+			}
+
+			continue
+		}
+
+		if fields != nil {
+			return fields
+		}
+
+		var start, end uintptr
+		_, err := fmt.Sscanf(line, "%x-%x", &start, &end)
+		if err == nil && start <= addr && addr < end {
+			fields = make(map[string]string)
+		}
+	}
+
+	if fields == nil {
+		t.Fatal("no mapping holds the buffer")
+	}
+
+	return fields
+}
+
+func TestChunksAreLockedAndLeftOutOfDumps(t *testing.T) {
+	var a arena
+
+	b, _ := a.alloc(32)
+	flags := strings.Fields(mappingOf(t, b)["VmFlags"])
+
+	has := func(flag string) bool {
+		for _, f := range flags {
+			if f == flag {
+				return true
+			}
+		}
+
+		return false
+	}
+
+	if !has("dd") {
+		t.Fatalf("the chunk is in core dumps, flags %v", flags)
+	}
+
+	var limit unix.Rlimit
+
+	err := unix.Getrlimit(unix.RLIMIT_MEMLOCK, &limit)
+	if err != nil || limit.Cur < chunkSize {
+		t.Skip("RLIMIT_MEMLOCK is too low to lock a chunk")
+	}
+
+	if !has("lo") {
+		t.Fatalf("the chunk is not locked, flags %v", flags)
+	}
+}
+
+func TestDisableCoreDumps(t *testing.T) {
+	err := DisableCoreDumps()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var limit unix.Rlimit
+
+	err = unix.Getrlimit(unix.RLIMIT_CORE, &limit)
+	if err != nil || limit.Cur != 0 {
+		t.Fatalf("core dump limit is %d, %v", limit.Cur, err)
+	}
+
+	dumpable, err := unix.PrctlRetInt(unix.PR_GET_DUMPABLE, 0, 0, 0, 0)
+	if err != nil || dumpable != 0 {
+		t.Fatalf("the process is dumpable: %d, %v", dumpable, err)
+	}
+}
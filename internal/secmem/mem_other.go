@@ -0,0 +1,16 @@
+//go:build !linux
+
+package secmem
+
+import "os"
+
+var pageSize = os.Getpagesize()
+
+// memory locking is not implemented here, secrets are still kept in one place to be wiped
+func mapChunk(size int) []byte {
+	return make([]byte, size)
+}
+
+func DisableCoreDumps() error {
+	return nil
+}
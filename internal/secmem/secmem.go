@@ -0,0 +1,172 @@
+// Package secmem keeps secrets in memory that is locked against swapping, left out of core dumps
+// and wiped when the vault is locked.
+package secmem
+
+import (
+	"runtime"
+	"sync"
+)
+
+const (
+	chunkSize = 64 << 10
+	// blocks are handed out in multiples of blockSize, so a freed block fits later secrets of about
+	// the same length
+	blockSize = 16
+)
+
+// arena hands out blocks from a few large mappings, locked memory is limited and expensive to map
+// per secret. Freed blocks are zeroed and kept by size for reuse, Wipe zeroes all of them at once
+// and starts a new generation: blocks of an earlier one are not taken back.
+type arena struct {
+	mutex  sync.Mutex
+	chunks [][]byte
+	index  int
+	offset int
+	free   map[int][][]byte
+	gen    uint64
+}
+
+var std arena
+
+// Buffer is a secret in locked memory that goes back to the arena once the Buffer is unreachable.
+// Whoever uses its bytes has to keep the Buffer itself alive meanwhile.
+type Buffer struct {
+	b   []byte
+	gen uint64
+}
+
+// NewBuffer returns a zeroed buffer of n bytes, nil for none.
+func NewBuffer(n int) *Buffer {
+	if n == 0 {
+		return nil
+	}
+
+	b, gen := std.alloc(n)
+	buf := &Buffer{b: b, gen: gen}
+
+	runtime.SetFinalizer(buf, func(buf *Buffer) {
+		std.release(buf.b, buf.gen)
+	})
+
+	return buf
+}
+
+// CopyBuffer returns a copy of b in a Buffer.
+func CopyBuffer(b []byte) *Buffer {
+	buf := NewBuffer(len(b))
+	copy(buf.Bytes(), b)
+
+	return buf
+}
+
+// Bytes returns the buffer itself, not a copy. It is valid until the next Wipe.
+func (buf *Buffer) Bytes() []byte {
+	if buf == nil {
+		return nil
+	}
+
+	return buf.b
+}
+
+// Alloc returns a zeroed buffer of n bytes in locked memory. It stays valid until the next Wipe.
+func Alloc(n int) []byte {
+	if n == 0 {
+		return nil
+	}
+
+	b, _ := std.alloc(n)
+
+	return b
+}
+
+// Copy returns a copy of b in locked memory.
+func Copy(b []byte) []byte {
+	buf := Alloc(len(b))
+	copy(buf, b)
+
+	return buf
+}
+
+// Wipe zeroes every buffer handed out so far and reuses their memory for later ones. Nothing that
+// still refers to such a buffer may be used afterwards.
+func Wipe() {
+	std.wipe()
+}
+
+// Zero overwrites b, for plaintext that had to pass through ordinary memory.
+func Zero(b []byte) {
+	clear(b)
+}
+
+// alloc returns n bytes of a block, its capacity is the whole block.
+func (a *arena) alloc(n int) ([]byte, uint64) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	size := (n + blockSize - 1) / blockSize * blockSize
+
+	if blocks := a.free[size]; len(blocks) > 0 {
+		block := blocks[len(blocks)-1]
+		a.free[size] = blocks[:len(blocks)-1]
+
+		return block[:n], a.gen
+	}
+
+	for a.index < len(a.chunks) {
+		chunk := a.chunks[a.index]
+		if len(chunk)-a.offset >= size {
+			block := chunk[a.offset : a.offset+size : a.offset+size]
+			a.offset += size
+
+			return block[:n], a.gen
+		}
+
+		a.index++
+		a.offset = 0
+	}
+
+	mapped := chunkSize
+	if size > mapped {
+		// round up to whole pages
+		mapped = (size + pageSize - 1) / pageSize * pageSize
+	}
+
+	a.chunks = append(a.chunks, mapChunk(mapped))
+	a.index = len(a.chunks) - 1
+	a.offset = size
+
+	return a.chunks[a.index][:n:size], a.gen
+}
+
+// release zeroes a block and keeps it for reuse, unless it was wiped since it was handed out.
+func (a *arena) release(b []byte, gen uint64) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	if gen != a.gen {
+		return
+	}
+
+	block := b[:cap(b)]
+	clear(block)
+
+	if a.free == nil {
+		a.free = make(map[int][][]byte)
+	}
+
+	a.free[len(block)] = append(a.free[len(block)], block)
+}
+
+func (a *arena) wipe() {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	for _, chunk := range a.chunks {
+		clear(chunk)
+	}
+
+	a.index = 0
+	a.offset = 0
+	a.free = nil
+	a.gen++
+}
@@ -0,0 +1,111 @@
+package secmem
+
+import (
+	"bytes"
+	"runtime"
+	"testing"
+	"time"
+)
+
+func TestArenaReusesReleasedBlocks(t *testing.T) {
+	var a arena
+
+	b, gen := a.alloc(20)
+	if len(b) != 20 || cap(b) != 32 {
+		t.Fatalf("got %d bytes in a block of %d", len(b), cap(b))
+	}
+
+	copy(b, "correct horse battery")
+	a.release(b, gen)
+
+	if !bytes.Equal(b[:cap(b)], make([]byte, cap(b))) {
+		t.Fatal("a released block is not zeroed")
+	}
+
+	// a secret of about the same length takes the block again
+	reused, _ := a.alloc(30)
+	if &reused[0] != &b[0] {
+		t.Fatal("the released block is not reused")
+	}
+
+	other, _ := a.alloc(30)
+	if &other[0] == &b[0] {
+		t.Fatal("the block is handed out twice")
+	}
+}
+
+func TestArenaWipe(t *testing.T) {
+	var a arena
+
+	b, gen := a.alloc(16)
+	copy(b, "secret")
+
+	a.wipe()
+
+	if !bytes.Equal(b, make([]byte, len(b))) {
+		t.Fatal("wipe left the secret")
+	}
+
+	// the block belongs to the new generation now, releasing the old buffer must not free it
+	c, _ := a.alloc(16)
+	a.release(b, gen)
+
+	d, _ := a.alloc(16)
+	if &c[0] != &b[0] || &d[0] == &c[0] {
+		t.Fatal("a block released after the wipe was handed out again")
+	}
+}
+
+func TestArenaLargeAllocations(t *testing.T) {
+	var a arena
+
+	large, gen := a.alloc(chunkSize + 1)
+
+	if len(large) != chunkSize+1 || cap(large)%blockSize != 0 {
+		t.Fatalf("got %d bytes in a block of %d", len(large), cap(large))
+	}
+
+	a.release(large, gen)
+
+	again, _ := a.alloc(chunkSize + 1)
+	if &again[0] != &large[0] {
+		t.Fatal("the large block is not reused")
+	}
+}
+
+// An unreachable Buffer goes back to the arena and is zeroed.
+func TestBufferIsReleased(t *testing.T) {
+	Wipe()
+
+	buf := CopyBuffer([]byte("correct horse battery staple"))
+	b := buf.Bytes()
+	buf = nil
+
+	deadline := time.Now().Add(5 * time.Second)
+
+	for time.Now().Before(deadline) {
+		runtime.GC()
+
+		std.mutex.Lock()
+		released := len(std.free[cap(b)]) > 0
+		std.mutex.Unlock()
+
+		if released {
+			if !bytes.Equal(b[:cap(b)], make([]byte, cap(b))) {
+				t.Fatal("a released buffer is not zeroed")
+			}
+
+			return
+		}
+
+		time.Sleep(time.Millisecond)
+	}
+
+	t.Fatal("an unreachable buffer was not released")
+}
+
+func TestBufferEmpty(t *testing.T) {
+	if buf := NewBuffer(0); buf != nil || buf.Bytes() != nil {
+		t.Fatal("got a buffer for nothing")
+	}
+}
@@ -0,0 +1,88 @@
+package service
+
+import (
+	"errors"
+	"fmt"
+
+	"manager/internal/domain"
+	"manager/internal/secmem"
+)
+
+var errBackupUnsupported = errors.New("backups are not supported by the storage backend")
+
+// backuper is implemented by backends whose storage is a single file. Snapshot returns that file
+// while the storage is open, Restore replaces it while the storage is closed.
+type backuper interface {
+	Snapshot() ([]byte, error)
+	Restore(data []byte) error
+}
+
+// Generation changes whenever the storage does.
+func (s *Service) Generation() uint64 {
+	return s.generation.Load()
+}
+
+func (s *Service) Snapshot() ([]byte, error) {
+	release, err := s.unsealed()
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	b, ok := s.repo.(backuper)
+	if !ok {
+		return nil, errBackupUnsupported
+	}
+
+	// the storage stays sealed behind the decoy, which is backed up through DecoyVault
+	if s.duress {
+		return nil, domain.ErrSealed
+	}
+
+	return b.Snapshot()
+}
+
+// Restore replaces the storage with a snapshot and locks it, it has to be unlocked again.
+func (s *Service) Restore(data []byte) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.duress {
+		return domain.ErrSealed
+	}
+
+	return s.restore(data)
+}
+
+// restore replaces the open vault, the storage or the decoy, with a snapshot and locks it.
+func (s *Service) restore(data []byte) error {
+	if s.sealed {
+		return domain.ErrSealed
+	}
+
+	vault := s.repo
+
+	b, ok := vault.(backuper)
+	if !ok {
+		return errBackupUnsupported
+	}
+
+	s.commitHistory()
+
+	err := vault.Close()
+	if err != nil {
+		return fmt.Errorf("failed to lock storage: %s", err.Error())
+	}
+
+	s.sealed = true
+	s.leaveDecoy()
+	s.generation.Add(1)
+	secmem.Wipe()
+
+	err = b.Restore(data)
+	if err != nil {
+		return fmt.Errorf("failed to restore storage: %s", err.Error())
+	}
+
+	return vault.Check()
+}
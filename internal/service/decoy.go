@@ -0,0 +1,152 @@
+package service
+
+import (
+	"errors"
+	"sync"
+
+	"manager/internal/domain"
+)
+
+var errProbeUnsupported = errors.New("the storage backend cannot check a password without opening the vault")
+
+// prober checks a password against a vault without writing to it.
+type prober interface {
+	Probe(password []byte) error
+}
+
+// EnableDecoy opens decoy instead of the storage for the duress password, which is the password of
+// the decoy. alert runs in the background whenever that happens. While the decoy is open, the
+// history and the backups of the storage are out of reach, the decoy has its own of both so that
+// nothing behaves differently from an unlocked storage.
+func (s *Service) EnableDecoy(decoy repository, alert func()) {
+	s.decoy = decoy
+	s.real = s.repo
+	s.alert = alert
+}
+
+// EnableDecoyHistory commits the changes to the decoy to a recorder of its own, it is called along
+// with EnableHistory.
+func (s *Service) EnableDecoyHistory(r recorder) error {
+	_, ok := s.decoy.(historian)
+	if !ok {
+		return errHistoryUnsupported
+	}
+
+	s.decoyHistory = r
+	if s.historyMutex == nil {
+		s.historyMutex = new(sync.Mutex)
+	}
+
+	return nil
+}
+
+// Duress tells whether the decoy is open. It is for choosing where the decoy is backed up and must
+// never reach a response.
+func (s *Service) Duress() bool {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	return s.duress
+}
+
+// DecoyVault is the decoy as a vault to back up, it has a snapshot only while the decoy is open.
+type DecoyVault struct {
+	s *Service
+}
+
+func (s *Service) DecoyVault() DecoyVault {
+	return DecoyVault{s: s}
+}
+
+func (v DecoyVault) Generation() uint64 {
+	return v.s.Generation()
+}
+
+func (v DecoyVault) Snapshot() ([]byte, error) {
+	release, err := v.s.unsealed()
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	if !v.s.duress {
+		return nil, domain.ErrSealed
+	}
+
+	b, ok := v.s.repo.(backuper)
+	if !ok {
+		return nil, errBackupUnsupported
+	}
+
+	return b.Snapshot()
+}
+
+// Restore replaces the decoy with a snapshot and locks it, like Restore does with the storage.
+func (v DecoyVault) Restore(data []byte) error {
+	v.s.mutex.Lock()
+	defer v.s.mutex.Unlock()
+
+	if !v.s.duress {
+		return domain.ErrSealed
+	}
+
+	return v.s.restore(data)
+}
+
+// open unlocks the storage, or the decoy for the duress password. The password is checked against
+// both without writing to either, and only the vault it is the password of is opened, so the time
+// to unlock does not tell which one it was and a vault is never touched for the password of the
+// other.
+func (s *Service) open(password []byte) error {
+	if s.decoy == nil {
+		return s.repo.Open(password)
+	}
+
+	real, ok := s.real.(prober)
+	if !ok {
+		return errProbeUnsupported
+	}
+
+	decoy, ok := s.decoy.(prober)
+	if !ok {
+		return errProbeUnsupported
+	}
+
+	realErr := real.Probe(password)
+	decoyErr := decoy.Probe(password)
+
+	if !errors.Is(realErr, domain.ErrWrongPassword) {
+		return s.real.Open(password)
+	}
+
+	// a decoy that cannot be checked is not opened either, the password is wrong as far as it shows
+	if decoyErr != nil {
+		return domain.ErrWrongPassword
+	}
+
+	err := s.decoy.Open(password)
+	if err != nil {
+		return err
+	}
+
+	s.repo = s.decoy
+	s.realHistory = s.history
+	s.history = s.decoyHistory
+	s.duress = true
+
+	go s.alert()
+
+	return nil
+}
+
+// leaveDecoy points the service back at the storage once the decoy is closed.
+func (s *Service) leaveDecoy() {
+	if !s.duress {
+		return
+	}
+
+	s.repo = s.real
+	s.history = s.realHistory
+	s.realHistory = nil
+	s.duress = false
+}
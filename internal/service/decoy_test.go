@@ -0,0 +1,262 @@
+package service
+
+import (
+	"errors"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"manager/internal/backend/jsonfile"
+	"manager/internal/domain"
+	"manager/internal/history"
+	repo "manager/internal/repository"
+)
+
+// newDecoyFiles creates a storage for "secret" and a decoy for "duress".
+func newDecoyFiles(t *testing.T) (string, string) {
+	t.Helper()
+
+	dir := t.TempDir()
+	storageFile := filepath.Join(dir, "storage.txt")
+	decoyFile := filepath.Join(dir, "decoy.txt")
+
+	for filename, password := range map[string]string{storageFile: "secret", decoyFile: "duress"} {
+		r := jsonfile.New(repo.New(), filename, 1<<20, true, testKDF)
+		r.Create()
+
+		s := New(r, testRecordTypes)
+
+		err := s.Unlock(password)
+		if err == nil {
+			err = s.Lock()
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	return storageFile, decoyFile
+}
+
+// newDecoyService sets up a storage for "secret" and a decoy for "duress", each with its history.
+// The returned channel receives the alerts.
+func newDecoyService(t *testing.T) (*Service, *history.Repo, *history.Repo, chan struct{}) {
+	t.Helper()
+
+	_, err := exec.LookPath("git")
+	if err != nil {
+		t.Skip("git is not installed")
+	}
+
+	storageFile, decoyFile := newDecoyFiles(t)
+
+	alerts := make(chan struct{}, 1)
+
+	s := New(jsonfile.New(repo.New(), storageFile, 1<<20, true, testKDF), testRecordTypes)
+	s.EnableDecoy(jsonfile.New(repo.New(), decoyFile, 1<<20, true, testKDF), func() {
+		alerts <- struct{}{}
+	})
+
+	storageHistory := history.New(storageFile)
+	decoyHistory := history.New(decoyFile)
+
+	for _, h := range []*history.Repo{storageHistory, decoyHistory} {
+		err := h.Init()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	err = s.EnableHistory(storageHistory)
+	if err == nil {
+		err = s.EnableDecoyHistory(decoyHistory)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() {
+		s.Lock()
+	})
+
+	startPersister(t, s, time.Millisecond, time.Second, 0)
+
+	return s, storageHistory, decoyHistory, alerts
+}
+
+func TestDuressHistory(t *testing.T) {
+	s, storageHistory, decoyHistory, alerts := newDecoyService(t)
+
+	err := s.Unlock("duress")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	<-alerts
+
+	if !s.Duress() {
+		t.Fatal("the decoy is not open")
+	}
+
+	err = s.AppendService("alice", "mail", "web", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	syncService(t, s)
+
+	versions, err := s.History("mail")
+	if err != nil || len(versions) != 1 {
+		t.Fatalf("History: got %v, %v", versions, err)
+	}
+
+	if len(logOf(t, decoyHistory, "mail")) != 1 || len(logOf(t, storageHistory, "mail")) != 0 {
+		t.Fatal("the change is not only in the history of the decoy")
+	}
+
+	err = s.RestoreVersion("alice", "mail", versions[0].Commit)
+	if err != nil {
+		t.Fatalf("RestoreVersion: %s", err)
+	}
+
+	err = s.Lock()
+	if err == nil {
+		err = s.Unlock("secret")
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if s.Duress() {
+		t.Fatal("the decoy is open for the master password")
+	}
+
+	storage, _, err := s.GetAll()
+	if err != nil || len(storage) != 0 {
+		t.Fatalf("the storage holds %v, %v", storage, err)
+	}
+
+	versions, err = s.History("mail")
+	if err != nil || len(versions) != 0 {
+		t.Fatalf("History of the storage: got %v, %v", versions, err)
+	}
+}
+
+// The master password is not tried on the decoy, which would be quarantined if it were.
+func TestUnlockLeavesDecoyAlone(t *testing.T) {
+	storageFile, decoyFile := newDecoyFiles(t)
+
+	err := os.WriteFile(decoyFile, []byte("MGRV garbage"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := New(jsonfile.New(repo.New(), storageFile, 1<<20, true, testKDF), testRecordTypes)
+	s.EnableDecoy(jsonfile.New(repo.New(), decoyFile, 1<<20, true, testKDF), func() {
+		t.Error("alert for the master password")
+	})
+
+	err = s.Unlock("secret")
+	if err == nil {
+		err = s.Lock()
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := os.ReadFile(decoyFile)
+	if err != nil || string(data) != "MGRV garbage" {
+		t.Fatalf("the decoy was changed: %q, %v", data, err)
+	}
+
+	quarantined, err := filepath.Glob(decoyFile + ".corrupt-*")
+	if err != nil || len(quarantined) != 0 {
+		t.Fatalf("the decoy was quarantined: %v, %v", quarantined, err)
+	}
+
+	err = s.Unlock("guess")
+	if !errors.Is(err, domain.ErrWrongPassword) {
+		t.Fatalf("got %v, want ErrWrongPassword", err)
+	}
+}
+
+func TestDuressBackups(t *testing.T) {
+	s, _, _, alerts := newDecoyService(t)
+	decoy := s.DecoyVault()
+
+	err := s.Unlock("duress")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	<-alerts
+
+	err = s.AppendService("alice", "mail", "web", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	syncService(t, s)
+
+	snapshot, err := decoy.Snapshot()
+	if err != nil {
+		t.Fatalf("Snapshot of the decoy: %s", err)
+	}
+
+	// the storage is out of reach, as when it is sealed
+	_, err = s.Snapshot()
+	if !errors.Is(err, domain.ErrSealed) {
+		t.Fatalf("Snapshot of the storage: got %v", err)
+	}
+
+	err = s.Restore(snapshot)
+	if !errors.Is(err, domain.ErrSealed) {
+		t.Fatalf("Restore of the storage: got %v", err)
+	}
+
+	err = s.DeleteService("alice", "mail")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = decoy.Restore(snapshot)
+	if err != nil {
+		t.Fatalf("Restore of the decoy: %s", err)
+	}
+
+	if !s.Sealed() || s.Duress() {
+		t.Fatal("the decoy is still open after the restore")
+	}
+
+	err = s.Unlock("duress")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	<-alerts
+
+	storage, _, err := s.GetAll()
+	if err != nil || len(storage) != 1 {
+		t.Fatalf("the restored decoy holds %v, %v", storage, err)
+	}
+
+	err = s.Lock()
+	if err == nil {
+		err = s.Unlock("secret")
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = decoy.Snapshot()
+	if !errors.Is(err, domain.ErrSealed) {
+		t.Fatalf("Snapshot of the decoy while the storage is open: got %v", err)
+	}
+
+	_, err = s.Snapshot()
+	if err != nil {
+		t.Fatalf("Snapshot of the storage: %s", err)
+	}
+}
@@ -0,0 +1,73 @@
+package service
+
+import (
+	"log"
+	"time"
+
+	"manager/internal/domain"
+)
+
+func (s *Service) Health() domain.Health {
+	s.healthMutex.Lock()
+	h := domain.Health{
+		Degraded: s.degraded,
+		Failures: s.failures,
+	}
+
+	if s.lastError != nil {
+		h.LastError = s.lastError.Error()
+		lastFailure := s.lastFailure
+		h.LastFailure = &lastFailure
+	}
+	s.healthMutex.Unlock()
+
+	s.mutex.RLock()
+	h.Sealed = s.sealed
+	h.ReadOnly = !s.sealed && s.repo.ReadOnly()
+	s.mutex.RUnlock()
+
+	return h
+}
+
+// Failing reports whether the last flush failed, changes made now may not reach the disk.
+func (s *Service) Failing() bool {
+	s.healthMutex.Lock()
+	defer s.healthMutex.Unlock()
+
+	return s.failures > 0
+}
+
+func (s *Service) isDegraded() bool {
+	s.healthMutex.Lock()
+	defer s.healthMutex.Unlock()
+
+	return s.degraded
+}
+
+// flushed counts failed flushes in a row and switches to the degraded mode after degradeAfter of
+// them, zero never does. A successful flush ends the degraded mode.
+func (s *Service) flushed(err error, degradeAfter int) {
+	s.healthMutex.Lock()
+	defer s.healthMutex.Unlock()
+
+	if err == nil {
+		if s.degraded {
+			log.Print("storage is written again, accepting changes")
+		}
+
+		s.failures = 0
+		s.lastError = nil
+		s.degraded = false
+
+		return
+	}
+
+	s.failures++
+	s.lastError = err
+	s.lastFailure = time.Now().UTC()
+
+	if !s.degraded && degradeAfter > 0 && s.failures >= degradeAfter {
+		s.degraded = true
+		log.Printf("%d flushes failed in a row, rejecting changes until the storage can be written again: %s", s.failures, err.Error())
+	}
+}
@@ -0,0 +1,263 @@
+package service
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"sync"
+
+	"manager/internal/domain"
+	"manager/internal/history"
+	repo "manager/internal/repository"
+)
+
+var (
+	errHistoryDisabled    = errors.New("history is not enabled")
+	errHistoryUnsupported = errors.New("history is not supported by the storage backend")
+)
+
+// recorder keeps the versions of the storage.
+type recorder interface {
+	Commit(change history.Change, snapshot []byte) error
+	Log(service string) ([]history.Version, error)
+	Show(commit string) ([]byte, error)
+}
+
+// historian is implemented by backends that can keep a history. A version is taken without copying
+// the storage and written out later with the key that is open then, Decode reads it back.
+type historian interface {
+	Current() *repo.Snapshot
+	SnapshotOf(snap *repo.Snapshot) ([]byte, error)
+	Decode(data []byte) (domain.Storage, error)
+	ApplyBatch(ops []domain.Operation) (bool, error)
+}
+
+// pendingRecord is a change waiting to be committed with the version of the storage it made.
+type pendingRecord struct {
+	change   history.Change
+	snapshot *repo.Snapshot
+}
+
+// EnableHistory commits every change to the recorder. The backend has to provide versions of the
+// storage and read them back.
+func (s *Service) EnableHistory(r recorder) error {
+	_, ok := s.repo.(historian)
+	if !ok {
+		return errHistoryUnsupported
+	}
+
+	s.history = r
+	s.historyMutex = new(sync.Mutex)
+
+	return nil
+}
+
+// History returns the versions of a service, the newest first.
+func (s *Service) History(serviceName string) ([]history.Version, error) {
+	release, err := s.unsealed()
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	if s.history == nil {
+		return nil, errHistoryDisabled
+	}
+
+	validServiceName, err := validationServiceName(serviceName)
+	if err != nil {
+		return nil, fmt.Errorf("validation name error: %s", err.Error())
+	}
+
+	return s.history.Log(validServiceName)
+}
+
+// RestoreVersion sets a service back to how it was in a commit, a service that did not exist then
+// is deleted. The restore is a change of its own and is committed as well.
+func (s *Service) RestoreVersion(actor, serviceName, commit string) error {
+	release, err := s.writable()
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	if s.history == nil {
+		return errHistoryDisabled
+	}
+
+	validServiceName, err := validationServiceName(serviceName)
+	if err != nil {
+		return fmt.Errorf("validation name error: %s", err.Error())
+	}
+
+	s.historyMutex.Lock()
+	defer s.historyMutex.Unlock()
+
+	data, err := s.history.Show(commit)
+	if err != nil {
+		return err
+	}
+
+	storage, err := s.repo.(historian).Decode(data)
+	if err != nil {
+		return fmt.Errorf("failed to read version: %s", err.Error())
+	}
+
+	current, err := s.repo.GetAll()
+	if err != nil {
+		return err
+	}
+
+	old, existed := storage[validServiceName]
+	_, exists := current[validServiceName]
+
+	if !existed && !exists {
+		return fmt.Errorf("element not found")
+	}
+
+	var ops []domain.Operation
+
+	if exists {
+		ops = append(ops, domain.Operation{Op: domain.OpDeleteService, Service: validServiceName})
+	}
+
+	if existed {
+		ops = append(ops, domain.Operation{
+			Op:       domain.OpAppendService,
+			Service:  validServiceName,
+			Type:     old.Type,
+			Favorite: old.Favorite,
+		})
+
+		logins := make([]string, 0, len(old.Elements))
+		for login := range old.Elements {
+			logins = append(logins, login)
+		}
+
+		sort.Strings(logins)
+
+		for _, login := range logins {
+			elem := old.Elements[login]
+
+			ops = append(ops, domain.Operation{
+				Op:      domain.OpAppendLogin,
+				Service: validServiceName,
+				Login:   login,
+				Element: &elem,
+			})
+		}
+	}
+
+	// readers never see the service deleted but not restored yet
+	ok, err := s.repo.(historian).ApplyBatch(ops)
+	if err != nil {
+		log.Printf("failed to apply operation: %s", err.Error())
+
+		return err
+	}
+
+	if !ok {
+		return fmt.Errorf("failed to restore version %s of %s", commit, validServiceName)
+	}
+
+	s.queueRecord(history.Change{
+		Op:      "restore-service",
+		Service: validServiceName,
+		Actor:   actor,
+		From:    commit,
+	})
+	s.markDirty()
+
+	return nil
+}
+
+// queueRecord takes the version of the storage a change made, it is committed by the persister.
+// historyMutex has to be held since the change, so the version holds nothing made after it.
+func (s *Service) queueRecord(change history.Change) {
+	s.records = append(s.records, pendingRecord{change: change, snapshot: s.repo.(historian).Current()})
+}
+
+// record commits the current state of the storage together with the changes queued before. It is
+// used with the service locked exclusively.
+func (s *Service) record(change history.Change) {
+	s.historyMutex.Lock()
+	s.queueRecord(change)
+	s.historyMutex.Unlock()
+
+	s.commitHistory()
+}
+
+// commitHistory commits the queued changes in order. The changes are made already, so a failure
+// is only logged. It runs in the persister, or with the service locked exclusively, and always
+// before the storage is closed, as the versions share the memory of the open storage.
+func (s *Service) commitHistory() {
+	if s.history == nil {
+		return
+	}
+
+	s.historyMutex.Lock()
+	records := s.records
+	s.records = nil
+	s.historyMutex.Unlock()
+
+	for _, rec := range records {
+		data, err := s.repo.(historian).SnapshotOf(rec.snapshot)
+		if err == nil {
+			err = s.history.Commit(rec.change, data)
+		}
+
+		if err != nil {
+			log.Printf("failed to record %s in history: %s", rec.change.Op, err.Error())
+		}
+	}
+}
+
+// recordExternal commits the storage when it differs from the last commit, after something else
+// than the service changed it, like a sync tool or a restored backup.
+func (s *Service) recordExternal(op string) {
+	if s.history == nil {
+		return
+	}
+
+	s.commitHistory()
+
+	storage, err := s.repo.GetAll()
+	if err != nil {
+		return
+	}
+
+	data, err := s.history.Show("HEAD")
+
+	switch {
+	case errors.Is(err, history.ErrEmpty):
+	case err != nil:
+		log.Printf("failed to read history: %s", err.Error())
+
+		return
+	default:
+		// a version written with another key cannot be compared and is committed again
+		committed, err := s.repo.(historian).Decode(data)
+		if err == nil && sameStorage(committed, storage) {
+			return
+		}
+	}
+
+	s.record(history.Change{Op: op, Actor: "manager"})
+}
+
+// sameStorage compares storages, no logins equals empty logins.
+func sameStorage(a, b domain.Storage) bool {
+	if len(a) != len(b) {
+		return false
+	}
+
+	for name, x := range a {
+		y, ok := b[name]
+		if !ok || !x.Equal(y) {
+			return false
+		}
+	}
+
+	return true
+}
@@ -0,0 +1,261 @@
+package service
+
+import (
+	"errors"
+	"os/exec"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"manager/internal/backend/jsonfile"
+	"manager/internal/domain"
+	"manager/internal/history"
+	repo "manager/internal/repository"
+)
+
+// newHistoryService unlocks a service over an encrypted storage file with the history enabled.
+func newHistoryService(t *testing.T) (*Service, *history.Repo) {
+	t.Helper()
+
+	_, err := exec.LookPath("git")
+	if err != nil {
+		t.Skip("git is not installed")
+	}
+
+	filename := filepath.Join(t.TempDir(), "storage.txt")
+
+	h := history.New(filename)
+
+	err = h.Init()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := jsonfile.New(repo.New(), filename, 1<<20, true, testKDF)
+	r.Create()
+
+	s := New(r, testRecordTypes)
+
+	err = s.EnableHistory(h)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = s.Unlock("secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() {
+		s.Lock()
+	})
+
+	return s, h
+}
+
+func logOf(t *testing.T, h *history.Repo, service string) []history.Version {
+	t.Helper()
+
+	versions, err := h.Log(service)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return versions
+}
+
+func syncService(t *testing.T, s *Service) {
+	t.Helper()
+
+	err := s.Sync()
+	if err != nil {
+		t.Fatalf("Sync: %s", err)
+	}
+}
+
+func element(password string) domain.Element {
+	return domain.Element{Password: domain.NewSecret([]byte(password))}
+}
+
+func TestHistoryIsCommittedByPersister(t *testing.T) {
+	s, h := newHistoryService(t)
+
+	err := s.AppendService("alice", "mail", "web", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the request only queues the change
+	if versions := logOf(t, h, "mail"); len(versions) != 0 {
+		t.Fatalf("committed before the persister ran: %+v", versions)
+	}
+
+	startPersister(t, s, time.Millisecond, time.Second, 0)
+	syncService(t, s)
+
+	versions := logOf(t, h, "mail")
+	if len(versions) != 1 || versions[0].Op != domain.OpAppendService || versions[0].Actor != "alice" {
+		t.Fatalf("got %+v", versions)
+	}
+}
+
+func TestLockCommitsQueuedChanges(t *testing.T) {
+	s, h := newHistoryService(t)
+
+	err := s.AppendService("alice", "mail", "web", false)
+	if err == nil {
+		err = s.AppendLogin("alice", "mail", "bob", element("one"))
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = s.Lock()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	versions := logOf(t, h, "mail")
+	if len(versions) != 2 || versions[0].Op != domain.OpAppendLogin || versions[1].Op != domain.OpAppendService {
+		t.Fatalf("got %+v", versions)
+	}
+
+	err = s.Unlock("secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// each version holds the storage as the change left it
+	data, err := h.Show(versions[1].Commit)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	storage, err := s.repo.(historian).Decode(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, ok := storage["mail"]; !ok || len(storage["mail"].Elements) != 0 {
+		t.Fatalf("the first version holds %+v", storage)
+	}
+}
+
+func TestRestoreVersion(t *testing.T) {
+	s, h := newHistoryService(t)
+	startPersister(t, s, time.Millisecond, time.Second, 0)
+
+	err := s.AppendService("alice", "mail", "web", false)
+	if err == nil {
+		err = s.AppendLogin("alice", "mail", "bob", element("one"))
+	}
+	if err == nil {
+		err = s.UpdateLogin("alice", "mail", "bob", element("two"))
+	}
+	if err == nil {
+		err = s.AppendService("alice", "bank", "card", false)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	syncService(t, s)
+
+	versions := logOf(t, h, "mail")
+	if len(versions) != 3 {
+		t.Fatalf("got %+v", versions)
+	}
+
+	err = s.RestoreVersion("carol", "mail", versions[1].Commit)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	storage, _, err := s.GetAll()
+	if err != nil || string(storage["mail"].Elements["bob"].Password.Bytes()) != "one" {
+		t.Fatalf("got %+v, %v", storage, err)
+	}
+
+	syncService(t, s)
+
+	restored := logOf(t, h, "mail")
+	if len(restored) != 4 || restored[0].Op != "restore-service" || restored[0].From != versions[1].Commit || restored[0].Actor != "carol" {
+		t.Fatalf("got %+v", restored[0])
+	}
+
+	// a service that did not exist in the version is deleted
+	err = s.RestoreVersion("carol", "bank", versions[1].Commit)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	storage, _, err = s.GetAll()
+	if _, ok := storage["bank"]; ok || err != nil {
+		t.Fatalf("got %+v, %v", storage, err)
+	}
+
+	err = s.RestoreVersion("carol", "mail", "0123456789abcdef")
+	if !errors.Is(err, history.ErrNotFound) {
+		t.Fatalf("got %v, want ErrNotFound", err)
+	}
+}
+
+// Readers never see the service deleted but not restored yet.
+func TestRestoreVersionIsAtomic(t *testing.T) {
+	s, h := newHistoryService(t)
+	startPersister(t, s, time.Millisecond, time.Second, 0)
+
+	err := s.AppendService("alice", "mail", "web", false)
+	if err == nil {
+		err = s.AppendLogin("alice", "mail", "bob", element("one"))
+	}
+	if err == nil {
+		err = s.AppendLogin("alice", "mail", "carol", element("two"))
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	syncService(t, s)
+
+	commit := logOf(t, h, "mail")[0].Commit
+
+	var stop atomic.Bool
+	var wg sync.WaitGroup
+	var torn atomic.Int64
+
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+
+			for !stop.Load() {
+				storage, _, err := s.GetAll()
+				if err == nil && len(storage["mail"].Elements) != 2 {
+					torn.Add(1)
+				}
+			}
+		}()
+	}
+
+	for i := 0; i < 20; i++ {
+		err = s.RestoreVersion("alice", "mail", commit)
+		if err != nil {
+			break
+		}
+	}
+
+	stop.Store(true)
+	wg.Wait()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if torn.Load() > 0 {
+		t.Fatalf("readers saw the service half restored %d times", torn.Load())
+	}
+}
@@ -0,0 +1,158 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+
+	"manager/internal/domain"
+	"manager/internal/secmem"
+)
+
+const autoLockCheckInterval = time.Second
+
+func (s *Service) Sealed() bool {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	return s.sealed
+}
+
+func (s *Service) Unlock(password string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if !s.sealed {
+		return domain.ErrUnsealed
+	}
+
+	err := s.open([]byte(password))
+	if err != nil {
+		return err
+	}
+
+	s.sealed = false
+	s.lastActivity.Store(time.Now().UnixNano())
+
+	s.recordExternal("unlock")
+
+	return nil
+}
+
+// Lock flushes the storage to disk, drops the key and the decrypted records and wipes the memory
+// that held their secrets.
+func (s *Service) Lock() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.sealed {
+		return nil
+	}
+
+	s.commitHistory()
+
+	err := s.repo.Close()
+	if err != nil {
+		return fmt.Errorf("failed to lock storage: %s", err.Error())
+	}
+
+	s.sealed = true
+	s.leaveDecoy()
+	secmem.Wipe()
+
+	return nil
+}
+
+// RunAutoLock locks the service once it has been idle for the given timeout.
+func (s *Service) RunAutoLock(ctx context.Context, timeout time.Duration) {
+	ticker := time.NewTicker(autoLockCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			// Sealed waits for a running unlock, which sets the last activity
+			if s.Sealed() {
+				continue
+			}
+
+			lastActivity := time.Unix(0, s.lastActivity.Load())
+			if time.Since(lastActivity) < timeout {
+				continue
+			}
+
+			err := s.Lock()
+			if err != nil {
+				log.Printf("failed to auto-lock: %s", err.Error())
+
+				continue
+			}
+
+			log.Print("storage locked after inactivity")
+		}
+	}
+}
+
+// writable is unsealed for operations that change the storage.
+func (s *Service) writable() (func(), error) {
+	release, err := s.unsealed()
+	if err != nil {
+		return nil, err
+	}
+
+	if s.repo.ReadOnly() {
+		release()
+
+		return nil, domain.ErrReadOnly
+	}
+
+	if s.isDegraded() {
+		release()
+
+		return nil, domain.ErrDegraded
+	}
+
+	return release, nil
+}
+
+// unsealed holds the read side of the lock state for the duration of an operation.
+func (s *Service) unsealed() (func(), error) {
+	s.mutex.RLock()
+
+	if s.sealed {
+		s.mutex.RUnlock()
+
+		return nil, domain.ErrSealed
+	}
+
+	s.lastActivity.Store(time.Now().UnixNano())
+
+	return s.mutex.RUnlock, nil
+}
+
+// exclusive is writable for operations that replace the key, no other operation runs meanwhile.
+func (s *Service) exclusive() (func(), error) {
+	s.mutex.Lock()
+
+	switch {
+	case s.sealed:
+		s.mutex.Unlock()
+
+		return nil, domain.ErrSealed
+	case s.repo.ReadOnly():
+		s.mutex.Unlock()
+
+		return nil, domain.ErrReadOnly
+	case s.isDegraded():
+		s.mutex.Unlock()
+
+		return nil, domain.ErrDegraded
+	}
+
+	s.lastActivity.Store(time.Now().UnixNano())
+
+	return s.mutex.Unlock, nil
+}
@@ -0,0 +1,140 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"manager/internal/backend/jsonfile"
+	"manager/internal/domain"
+	repo "manager/internal/repository"
+)
+
+func TestLockDropsAccess(t *testing.T) {
+	repo := newMemRepository("secret")
+	s := newTestService(t, repo)
+
+	err := s.AppendService("test", "mail", "web", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = s.Lock()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if repo.open {
+		t.Fatal("the storage is still open after Lock")
+	}
+
+	_, _, err = s.GetAll()
+	if !errors.Is(err, domain.ErrSealed) {
+		t.Fatalf("GetAll after Lock: got %v", err)
+	}
+
+	if !s.Health().Sealed {
+		t.Fatal("health does not report sealed")
+	}
+}
+
+func TestAutoLock(t *testing.T) {
+	s := newTestService(t, newMemRepository("secret"))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	go s.RunAutoLock(ctx, 10*time.Millisecond)
+
+	deadline := time.Now().Add(5 * autoLockCheckInterval)
+	for !s.Sealed() {
+		if time.Now().After(deadline) {
+			t.Fatal("the idle service was not locked")
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestAutoLockKeepsActiveService(t *testing.T) {
+	s := newTestService(t, newMemRepository("secret"))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	go s.RunAutoLock(ctx, time.Hour)
+
+	time.Sleep(autoLockCheckInterval + 100*time.Millisecond)
+
+	if s.Sealed() {
+		t.Fatal("the service was locked before the timeout")
+	}
+}
+
+// Secrets are encoded before a concurrent Lock can wipe them, a reader gets them whole or not at all.
+func TestGetAllJSONDuringLock(t *testing.T) {
+	r := jsonfile.New(repo.New(), filepath.Join(t.TempDir(), "storage.txt"), 1<<20, true, testKDF)
+	r.Create()
+
+	s := New(r, testRecordTypes)
+
+	err := s.Unlock("secret")
+	if err == nil {
+		err = s.AppendService("test", "mail", "web", false)
+	}
+	if err == nil {
+		err = s.AppendLogin("test", "mail", "alice", element("correct horse battery staple"))
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	startPersister(t, s, time.Millisecond, time.Second, 0)
+	syncService(t, s)
+
+	done := make(chan struct{})
+	errs := make(chan error, 1)
+
+	go func() {
+		defer close(errs)
+
+		for {
+			select {
+			case <-done:
+				return
+			default:
+			}
+
+			data, _, err := s.GetAllJSON()
+			if errors.Is(err, domain.ErrSealed) {
+				continue
+			}
+
+			if err != nil || !strings.Contains(string(data), "correct horse battery staple") {
+				errs <- fmt.Errorf("got %s, %v", data, err)
+
+				return
+			}
+		}
+	}()
+
+	for i := 0; i < 50; i++ {
+		err = s.Lock()
+		if err == nil {
+			err = s.Unlock("secret")
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	close(done)
+
+	for err := range errs {
+		t.Fatal(err)
+	}
+}
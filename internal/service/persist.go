@@ -0,0 +1,137 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"log"
+	"time"
+)
+
+var errPersisterStopped = errors.New("persister is stopped")
+
+// markDirty schedules a flush of the storage to disk. Several changes are coalesced into one write.
+func (s *Service) markDirty() {
+	s.generation.Add(1)
+
+	select {
+	case s.dirty <- struct{}{}:
+	default:
+	}
+}
+
+// Sync flushes all changes made so far and reports whether they reached the disk.
+func (s *Service) Sync() error {
+	done := make(chan error, 1)
+
+	select {
+	case s.syncs <- done:
+	case <-s.stopped:
+		return errPersisterStopped
+	}
+
+	select {
+	case err := <-done:
+		return err
+	case <-s.stopped:
+		return errPersisterStopped
+	}
+}
+
+// RunPersister is the only writer of the storage file while the service is running. A flush happens
+// once no changes arrived for debounce, but no later than maxLatency after the first pending change.
+// Pending changes are flushed when ctx is done. After degradeAfter failed flushes in a row changes
+// are rejected, failed flushes are retried every maxLatency.
+func (s *Service) RunPersister(ctx context.Context, debounce, maxLatency time.Duration, degradeAfter int) {
+	defer close(s.stopped)
+
+	timer := time.NewTimer(0)
+	if !timer.Stop() {
+		<-timer.C
+	}
+
+	pending := false
+	var firstChange time.Time
+
+	flush := func() error {
+		if !timer.Stop() {
+			select {
+			case <-timer.C:
+			default:
+			}
+		}
+
+		err := s.UpdateFile()
+		s.flushed(err, degradeAfter)
+
+		if err != nil {
+			log.Printf("failed to update file: %s", err.Error())
+
+			// keep the changes pending and retry later
+			timer.Reset(maxLatency)
+
+			return err
+		}
+
+		pending = false
+
+		return nil
+	}
+
+	// changed starts the maximum latency with the first pending change, wherever it is picked up
+	changed := func() {
+		if !pending {
+			pending = true
+			firstChange = time.Now()
+		}
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			// a change may still sit in the dirty channel
+			select {
+			case <-s.dirty:
+				changed()
+			default:
+			}
+
+			if pending {
+				flush()
+			}
+
+			return
+		case <-s.dirty:
+			changed()
+
+			wait := debounce
+			if remaining := maxLatency - time.Since(firstChange); remaining < wait {
+				wait = remaining
+			}
+
+			if !timer.Stop() {
+				select {
+				case <-timer.C:
+				default:
+				}
+			}
+			timer.Reset(wait)
+		case <-timer.C:
+			flush()
+		case done := <-s.syncs:
+			// the change that is being synced may still sit in the dirty channel
+			select {
+			case <-s.dirty:
+				changed()
+			default:
+			}
+
+			if !pending {
+				done <- nil
+
+				continue
+			}
+
+			done <- flush()
+		}
+	}
+}
@@ -0,0 +1,256 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"manager/internal/domain"
+)
+
+// startPersister runs the persister until the test ends.
+func startPersister(t *testing.T, s *Service, debounce, maxLatency time.Duration, degradeAfter int) context.CancelFunc {
+	t.Helper()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go s.RunPersister(ctx, debounce, maxLatency, degradeAfter)
+
+	t.Cleanup(func() {
+		cancel()
+		<-s.stopped
+	})
+
+	return cancel
+}
+
+func TestPersisterCoalescesChanges(t *testing.T) {
+	repo := newMemRepository("secret")
+	s := newTestService(t, repo)
+	startPersister(t, s, time.Hour, time.Hour, 0)
+
+	for i := 0; i < 10; i++ {
+		err := s.AppendService("test", fmt.Sprintf("service-%d", i), "web", false)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if _, written, _ := repo.state(); written != 0 {
+		t.Fatalf("%d changes written before the debounce", written)
+	}
+
+	err := s.Sync()
+	if err != nil {
+		t.Fatalf("Sync: %s", err)
+	}
+
+	changes, written, flushes := repo.state()
+	if changes != 10 || written != 10 || flushes != 1 {
+		t.Fatalf("got %d changes, %d written in %d flushes, want 10 in one", changes, written, flushes)
+	}
+
+	// nothing pending, nothing to write
+	if err = s.Sync(); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, _, flushes = repo.state(); flushes != 1 {
+		t.Fatalf("Sync without changes wrote again, %d flushes", flushes)
+	}
+}
+
+func TestPersisterMaxLatency(t *testing.T) {
+	repo := newMemRepository("secret")
+	s := newTestService(t, repo)
+	startPersister(t, s, time.Hour, 20*time.Millisecond, 0)
+
+	err := s.AppendService("test", "mail", "web", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if _, written, _ := repo.state(); written == 1 {
+			return
+		}
+
+		if time.Now().After(deadline) {
+			t.Fatal("the change was not written after the maximum latency")
+		}
+
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestPersisterFlushesOnStop(t *testing.T) {
+	repo := newMemRepository("secret")
+	s := newTestService(t, repo)
+	stop := startPersister(t, s, time.Hour, time.Hour, 0)
+
+	err := s.AppendService("test", "mail", "web", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stop()
+	<-s.stopped
+
+	if _, written, _ := repo.state(); written != 1 {
+		t.Fatal("the pending change was not written on stop")
+	}
+
+	if err = s.Sync(); !errors.Is(err, errPersisterStopped) {
+		t.Fatalf("Sync after stop: got %v", err)
+	}
+}
+
+func TestPersisterDegrades(t *testing.T) {
+	repo := newMemRepository("secret")
+	s := newTestService(t, repo)
+	startPersister(t, s, time.Hour, time.Hour, 2)
+
+	diskFull := errors.New("no space left on device")
+	repo.failFlushes(diskFull)
+
+	for i := 0; i < 2; i++ {
+		err := s.AppendService("test", fmt.Sprintf("service-%d", i), "web", false)
+		if err != nil {
+			t.Fatalf("change %d: %s", i, err)
+		}
+
+		if err = s.Sync(); !errors.Is(err, diskFull) {
+			t.Fatalf("Sync: got %v", err)
+		}
+	}
+
+	health := s.Health()
+	if !health.Degraded || health.Failures != 2 || health.LastError != diskFull.Error() {
+		t.Fatalf("got health %+v", health)
+	}
+
+	err := s.AppendService("test", "rejected", "web", false)
+	if !errors.Is(err, domain.ErrDegraded) {
+		t.Fatalf("change while degraded: got %v", err)
+	}
+
+	repo.failFlushes(nil)
+
+	if err = s.Sync(); err != nil {
+		t.Fatalf("Sync after the disk recovered: %s", err)
+	}
+
+	if s.Health().Degraded || s.Failing() {
+		t.Fatal("still degraded after a successful flush")
+	}
+
+	if changes, written, _ := repo.state(); changes != 2 || written != 2 {
+		t.Fatalf("got %d changes, %d written", changes, written)
+	}
+}
+
+// A failed flush of a change that Sync picked up is retried after the maximum latency, not on the
+// next change.
+func TestPersisterRetriesAfterMaxLatency(t *testing.T) {
+	repo := newMemRepository("secret")
+	s := newTestService(t, repo)
+	startPersister(t, s, time.Hour, time.Hour, 0)
+
+	diskFull := errors.New("no space left on device")
+	repo.failFlushes(diskFull)
+
+	for i := 0; i < 10; i++ {
+		err := s.AppendService("test", fmt.Sprintf("service-%d", i), "web", false)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if i == 0 {
+			if err = s.Sync(); !errors.Is(err, diskFull) {
+				t.Fatalf("Sync: got %v", err)
+			}
+		}
+	}
+
+	time.Sleep(50 * time.Millisecond)
+
+	if failures := s.Health().Failures; failures != 1 {
+		t.Fatalf("got %d failed flushes, want 1", failures)
+	}
+}
+
+// Sync returns only once every change made before it is written, whatever runs concurrently.
+func TestPersisterConcurrentWriters(t *testing.T) {
+	repo := newMemRepository("secret")
+	s := newTestService(t, repo)
+	startPersister(t, s, time.Millisecond, 5*time.Millisecond, 0)
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 8)
+
+	for w := 0; w < 8; w++ {
+		wg.Add(1)
+
+		go func(w int) {
+			defer wg.Done()
+
+			for i := 0; i < 25; i++ {
+				service := fmt.Sprintf("service-%d-%d", w, i)
+
+				err := s.AppendService("test", service, "web", false)
+				if err == nil {
+					err = s.AppendLogin("test", service, "user", domain.Element{Description: "login"})
+				}
+				if err == nil {
+					_, _, err = s.GetAll()
+				}
+				if err != nil {
+					errs <- err
+
+					return
+				}
+
+				if i%5 != 0 {
+					continue
+				}
+
+				err = s.Sync()
+				if err != nil {
+					errs <- err
+
+					return
+				}
+
+				// the writer's own changes are on disk once Sync returns
+				if _, written, _ := repo.state(); written < 2*(i+1) {
+					errs <- fmt.Errorf("writer %d: only %d changes written after Sync", w, written)
+
+					return
+				}
+			}
+		}(w)
+	}
+
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		t.Fatal(err)
+	}
+
+	if err := s.Sync(); err != nil {
+		t.Fatal(err)
+	}
+
+	changes, written, flushes := repo.state()
+	if changes != 400 || written != 400 {
+		t.Fatalf("got %d changes, %d written", changes, written)
+	}
+
+	if flushes >= changes {
+		t.Fatalf("%d flushes for %d changes, nothing was coalesced", flushes, changes)
+	}
+}
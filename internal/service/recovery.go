@@ -0,0 +1,152 @@
+package service
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"manager/internal/domain"
+	"manager/internal/history"
+	"manager/internal/vault"
+)
+
+const maxRecoveryCodes = 100
+
+var errRecoveryUnsupported = errors.New("recovery codes are not supported by the storage backend")
+
+// recoverer is implemented by backends that keep the key slots of a vault.
+type recoverer interface {
+	Key() *vault.Key
+	SetKey(key *vault.Key) error
+	Recover(code, password []byte) error
+}
+
+// keyProber reads the key of a vault from its key slot, without opening the vault.
+type keyProber interface {
+	ProbeKey(password []byte) (*vault.Key, error)
+}
+
+// Recovery tells how many recovery codes are left.
+func (s *Service) Recovery() (domain.Recovery, error) {
+	release, err := s.unsealed()
+	if err != nil {
+		return domain.Recovery{}, err
+	}
+	defer release()
+
+	r, ok := s.repo.(recoverer)
+	if !ok {
+		return domain.Recovery{}, errRecoveryUnsupported
+	}
+
+	codes, key := r.Key().Recovery()
+
+	return domain.Recovery{Codes: codes, Key: key}, nil
+}
+
+// ProbeRecovery tells how many recovery codes are left like Recovery does, from the key slot the
+// password opens. Nothing is opened or written, so another process may hold the storage meanwhile.
+func (s *Service) ProbeRecovery(password string) (domain.Recovery, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	p, ok := s.repo.(keyProber)
+	if !ok {
+		return domain.Recovery{}, errRecoveryUnsupported
+	}
+
+	key, err := p.ProbeKey([]byte(password))
+	if err != nil || key == nil {
+		return domain.Recovery{}, err
+	}
+
+	codes, withKey := key.Recovery()
+
+	return domain.Recovery{Codes: codes, Key: withKey}, nil
+}
+
+// GenerateRecovery replaces the recovery codes, and the recovery key when withKey is set, with new
+// ones. Every one of them opens the vault on its own, they are shown only once.
+func (s *Service) GenerateRecovery(actor, password string, codes int, withKey bool) (domain.RecoveryCodes, error) {
+	if codes < 0 || codes > maxRecoveryCodes || (codes == 0 && !withKey) {
+		return domain.RecoveryCodes{}, fmt.Errorf("between 1 and %d recovery codes can be generated", maxRecoveryCodes)
+	}
+
+	release, err := s.exclusive()
+	if err != nil {
+		return domain.RecoveryCodes{}, err
+	}
+	defer release()
+
+	r, ok := s.repo.(recoverer)
+	if !ok {
+		return domain.RecoveryCodes{}, errRecoveryUnsupported
+	}
+
+	key := r.Key()
+
+	err = key.Verify([]byte(password))
+	if errors.Is(err, vault.ErrWrongPassword) {
+		return domain.RecoveryCodes{}, domain.ErrWrongPassword
+	}
+	if err != nil {
+		return domain.RecoveryCodes{}, err
+	}
+
+	next, generated, recoveryKey, err := key.WithRecovery(codes, withKey)
+	if err != nil {
+		return domain.RecoveryCodes{}, err
+	}
+
+	err = r.SetKey(next)
+	if err != nil {
+		return domain.RecoveryCodes{}, fmt.Errorf("failed to write recovery codes: %s", err.Error())
+	}
+
+	s.generation.Add(1)
+	log.Printf("%d recovery codes generated by %s", codes, actor)
+
+	if s.history != nil {
+		s.record(history.Change{Op: "recovery-codes", Actor: actor})
+	}
+
+	return domain.RecoveryCodes{Codes: generated, Key: recoveryKey}, nil
+}
+
+// Recover unlocks the storage with a recovery code or the recovery key and sets a new master
+// password and data key. The code is used up, with a copy of the storage made before it opens only
+// that copy.
+func (s *Service) Recover(code, password string) error {
+	if password == "" {
+		return fmt.Errorf("new password is empty")
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if !s.sealed {
+		return domain.ErrUnsealed
+	}
+
+	r, ok := s.repo.(recoverer)
+	if !ok {
+		return errRecoveryUnsupported
+	}
+
+	err := r.Recover([]byte(code), []byte(password))
+	if err != nil {
+		return err
+	}
+
+	s.sealed = false
+	s.lastActivity.Store(time.Now().UnixNano())
+	s.generation.Add(1)
+
+	codes, _ := r.Key().Recovery()
+	log.Printf("storage recovered and master password reset, %d recovery codes left", codes)
+
+	s.recordExternal("recover")
+
+	return nil
+}
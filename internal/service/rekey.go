@@ -0,0 +1,51 @@
+package service
+
+import (
+	"errors"
+	"fmt"
+	"log"
+
+	"manager/internal/history"
+)
+
+var errRekeyUnsupported = errors.New("changing the master password is not supported by the storage backend")
+
+// rekeyer is implemented by backends that can protect the open storage with a new password.
+type rekeyer interface {
+	Rekey(current, password []byte) error
+}
+
+// Rekey changes the master password, encrypts the records under a new data key and raises the key
+// derivation parameters to the configured ones. Backups and versions in the history made before
+// stay readable with the old password, but hold only the records of their time: the old password
+// does not lead to the data key from then on.
+func (s *Service) Rekey(actor, current, password string) error {
+	if password == "" {
+		return fmt.Errorf("new password is empty")
+	}
+
+	release, err := s.exclusive()
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	r, ok := s.repo.(rekeyer)
+	if !ok {
+		return errRekeyUnsupported
+	}
+
+	err = r.Rekey([]byte(current), []byte(password))
+	if err != nil {
+		return err
+	}
+
+	s.generation.Add(1)
+	log.Printf("master password changed by %s, backups made before stay readable with the old password", actor)
+
+	if s.history != nil {
+		s.record(history.Change{Op: "rekey", Actor: actor})
+	}
+
+	return nil
+}
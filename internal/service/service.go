@@ -1,114 +1,231 @@
 package service
 
 import (
-	"encoding/json"
 	"fmt"
 	"log"
-	"os"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"manager/internal/domain"
+	"manager/internal/history"
+	repo "manager/internal/repository"
 )
 
 type repository interface {
-	SetStorage(domain.Storage)
-	Get(string) (domain.Service, bool)
-	GetAll() domain.Storage
-	UpdateLogin(string, string, domain.Element) bool
-	AppendLogin(string, string, domain.Element) bool
-	DeleteLogin(string, string) bool
-	UpdateService(string, string, bool) bool
-	AppendService(string, string, bool) bool
-	DeleteService(string) bool
+	Check() error
+	Open(password []byte) error
+	Close() error
+	Flush() error
+	ReadOnly() bool
+	GetAll() (domain.Storage, error)
+	GetByType(recordType string) (domain.Storage, error)
+	GetFavorites() (domain.Storage, error)
+	Apply(domain.Operation) (bool, error)
 }
 
 type Service struct {
 	repo        repository
-	filename    string
 	recordTypes []string
+
+	sealed       bool
+	mutex        *sync.RWMutex
+	lastActivity atomic.Int64
+	generation   atomic.Uint64
+
+	dirty   chan struct{}
+	syncs   chan chan error
+	stopped chan struct{}
+
+	healthMutex *sync.Mutex
+	failures    int
+	lastError   error
+	lastFailure time.Time
+	degraded    bool
+
+	// history is nil unless it is enabled, historyMutex keeps the records in the order of the changes
+	history      recorder
+	historyMutex *sync.Mutex
+	records      []pendingRecord
+
+	// unsealShares are the key shares given so far, all of the split with unsealID
+	unsealMutex     *sync.Mutex
+	unsealID        []byte
+	unsealThreshold int
+	unsealShares    [][]byte
+
+	// decoy is nil unless it is enabled, real and realHistory hold the storage and its history while
+	// the decoy is open
+	decoy        repository
+	decoyHistory recorder
+	real         repository
+	realHistory  recorder
+	duress       bool
+	alert        func()
 }
 
-func New(repo repository, filename string, recordTypes []string) *Service {
+func New(repo repository, recordTypes []string) *Service {
 	return &Service{
 		repo:        repo,
-		filename:    filename,
 		recordTypes: recordTypes,
+		sealed:      true,
+		mutex:       new(sync.RWMutex),
+		healthMutex: new(sync.Mutex),
+		unsealMutex: new(sync.Mutex),
+		dirty:       make(chan struct{}, 1),
+		syncs:       make(chan chan error),
+		stopped:     make(chan struct{}),
 	}
 }
 
-func (s *Service) readFile() (domain.Storage, error) {
-	bytes, err := os.ReadFile(s.filename)
-	if err != nil {
-		return nil, fmt.Errorf("failed to read file: %s", err.Error())
+// Check validates the storage before it is unlocked.
+func (s *Service) Check() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	err := s.repo.Check()
+	if err != nil || s.decoy == nil {
+		return err
 	}
 
-	var data domain.Storage
+	return s.decoy.Check()
+}
 
-	err = json.Unmarshal(bytes, &data)
-	if err != nil {
-		return nil, fmt.Errorf("failed to unmarshal file: %s", err.Error())
+// UpdateFile persists the changes made since the last call and commits them to the history.
+func (s *Service) UpdateFile() error {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	if s.sealed {
+		return nil
 	}
 
-	return data, nil
+	err := s.repo.Flush()
+
+	s.commitHistory()
+
+	return err
+}
+
+// versioned is implemented by backends that serve readers from immutable versions of the storage.
+type versioned interface {
+	Current() *repo.Snapshot
 }
 
-func (s *Service) WriteStorageFromFile() error {
-	data, err := s.readFile()
+// GetAll returns the storage with its version. With a versioned backend readers get a consistent
+// view that later changes leave as it is, other backends report version 0.
+func (s *Service) GetAll() (domain.Storage, uint64, error) {
+	release, err := s.unsealed()
 	if err != nil {
-		return fmt.Errorf("failed to write storage from file: %s", err.Error())
+		return domain.Storage{}, 0, err
 	}
+	defer release()
 
-	s.repo.SetStorage(data)
+	return s.getAll()
+}
 
-	return nil
+func (s *Service) GetByType(recordType string) (domain.Storage, uint64, error) {
+	release, err := s.unsealed()
+	if err != nil {
+		return domain.Storage{}, 0, err
+	}
+	defer release()
+
+	return s.getByType(recordType)
 }
 
-func (s *Service) UpdateFile() error {
-	file, err := os.OpenFile(s.filename, os.O_CREATE|os.O_WRONLY, 0644)
+func (s *Service) GetFavorites() (domain.Storage, uint64, error) {
+	release, err := s.unsealed()
 	if err != nil {
-		return fmt.Errorf("failed to open or create file: %s", err.Error())
+		return domain.Storage{}, 0, err
 	}
-	defer file.Close()
+	defer release()
+
+	return s.getFavorites()
+}
+
+// GetAllJSON returns the storage encoded as JSON with its version. The secrets are encoded while
+// the storage stays unlocked, a Lock in between would wipe them. The result is the only copy of
+// them outside of locked memory, the caller wipes it once it is written.
+func (s *Service) GetAllJSON() ([]byte, uint64, error) {
+	return s.marshal(s.getAll)
+}
 
-	storage, err := json.Marshal(s.repo.GetAll())
+func (s *Service) GetByTypeJSON(recordType string) ([]byte, uint64, error) {
+	return s.marshal(func() (domain.Storage, uint64, error) {
+		return s.getByType(recordType)
+	})
+}
+
+func (s *Service) GetFavoritesJSON() ([]byte, uint64, error) {
+	return s.marshal(s.getFavorites)
+}
+
+func (s *Service) marshal(get func() (domain.Storage, uint64, error)) ([]byte, uint64, error) {
+	release, err := s.unsealed()
 	if err != nil {
-		return fmt.Errorf("failed to marshal storage: %s", err.Error())
+		return nil, 0, err
 	}
+	defer release()
 
-	_, err = file.Write(storage)
+	storage, version, err := get()
 	if err != nil {
-		return fmt.Errorf("failed to write storage in file: %s", err.Error())
+		return nil, 0, err
 	}
 
-	return nil
+	return domain.EncodeStorage(storage), version, nil
 }
 
-func (s *Service) GetAll() domain.Storage {
-	return s.repo.GetAll()
+func (s *Service) getAll() (domain.Storage, uint64, error) {
+	if v, ok := s.repo.(versioned); ok {
+		snap := v.Current()
+
+		return snap.Storage(), snap.Version, nil
+	}
+
+	storage, err := s.repo.GetAll()
+
+	return storage, 0, err
 }
 
-func (s *Service) GetByType(recordType string) (domain.Storage, error) {
+func (s *Service) getByType(recordType string) (domain.Storage, uint64, error) {
 	if !contains(s.recordTypes, recordType) {
-		return domain.Storage{}, fmt.Errorf("undefined record type")
+		return domain.Storage{}, 0, fmt.Errorf("undefined record type")
 	}
 
-	storage := s.repo.GetAll()
-	storageWithType := make(domain.Storage)
+	if v, ok := s.repo.(versioned); ok {
+		snap := v.Current()
 
-	for name, value := range storage {
-		if value.Type != recordType {
-			continue
-		}
+		return snap.GetByType(recordType), snap.Version, nil
+	}
+
+	storage, err := s.repo.GetByType(recordType)
+
+	return storage, 0, err
+}
+
+func (s *Service) getFavorites() (domain.Storage, uint64, error) {
+	if v, ok := s.repo.(versioned); ok {
+		snap := v.Current()
 
-		storageWithType[name] = value
+		return snap.GetFavorites(), snap.Version, nil
 	}
 
-	return storageWithType, nil
+	storage, err := s.repo.GetFavorites()
+
+	return storage, 0, err
 }
 
 // service
 
-func (s *Service) AppendService(serviceName, serviceType string, favorite bool) error {
+func (s *Service) AppendService(actor, serviceName, serviceType string, favorite bool) error {
+	release, err := s.writable()
+	if err != nil {
+		return err
+	}
+	defer release()
+
 	validServiceName, err := validationServiceName(serviceName)
 	if err != nil {
 		return fmt.Errorf("validation name error: %s", err.Error())
@@ -119,24 +236,34 @@ func (s *Service) AppendService(serviceName, serviceType string, favorite bool)
 		return fmt.Errorf("validation elem error: %s", err.Error())
 	}
 
-	ok := s.repo.AppendService(validServiceName, validServiceType, favorite)
+	ok, err := s.apply(actor, domain.Operation{
+		Op:       domain.OpAppendService,
+		Service:  validServiceName,
+		Type:     validServiceType,
+		Favorite: favorite,
+	})
+	if err != nil {
+		log.Printf("failed to apply operation: %s", err.Error())
+
+		return err
+	}
+
 	if !ok {
 		log.Print("failed to update file: element already exists")
 
 		return fmt.Errorf("element already exists")
 	}
 
-	err = s.UpdateFile()
-	if err != nil {
-		log.Printf("failed to update file: %s", err.Error())
+	return nil
+}
 
+func (s *Service) UpdateService(actor, serviceName, serviceType string, favorite bool) error {
+	release, err := s.writable()
+	if err != nil {
 		return err
 	}
+	defer release()
 
-	return nil
-}
-
-func (s *Service) UpdateService(serviceName, serviceType string, favorite bool) error {
 	validServiceName, err := validationServiceName(serviceName)
 	if err != nil {
 		return fmt.Errorf("validation name error: %s", err.Error())
@@ -147,45 +274,67 @@ func (s *Service) UpdateService(serviceName, serviceType string, favorite bool)
 		return fmt.Errorf("validation elem error: %s", err.Error())
 	}
 
-	ok := s.repo.UpdateService(validServiceName, validServiceType, favorite)
+	ok, err := s.apply(actor, domain.Operation{
+		Op:       domain.OpUpdateService,
+		Service:  validServiceName,
+		Type:     validServiceType,
+		Favorite: favorite,
+	})
+	if err != nil {
+		log.Printf("failed to apply operation: %s", err.Error())
+
+		return err
+	}
+
 	if !ok {
 		log.Print("failed to update file: element not found")
 
 		return fmt.Errorf("element not found")
 	}
 
-	err = s.UpdateFile()
-	if err != nil {
-		log.Printf("failed to update file: %s", err.Error())
-	}
-
 	return nil
 }
 
-func (s *Service) DeleteService(serviceName string) error {
+func (s *Service) DeleteService(actor, serviceName string) error {
+	release, err := s.writable()
+	if err != nil {
+		return err
+	}
+	defer release()
+
 	validServiceName, err := validationServiceName(serviceName)
 	if err != nil {
 		return fmt.Errorf("validation name error: %s", err.Error())
 	}
 
-	ok := s.repo.DeleteService(validServiceName)
+	ok, err := s.apply(actor, domain.Operation{
+		Op:      domain.OpDeleteService,
+		Service: validServiceName,
+	})
+	if err != nil {
+		log.Printf("failed to apply operation: %s", err.Error())
+
+		return err
+	}
+
 	if !ok {
 		log.Print("failed to update file: element not found")
 
 		return fmt.Errorf("element not found")
 	}
 
-	err = s.UpdateFile()
-	if err != nil {
-		log.Printf("failed to update file: %s", err.Error())
-	}
-
 	return nil
 }
 
 // login
 
-func (s *Service) AppendLogin(serviceName, login string, elem domain.Element) error {
+func (s *Service) AppendLogin(actor, serviceName, login string, elem domain.Element) error {
+	release, err := s.writable()
+	if err != nil {
+		return err
+	}
+	defer release()
+
 	validServiceName, err := validationServiceName(serviceName)
 	if err != nil {
 		return fmt.Errorf("validation name error: %s", err.Error())
@@ -201,24 +350,34 @@ func (s *Service) AppendLogin(serviceName, login string, elem domain.Element) er
 		return fmt.Errorf("validation elem error: %s", err.Error())
 	}
 
-	ok := s.repo.AppendLogin(validServiceName, validLogin, validElem)
+	ok, err := s.apply(actor, domain.Operation{
+		Op:      domain.OpAppendLogin,
+		Service: validServiceName,
+		Login:   validLogin,
+		Element: &validElem,
+	})
+	if err != nil {
+		log.Printf("failed to apply operation: %s", err.Error())
+
+		return err
+	}
+
 	if !ok {
 		log.Print("failed to update file: element already exists")
 
 		return fmt.Errorf("element already exists")
 	}
 
-	err = s.UpdateFile()
-	if err != nil {
-		log.Printf("failed to update file: %s", err.Error())
+	return nil
+}
 
+func (s *Service) UpdateLogin(actor, serviceName, login string, elem domain.Element) error {
+	release, err := s.writable()
+	if err != nil {
 		return err
 	}
+	defer release()
 
-	return nil
-}
-
-func (s *Service) UpdateLogin(serviceName, login string, elem domain.Element) error {
 	validServiceName, err := validationServiceName(serviceName)
 	if err != nil {
 		return fmt.Errorf("validation name error: %s", err.Error())
@@ -234,22 +393,34 @@ func (s *Service) UpdateLogin(serviceName, login string, elem domain.Element) er
 		return fmt.Errorf("validation elem error: %s", err.Error())
 	}
 
-	ok := s.repo.UpdateLogin(validServiceName, validLogin, validElem)
+	ok, err := s.apply(actor, domain.Operation{
+		Op:      domain.OpUpdateLogin,
+		Service: validServiceName,
+		Login:   validLogin,
+		Element: &validElem,
+	})
+	if err != nil {
+		log.Printf("failed to apply operation: %s", err.Error())
+
+		return err
+	}
+
 	if !ok {
 		log.Print("failed to update file: element not found")
 
 		return fmt.Errorf("element not found")
 	}
 
-	err = s.UpdateFile()
-	if err != nil {
-		log.Printf("failed to update file: %s", err.Error())
-	}
-
 	return nil
 }
 
-func (s *Service) DeleteLogin(serviceName, login string) error {
+func (s *Service) DeleteLogin(actor, serviceName, login string) error {
+	release, err := s.writable()
+	if err != nil {
+		return err
+	}
+	defer release()
+
 	validServiceName, err := validationServiceName(serviceName)
 	if err != nil {
 		return fmt.Errorf("validation name error: %s", err.Error())
@@ -260,19 +431,44 @@ func (s *Service) DeleteLogin(serviceName, login string) error {
 		return fmt.Errorf("validation elem error: %s", err.Error())
 	}
 
-	ok := s.repo.DeleteLogin(validServiceName, validLogin)
+	ok, err := s.apply(actor, domain.Operation{
+		Op:      domain.OpDeleteLogin,
+		Service: validServiceName,
+		Login:   validLogin,
+	})
+	if err != nil {
+		log.Printf("failed to apply operation: %s", err.Error())
+
+		return err
+	}
+
 	if !ok {
 		log.Print("failed to update file: element not found")
 
 		return fmt.Errorf("element not found")
 	}
 
-	err = s.UpdateFile()
-	if err != nil {
-		log.Printf("failed to update file: %s", err.Error())
+	return nil
+}
+
+// apply changes the repository and schedules the change to be persisted. With the history enabled
+// the change is committed on behalf of the actor together with the next flush.
+func (s *Service) apply(actor string, op domain.Operation) (bool, error) {
+	if s.history != nil {
+		s.historyMutex.Lock()
+		defer s.historyMutex.Unlock()
 	}
 
-	return nil
+	ok, err := s.repo.Apply(op)
+	if ok {
+		if s.history != nil {
+			s.queueRecord(history.Change{Op: op.Op, Service: op.Service, Login: op.Login, Actor: actor})
+		}
+
+		s.markDirty()
+	}
+
+	return ok, err
 }
 
 // other
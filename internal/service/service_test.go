@@ -0,0 +1,232 @@
+package service
+
+import (
+	"errors"
+	"sync"
+	"testing"
+
+	"manager/internal/domain"
+	"manager/internal/vault"
+)
+
+var testRecordTypes = []string{"web", "card"}
+
+var testKDF = vault.KDFParams{Time: 1, Memory: 64, Threads: 1}
+
+// memRepository keeps the storage in memory and counts what reached its fake disk.
+type memRepository struct {
+	mutex    sync.Mutex
+	password string
+	storage  domain.Storage
+	open     bool
+	readOnly bool
+
+	// changes is the number of applied operations, written the number of them on disk
+	changes  int
+	written  int
+	flushes  int
+	flushErr error
+}
+
+func newMemRepository(password string) *memRepository {
+	return &memRepository{password: password, storage: domain.Storage{}}
+}
+
+func (r *memRepository) Check() error {
+	return nil
+}
+
+func (r *memRepository) Open(password []byte) error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if string(password) != r.password {
+		return domain.ErrWrongPassword
+	}
+
+	r.open = true
+
+	return nil
+}
+
+func (r *memRepository) Close() error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	r.open = false
+
+	return nil
+}
+
+func (r *memRepository) Flush() error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if r.flushErr != nil {
+		return r.flushErr
+	}
+
+	if r.written != r.changes {
+		r.flushes++
+		r.written = r.changes
+	}
+
+	return nil
+}
+
+func (r *memRepository) Rekey(current, password []byte) error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if string(current) != r.password {
+		return domain.ErrWrongPassword
+	}
+
+	r.password = string(password)
+
+	return nil
+}
+
+func (r *memRepository) ReadOnly() bool {
+	return r.readOnly
+}
+
+func (r *memRepository) GetAll() (domain.Storage, error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	storage := make(domain.Storage, len(r.storage))
+	for name, service := range r.storage {
+		storage[name] = service
+	}
+
+	return storage, nil
+}
+
+func (r *memRepository) GetByType(recordType string) (domain.Storage, error) {
+	return domain.Storage{}, nil
+}
+
+func (r *memRepository) GetFavorites() (domain.Storage, error) {
+	return domain.Storage{}, nil
+}
+
+func (r *memRepository) Apply(op domain.Operation) (bool, error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	service, exists := r.storage[op.Service]
+
+	switch op.Op {
+	case domain.OpAppendService:
+		if exists {
+			return false, nil
+		}
+
+		r.storage[op.Service] = domain.Service{Type: op.Type, Favorite: op.Favorite, Elements: map[string]domain.Element{}}
+	case domain.OpDeleteService:
+		if !exists {
+			return false, nil
+		}
+
+		delete(r.storage, op.Service)
+	case domain.OpAppendLogin:
+		if !exists {
+			return false, nil
+		}
+
+		if _, ok := service.Elements[op.Login]; ok {
+			return false, nil
+		}
+
+		elements := make(map[string]domain.Element, len(service.Elements)+1)
+		for login, elem := range service.Elements {
+			elements[login] = elem
+		}
+		elements[op.Login] = *op.Element
+		service.Elements = elements
+		r.storage[op.Service] = service
+	default:
+		return false, errors.New("operation not supported by the test repository")
+	}
+
+	r.changes++
+
+	return true, nil
+}
+
+// state returns the applied changes, those on disk and the number of writes.
+func (r *memRepository) state() (changes, written, flushes int) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	return r.changes, r.written, r.flushes
+}
+
+func (r *memRepository) failFlushes(err error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	r.flushErr = err
+}
+
+func newTestService(t *testing.T, repo repository) *Service {
+	t.Helper()
+
+	s := New(repo, testRecordTypes)
+
+	err := s.Unlock("secret")
+	if err != nil {
+		t.Fatalf("Unlock: %s", err)
+	}
+
+	return s
+}
+
+func TestSealed(t *testing.T) {
+	s := New(newMemRepository("secret"), testRecordTypes)
+
+	_, _, err := s.GetAll()
+	if !errors.Is(err, domain.ErrSealed) {
+		t.Fatalf("GetAll while sealed: got %v", err)
+	}
+
+	err = s.AppendService("test", "mail", "web", false)
+	if !errors.Is(err, domain.ErrSealed) {
+		t.Fatalf("AppendService while sealed: got %v", err)
+	}
+
+	err = s.Unlock("guess")
+	if !errors.Is(err, domain.ErrWrongPassword) || !s.Sealed() {
+		t.Fatalf("Unlock with a wrong password: got %v", err)
+	}
+
+	err = s.Unlock("secret")
+	if err != nil || s.Sealed() {
+		t.Fatalf("Unlock: %v", err)
+	}
+
+	if err = s.Unlock("secret"); !errors.Is(err, domain.ErrUnsealed) {
+		t.Fatalf("second Unlock: got %v", err)
+	}
+
+	if err = s.Lock(); err != nil || !s.Sealed() {
+		t.Fatalf("Lock: %v", err)
+	}
+}
+
+func TestReadOnly(t *testing.T) {
+	repo := newMemRepository("secret")
+	repo.readOnly = true
+
+	s := newTestService(t, repo)
+
+	err := s.AppendService("test", "mail", "web", false)
+	if !errors.Is(err, domain.ErrReadOnly) {
+		t.Fatalf("got %v, want ErrReadOnly", err)
+	}
+
+	if !s.Health().ReadOnly {
+		t.Fatal("health does not report read-only")
+	}
+}
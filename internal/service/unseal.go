@@ -0,0 +1,187 @@
+package service
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+
+	"manager/internal/domain"
+	"manager/internal/shamir"
+)
+
+// A vault split into key shares is protected by a random secret instead of a password that someone
+// knows. The secret goes through the key derivation like any password, so every backend that can
+// change its password can be split.
+const (
+	secretSize  = 32
+	splitIDSize = 4
+)
+
+// Unseal adds a key share, the vault is unlocked once the threshold of shares is reached. The
+// collected shares are dropped after every attempt to combine them, successful or not.
+func (s *Service) Unseal(share string) (domain.UnsealProgress, error) {
+	s.unsealMutex.Lock()
+	defer s.unsealMutex.Unlock()
+
+	if !s.Sealed() {
+		return s.unsealProgress(), domain.ErrUnsealed
+	}
+
+	id, threshold, data, err := decodeShare(share)
+	if err != nil {
+		return s.unsealProgress(), err
+	}
+
+	if s.unsealID != nil && (!bytes.Equal(id, s.unsealID) || threshold != s.unsealThreshold) {
+		return s.unsealProgress(), fmt.Errorf("%w: the share belongs to another split than the ones given so far", domain.ErrInvalidShare)
+	}
+
+	for _, given := range s.unsealShares {
+		if given[len(given)-1] == data[len(data)-1] {
+			return s.unsealProgress(), fmt.Errorf("%w: the share was given already", domain.ErrInvalidShare)
+		}
+	}
+
+	s.unsealID = id
+	s.unsealThreshold = threshold
+	s.unsealShares = append(s.unsealShares, data)
+
+	if len(s.unsealShares) < threshold {
+		return s.unsealProgress(), nil
+	}
+
+	secret, err := shamir.Combine(s.unsealShares)
+	s.resetUnseal()
+
+	if err == nil {
+		err = s.Unlock(encodeSecret(secret))
+	}
+
+	return s.unsealProgress(), err
+}
+
+// ResetUnseal drops the key shares given so far.
+func (s *Service) ResetUnseal() {
+	s.unsealMutex.Lock()
+	defer s.unsealMutex.Unlock()
+
+	s.resetUnseal()
+}
+
+func (s *Service) UnsealProgress() domain.UnsealProgress {
+	s.unsealMutex.Lock()
+	defer s.unsealMutex.Unlock()
+
+	return s.unsealProgress()
+}
+
+func (s *Service) unsealProgress() domain.UnsealProgress {
+	return domain.UnsealProgress{
+		Sealed:    s.Sealed(),
+		Threshold: s.unsealThreshold,
+		Progress:  len(s.unsealShares),
+	}
+}
+
+func (s *Service) resetUnseal() {
+	s.unsealID = nil
+	s.unsealThreshold = 0
+	s.unsealShares = nil
+}
+
+// InitShares replaces the master password with a secret split into key shares, threshold of them
+// unseal the vault from then on.
+func (s *Service) InitShares(actor, password string, shares, threshold int) ([]string, error) {
+	return s.split(actor, password, shares, threshold)
+}
+
+// RekeyShares splits the vault again, with the threshold of the current shares. The shares of the
+// previous split no longer unseal it, together with an old copy of the vault they only open that.
+func (s *Service) RekeyShares(actor string, current []string, shares, threshold int) ([]string, error) {
+	var id []byte
+	var given [][]byte
+	var currentThreshold int
+
+	for _, share := range current {
+		shareID, shareThreshold, data, err := decodeShare(share)
+		if err != nil {
+			return nil, err
+		}
+
+		if id != nil && (!bytes.Equal(shareID, id) || shareThreshold != currentThreshold) {
+			return nil, fmt.Errorf("%w: the shares belong to different splits", domain.ErrInvalidShare)
+		}
+
+		id = shareID
+		currentThreshold = shareThreshold
+		given = append(given, data)
+	}
+
+	if len(given) < currentThreshold || len(given) == 0 {
+		return nil, fmt.Errorf("%w: %d of %d shares given", domain.ErrInvalidShare, len(given), currentThreshold)
+	}
+
+	secret, err := shamir.Combine(given)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", domain.ErrInvalidShare, err.Error())
+	}
+
+	return s.split(actor, encodeSecret(secret), shares, threshold)
+}
+
+func (s *Service) split(actor, current string, shares, threshold int) ([]string, error) {
+	secret := make([]byte, secretSize)
+	id := make([]byte, splitIDSize)
+
+	_, err := rand.Read(secret)
+	if err == nil {
+		_, err = rand.Read(id)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate secret: %s", err.Error())
+	}
+
+	split, err := shamir.Split(secret, shares, threshold)
+	if err != nil {
+		return nil, err
+	}
+
+	err = s.Rekey(actor, current, encodeSecret(secret))
+	if err != nil {
+		return nil, err
+	}
+
+	encoded := make([]string, len(split))
+	for i, share := range split {
+		encoded[i] = encodeShare(id, threshold, share)
+	}
+
+	return encoded, nil
+}
+
+func encodeSecret(secret []byte) string {
+	return base64.RawStdEncoding.EncodeToString(secret)
+}
+
+// encodeShare prefixes a share with the id of its split and the threshold, the id tells shares of
+// different splits apart before they are combined into a wrong secret.
+func encodeShare(id []byte, threshold int, share []byte) string {
+	data := append(append(id[:splitIDSize:splitIDSize], byte(threshold)), share...)
+
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+func decodeShare(share string) ([]byte, int, []byte, error) {
+	data, err := base64.RawURLEncoding.DecodeString(share)
+	if err != nil || len(data) != splitIDSize+1+secretSize+1 {
+		return nil, 0, nil, domain.ErrInvalidShare
+	}
+
+	threshold := int(data[splitIDSize])
+	if threshold < 2 || data[len(data)-1] == 0 {
+		return nil, 0, nil, domain.ErrInvalidShare
+	}
+
+	return data[:splitIDSize], threshold, data[splitIDSize+1:], nil
+}
@@ -0,0 +1,103 @@
+package service
+
+import (
+	"errors"
+	"testing"
+
+	"manager/internal/domain"
+)
+
+func unseal(t *testing.T, s *Service, shares []string) error {
+	t.Helper()
+
+	s.ResetUnseal()
+
+	var err error
+	for _, share := range shares {
+		_, err = s.Unseal(share)
+		if err != nil {
+			break
+		}
+	}
+
+	return err
+}
+
+func TestUnsealWithShares(t *testing.T) {
+	repo := newMemRepository("secret")
+	s := newTestService(t, repo)
+
+	shares, err := s.InitShares("test", "secret", 5, 3)
+	if err != nil {
+		t.Fatalf("InitShares: %s", err)
+	}
+
+	if err = s.Lock(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = s.Unlock("secret"); !errors.Is(err, domain.ErrWrongPassword) {
+		t.Fatalf("the master password still unlocks: %v", err)
+	}
+
+	if err = unseal(t, s, shares[:2]); err != nil || !s.Sealed() {
+		t.Fatalf("two of three shares: %v, sealed %v", err, s.Sealed())
+	}
+
+	if progress := s.UnsealProgress(); progress.Progress != 2 || progress.Threshold != 3 {
+		t.Fatalf("got progress %+v", progress)
+	}
+
+	if _, err = s.Unseal(shares[1]); !errors.Is(err, domain.ErrInvalidShare) {
+		t.Fatalf("the same share twice: got %v", err)
+	}
+
+	if err = unseal(t, s, shares[2:]); err != nil || s.Sealed() {
+		t.Fatalf("three shares: %v, sealed %v", err, s.Sealed())
+	}
+}
+
+func TestRekeyShares(t *testing.T) {
+	repo := newMemRepository("secret")
+	s := newTestService(t, repo)
+
+	shares, err := s.InitShares("test", "secret", 5, 3)
+	if err != nil {
+		t.Fatalf("InitShares: %s", err)
+	}
+
+	password := repo.password
+
+	for name, given := range map[string][]string{
+		"none":             nil,
+		"below threshold":  shares[:2],
+		"same share twice": {shares[0], shares[0], shares[1]},
+		"not a share":      {shares[0], shares[1], "share"},
+	} {
+		_, err = s.RekeyShares("test", given, 3, 2)
+		if !errors.Is(err, domain.ErrInvalidShare) {
+			t.Fatalf("%s: got %v", name, err)
+		}
+
+		if repo.password != password {
+			t.Fatalf("%s: the vault was split again", name)
+		}
+	}
+
+	rekeyed, err := s.RekeyShares("test", shares[2:], 3, 2)
+	if err != nil {
+		t.Fatalf("RekeyShares: %s", err)
+	}
+
+	if err = s.Lock(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = unseal(t, s, shares[:3]); !errors.Is(err, domain.ErrWrongPassword) {
+		t.Fatalf("the previous shares still unseal: %v", err)
+	}
+
+	if err = unseal(t, s, rekeyed[1:]); err != nil || s.Sealed() {
+		t.Fatalf("two of the new shares: %v, sealed %v", err, s.Sealed())
+	}
+}
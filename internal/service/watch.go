@@ -0,0 +1,65 @@
+package service
+
+import (
+	"context"
+	"log"
+	"time"
+)
+
+// reloader is implemented by backends that can pick up a storage file replaced on disk.
+type reloader interface {
+	Changed() bool
+	Reload() error
+}
+
+// RunWatcher polls the storage file and reloads it when another program replaced it, so the next
+// flush does not overwrite the new file with stale data.
+func (s *Service) RunWatcher(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if !s.changed() {
+				continue
+			}
+
+			err := s.reload()
+			if err != nil {
+				log.Printf("failed to reload storage: %s", err.Error())
+			}
+		}
+	}
+}
+
+// changed looks at the storage that is open, which is the decoy for the duress password.
+func (s *Service) changed() bool {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	r, ok := s.repo.(reloader)
+
+	return ok && !s.sealed && r.Changed()
+}
+
+func (s *Service) reload() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	r, ok := s.repo.(reloader)
+	if !ok || s.sealed {
+		return nil
+	}
+
+	err := r.Reload()
+
+	// changes applied again on top of the new file are written by the persister
+	s.markDirty()
+
+	s.recordExternal("reload")
+
+	return err
+}
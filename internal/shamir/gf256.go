@@ -0,0 +1,42 @@
+package shamir
+
+// Arithmetic in GF(2^8) with the polynomial x^8 + x^4 + x^3 + x + 1 of AES. Addition is xor,
+// multiplication and division go through the logarithms to the generator 3.
+var (
+	expTable [255]byte
+	logTable [256]byte
+)
+
+func init() {
+	x := byte(1)
+
+	for i := range expTable {
+		expTable[i] = x
+		logTable[x] = byte(i)
+
+		// multiply by 3: x * 2 reduced by the polynomial, plus x
+		double := x << 1
+		if x&0x80 != 0 {
+			double ^= 0x1b
+		}
+
+		x ^= double
+	}
+}
+
+func mul(a, b byte) byte {
+	if a == 0 || b == 0 {
+		return 0
+	}
+
+	return expTable[(int(logTable[a])+int(logTable[b]))%255]
+}
+
+// div divides by b, which must not be zero.
+func div(a, b byte) byte {
+	if a == 0 {
+		return 0
+	}
+
+	return expTable[(int(logTable[a])-int(logTable[b])+255)%255]
+}
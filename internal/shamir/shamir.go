@@ -0,0 +1,112 @@
+package shamir
+
+import (
+	"crypto/rand"
+	"errors"
+	"fmt"
+)
+
+var (
+	ErrInvalidParams = errors.New("threshold must be between 2 and the number of shares, at most 255")
+	ErrInvalidShares = errors.New("shares do not belong together")
+)
+
+// Split divides the secret into n shares, any threshold of which give it back with Combine. Every
+// share is the secret sized value of a random polynomial over GF(2^8) for each byte, followed by
+// the point it was evaluated at.
+func Split(secret []byte, n, threshold int) ([][]byte, error) {
+	if threshold < 2 || threshold > n || n > 255 {
+		return nil, ErrInvalidParams
+	}
+
+	if len(secret) == 0 {
+		return nil, fmt.Errorf("secret is empty")
+	}
+
+	shares := make([][]byte, n)
+	for i := range shares {
+		shares[i] = make([]byte, len(secret)+1)
+		shares[i][len(secret)] = byte(i + 1)
+	}
+
+	coefficients := make([]byte, threshold-1)
+
+	for b, constant := range secret {
+		_, err := rand.Read(coefficients)
+		if err != nil {
+			return nil, fmt.Errorf("failed to generate coefficients: %s", err.Error())
+		}
+
+		for _, share := range shares {
+			share[b] = evaluate(constant, coefficients, share[len(secret)])
+		}
+	}
+
+	return shares, nil
+}
+
+// Combine interpolates the secret from shares made by Split. Too few shares give a wrong secret,
+// which cannot be told from the right one here.
+func Combine(shares [][]byte) ([]byte, error) {
+	if len(shares) < 2 {
+		return nil, ErrInvalidShares
+	}
+
+	size := len(shares[0])
+	if size < 2 {
+		return nil, ErrInvalidShares
+	}
+
+	xs := make([]byte, len(shares))
+	seen := make(map[byte]bool)
+
+	for i, share := range shares {
+		if len(share) != size {
+			return nil, ErrInvalidShares
+		}
+
+		x := share[size-1]
+		if x == 0 || seen[x] {
+			return nil, ErrInvalidShares
+		}
+
+		seen[x] = true
+		xs[i] = x
+	}
+
+	secret := make([]byte, size-1)
+
+	for b := range secret {
+		var value byte
+
+		// lagrange interpolation at zero
+		for i, share := range shares {
+			basis := byte(1)
+
+			for j, x := range xs {
+				if j == i {
+					continue
+				}
+
+				basis = mul(basis, div(x, x^xs[i]))
+			}
+
+			value ^= mul(share[b], basis)
+		}
+
+		secret[b] = value
+	}
+
+	return secret, nil
+}
+
+// evaluate computes the polynomial with the constant and coefficients at x by Horner's method.
+func evaluate(constant byte, coefficients []byte, x byte) byte {
+	var y byte
+
+	for i := len(coefficients) - 1; i >= 0; i-- {
+		y = mul(y, x) ^ coefficients[i]
+	}
+
+	return mul(y, x) ^ constant
+}
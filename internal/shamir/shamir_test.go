@@ -0,0 +1,101 @@
+package shamir
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+)
+
+func TestField(t *testing.T) {
+	// from the multiplication example of FIPS 197
+	if got := mul(0x57, 0x83); got != 0xc1 {
+		t.Fatalf("0x57 * 0x83: got %#x, want 0xc1", got)
+	}
+
+	for a := 1; a < 256; a++ {
+		for b := 1; b < 256; b++ {
+			if got := div(mul(byte(a), byte(b)), byte(b)); got != byte(a) {
+				t.Fatalf("%d * %d / %d: got %d", a, b, b, got)
+			}
+		}
+	}
+}
+
+func TestSplitCombine(t *testing.T) {
+	secret := []byte("correct horse battery staple")
+
+	for _, tc := range []struct{ n, threshold int }{{2, 2}, {3, 2}, {5, 3}, {10, 10}, {255, 4}} {
+		shares, err := Split(secret, tc.n, tc.threshold)
+		if err != nil {
+			t.Fatalf("%d of %d: %s", tc.threshold, tc.n, err)
+		}
+
+		if len(shares) != tc.n {
+			t.Fatalf("%d of %d: got %d shares", tc.threshold, tc.n, len(shares))
+		}
+
+		// every window of threshold shares, and all of them, give the secret back
+		for start := 0; start+tc.threshold <= tc.n; start += tc.threshold {
+			got, err := Combine(shares[start : start+tc.threshold])
+			if err != nil || !bytes.Equal(got, secret) {
+				t.Fatalf("%d of %d from %d: got %q, %v", tc.threshold, tc.n, start, got, err)
+			}
+		}
+
+		got, err := Combine(shares)
+		if err != nil || !bytes.Equal(got, secret) {
+			t.Fatalf("%d of %d, all shares: got %q, %v", tc.threshold, tc.n, got, err)
+		}
+
+		// fewer shares give something else
+		if tc.threshold > 2 {
+			got, err := Combine(shares[:tc.threshold-1])
+			if err != nil || bytes.Equal(got, secret) {
+				t.Fatalf("%d of %d, one share short: got the secret", tc.threshold, tc.n)
+			}
+		}
+	}
+}
+
+func TestSplitInvalid(t *testing.T) {
+	for _, tc := range []struct{ n, threshold int }{{3, 1}, {2, 3}, {256, 2}} {
+		_, err := Split([]byte("secret"), tc.n, tc.threshold)
+		if !errors.Is(err, ErrInvalidParams) {
+			t.Fatalf("%d of %d: got %v", tc.threshold, tc.n, err)
+		}
+	}
+
+	_, err := Split(nil, 3, 2)
+	if err == nil {
+		t.Fatal("split an empty secret")
+	}
+}
+
+func TestCombineInvalid(t *testing.T) {
+	shares, err := Split([]byte("secret"), 3, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	other, err := Split([]byte("longer secret"), 3, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	zero := append([]byte(nil), shares[1]...)
+	zero[len(zero)-1] = 0
+
+	for name, given := range map[string][][]byte{
+		"one share":   shares[:1],
+		"duplicate x": {shares[0], shares[0]},
+		"zero x":      {shares[0], zero},
+		"other size":  {shares[0], other[1]},
+		"empty share": {{}, {}},
+		"no shares":   nil,
+	} {
+		_, err := Combine(given)
+		if !errors.Is(err, ErrInvalidShares) {
+			t.Fatalf("%s: got %v", name, err)
+		}
+	}
+}
@@ -0,0 +1,292 @@
+package vault
+
+import (
+	"crypto/ecdh"
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"strings"
+
+	"manager/internal/secmem"
+)
+
+// Recovery slots wrap the data key under one-time recovery codes and an optional recovery key that
+// is meant to be kept offline. A code starts with the id of its slot, so opening one takes a single
+// key derivation. The code derives an X25519 key pair and the slot holds the data key sealed to its
+// public key, so a rotated data key is sealed to the slots left without knowing their codes.
+const (
+	groupSize         = 5
+	codeGroups        = 4
+	recoveryKeyGroups = 10
+	alphabet          = "ABCDEFGHIJKLMNOPQRSTUVWXYZ234567"
+)
+
+var ErrInvalidCode = errors.New("invalid recovery code")
+
+type recoverySlot struct {
+	ID string `json:"id"`
+	// Key marks the slot of the recovery key, it is not used up like the codes
+	Key     bool      `json:"key,omitempty"`
+	KDF     KDFParams `json:"kdf"`
+	Salt    []byte    `json:"salt"`
+	DataKey []byte    `json:"data_key"`
+
+	// Public is the key the data key is sealed to, with the Ephemeral key of the sender
+	Public    []byte `json:"public,omitempty"`
+	Ephemeral []byte `json:"ephemeral,omitempty"`
+}
+
+// WithRecovery returns the key with new recovery slots in place of the ones it has: count one-time
+// codes, and a recovery key when withKey is set. The codes and the key are formatted for printing
+// and derived with the parameters of the password slot.
+func (k *Key) WithRecovery(count int, withKey bool) (*Key, []string, string, error) {
+	next := &Key{
+		dataKey:  k.dataKey,
+		header:   k.header,
+		previous: k.previous,
+	}
+	next.header.Recovery = nil
+
+	codes := make([]string, 0, count)
+
+	for i := 0; i < count; i++ {
+		code, slot, err := newRecovery(k.dataKey, codeGroups, false, k.header.KDF)
+		if err != nil {
+			return nil, nil, "", err
+		}
+
+		codes = append(codes, code)
+		next.header.Recovery = append(next.header.Recovery, slot)
+	}
+
+	var recoveryKey string
+
+	if withKey {
+		code, slot, err := newRecovery(k.dataKey, recoveryKeyGroups, true, k.header.KDF)
+		if err != nil {
+			return nil, nil, "", err
+		}
+
+		recoveryKey = code
+		next.header.Recovery = append(next.header.Recovery, slot)
+	}
+
+	return next, codes, recoveryKey, nil
+}
+
+// Recovery tells how many recovery codes are left and whether there is a recovery key.
+func (k *Key) Recovery() (int, bool) {
+	codes := 0
+	key := false
+
+	for _, slot := range k.header.Recovery {
+		if slot.Key {
+			key = true
+		} else {
+			codes++
+		}
+	}
+
+	return codes, key
+}
+
+// DecryptRecovery opens a vault file with a recovery code or the recovery key. The slot of a code is
+// dropped from the returned key, so it is used up once the key is written.
+func DecryptRecovery(data, code []byte) (*Key, []byte, error) {
+	h, ad, body, err := parse(data)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	key, err := unlockRecovery(h, code)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	plaintext, err := openBody(key.dataKey, h, ad, body)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return key, plaintext, nil
+}
+
+// UnlockSlotRecovery opens a slot returned by Slot with a recovery code, like DecryptRecovery.
+func UnlockSlotRecovery(slot, code []byte) (*Key, error) {
+	h, err := parseSlot(slot)
+	if err != nil {
+		return nil, err
+	}
+
+	return unlockRecovery(h, code)
+}
+
+func unlockRecovery(h header, code []byte) (*Key, error) {
+	normalized := normalizeCode(code)
+	if len(normalized) <= groupSize {
+		return nil, ErrInvalidCode
+	}
+
+	for i, slot := range h.Recovery {
+		if slot.ID != string(normalized[:groupSize]) {
+			continue
+		}
+
+		kek, err := slot.kek(deriveKey(normalized, slot.Salt, slot.KDF))
+		if err != nil {
+			return nil, ErrInvalidCode
+		}
+
+		dataKey, err := unwrap(kek, slot.DataKey)
+		if err != nil {
+			return nil, ErrInvalidCode
+		}
+
+		if !slot.Key {
+			h.Recovery = append(h.Recovery[:i:i], h.Recovery[i+1:]...)
+		}
+
+		return openKey(dataKey, h)
+	}
+
+	return nil, ErrInvalidCode
+}
+
+// rotateRecovery seals a new data key to the recovery slots.
+func rotateRecovery(slots []recoverySlot, dataKey []byte) ([]recoverySlot, error) {
+	var rotated []recoverySlot
+
+	for _, slot := range slots {
+		err := slot.seal(dataKey)
+		if err != nil {
+			return nil, err
+		}
+
+		rotated = append(rotated, slot)
+	}
+
+	return rotated, nil
+}
+
+// seal wraps the data key for the public key of the slot under a fresh ephemeral key.
+func (s *recoverySlot) seal(dataKey []byte) error {
+	public, err := ecdh.X25519().NewPublicKey(s.Public)
+	if err != nil {
+		return fmt.Errorf("%w: invalid recovery slot %s", ErrCorrupted, s.ID)
+	}
+
+	ephemeral, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return fmt.Errorf("failed to generate ephemeral key: %s", err.Error())
+	}
+
+	shared, err := ephemeral.ECDH(public)
+	if err != nil {
+		return fmt.Errorf("%w: invalid recovery slot %s", ErrCorrupted, s.ID)
+	}
+
+	s.Ephemeral = ephemeral.PublicKey().Bytes()
+
+	kek := slotKEK(shared, s.Ephemeral, s.Public)
+	s.DataKey, err = seal(kek, dataKey, nil)
+	secmem.Zero(kek)
+	if err != nil {
+		return fmt.Errorf("failed to wrap data key: %s", err.Error())
+	}
+
+	return nil
+}
+
+// kek returns the key the data key is wrapped under from the private key derived from the code.
+func (s *recoverySlot) kek(private []byte) ([]byte, error) {
+	defer secmem.Zero(private)
+
+	key, err := ecdh.X25519().NewPrivateKey(private)
+	if err != nil {
+		return nil, err
+	}
+
+	ephemeral, err := ecdh.X25519().NewPublicKey(s.Ephemeral)
+	if err != nil {
+		return nil, err
+	}
+
+	shared, err := key.ECDH(ephemeral)
+	if err != nil {
+		return nil, err
+	}
+
+	return slotKEK(shared, s.Ephemeral, s.Public), nil
+}
+
+func slotKEK(shared, ephemeral, public []byte) []byte {
+	defer secmem.Zero(shared)
+
+	h := sha256.New()
+	h.Write([]byte("manager recovery slot"))
+	h.Write(shared)
+	h.Write(ephemeral)
+	h.Write(public)
+
+	return h.Sum(nil)
+}
+
+func newRecovery(dataKey []byte, groups int, key bool, params KDFParams) (string, recoverySlot, error) {
+	chars := make([]byte, (groups+1)*groupSize)
+	if _, err := rand.Read(chars); err != nil {
+		return "", recoverySlot{}, fmt.Errorf("failed to generate recovery code: %s", err.Error())
+	}
+
+	// 256 is a multiple of the alphabet size, so every character is equally likely
+	for i, b := range chars {
+		chars[i] = alphabet[int(b)%len(alphabet)]
+	}
+
+	salt := make([]byte, saltSize)
+	if _, err := rand.Read(salt); err != nil {
+		return "", recoverySlot{}, fmt.Errorf("failed to generate salt: %s", err.Error())
+	}
+
+	private := deriveKey(chars, salt, params)
+	pair, err := ecdh.X25519().NewPrivateKey(private)
+	secmem.Zero(private)
+	if err != nil {
+		return "", recoverySlot{}, fmt.Errorf("failed to derive recovery key pair: %s", err.Error())
+	}
+
+	slot := recoverySlot{
+		ID:     string(chars[:groupSize]),
+		Key:    key,
+		KDF:    params,
+		Salt:   salt,
+		Public: pair.PublicKey().Bytes(),
+	}
+
+	err = slot.seal(dataKey)
+	if err != nil {
+		return "", recoverySlot{}, err
+	}
+
+	parts := make([]string, 0, groups+1)
+	for i := 0; i < len(chars); i += groupSize {
+		parts = append(parts, string(chars[i:i+groupSize]))
+	}
+
+	return strings.Join(parts, "-"), slot, nil
+}
+
+// normalizeCode accepts codes typed in lower case, without dashes or with spaces.
+func normalizeCode(code []byte) []byte {
+	normalized := make([]byte, 0, len(code))
+
+	for _, c := range strings.ToUpper(string(code)) {
+		if c == '-' || c == ' ' {
+			continue
+		}
+
+		normalized = append(normalized, byte(c))
+	}
+
+	return normalized
+}
@@ -0,0 +1,69 @@
+package vault
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestRecoveryCodes(t *testing.T) {
+	key, codes, recoveryKey, err := newTestKey(t, "secret").WithRecovery(3, true)
+	if err != nil {
+		t.Fatalf("WithRecovery: %s", err)
+	}
+
+	if n, withKey := key.Recovery(); n != 3 || !withKey || len(codes) != 3 || recoveryKey == "" {
+		t.Fatalf("got %d codes and key %v", n, withKey)
+	}
+
+	data := encrypt(t, key, []byte("records"))
+
+	_, _, err = DecryptRecovery(data, []byte("AAAAA-BBBBB-CCCCC-DDDDD-EEEEE"))
+	if !errors.Is(err, ErrInvalidCode) {
+		t.Fatalf("unknown code: got %v", err)
+	}
+
+	// a code is accepted as typed, in lower case and without dashes
+	typed := strings.ToLower(strings.ReplaceAll(codes[0], "-", " "))
+
+	opened, plaintext, err := DecryptRecovery(data, []byte(typed))
+	if err != nil || !bytes.Equal(plaintext, []byte("records")) {
+		t.Fatalf("DecryptRecovery: %v", err)
+	}
+
+	if n, _ := opened.Recovery(); n != 2 {
+		t.Fatalf("the used code is still there, %d codes left", n)
+	}
+
+	rotated, err := opened.Rotate([]byte("new"), testKDF)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data = encrypt(t, rotated, []byte("rotated"))
+
+	_, _, err = DecryptRecovery(data, []byte(codes[0]))
+	if !errors.Is(err, ErrInvalidCode) {
+		t.Fatalf("used code: got %v", err)
+	}
+
+	for _, code := range []string{codes[1], codes[2], recoveryKey, recoveryKey} {
+		opened, plaintext, err := DecryptRecovery(data, []byte(code))
+		if err != nil || string(plaintext) != "rotated" {
+			t.Fatalf("code after rotation: %v", err)
+		}
+
+		data = encrypt(t, opened, plaintext)
+	}
+
+	// the recovery key is not used up
+	if n, withKey := key.Recovery(); n != 3 || !withKey {
+		t.Fatalf("the original key changed: %d codes, key %v", n, withKey)
+	}
+
+	_, plaintext, err = DecryptRecovery(data, []byte(recoveryKey))
+	if err != nil || string(plaintext) != "rotated" {
+		t.Fatalf("recovery key used again: %v", err)
+	}
+}
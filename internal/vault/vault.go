@@ -0,0 +1,578 @@
+package vault
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/chacha20poly1305"
+
+	"manager/internal/secmem"
+)
+
+// File layout:
+//
+//	magic "MGRV" | version (1 byte) | header length (uint32, big endian) | header (JSON) | body
+//
+// The body is the plaintext split into chunks of chunkSize bytes, each sealed with
+// XChaCha20-Poly1305 under the data key. The nonce of every chunk is the stream nonce
+// from the header followed by the chunk counter and a last-chunk flag, and the whole
+// prefix up to the end of the header is used as additional data.
+const (
+	magic      = "MGRV"
+	version1   = 1
+	prefixSize = len(magic) + 1 + 4
+
+	keySize         = chacha20poly1305.KeySize
+	saltSize        = 16
+	streamNonceSize = 16
+	chunkSize       = 64 * 1024
+	overhead        = chacha20poly1305.Overhead
+
+	// the key derivation parameters are read before anything is authenticated, these bounds keep
+	// a crafted header from crashing the process or exhausting its memory
+	maxKDFTime   = 64
+	maxKDFMemory = 1024 * 1024
+)
+
+var (
+	ErrWrongPassword = errors.New("wrong master password")
+	ErrCorrupted     = errors.New("vault file is corrupted")
+	ErrNotEncrypted  = errors.New("file is not an encrypted vault")
+)
+
+type KDFParams struct {
+	Time    uint32 `json:"time"`
+	Memory  uint32 `json:"memory"`
+	Threads uint8  `json:"threads"`
+}
+
+type header struct {
+	KDF     KDFParams `json:"kdf"`
+	Salt    []byte    `json:"salt"`
+	DataKey []byte    `json:"data_key"`
+	Nonce   []byte    `json:"nonce,omitempty"`
+
+	// Previous holds the data keys replaced by rotations, sealed under the data key
+	Previous []byte `json:"previous,omitempty"`
+
+	Recovery []recoverySlot `json:"recovery,omitempty"`
+}
+
+// Key is an unlocked vault: the data key together with the password slot that wraps it. The data
+// key is kept in locked memory, a Key is unusable once the vault is locked and the memory wiped.
+type Key struct {
+	dataKey []byte
+	header  header
+
+	// previous are the data keys before the rotations, newest first
+	previous [][]byte
+}
+
+func NewKey(password []byte, params KDFParams) (*Key, error) {
+	dataKey := secmem.Alloc(keySize)
+	if _, err := rand.Read(dataKey); err != nil {
+		return nil, fmt.Errorf("failed to generate data key: %s", err.Error())
+	}
+
+	return wrap(dataKey, password, params)
+}
+
+// Upgrade returns the key rotated to a password slot made with params when its own slot is
+// cheaper, and nil when it is not. The new data key keeps copies that still hold the cheaper slot,
+// like the previous generation of a file, a backup or pages a database has not reused yet, from
+// reaching anything written from then on.
+func (k *Key) Upgrade(password []byte, params KDFParams) (*Key, error) {
+	if !k.KDF().Weaker(params) {
+		return nil, nil
+	}
+
+	return k.Rotate(password, params)
+}
+
+// Rotate returns a key with a new data key in a new password slot. Copies of the vault made
+// before, like the previous generation of a file or a backup, stay readable with the old password
+// but only reach the old data key. The key keeps the old data keys sealed under the new one, so
+// versions in the history still open with it. Recovery slots are carried over to the new data key.
+func (k *Key) Rotate(password []byte, params KDFParams) (*Key, error) {
+	key, err := NewKey(password, params)
+	if err != nil {
+		return nil, err
+	}
+
+	key.previous = append([][]byte{k.dataKey}, k.previous...)
+
+	previous := make([]byte, 0, len(key.previous)*keySize)
+	for _, dataKey := range key.previous {
+		previous = append(previous, dataKey...)
+	}
+
+	key.header.Previous, err = seal(key.dataKey, previous, nil)
+	secmem.Zero(previous)
+	if err != nil {
+		return nil, fmt.Errorf("failed to seal previous data keys: %s", err.Error())
+	}
+
+	key.header.Recovery, err = rotateRecovery(k.header.Recovery, key.dataKey)
+	if err != nil {
+		return nil, err
+	}
+
+	return key, nil
+}
+
+// Verify checks the password against the password slot of the key.
+func (k *Key) Verify(password []byte) error {
+	_, err := unlock(k.header, password)
+
+	return err
+}
+
+// KDF returns the key derivation parameters of the password slot.
+func (k *Key) KDF() KDFParams {
+	return k.header.KDF
+}
+
+// Validate checks the parameters against the bounds accepted from a file.
+func (p KDFParams) Validate() error {
+	if p.Time == 0 || p.Time > maxKDFTime || p.Threads == 0 || p.Memory < 8*uint32(p.Threads) || p.Memory > maxKDFMemory {
+		return fmt.Errorf("key derivation parameters out of range: time %d, memory %d KiB, threads %d", p.Time, p.Memory, p.Threads)
+	}
+
+	return nil
+}
+
+// Weaker reports whether the parameters cost less time or memory than q. The threads only change
+// how the cost is spread, they do not count.
+func (p KDFParams) Weaker(q KDFParams) bool {
+	return p.Time < q.Time || p.Memory < q.Memory
+}
+
+func wrap(dataKey, password []byte, params KDFParams) (*Key, error) {
+	salt := make([]byte, saltSize)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, fmt.Errorf("failed to generate salt: %s", err.Error())
+	}
+
+	kek := deriveKey(password, salt, params)
+	wrapped, err := seal(kek, dataKey, nil)
+	secmem.Zero(kek)
+	if err != nil {
+		return nil, fmt.Errorf("failed to wrap data key: %s", err.Error())
+	}
+
+	return &Key{
+		dataKey: dataKey,
+		header: header{
+			KDF:     params,
+			Salt:    salt,
+			DataKey: wrapped,
+		},
+	}, nil
+}
+
+func IsEncrypted(data []byte) bool {
+	return bytes.HasPrefix(data, []byte(magic))
+}
+
+// Encrypt seals plaintext into a complete vault file. A fresh stream nonce is used on every call.
+func (k *Key) Encrypt(plaintext []byte) ([]byte, error) {
+	h := k.header
+	h.Nonce = make([]byte, streamNonceSize)
+	if _, err := rand.Read(h.Nonce); err != nil {
+		return nil, fmt.Errorf("failed to generate nonce: %s", err.Error())
+	}
+
+	headerJSON, err := json.Marshal(h)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal header: %s", err.Error())
+	}
+
+	aead, err := chacha20poly1305.NewX(k.dataKey)
+	if err != nil {
+		return nil, err
+	}
+
+	chunks := (len(plaintext) + chunkSize - 1) / chunkSize
+	if chunks == 0 {
+		chunks = 1
+	}
+
+	out := make([]byte, 0, prefixSize+len(headerJSON)+len(plaintext)+chunks*overhead)
+	out = append(out, magic...)
+	out = append(out, version1)
+	out = binary.BigEndian.AppendUint32(out, uint32(len(headerJSON)))
+	out = append(out, headerJSON...)
+	ad := out[:len(out):len(out)]
+
+	for i := 0; i < chunks; i++ {
+		end := (i + 1) * chunkSize
+		if end > len(plaintext) {
+			end = len(plaintext)
+		}
+
+		out = aead.Seal(out, chunkNonce(h.Nonce, uint64(i), i == chunks-1), plaintext[i*chunkSize:end], ad)
+	}
+
+	return out, nil
+}
+
+// Decrypt opens a vault file with the master password. ErrWrongPassword is returned only when
+// the password slot cannot be opened, any damage to the body is reported as ErrCorrupted.
+func Decrypt(data, password []byte) (*Key, []byte, error) {
+	h, ad, body, err := parse(data)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	key, err := unlock(h, password)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	plaintext, err := openBody(key.dataKey, h, ad, body)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return key, plaintext, nil
+}
+
+// UnlockHeader opens the password slot in the header of a vault file without reading the body,
+// to tell whether the password is the one of the file.
+func UnlockHeader(data, password []byte) (*Key, error) {
+	h, _, _, err := parse(data)
+	if err != nil {
+		return nil, err
+	}
+
+	return unlock(h, password)
+}
+
+// Decrypt opens a vault file encrypted under the same data key or one it was rotated from without
+// the password, such as a copy of the vault written by another process. A file under another data
+// key fails like a corrupted one.
+func (k *Key) Decrypt(data []byte) ([]byte, error) {
+	h, ad, body, err := parse(data)
+	if err != nil {
+		return nil, err
+	}
+
+	plaintext, err := openBody(k.dataKey, h, ad, body)
+
+	for _, dataKey := range k.previous {
+		if err == nil {
+			break
+		}
+
+		plaintext, err = openBody(dataKey, h, ad, body)
+	}
+
+	return plaintext, err
+}
+
+func openBody(dataKey []byte, h header, ad, body []byte) ([]byte, error) {
+	aead, err := chacha20poly1305.NewX(dataKey)
+	if err != nil {
+		return nil, err
+	}
+
+	plaintext := make([]byte, 0, len(body))
+
+	for i := uint64(0); ; i++ {
+		size := chunkSize + overhead
+		last := len(body) <= size
+		if last {
+			size = len(body)
+		}
+
+		plaintext, err = aead.Open(plaintext, chunkNonce(h.Nonce, i, last), body[:size], ad)
+		if err != nil {
+			return nil, fmt.Errorf("%w: chunk %d failed authentication", ErrCorrupted, i)
+		}
+
+		body = body[size:]
+		if last {
+			break
+		}
+	}
+
+	return plaintext, nil
+}
+
+// DecryptPartial opens every chunk that still authenticates and returns the runs of consecutive
+// good chunks, so records can be salvaged from a damaged file.
+func DecryptPartial(data, password []byte) (*Key, [][]byte, error) {
+	h, ad, body, err := parse(data)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	key, err := unlock(h, password)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	aead, err := chacha20poly1305.NewX(key.dataKey)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var segments [][]byte
+	var segment []byte
+
+	for i := uint64(0); len(body) > 0; i++ {
+		size := chunkSize + overhead
+		last := len(body) <= size
+		if last {
+			size = len(body)
+		}
+
+		chunk, err := aead.Open(nil, chunkNonce(h.Nonce, i, last), body[:size], ad)
+		if err != nil && last {
+			// a truncated file loses the last-chunk flag
+			chunk, err = aead.Open(nil, chunkNonce(h.Nonce, i, false), body[:size], ad)
+		}
+
+		if err == nil {
+			segment = append(segment, chunk...)
+		} else if segment != nil {
+			segments = append(segments, segment)
+			segment = nil
+		}
+
+		body = body[size:]
+	}
+
+	if segment != nil {
+		segments = append(segments, segment)
+	}
+
+	return key, segments, nil
+}
+
+// CheckHeader validates the file structure that can be checked without the password.
+func CheckHeader(data []byte) error {
+	_, _, _, err := parse(data)
+
+	return err
+}
+
+func parse(data []byte) (header, []byte, []byte, error) {
+	if !IsEncrypted(data) {
+		return header{}, nil, nil, ErrNotEncrypted
+	}
+
+	if len(data) < prefixSize {
+		return header{}, nil, nil, fmt.Errorf("%w: truncated header", ErrCorrupted)
+	}
+
+	if data[len(magic)] != version1 {
+		return header{}, nil, nil, fmt.Errorf("unsupported vault version %d", data[len(magic)])
+	}
+
+	headerLen := int(binary.BigEndian.Uint32(data[len(magic)+1:]))
+	if headerLen > len(data)-prefixSize {
+		return header{}, nil, nil, fmt.Errorf("%w: truncated header", ErrCorrupted)
+	}
+
+	var h header
+
+	err := json.Unmarshal(data[prefixSize:prefixSize+headerLen], &h)
+	if err != nil {
+		return header{}, nil, nil, fmt.Errorf("%w: invalid header: %s", ErrCorrupted, err.Error())
+	}
+
+	if len(h.Salt) != saltSize || len(h.Nonce) != streamNonceSize {
+		return header{}, nil, nil, fmt.Errorf("%w: invalid header", ErrCorrupted)
+	}
+
+	err = h.validate()
+	if err != nil {
+		return header{}, nil, nil, err
+	}
+
+	end := prefixSize + headerLen
+
+	return h, data[:end:end], data[end:], nil
+}
+
+func unlock(h header, password []byte) (*Key, error) {
+	dataKey, err := unwrap(deriveKey(password, h.Salt, h.KDF), h.DataKey)
+	if err != nil {
+		return nil, ErrWrongPassword
+	}
+
+	return openKey(dataKey, h)
+}
+
+// openKey returns the key of a header whose data key has been unwrapped.
+func openKey(dataKey []byte, h header) (*Key, error) {
+	h.Nonce = nil
+
+	key := &Key{
+		dataKey: dataKey,
+		header:  h,
+	}
+
+	if h.Previous == nil {
+		return key, nil
+	}
+
+	previous, err := open(dataKey, h.Previous, nil)
+	if err != nil || len(previous)%keySize != 0 {
+		return nil, fmt.Errorf("%w: invalid previous data keys", ErrCorrupted)
+	}
+	defer secmem.Zero(previous)
+
+	for i := 0; i < len(previous); i += keySize {
+		key.previous = append(key.previous, secmem.Copy(previous[i:i+keySize]))
+	}
+
+	return key, nil
+}
+
+// unwrap opens a wrapped data key into locked memory and wipes the key encryption key.
+func unwrap(kek, wrapped []byte) ([]byte, error) {
+	dataKey, err := open(kek, wrapped, nil)
+	secmem.Zero(kek)
+	if err != nil {
+		return nil, err
+	}
+	defer secmem.Zero(dataKey)
+
+	return secmem.Copy(dataKey), nil
+}
+
+func deriveKey(password, salt []byte, params KDFParams) []byte {
+	return argon2.IDKey(password, salt, params.Time, params.Memory, params.Threads, keySize)
+}
+
+func chunkNonce(prefix []byte, counter uint64, last bool) []byte {
+	nonce := make([]byte, chacha20poly1305.NonceSizeX)
+	copy(nonce, prefix)
+
+	var c [8]byte
+	binary.BigEndian.PutUint64(c[:], counter)
+	copy(nonce[streamNonceSize:], c[1:])
+
+	if last {
+		nonce[len(nonce)-1] = 1
+	}
+
+	return nonce
+}
+
+func seal(key, plaintext, ad []byte) ([]byte, error) {
+	aead, err := chacha20poly1305.NewX(key)
+	if err != nil {
+		return nil, err
+	}
+
+	nonce := make([]byte, aead.NonceSize(), aead.NonceSize()+len(plaintext)+aead.Overhead())
+	if _, err = rand.Read(nonce); err != nil {
+		return nil, err
+	}
+
+	return aead.Seal(nonce, nonce, plaintext, ad), nil
+}
+
+func open(key, ciphertext, ad []byte) ([]byte, error) {
+	aead, err := chacha20poly1305.NewX(key)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(ciphertext) < aead.NonceSize() {
+		return nil, errors.New("ciphertext too short")
+	}
+
+	return aead.Open(nil, ciphertext[:aead.NonceSize()], ciphertext[aead.NonceSize():], ad)
+}
+
+// Seal encrypts a small standalone message, such as a journal entry, under the data key.
+func (k *Key) Seal(plaintext, ad []byte) ([]byte, error) {
+	return seal(k.dataKey, plaintext, ad)
+}
+
+func (k *Key) Open(ciphertext, ad []byte) ([]byte, error) {
+	plaintext, err := open(k.dataKey, ciphertext, ad)
+	if err != nil {
+		return nil, ErrCorrupted
+	}
+
+	return plaintext, nil
+}
+
+// MAC authenticates data kept in the clear under a key derived from the data key.
+func (k *Key) MAC(message []byte) []byte {
+	derive := hmac.New(sha256.New, k.dataKey)
+	derive.Write([]byte("manager record signature"))
+
+	mac := hmac.New(sha256.New, derive.Sum(nil))
+	mac.Write(message)
+
+	return mac.Sum(nil)
+}
+
+// Slot returns the password slot of the key, for storages that keep it outside of a vault file.
+func (k *Key) Slot() ([]byte, error) {
+	h := k.header
+	h.Nonce = nil
+
+	slot, err := json.Marshal(h)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal key slot: %s", err.Error())
+	}
+
+	return slot, nil
+}
+
+// UnlockSlot opens a password slot returned by Slot.
+func UnlockSlot(slot, password []byte) (*Key, error) {
+	h, err := parseSlot(slot)
+	if err != nil {
+		return nil, err
+	}
+
+	return unlock(h, password)
+}
+
+func parseSlot(slot []byte) (header, error) {
+	var h header
+
+	err := json.Unmarshal(slot, &h)
+	if err != nil || len(h.Salt) != saltSize {
+		return header{}, fmt.Errorf("%w: invalid key slot", ErrCorrupted)
+	}
+
+	err = h.validate()
+	if err != nil {
+		return header{}, err
+	}
+
+	return h, nil
+}
+
+// validate checks the key derivation parameters of every slot.
+func (h header) validate() error {
+	err := h.KDF.Validate()
+	if err != nil {
+		return fmt.Errorf("%w: %s", ErrCorrupted, err.Error())
+	}
+
+	for _, slot := range h.Recovery {
+		err = slot.KDF.Validate()
+		if err != nil {
+			return fmt.Errorf("%w: recovery slot %s: %s", ErrCorrupted, slot.ID, err.Error())
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,306 @@
+package vault
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"testing"
+)
+
+var testKDF = KDFParams{Time: 1, Memory: 64, Threads: 1}
+
+func newTestKey(t *testing.T, password string) *Key {
+	t.Helper()
+
+	key, err := NewKey([]byte(password), testKDF)
+	if err != nil {
+		t.Fatalf("NewKey: %s", err)
+	}
+
+	return key
+}
+
+func encrypt(t *testing.T, key *Key, plaintext []byte) []byte {
+	t.Helper()
+
+	data, err := key.Encrypt(plaintext)
+	if err != nil {
+		t.Fatalf("Encrypt: %s", err)
+	}
+
+	return data
+}
+
+// rewriteHeader changes the header of a vault file and fixes up its length, the body then no
+// longer authenticates, which does not matter for checks that run before it is opened.
+func rewriteHeader(t *testing.T, data []byte, change func(h *header)) []byte {
+	t.Helper()
+
+	h, _, body, err := parse(data)
+	if err != nil {
+		t.Fatalf("parse: %s", err)
+	}
+
+	change(&h)
+
+	headerJSON, err := json.Marshal(h)
+	if err != nil {
+		t.Fatalf("marshal header: %s", err)
+	}
+
+	out := append([]byte(magic), version1)
+	out = binary.BigEndian.AppendUint32(out, uint32(len(headerJSON)))
+	out = append(out, headerJSON...)
+
+	return append(out, body...)
+}
+
+func TestEncryptDecrypt(t *testing.T) {
+	key := newTestKey(t, "secret")
+
+	for _, size := range []int{0, 1, chunkSize - 1, chunkSize, chunkSize + 1, 3*chunkSize + 7} {
+		plaintext := bytes.Repeat([]byte{'x'}, size)
+
+		data := encrypt(t, key, plaintext)
+		if !IsEncrypted(data) {
+			t.Fatalf("size %d: file is not marked encrypted", size)
+		}
+
+		opened, got, err := Decrypt(data, []byte("secret"))
+		if err != nil {
+			t.Fatalf("size %d: Decrypt: %s", size, err)
+		}
+
+		if !bytes.Equal(got, plaintext) {
+			t.Fatalf("size %d: plaintext differs", size)
+		}
+
+		// the key from the password opens the next file without deriving again
+		got, err = opened.Decrypt(encrypt(t, key, plaintext))
+		if err != nil || !bytes.Equal(got, plaintext) {
+			t.Fatalf("size %d: Key.Decrypt: %v", size, err)
+		}
+	}
+}
+
+func TestEncryptUsesFreshNonce(t *testing.T) {
+	key := newTestKey(t, "secret")
+
+	if bytes.Equal(encrypt(t, key, []byte("same")), encrypt(t, key, []byte("same"))) {
+		t.Fatal("two encryptions of the same plaintext are identical")
+	}
+}
+
+func TestDecryptWrongPassword(t *testing.T) {
+	data := encrypt(t, newTestKey(t, "secret"), []byte("records"))
+
+	_, _, err := Decrypt(data, []byte("guess"))
+	if !errors.Is(err, ErrWrongPassword) {
+		t.Fatalf("got %v, want ErrWrongPassword", err)
+	}
+}
+
+func TestUnlockHeader(t *testing.T) {
+	data := encrypt(t, newTestKey(t, "secret"), []byte("records"))
+
+	// the body is not needed
+	data = data[:len(data)-1]
+
+	_, err := UnlockHeader(data, []byte("secret"))
+	if err != nil {
+		t.Fatalf("UnlockHeader: %s", err)
+	}
+
+	_, err = UnlockHeader(data, []byte("guess"))
+	if !errors.Is(err, ErrWrongPassword) {
+		t.Fatalf("got %v, want ErrWrongPassword", err)
+	}
+}
+
+func TestDecryptTampered(t *testing.T) {
+	key := newTestKey(t, "secret")
+	data := encrypt(t, key, bytes.Repeat([]byte{'x'}, 2*chunkSize+10))
+
+	_, ad, _, err := parse(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := map[string]func(data []byte) []byte{
+		"flipped body byte": func(data []byte) []byte {
+			data[len(ad)+10] ^= 1
+			return data
+		},
+		"flipped last byte": func(data []byte) []byte {
+			data[len(data)-1] ^= 1
+			return data
+		},
+		"dropped last chunk": func(data []byte) []byte {
+			return data[:len(ad)+2*(chunkSize+overhead)]
+		},
+		"appended bytes": func(data []byte) []byte {
+			return append(data, 0)
+		},
+		"swapped nonce": func(data []byte) []byte {
+			return rewriteHeader(t, data, func(h *header) {
+				h.Nonce[0] ^= 1
+			})
+		},
+	}
+
+	for name, tamper := range tests {
+		t.Run(name, func(t *testing.T) {
+			tampered := tamper(append([]byte(nil), data...))
+
+			_, _, err := Decrypt(tampered, []byte("secret"))
+			if !errors.Is(err, ErrCorrupted) {
+				t.Fatalf("Decrypt: got %v, want ErrCorrupted", err)
+			}
+
+			_, err = key.Decrypt(tampered)
+			if !errors.Is(err, ErrCorrupted) {
+				t.Fatalf("Key.Decrypt: got %v, want ErrCorrupted", err)
+			}
+		})
+	}
+}
+
+func TestDecryptOtherKey(t *testing.T) {
+	data := encrypt(t, newTestKey(t, "secret"), []byte("records"))
+
+	_, err := newTestKey(t, "secret").Decrypt(data)
+	if !errors.Is(err, ErrCorrupted) {
+		t.Fatalf("got %v, want ErrCorrupted", err)
+	}
+}
+
+func TestHeaderKDFBounds(t *testing.T) {
+	data := encrypt(t, newTestKey(t, "secret"), []byte("records"))
+
+	tests := map[string]KDFParams{
+		"zero time":            {Time: 0, Memory: 64, Threads: 1},
+		"zero threads":         {Time: 1, Memory: 64, Threads: 0},
+		"huge memory":          {Time: 1, Memory: 1 << 31, Threads: 1},
+		"huge time":            {Time: 1 << 30, Memory: 64, Threads: 1},
+		"memory below threads": {Time: 1, Memory: 8, Threads: 4},
+	}
+
+	for name, params := range tests {
+		t.Run(name, func(t *testing.T) {
+			crafted := rewriteHeader(t, data, func(h *header) {
+				h.KDF = params
+			})
+
+			_, _, err := Decrypt(crafted, []byte("secret"))
+			if !errors.Is(err, ErrCorrupted) {
+				t.Fatalf("Decrypt: got %v, want ErrCorrupted", err)
+			}
+
+			err = CheckHeader(crafted)
+			if !errors.Is(err, ErrCorrupted) {
+				t.Fatalf("CheckHeader: got %v, want ErrCorrupted", err)
+			}
+		})
+	}
+}
+
+func TestSlotKDFBounds(t *testing.T) {
+	slot, err := newTestKey(t, "secret").Slot()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var h header
+	if err = json.Unmarshal(slot, &h); err != nil {
+		t.Fatal(err)
+	}
+
+	h.KDF.Threads = 0
+
+	crafted, err := json.Marshal(h)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = UnlockSlot(crafted, []byte("secret"))
+	if !errors.Is(err, ErrCorrupted) {
+		t.Fatalf("got %v, want ErrCorrupted", err)
+	}
+}
+
+func TestRotate(t *testing.T) {
+	first := newTestKey(t, "old")
+	older := encrypt(t, first, []byte("older"))
+
+	second, err := first.Rotate([]byte("new"), testKDF)
+	if err != nil {
+		t.Fatalf("Rotate: %s", err)
+	}
+
+	newer := encrypt(t, second, []byte("newer"))
+
+	_, _, err = Decrypt(newer, []byte("old"))
+	if !errors.Is(err, ErrWrongPassword) {
+		t.Fatalf("old password on the rotated file: got %v", err)
+	}
+
+	_, err = first.Decrypt(newer)
+	if !errors.Is(err, ErrCorrupted) {
+		t.Fatalf("old key on the rotated file: got %v", err)
+	}
+
+	// the previous data keys travel in the header, a rotated key opens older files
+	opened, _, err := Decrypt(newer, []byte("new"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	third, err := opened.Rotate([]byte("newest"), testKDF)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	opened, _, err = Decrypt(encrypt(t, third, nil), []byte("newest"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for want, data := range map[string][]byte{"older": older, "newer": newer} {
+		got, err := opened.Decrypt(data)
+		if err != nil || string(got) != want {
+			t.Fatalf("rotated key on the %s file: %q, %v", want, got, err)
+		}
+	}
+}
+
+func TestUpgrade(t *testing.T) {
+	key := newTestKey(t, "secret")
+	older := encrypt(t, key, []byte("records"))
+
+	upgraded, err := key.Upgrade([]byte("secret"), testKDF)
+	if err != nil || upgraded != nil {
+		t.Fatalf("same parameters: got %v, %v", upgraded, err)
+	}
+
+	stronger := KDFParams{Time: testKDF.Time + 1, Memory: testKDF.Memory, Threads: testKDF.Threads}
+
+	upgraded, err = key.Upgrade([]byte("secret"), stronger)
+	if err != nil || upgraded == nil || upgraded.KDF() != stronger {
+		t.Fatalf("got %v, %v", upgraded, err)
+	}
+
+	if upgraded.Verify([]byte("secret")) != nil {
+		t.Fatal("the upgraded key does not take the password")
+	}
+
+	got, err := upgraded.Decrypt(older)
+	if err != nil || string(got) != "records" {
+		t.Fatalf("upgraded key on an older file: %q, %v", got, err)
+	}
+
+	_, err = key.Decrypt(encrypt(t, upgraded, nil))
+	if !errors.Is(err, ErrCorrupted) {
+		t.Fatalf("the cheaper slot reaches the upgraded data key: got %v", err)
+	}
+}
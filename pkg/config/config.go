@@ -2,13 +2,51 @@ package config
 
 import (
 	"fmt"
+	"time"
+
 	"github.com/ilyakaznacheev/cleanenv"
 )
 
 type Config struct {
-	FilePath    string   `yaml:"file_path"`
-	ServerPort  string   `yaml:"server_port"`
-	RecordTypes []string `yaml:"record_types"`
+	Backend         string        `yaml:"backend" env-default:"json"`
+	FilePath        string        `yaml:"file_path"`
+	Plaintext       bool          `yaml:"plaintext"`
+	ServerPort      string        `yaml:"server_port"`
+	RecordTypes     []string      `yaml:"record_types"`
+	AutoLockTimeout time.Duration `yaml:"auto_lock_timeout" env-default:"15m"`
+	FlushDebounce   time.Duration `yaml:"flush_debounce" env-default:"200ms"`
+	FlushMaxLatency time.Duration `yaml:"flush_max_latency" env-default:"2s"`
+	CompactSize     int64         `yaml:"journal_compact_size" env-default:"1048576"`
+	DegradeAfter    int           `yaml:"degrade_after" env-default:"3"`
+	KDFTime         uint32        `yaml:"kdf_time" env-default:"3"`
+	KDFMemory       uint32        `yaml:"kdf_memory" env-default:"65536"`
+	KDFThreads      uint8         `yaml:"kdf_threads" env-default:"4"`
+	WatchInterval   time.Duration `yaml:"watch_interval" env-default:"2s"`
+	History         bool          `yaml:"history"`
+	BackupDir       string        `yaml:"backup_dir" env-default:"backups"`
+	BackupInterval  time.Duration `yaml:"backup_interval" env-default:"1h"`
+	BackupHourly    int           `yaml:"backup_keep_hourly" env-default:"24"`
+	BackupDaily     int           `yaml:"backup_keep_daily" env-default:"7"`
+	BackupWeekly    int           `yaml:"backup_keep_weekly" env-default:"4"`
+	// backups are copied to the remote targets encrypted to the age recipients
+	BackupRecipients []string `yaml:"backup_recipients"`
+	BackupIdentity   string   `yaml:"backup_identity"`
+	S3Endpoint       string   `yaml:"backup_s3_endpoint"`
+	S3Bucket         string   `yaml:"backup_s3_bucket"`
+	S3Prefix         string   `yaml:"backup_s3_prefix"`
+	S3AccessKey      string   `yaml:"backup_s3_access_key" env:"BACKUP_S3_ACCESS_KEY"`
+	S3SecretKey      string   `yaml:"backup_s3_secret_key" env:"BACKUP_S3_SECRET_KEY"`
+	S3DisableTLS     bool     `yaml:"backup_s3_disable_tls"`
+	WebDAVURL        string   `yaml:"backup_webdav_url"`
+	WebDAVDir        string   `yaml:"backup_webdav_dir"`
+	WebDAVUser       string   `yaml:"backup_webdav_user" env:"BACKUP_WEBDAV_USER"`
+	WebDAVPassword   string   `yaml:"backup_webdav_password" env:"BACKUP_WEBDAV_PASSWORD"`
+	// a second vault is opened instead of the storage for its own password, its files and backups
+	// are named in the configuration like those of any vault
+	SecondFilePath     string `yaml:"second_file_path"`
+	SecondBackupDir    string `yaml:"second_backup_dir"`
+	SecondBackupPrefix string `yaml:"second_backup_prefix"`
+	SecondHook         string `yaml:"second_hook"`
 }
 
 func New(configPath string) (*Config, error) {